@@ -8,7 +8,7 @@
 package peer
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -17,24 +17,31 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/engr-sjb/diogel/internal/archive"
+	"github.com/engr-sjb/diogel/internal/clock"
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/dataredundancy"
 	"github.com/engr-sjb/diogel/internal/features/capsule"
 	"github.com/engr-sjb/diogel/internal/features/ports"
 	"github.com/engr-sjb/diogel/internal/features/user"
 	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
 	"github.com/engr-sjb/diogel/internal/protocol"
 	"github.com/engr-sjb/diogel/internal/serialize"
 	"github.com/engr-sjb/diogel/internal/storage"
 	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/engr-sjb/diogel/internal/transport/memory"
+	"github.com/engr-sjb/diogel/internal/transport/nat"
+	"github.com/engr-sjb/diogel/internal/transport/quic"
 	"github.com/engr-sjb/diogel/internal/transport/tcp"
 	"github.com/google/uuid"
+	"github.com/uptrace/bun"
 	bolt "go.etcd.io/bbolt"
 )
 
@@ -46,10 +53,44 @@ type features struct {
 type PeerConfig struct {
 	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
 
-	Addr                    string
-	appDir                  string
+	Addr string
+	// AppDir is where the peer keeps its db and objects. Defaults to
+	// ./.diogel/<Addr>.
+	AppDir                  string
 	BootstrapPeers          []string
 	MinConnectedRemotePeers uint32
+	// RendezvousAddr is the udp addr of a rendezvous server. When set, peers
+	// behind NATs are reached with a hole punch or a relay through it. Optional.
+	RendezvousAddr string
+	// QUICAddr is the udp addr of the quic transport, which then runs next to
+	// tcp. Peers reach it with a "quic://" addr. Optional.
+	QUICAddr string
+	// Network puts the peer on an in memory network instead of tcp, for tests.
+	// RendezvousAddr and QUICAddr are ignored when it is set. Optional.
+	Network *memory.Network
+	// TestHooks are passed on to the capsule service. Optional.
+	TestHooks *capsule.TestHooks
+	// Clock is where the peer gets the time from. Defaults to the real clock.
+	Clock clock.Clock
+	// DBDriver is the db the peer keeps its data in, storage.DriverSQLite or
+	// storage.DriverBBolt. Defaults to sqlite.
+	DBDriver string
+	// ObjectsDir is where the shards we hold for others are kept, like a dir
+	// on a NAS mount. Optional, defaults to AppDir.
+	ObjectsDir string
+	// RemoteObjects keeps the shards we hold for others in an S3 or WebDAV
+	// store instead. RootDir and Keyring are set by the peer. Optional.
+	RemoteObjects *capsule.RemoteStoreConfig
+	// IsStorageProvider has the peer hold shards owners put with it as a
+	// storage provider. Optional.
+	IsStorageProvider bool
+	// StorageProviders are the addrs of the storage providers our capsules
+	// put shards with, next to the guardians. Optional.
+	StorageProviders []string
+	// FaultTolerance is how many of the guardians and storage providers of a
+	// capsule we create can be lost, its erasure profile is derived from it.
+	// Optional, defaults to capsule.DefaultErasureProfile.
+	FaultTolerance int
 }
 
 type peer struct {
@@ -58,8 +99,14 @@ type peer struct {
 	privateKey []byte
 	publicKey  []byte
 	shutdownWG *sync.WaitGroup
-	db         *bolt.DB
-	serialize  serialize.Serializer
+	cancel     context.CancelFunc
+	logger     *slog.Logger
+	db         *bolt.DB             // only with storage.DriverBBolt.
+	sqlDB      *bun.DB              // only with storage.DriverSQLite.
+	serialize  serialize.Serializer // gob, for protocol v1 payloads.
+	msgpack    serialize.Serializer // for protocol v2 and v3 payloads.
+	registry   *message.Registry    // every message we can send or receive.
+	router     *transport.Router    // routes incoming messages to feature handlers.
 	protocol   protocol.Protocol
 	cCrypto    customcrypto.CCrypto
 	archive    archive.Archiver
@@ -90,11 +137,25 @@ func NewPeer(cfg *PeerConfig) *peer {
 	case cfg.MinConnectedRemotePeers == 0:
 		cfg.MinConnectedRemotePeers = 50
 	}
+	if cfg.AppDir == "" {
+		cfg.AppDir = fmt.Sprintf("./.diogel/%s", cfg.Addr)
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.New()
+	}
+	switch cfg.DBDriver {
+	case "":
+		cfg.DBDriver = storage.DriverSQLite
+	case storage.DriverSQLite, storage.DriverBBolt:
+	default:
+		log.Fatalf("DBDriver %q in PeerConfig is not a known driver", cfg.DBDriver)
+	}
 
 	// NOTICE IMPORTANT: make sure you are initializing the fields on the returned struct that need to be initialized.
 	return &peer{
 		PeerConfig: cfg,
 		shutdownWG: &sync.WaitGroup{},
+		logger:     slog.Default().With("peer", cfg.Addr),
 		features: &features{
 			// NOTICE IMPORTANT:
 			User:    &user.User{},
@@ -104,20 +165,50 @@ func NewPeer(cfg *PeerConfig) *peer {
 	}
 }
 
+// Run starts the peer and blocks till it gets an interrupt, then shuts it down.
 func (p *peer) Run() {
-	ctx, cancel := context.WithCancel(
+	ctx, stop := signal.NotifyContext(
 		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
 	)
-	defer cancel()
+	defer stop()
 
-	p.prepDeps(ctx)
-	p.serialize.Register(
-		message.Msgs...,
-	)
-	//todo: fix this register error as duplicates
+	p.Start(ctx)
+	<-ctx.Done()
+	p.Stop()
+}
+
+// Start starts the peer. It runs till ctx is done or Stop is called.
+func (p *peer) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
 
+	p.prepDeps(ctx)
 	p.prepFeatures(ctx)
+}
 
+// Stop shuts the peer down and waits for it. Its AppDir can be used by a new
+// peer after.
+func (p *peer) Stop() {
+	p.cancel()
+	p.transport.Close()
+	p.shutdownWG.Wait()
+
+	var err error
+	switch p.DBDriver {
+	case storage.DriverSQLite:
+		err = p.sqlDB.Close()
+	case storage.DriverBBolt:
+		err = p.db.Close()
+	}
+	if err != nil {
+		p.logger.Error("failed to close db", "err", err)
+	}
+}
+
+// ID returns the peer's ID. It is only set after Start.
+func (p *peer) ID() uuid.UUID {
+	return p.peerID
 }
 
 // prepDeps prepares and initializes the peer's dependencies need by the various components.
@@ -127,42 +218,53 @@ func (p *peer) prepDeps(ctx context.Context) {
 	// 	log.Fatalf("Error getting user home directory: %v", err)
 	// }
 
-	directory := fmt.Sprintf(
-		"./.diogel/%s", //todo:  this should come from the config.
-		p.Addr,
-	)
-
 	err := os.MkdirAll(
-		directory,
+		p.AppDir,
 		0700,
 	)
 	if err != nil {
 		log.Fatal("Error creating .diogel directory")
 	}
 
-	p.db = storage.NewBBolt(directory, p.logger)
+	switch p.DBDriver {
+	case storage.DriverSQLite:
+		p.sqlDB = storage.NewSQLite(p.AppDir, p.logger)
+	case storage.DriverBBolt:
+		p.db = storage.NewBBolt(p.AppDir, p.logger)
+	}
 	p.serialize = serialize.New()
-	p.protocol = protocol.NewProtocol(p.serialize)
+	p.msgpack = serialize.NewMsgpack()
+	p.registry = message.NewRegistry()
+	p.router = transport.NewRouter(p.registry)
+	p.protocol = protocol.NewProtocol(p.registry, p.serialize, p.msgpack)
 	p.cCrypto = customcrypto.NewCCrypto()
 	p.archive = archive.NewArchive() //todo: i think the depends too should take in the shutdown waitGroup too. not sure yet. think about as we already inject into the features.
 }
 
 // prepFeatures prepares and initializes and configures the peer's features.
 func (p *peer) prepFeatures(ctx context.Context) {
-	userDBStore := user.NewDBStore(
-		&user.DBStoreConfig{
-			DB:                    p.db,
-			UserSettingBucketName: "settings", // todo: sort these bucket names properly.
-		},
-	)
+	userServiceConfig := &user.ServiceConfig{
+		Ctx:     ctx,
+		CCrypto: p.cCrypto,
+		Logger:  p.logger,
+	}
+	switch p.DBDriver {
+	case storage.DriverSQLite:
+		userServiceConfig.DBStore = user.NewSQLiteDBStore(
+			&user.SQLiteDBStoreConfig{
+				DB: p.sqlDB,
+			},
+		)
+	case storage.DriverBBolt:
+		userServiceConfig.DBStore = user.NewDBStore(
+			&user.DBStoreConfig{
+				DB:                    p.db,
+				UserSettingBucketName: "settings", // todo: sort these bucket names properly.
+			},
+		)
+	}
 
-	p.features.User.Service = user.NewService(
-		&user.ServiceConfig{
-			Ctx:     ctx,
-			DBStore: userDBStore,
-			CCrypto: p.cCrypto,
-		},
-	)
+	p.features.User.Service = user.NewService(userServiceConfig)
 
 	pwd := "fake_password" // todo: should come from ui.
 	if err := p.features.User.Service.InitIdentity(pwd); err != nil {
@@ -173,7 +275,133 @@ func (p *peer) prepFeatures(ctx context.Context) {
 
 	onMessage := p.makeOnMessageHandler(ctx)
 
-	p.transport = tcp.NewTCPTransport(
+	p.transport = p.newTransport(ctx, onMessage)
+
+	// Capsule Feature
+	capsuleServiceConfig := &capsule.ServiceConfig{
+		Ctx:      ctx,
+		Shutdown: p.shutdownWG,
+		Defaults: &capsule.Defaults{
+			MinNumOfGuardians: 3,
+			//todo: we might have to pull the max from a subscription plan in future. not sure yet.
+			MaxNumOfGuardians: 10,
+		},
+		PeerID:              p.peerID,
+		PrivateKey:          p.privateKey,
+		PublicKey:           p.publicKey,
+		Archive:             p.archive,
+		CCrypto:             p.cCrypto,
+		Serialize:           p.serialize,
+		NewErasureCoderFunc: dataredundancy.NewReedSolomonCoder,
+		Clock:               p.Clock,
+		GC: &capsule.GCConfig{
+			Interval: 6 * time.Hour,
+			// An object only goes without a shard for the time a unit of work
+			// is in flight, a day is far more than that.
+			GracePeriod: 24 * time.Hour,
+		},
+		//todo: let the user set how much they hold for others.
+		Quota: &capsule.QuotaConfig{
+			MaxBytesPerOwner: 1 << 30, // 1gb
+			MaxBytesTotal:    10 << 30,
+			// A shard is at most ~20kb, so this is ~300mb of a capsule.
+			MaxShardsPerCapsule: 1 << 14,
+			MinFreeBytes:        512 << 20,
+		},
+		Repair: &capsule.RepairConfig{
+			Interval: 12 * time.Hour,
+			// A repair group gets its shards back once half of its parity
+			// shards are gone.
+			SafetyMargin:     11,
+			ConnectToPeer:    p.transport.ConnectToPeer,
+			StorageProviders: p.StorageProviders,
+		},
+		IsStorageProvider: p.IsStorageProvider,
+		Logger:            p.logger,
+		TestHooks:         p.TestHooks,
+		//todo: should take a callback function that searches thru connected peers and populate the
+	}
+	switch {
+	case p.RemoteObjects != nil:
+		p.RemoteObjects.RootDir = p.AppDir
+		p.RemoteObjects.Keyring = p.features.User.Service.Keyring()
+		capsuleServiceConfig.FileStore = capsule.NewRemoteObjectStore(p.RemoteObjects)
+	default:
+		capsuleServiceConfig.FileStore = capsule.NewObjectStore(
+			&capsule.FileStoreConfig{
+				RootDir:    p.AppDir,
+				ObjectsDir: p.ObjectsDir,
+				Keyring:    p.features.User.Service.Keyring(),
+			},
+		)
+	}
+	switch p.DBDriver {
+	case storage.DriverSQLite:
+		capsuleServiceConfig.DBStore = capsule.NewSQLiteDBStore(
+			&capsule.SQLiteDBStoreConfig{
+				DB:      p.sqlDB,
+				Keyring: p.features.User.Service.Keyring(),
+			},
+		)
+	case storage.DriverBBolt:
+		capsuleServiceConfig.DBStore = capsule.NewDBStore(
+			&capsule.DBStoreConfig{
+				DB:      p.db,
+				Keyring: p.features.User.Service.Keyring(),
+			},
+		)
+	}
+
+	p.features.Capsule.Service = capsule.NewService(capsuleServiceConfig)
+
+	// The capsule stores sealed everything with the current data key when
+	// they were made, which finishes a password change a crash cut short.
+	if err := p.features.User.Service.RetireDataKeys(); err != nil {
+		log.Fatalf("failed to retire old data keys: %v", err)
+	}
+
+	finished, dropped, err := p.features.Capsule.Service.RecoverUnfinishedWrites()
+	if err != nil {
+		log.Fatalf("failed to recover capsule writes: %v", err)
+	}
+	if finished > 0 || dropped > 0 {
+		p.logger.Info("recovered unfinished capsule writes", "finished", finished, "dropped", dropped)
+	}
+	p.features.Capsule.Service.StartGC()
+	p.features.Capsule.Service.StartRepair()
+
+	// NOTICE IMPORTANT: Every feature registers the handlers of the messages it
+	// receives here. A message without a handler is logged and dropped.
+	if err := p.features.Capsule.RegisterHandlers(p.router); err != nil {
+		log.Fatalf("failed to register capsule handlers: %v", err)
+	}
+	if err := p.registerHandlers(); err != nil {
+		log.Fatalf("failed to register peer handlers: %v", err)
+	}
+}
+
+// newTransport makes the transports from the config. Every transport calls
+// into the same onConnect, onDisconnect and onMessage.
+func (p *peer) newTransport(ctx context.Context, onMessage transport.OnMessage) transport.Transport {
+	if p.Network != nil {
+		return memory.NewMemoryTransport(
+			&memory.MemoryTransportConfig{
+				Ctx:          ctx,
+				ShutdownWG:   p.shutdownWG,
+				Network:      p.Network,
+				PublicKey:    p.publicKey,
+				Logger:       p.logger,
+				Protocol:     p.protocol,
+				Addr:         p.Addr,
+				Clock:        p.Clock,
+				OnConnect:    p.onConnect,
+				OnDisconnect: p.onDisconnect,
+				OnMessage:    onMessage,
+			},
+		)
+	}
+
+	tcpTransport := tcp.NewTCPTransport(
 		&tcp.TCPTransportConfig{
 			Ctx:            ctx,
 			ShutdownWG:     p.shutdownWG,
@@ -184,45 +412,49 @@ func (p *peer) prepFeatures(ctx context.Context) {
 			Logger:         p.logger,
 			Protocol:       p.protocol,
 			DialTimeout:    time.Second * 2, // todo: reevaluate
+			Clock:          p.Clock,
 			OnConnect:      p.onConnect,
 			OnDisconnect:   p.onDisconnect,
 			OnMessage:      onMessage,
 		},
 	)
 
-	// Capsule Feature
-	capsuleDBStore := capsule.NewDBStore(
-		&capsule.DBStoreConfig{
-			DB: p.db,
-		},
-	)
-
-	capsuleObjectStore := capsule.NewObjectStore(
-		&capsule.FileStoreConfig{
-			RootDir: p.appDir,
-		},
-	)
+	var tcpOrNATTransport transport.Transport = tcpTransport
+	if p.RendezvousAddr != "" {
+		tcpOrNATTransport = nat.NewTransport(
+			&nat.TransportConfig{
+				Ctx:            ctx,
+				ShutdownWG:     p.shutdownWG,
+				Logger:         p.logger,
+				Clock:          p.Clock,
+				Inner:          tcpTransport,
+				RendezvousAddr: p.RendezvousAddr,
+				AdvertisedAddr: p.Addr,
+			},
+		)
+	}
 
-	p.features.Capsule.Service = capsule.NewService(
-		&capsule.ServiceConfig{
-			Ctx:      ctx,
-			Shutdown: p.shutdownWG,
-			Defaults: &capsule.Defaults{
-				MinNumOfGuardians: 3,
-				//todo: we need the max. we might have to pull this from a subscription plan inn future. not sure yet.
+	transports := map[string]transport.Transport{
+		transport.NetworkTCP: tcpOrNATTransport,
+	}
+	if p.QUICAddr != "" {
+		transports[transport.NetworkQUIC] = quic.NewQUICTransport(
+			&quic.QUICTransportConfig{
+				Ctx:          ctx,
+				ShutdownWG:   p.shutdownWG,
+				PublicKey:    p.publicKey,
+				Logger:       p.logger,
+				Protocol:     p.protocol,
+				Addr:         p.QUICAddr,
+				DialTimeout:  time.Second * 2, // todo: reevaluate
+				Clock:        p.Clock,
+				OnConnect:    p.onConnect,
+				OnDisconnect: p.onDisconnect,
+				OnMessage:    onMessage,
 			},
-			PeerID:              p.peerID,
-			PrivateKey:          p.privateKey,
-			PublicKey:           p.publicKey,
-			Archive:             p.archive,
-			CCrypto:             p.cCrypto,
-			Serialize:           p.serialize,
-			DBStore:             capsuleDBStore,
-			FileStore:           capsuleObjectStore,
-			NewErasureCoderFunc: dataredundancy.NewReedSolomonCoder,
-			//todo: should take a callback function that searches thru connected peers and populate the
-		},
-	)
+		)
+	}
+	return transport.NewMultiTransport(transports)
 }
 
 func (p *peer) makeOnMessageHandler(ctx context.Context) transport.OnMessage {
@@ -259,62 +491,74 @@ func (p *peer) makeOnMessageHandler(ctx context.Context) transport.OnMessage {
 }
 
 func (p *peer) onMessage(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
-	msgCtx, cancel := context.WithTimeout(
-		ctx,
-		(time.Second * 2), // todo: reconsider this time
+	// A handler receiving streams runs on ctx for as long as they take, the
+	// streams give up by themselves on a remote peer that goes quiet.
+	var (
+		msgCtx context.Context
+		cancel context.CancelFunc
 	)
+	if p.router.IsStream(msg) {
+		msgCtx, cancel = context.WithCancel(ctx)
+	} else {
+		msgCtx, cancel = clock.WithTimeout(
+			ctx,
+			p.Clock,
+			(time.Second * 2), // todo: reconsider this time
+		)
+	}
 	defer cancel()
 
-	switch newMsg := msg.(type) {
-	// Capsule Feature
-	case message.CapsuleIncomingStream:
-		err := p.features.Capsule.Service.ReceiveCapsuleStream(
-			msgCtx,
-			remotePeer,
-			&newMsg,
+	err := p.router.Dispatch(msgCtx, remotePeer, msg)
+	if errors.Is(err, transport.ErrNoHandler) || errors.Is(err, transport.ErrUnregisteredType) {
+		log.Println(
+			"unknown msg in router:", err,
 		)
+		return nil
+	}
 
-		if err != nil {
-			return err
-		}
+	return err
+}
 
-		// Todo:  Add proper data
-		if err := p.features.Heartbeat.Service.Add(); err != nil {
-			return err
+// registerHandlers registers the handlers of messages that have no feature of
+// their own yet.
+func (p *peer) registerHandlers() error {
+	/*
+		todo - call the service to act on message if thats whats needed.
+		todo or
+		todo - call the ui to display something if the user need to confirm an action before it takes place.
+	*/
+	logOnly := func(text string) transport.Handler {
+		return func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			log.Println(text)
+			return nil
 		}
+	}
 
-		log.Println("incoming capsule stream")
-
-	case message.ContinueCapsuleStream:
-		/*
-			todo - call the service to act on message if thats whats needed.
-			todo or
-			todo - call the ui to display something if the user need to confirm an action before it takes place.
-		*/
-		log.Println("incoming Re capsule stream")
-
-	case message.CapsuleReStream:
-		/*
-			todo - call the service to act on message if thats whats needed.
-			todo or
-			todo - call the ui to display something if the user need to confirm an action before it takes place.
-		*/
-		log.Println("incoming Re capsule stream")
-
-	// Heartbeat Feature
-	case message.HeartbeatCheck:
-		log.Println("incoming HeartbeatCheck")
+	handlers := map[message.ID]transport.Handler{
+		// A remote peer refusing what we sent, eg. a guardian that is full.
+		// todo: show it on the ui once there is one.
+		message.IDErrorMessage: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			errMsg := msg.(message.ErrorMessage)
+			log.Printf(
+				"remote peer %s refused: %s (code %d): %s",
+				remotePeer.ID(), errMsg.Code, errMsg.Code, errMsg.Message,
+			)
+			return nil
+		},
+		message.IDContinueCapsuleStream: logOnly("incoming Re capsule stream"),
+		message.IDCapsuleReStream:       logOnly("incoming Re capsule stream"),
+		// Heartbeat Feature
+		message.IDHeartbeatCheck: logOnly("incoming HeartbeatCheck"),
+	}
 
-	default:
-		log.Println(
-			"unknown msg in router",
-		)
+	for id, h := range handlers {
+		if err := p.router.Handle(id, h); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
-	}
-}
 
 // onConnect is passed to the transport to be used to register newly connected
 // remote peers to this peer's internal memory map.
@@ -388,7 +632,16 @@ func (p *peer) findRemotePeersBy(addrs []string) ([]transport.RemotePeer, error)
 
 	wg.Wait()
 
-	return rps, nil
+	// Dropping the ones we couldn't reach, the capsule service decides if the
+	// rest are enough.
+	reached := rps[:0]
+	for i := range rps {
+		if rps[i] != nil {
+			reached = append(reached, rps[i])
+		}
+	}
+
+	return reached, nil
 }
 
 func (p *peer) closeConnectedPeers() error {
@@ -415,20 +668,109 @@ func (p *peer) Create(ctx context.Context, letterContent string, filePaths []str
 		return err
 	}
 
+	// The ones we can't reach get no shards, their shards go to the guardians.
+	storageProviders, err := p.findRemotePeersBy(p.StorageProviders)
+	if err != nil {
+		return err
+	}
+
 	content := strings.NewReader(letterContent)
 
 	cc := &capsule.CreateCapsuleDTO{
-		RemotePeerGuardians: remotePeers,
+		RemotePeerGuardians:        remotePeers,
+		RemotePeerStorageProviders: storageProviders,
 		Letter: &ports.FileMem{
 			Name:    capsule.LetterName,
 			Content: io.NopCloser(content),
 			Mode:    0644,
-			ModTime: time.Now(),
+			ModTime: p.Clock.Now(),
 			Size:    content.Size(),
 		},
-		FilePaths:     filePaths,
-		SilencePeriod: silencePeriod,
+		FilePaths:      filePaths,
+		SilencePeriod:  silencePeriod,
+		FaultTolerance: p.FaultTolerance,
 	}
 
 	return p.features.Capsule.Service.CreateAndSendCapsule(ctx, cc)
 }
+
+// ChangePassword changes the password of the identity and seals everything kept
+// at rest again with a new data key.
+func (p *peer) ChangePassword(oldPassword, newPassword string) error {
+	if err := p.features.User.Service.ChangePassword(oldPassword, newPassword); err != nil {
+		return err
+	}
+
+	resealed, err := p.features.Capsule.Service.ResealAtRest()
+	if err != nil {
+		return err
+	}
+	p.logger.Info("sealed again with the new data key", "resealed", resealed)
+
+	// NOTICE IMPORTANT: The old data keys are not retired here. A write that
+	// sealed with the old key right before the change can land after the
+	// reseal, the stores seal again on the next start before anything writes
+	// and the keys are retired then. The old keys are only wrapped with the
+	// new password, whoever has the old one can't get them.
+	return nil
+}
+
+// HeldCapsule returns what we hold of a capsule we are a guardian of.
+func (p *peer) HeldCapsule(capsuleID uuid.UUID) (*capsule.HeldCapsuleDTO, error) {
+	return p.features.Capsule.Service.GetHeldCapsule(capsuleID)
+}
+
+// FetchProviderShard fetches the shard of hash of a capsule we are a guardian
+// of back from the storage provider it was put with.
+func (p *peer) FetchProviderShard(ctx context.Context, capsuleID uuid.UUID, hash [32]byte) ([]byte, error) {
+	held, err := p.features.Capsule.Service.GetHeldCapsule(capsuleID)
+	if err != nil {
+		return nil, err
+	}
+
+	i := slices.IndexFunc(held.ProviderShards, func(ps message.ProviderShardManifest) bool {
+		return ps.Hash == hash
+	})
+	if i < 0 {
+		return nil, fmt.Errorf("capsule %s has no shard of hash %x with a storage provider", capsuleID, hash)
+	}
+	shard := held.ProviderShards[i]
+
+	provider, err := p.transport.ConnectToPeer(shard.ProviderAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer provider.Close()
+
+	// SECURITY: Whoever is on the addr now might not be the provider the
+	// shard was put with.
+	if !bytes.Equal(provider.PublicKey(), shard.ProviderPublicKey) {
+		return nil, fmt.Errorf("peer on %s is not the storage provider of shard %x", shard.ProviderAddr, hash)
+	}
+
+	return p.features.Capsule.Service.FetchProviderShard(ctx, provider, shard)
+}
+
+// Recover reads a capsule we are a guardian of back with its master key, the
+// guardians' key shares combined, and writes its files to fileStore.
+func (p *peer) Recover(ctx context.Context, capsuleID uuid.UUID, masterKey []byte, fileStore ports.FileStorer) error {
+	return p.features.Capsule.Service.RecoverCapsule(ctx, capsuleID, masterKey, fileStore)
+}
+
+// Repair runs the repair of the capsules we are a guardian of now, instead of
+// waiting for its schedule.
+func (p *peer) Repair() (capsule.RepairReport, error) {
+	return p.features.Capsule.Service.RepairCapsules()
+}
+
+// Audit has the guardian or storage provider on addr prove it still holds its
+// shards of a capsule we are a guardian of.
+func (p *peer) Audit(ctx context.Context, capsuleID uuid.UUID, addr string) (*capsule.AuditReportDTO, error) {
+	holder, err := p.transport.ConnectToPeer(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer holder.Close()
+
+	return p.features.Capsule.Service.AuditHolder(ctx, capsuleID, holder)
+}
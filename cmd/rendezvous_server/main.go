@@ -1 +1,43 @@
 package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/transport/nat"
+)
+
+func main() {
+	log.SetFlags(log.Llongfile | log.Ltime)
+
+	addr := flag.String("addr", ":7000", "udp addr peers register and punch on")
+	relayAddr := flag.String("relay-addr", ":7001", "tcp addr peers relay through")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := nat.NewServer(
+		&nat.ServerConfig{
+			Ctx:       ctx,
+			Logger:    slog.Default().With("server", "rendezvous"),
+			Clock:     clock.New(),
+			Addr:      *addr,
+			RelayAddr: *relayAddr,
+		},
+	)
+
+	if err := server.Listen(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("rendezvous server listening on udp %s, relaying on tcp %s\n", server.UDPAddr(), *relayAddr)
+
+	server.Serve()
+}
@@ -49,8 +49,16 @@ var (
 	}()
 )
 
+// NumOfWorkers is how many workers work on a stream at once, like the blocks a
+// capsule is encoded in.
+func NumOfWorkers() int {
+	return int(numOfWorkers)
+}
+
 type Archiver interface {
 	ArchiveStream(ctx context.Context, files []ports.File, dst io.WriteCloser) error
+	// UnArchiveStream writes the files ArchiveStream put in src to fileStore.
+	UnArchiveStream(ctx context.Context, src io.Reader, fileStore ports.FileStorer) error
 }
 
 var _ Archiver = (*archive)(nil)
@@ -0,0 +1,131 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package clock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeTimer(t *testing.T) {
+	f := NewFake(start)
+	timer := f.NewTimer(time.Hour)
+
+	f.Advance(59 * time.Minute)
+	assertNotFired(t, timer.C())
+
+	f.Advance(time.Minute)
+	assert.Equal(t, start.Add(time.Hour), <-timer.C())
+
+	t.Run("stop", func(t *testing.T) {
+		timer := f.NewTimer(time.Hour)
+		assert.True(t, timer.Stop())
+		assert.False(t, timer.Stop())
+
+		f.Advance(2 * time.Hour)
+		assertNotFired(t, timer.C())
+	})
+
+	t.Run("zero fires right away", func(t *testing.T) {
+		<-f.After(0)
+	})
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(start)
+	ticker := f.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for i := 1; i <= 3; i++ {
+		f.Advance(time.Minute)
+		assert.Equal(t, start.Add(time.Duration(i)*time.Minute), <-ticker.C())
+	}
+
+	// Ticks nobody read are dropped, like on the real ticker.
+	f.Advance(10 * time.Minute)
+	<-ticker.C()
+	assertNotFired(t, ticker.C())
+}
+
+func TestFakeFiresInOrder(t *testing.T) {
+	f := NewFake(start)
+
+	fired := make(chan string, 3)
+	f.AfterFunc(3*time.Hour, func() { fired <- "3h" })
+	f.AfterFunc(time.Hour, func() { fired <- "1h" })
+	timer := f.NewTimer(2 * time.Hour)
+
+	f.Advance(5 * time.Hour)
+
+	assert.Equal(t, start.Add(2*time.Hour), <-timer.C())
+	got := []string{<-fired, <-fired}
+	assert.ElementsMatch(t, []string{"1h", "3h"}, got)
+	assert.Equal(t, start.Add(5*time.Hour), f.Now())
+}
+
+func TestFakeSilencePeriod(t *testing.T) {
+	const silencePeriod = 278 * time.Hour
+
+	f := NewFake(start)
+	lastHeartbeat := f.Now()
+
+	silent := make(chan struct{})
+	go func() {
+		<-f.After(silencePeriod)
+		close(silent)
+	}()
+	f.BlockUntil(1)
+
+	began := time.Now()
+	f.Advance(silencePeriod - time.Second)
+	assert.Less(t, f.Since(lastHeartbeat), silencePeriod)
+	assertNotFired(t, silent)
+
+	f.Advance(time.Second)
+	<-silent
+	assert.Equal(t, silencePeriod, f.Since(lastHeartbeat))
+	assert.Less(t, time.Since(began), time.Second)
+}
+
+func TestWithTimeout(t *testing.T) {
+	f := NewFake(start)
+
+	ctx, cancel := WithTimeout(context.Background(), f, 2*time.Second)
+	defer cancel()
+
+	f.Advance(time.Second)
+	require.NoError(t, ctx.Err())
+
+	f.Advance(time.Second)
+	<-ctx.Done()
+	assert.ErrorIs(t, context.Cause(ctx), context.DeadlineExceeded)
+
+	t.Run("real clock", func(t *testing.T) {
+		ctx, cancel := WithTimeout(context.Background(), New(), time.Millisecond)
+		defer cancel()
+
+		<-ctx.Done()
+		assert.ErrorIs(t, ctx.Err(), context.DeadlineExceeded)
+	})
+}
+
+func assertNotFired[T any](t *testing.T, c <-chan T) {
+	t.Helper()
+
+	select {
+	case <-c:
+		t.Fatal("fired too early")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
@@ -0,0 +1,200 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+/*
+Fake is a Clock for tests. Its time only moves when Advance is called, and
+timers and tickers fire as Advance walks past them, in the order they are due.
+Weeks of silence go by in one call.
+*/
+type Fake struct {
+	mu      sync.Mutex
+	changed *sync.Cond // broadcast when a timer is added or removed.
+	now     time.Time
+	timers  map[*fakeTimer]struct{}
+}
+
+var _ Clock = (*Fake)(nil)
+
+func NewFake(start time.Time) *Fake {
+	f := &Fake{
+		now:    start,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+	f.changed = sync.NewCond(&f.mu)
+
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+
+	return t
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	t := &fakeTimer{clock: f, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+
+	return (*fakeTicker)(t)
+}
+
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	t := &fakeTimer{clock: f, fn: fn}
+	t.Reset(d)
+
+	return t
+}
+
+// Advance moves the clock forward by d, firing every timer due on the way.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	target := f.now.Add(d)
+
+	for {
+		next := f.nextDue(target)
+		if next == nil {
+			break
+		}
+
+		f.now = next.at
+		next.fire()
+	}
+
+	f.now = target
+}
+
+// BlockUntil waits till n timers, tickers or Afters are waiting on the clock.
+// Use it to know code got to where it waits before calling Advance.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for len(f.timers) < n {
+		f.changed.Wait()
+	}
+}
+
+// nextDue is the timer due first at or before target. It expects f.mu to be held.
+func (f *Fake) nextDue(target time.Time) *fakeTimer {
+	var next *fakeTimer
+	for t := range f.timers {
+		if t.at.After(target) {
+			continue
+		}
+		if next == nil || t.at.Before(next.at) {
+			next = t
+		}
+	}
+
+	return next
+}
+
+type fakeTimer struct {
+	clock  *Fake
+	at     time.Time
+	c      chan time.Time
+	fn     func()
+	period time.Duration // only for tickers.
+}
+
+// fire expects clock.mu to be held.
+func (t *fakeTimer) fire() {
+	if t.period > 0 {
+		t.at = t.at.Add(t.period)
+	} else {
+		delete(t.clock.timers, t)
+		t.clock.changed.Broadcast()
+	}
+
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+
+	// Like the real ones, a tick nobody read yet is dropped.
+	select {
+	case t.c <- t.clock.now:
+	default:
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, isActive := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	t.clock.changed.Broadcast()
+
+	return isActive
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	_, isActive := t.clock.timers[t]
+	t.at = t.clock.now.Add(d)
+	if t.period > 0 {
+		t.period = d
+	}
+	t.clock.timers[t] = struct{}{}
+	t.clock.changed.Broadcast()
+
+	if d <= 0 && t.period == 0 {
+		t.fire()
+	}
+
+	return isActive
+}
+
+type fakeTicker fakeTimer
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	(*fakeTimer)(t).Stop()
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	(*fakeTimer)(t).Reset(d)
+}
@@ -0,0 +1,413 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package customcrypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+A Keyring seals what a peer keeps at rest with its data keys. The data keys are
+random, and the user feature keeps them wrapped with the key it derives from
+the password, so a new password only has to wrap them again.
+
+Sealed data is AES-256-GCM in chunks, so big objects can be sealed and opened
+as a stream:
+
+	header  magic(4) | format(1) | key ID(4) | nonce prefix(7)
+	chunks  sealed chunks of sealChunkSize, the last one can be shorter.
+
+The nonce of a chunk is the nonce prefix | chunk counter(4) | 1 if it is the
+last chunk. Every chunk is sealed with the header and the caller's associated
+data, so a chunk can't be moved, dropped or put under another name.
+*/
+
+const (
+	DataKeySize = 32
+
+	sealFormat     = 1
+	sealChunkSize  = 64 * 1024
+	sealMagicSize  = 4
+	sealPrefixSize = 7
+	// SealHeaderSize is how much of sealed data SealedKeyID needs.
+	SealHeaderSize = sealMagicSize + 1 + 4 + sealPrefixSize
+)
+
+// sealMagic starts with a 0, which json and the peer's own formats never do.
+var sealMagic = [sealMagicSize]byte{0x00, 'd', 'g', 's'}
+
+var (
+	ErrNotSealed  = errors.New("data is not sealed")
+	ErrUnknownKey = errors.New("data is sealed with a key not in the keyring")
+	ErrSealBroken = errors.New("sealed data is corrupted or cut short")
+)
+
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{
+		keys: make(map[uint32]cipher.AEAD),
+	}
+}
+
+// NewDataKey makes a random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Add adds key to the keyring under id. It does not make it the current key.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if id == 0 {
+		return errors.New("key ID 0 is not a valid key ID")
+	}
+	if len(key) != DataKeySize {
+		return fmt.Errorf("data key must be %d bytes", DataKeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[id] = aead
+
+	return nil
+}
+
+// SetCurrent makes the key of id the one everything is sealed with from now.
+func (k *Keyring) SetCurrent(id uint32) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[id]; !ok {
+		return fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+	k.current = id
+
+	return nil
+}
+
+// Current is the ID of the key everything is sealed with, 0 if there is none.
+func (k *Keyring) Current() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current
+}
+
+// Retire removes every key but the current one.
+//
+// NOTICE IMPORTANT: Anything still sealed with a retired key can't be opened
+// again. Reseal everything first.
+func (k *Keyring) Retire() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for id := range k.keys {
+		if id != k.current {
+			delete(k.keys, id)
+		}
+	}
+}
+
+func (k *Keyring) aead(id uint32) (cipher.AEAD, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKey, id)
+	}
+
+	return aead, nil
+}
+
+// Seal seals data with the current key. ad is not in the sealed data, the
+// same ad must be given to Open.
+func (k *Keyring) Seal(data, ad []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(SealHeaderSize + len(data) + (len(data)/sealChunkSize+1)*16)
+
+	w, err := k.NewSealWriter(&buf, ad)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Open opens what Seal sealed with the same ad.
+func (k *Keyring) Open(sealed, ad []byte) ([]byte, error) {
+	r, err := k.NewOpenReader(bytes.NewReader(sealed), ad)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	return data, nil
+}
+
+// IsSealed tells if b starts like sealed data.
+func IsSealed(b []byte) bool {
+	return len(b) >= SealHeaderSize && bytes.HasPrefix(b, sealMagic[:])
+}
+
+// SealedKeyID is the ID of the key header was sealed with. header has to be at
+// least SealHeaderSize long.
+func SealedKeyID(header []byte) (uint32, bool) {
+	if !IsSealed(header) || header[sealMagicSize] != sealFormat {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint32(header[sealMagicSize+1:]), true
+}
+
+// NewSealWriter seals what is written to it into w with the current key. Close
+// it to write the last chunk, it does not close w.
+func (k *Keyring) NewSealWriter(w io.Writer, ad []byte) (io.WriteCloser, error) {
+	k.mu.RLock()
+	id := k.current
+	k.mu.RUnlock()
+
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, SealHeaderSize)
+	copy(header, sealMagic[:])
+	header[sealMagicSize] = sealFormat
+	binary.BigEndian.PutUint32(header[sealMagicSize+1:], id)
+	if _, err := rand.Read(header[SealHeaderSize-sealPrefixSize:]); err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &sealWriter{
+		sealStream: newSealStream(aead, header, ad),
+		w:          w,
+		buf:        make([]byte, 0, sealChunkSize),
+	}, nil
+}
+
+// NewOpenReader opens what a seal writer sealed into r with the same ad. It
+// fails with ErrSealBroken on a chunk that was changed, moved or cut off.
+func (k *Keyring) NewOpenReader(r io.Reader, ad []byte) (io.Reader, error) {
+	header := make([]byte, SealHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotSealed
+		}
+		return nil, err
+	}
+
+	id, ok := SealedKeyID(header)
+	if !ok {
+		return nil, ErrNotSealed
+	}
+
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &openReader{
+		sealStream: newSealStream(aead, header, ad),
+		r:          r,
+		chunk:      make([]byte, sealChunkSize+aead.Overhead()+1),
+		plain:      make([]byte, 0, sealChunkSize),
+	}, nil
+}
+
+type sealStream struct {
+	aead    cipher.AEAD
+	ad      []byte
+	nonce   []byte
+	counter uint32
+}
+
+func newSealStream(aead cipher.AEAD, header, ad []byte) sealStream {
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[SealHeaderSize-sealPrefixSize:])
+
+	return sealStream{
+		aead:  aead,
+		ad:    append(append([]byte{}, header...), ad...),
+		nonce: nonce,
+	}
+}
+
+func (s *sealStream) nextNonce(isLast bool) ([]byte, error) {
+	if s.counter == ^uint32(0) {
+		return nil, errors.New("sealed data is too big")
+	}
+
+	binary.BigEndian.PutUint32(s.nonce[sealPrefixSize:], s.counter)
+	s.nonce[len(s.nonce)-1] = 0
+	if isLast {
+		s.nonce[len(s.nonce)-1] = 1
+	}
+	s.counter++
+
+	return s.nonce, nil
+}
+
+type sealWriter struct {
+	sealStream
+	w        io.Writer
+	buf      []byte
+	isClosed bool
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	if s.isClosed {
+		return 0, errors.New("seal writer is closed")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more comes, the last chunk has to
+		// be sealed as the last.
+		if len(s.buf) == sealChunkSize {
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(s.buf[len(s.buf):sealChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+func (s *sealWriter) Close() error {
+	if s.isClosed {
+		return nil
+	}
+	s.isClosed = true
+
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(isLast bool) error {
+	nonce, err := s.nextNonce(isLast)
+	if err != nil {
+		return err
+	}
+
+	sealed := s.aead.Seal(nil, nonce, s.buf, s.ad)
+	s.buf = s.buf[:0]
+
+	_, err = s.w.Write(sealed)
+
+	return err
+}
+
+type openReader struct {
+	sealStream
+	r io.Reader
+	// chunk is one sealed chunk and the first byte of the next, to tell if it
+	// is the last.
+	chunk  []byte
+	ahead  int
+	plain  []byte
+	out    []byte
+	isDone bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.out) == 0 {
+		if o.isDone {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.out)
+	o.out = o.out[n:]
+
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.chunk[o.ahead:])
+	n += o.ahead
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		o.isDone = true
+	case err != nil:
+		return err
+	}
+
+	sealedLen := n
+	if !o.isDone {
+		sealedLen = n - 1
+	}
+
+	nonce, err := o.nextNonce(o.isDone)
+	if err != nil {
+		return err
+	}
+
+	out, err := o.aead.Open(o.plain[:0], nonce, o.chunk[:sealedLen], o.ad)
+	if err != nil {
+		return ErrSealBroken
+	}
+	o.out = out
+
+	if !o.isDone {
+		// The byte read ahead is the first of the next chunk.
+		o.chunk[0] = o.chunk[n-1]
+		o.ahead = 1
+	}
+
+	return nil
+}
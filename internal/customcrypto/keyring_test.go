@@ -0,0 +1,152 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package customcrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyring(t *testing.T) {
+	sizes := map[string]int{
+		"empty":             0,
+		"small":             100,
+		"one chunk":         sealChunkSize,
+		"more than a chunk": sealChunkSize + 1,
+		"many chunks":       3*sealChunkSize + 17,
+		"many whole chunks": 3 * sealChunkSize,
+	}
+
+	k := newTestKeyring(t, 1)
+	ad := []byte("capsules/1")
+
+	for name, size := range sizes {
+		t.Run(name, func(t *testing.T) {
+			data := make([]byte, size)
+			_, err := rand.Read(data)
+			require.NoError(t, err)
+
+			sealed, err := k.Seal(data, ad)
+			require.NoError(t, err)
+			assert.True(t, IsSealed(sealed))
+
+			id, ok := SealedKeyID(sealed)
+			require.True(t, ok)
+			assert.Equal(t, uint32(1), id)
+
+			opened, err := k.Open(sealed, ad)
+			require.NoError(t, err)
+			if size == 0 {
+				assert.Nil(t, opened)
+			} else {
+				assert.Equal(t, data, opened)
+			}
+
+			t.Run("stream", func(t *testing.T) {
+				var buf bytes.Buffer
+				w, err := k.NewSealWriter(&buf, ad)
+				require.NoError(t, err)
+				// Written in odd pieces so chunks don't line up with writes.
+				for p := data; len(p) > 0; {
+					n := min(len(p), 1000)
+					_, err := w.Write(p[:n])
+					require.NoError(t, err)
+					p = p[n:]
+				}
+				require.NoError(t, w.Close())
+
+				r, err := k.NewOpenReader(&buf, ad)
+				require.NoError(t, err)
+				opened, err := io.ReadAll(r)
+				require.NoError(t, err)
+				assert.Equal(t, len(data), len(opened))
+				assert.True(t, bytes.Equal(data, opened))
+			})
+
+			t.Run("other ad", func(t *testing.T) {
+				_, err := k.Open(sealed, []byte("capsules/2"))
+				require.ErrorIs(t, err, ErrSealBroken)
+			})
+
+			t.Run("flipped bit", func(t *testing.T) {
+				broken := bytes.Clone(sealed)
+				broken[len(broken)-1] ^= 1
+				_, err := k.Open(broken, ad)
+				require.ErrorIs(t, err, ErrSealBroken)
+			})
+
+			t.Run("cut short", func(t *testing.T) {
+				if size <= sealChunkSize {
+					t.Skip("has only the last chunk")
+				}
+				// Cut right after the first chunk, which is whole.
+				cut := sealed[:SealHeaderSize+sealChunkSize+16]
+				_, err := k.Open(cut, ad)
+				require.ErrorIs(t, err, ErrSealBroken)
+			})
+		})
+	}
+
+	t.Run("not sealed", func(t *testing.T) {
+		_, err := k.Open([]byte(`{"ownerId":"..."}`), ad)
+		require.ErrorIs(t, err, ErrNotSealed)
+		assert.False(t, IsSealed([]byte(`{"ownerId":"..."}`)))
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		k := newTestKeyring(t, 1)
+		sealedWith1, err := k.Seal([]byte("old"), ad)
+		require.NoError(t, err)
+
+		key, err := NewDataKey()
+		require.NoError(t, err)
+		require.NoError(t, k.Add(2, key))
+		require.NoError(t, k.SetCurrent(2))
+		assert.Equal(t, uint32(2), k.Current())
+
+		sealedWith2, err := k.Seal([]byte("new"), ad)
+		require.NoError(t, err)
+		id, _ := SealedKeyID(sealedWith2)
+		assert.Equal(t, uint32(2), id)
+
+		opened, err := k.Open(sealedWith1, ad)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("old"), opened)
+
+		k.Retire()
+		_, err = k.Open(sealedWith1, ad)
+		require.ErrorIs(t, err, ErrUnknownKey)
+
+		opened, err = k.Open(sealedWith2, ad)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("new"), opened)
+	})
+
+	t.Run("no current key", func(t *testing.T) {
+		_, err := NewKeyring().Seal([]byte("data"), ad)
+		require.ErrorIs(t, err, ErrUnknownKey)
+	})
+}
+
+func newTestKeyring(t *testing.T, id uint32) *Keyring {
+	t.Helper()
+
+	key, err := NewDataKey()
+	require.NoError(t, err)
+
+	k := NewKeyring()
+	require.NoError(t, k.Add(id, key))
+	require.NoError(t, k.SetCurrent(id))
+
+	return k
+}
@@ -2,29 +2,26 @@
 package dataredundancy
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
 
+	"github.com/google/uuid"
 	"github.com/klauspost/reedsolomon"
 )
 
-const (
-	headerLength = 8
-)
-
 // ErasureCoder handles data erasure coding and reconstruction
 type ErasureCoder interface {
-	Erasure(data []byte) ([][]byte, error)
+	Erasure(capsuleID, repairGroupID uuid.UUID, data []byte) ([][]byte, error)
+	ErasureInto(buf []byte, capsuleID, repairGroupID uuid.UUID, data []byte) ([][]byte, error)
 	Reconstruct(shards [][]byte, dst io.Writer) error
+	Repair(shards [][]byte) ([][]byte, error)
 }
 
 // NewErasureCoderFunc returns an erasureCoder that handles data erasure coding and reconstruction
 type NewErasureCoderFunc func(dataShardsNum, parityShardsNum int) (*erasureCode, error)
 
-// ErasureFunc
-type ErasureFunc func(data []byte) ([][]byte, error)
+// ErasureFunc is ErasureInto.
+type ErasureFunc func(buf []byte, capsuleID, repairGroupID uuid.UUID, data []byte) ([][]byte, error)
 
 // ReconstructFunc
 type ReconstructFunc func(shards [][]byte, dst io.Writer) ([]byte, error)
@@ -52,41 +49,116 @@ func NewReedSolomonCoder(dataShardsNum, parityShardsNum int) (*erasureCode, erro
 	}, nil
 }
 
-// Erasure splits data into erasure-coded shards
-func (self *erasureCode) Erasure(data []byte) ([][]byte, error) {
-	lengthBytes := make([]byte, headerLength)
-	binary.BigEndian.PutUint64(lengthBytes, uint64(len(data)))
-	dataWithLength := append(lengthBytes, data...)
+// Erasure splits data into erasure-coded shards, each with a ShardHeader of
+// the block in front.
+func (self *erasureCode) Erasure(capsuleID, repairGroupID uuid.UUID, data []byte) ([][]byte, error) {
+	return self.ErasureInto(nil, capsuleID, repairGroupID, data)
+}
 
-	shards, err := self.encoder.Split(dataWithLength)
-	if err != nil {
-		return nil, err
+// ErasureInto is Erasure with the shards in buf, one after the other, so a
+// caller coding block after block can use the same memory for all of them.
+// buf is only grown when it is short, see ShardsSize. The shards are only good
+// till buf is used again.
+func (self *erasureCode) ErasureInto(buf []byte, capsuleID, repairGroupID uuid.UUID, data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, reedsolomon.ErrShortData
+	}
+
+	totalShards := self.dataShardNum + self.parityShardNum
+	shardLen := ShardsSize(len(data), self.dataShardNum, self.parityShardNum) / totalShards
+	if cap(buf) < shardLen*totalShards {
+		buf = make([]byte, shardLen*totalShards)
+	}
+	buf = buf[:shardLen*totalShards]
+
+	// The data is copied once, straight to where it is in its shard. The
+	// padding of the last data shard is zeroed, buf can have an old block in
+	// it.
+	shards := make([][]byte, totalShards)
+	bodies := make([][]byte, totalShards)
+	for i := range shards {
+		shards[i] = buf[i*shardLen : (i+1)*shardLen : (i+1)*shardLen]
+		bodies[i] = shards[i][ShardHeaderSize:]
+		if i < self.dataShardNum {
+			n := copy(bodies[i], data[min(len(data), i*len(bodies[i])):])
+			clear(bodies[i][n:])
+		}
 	}
 
-	err = self.encoder.Encode(shards)
+	err := self.encoder.Encode(bodies)
 	if err != nil {
 		return nil, err
 	}
 
-	//Todo: We need to add a header to each shard that has its index and its repairID in it.
-	for i, shard := range shards {
-		//Todo: create header and shard in-place.
-		shards[i] = append([]byte{uint8(i)}, shard...)
+	header := ShardHeader{
+		Version:        ShardHeaderVersion,
+		DataShards:     uint8(self.dataShardNum),
+		ParityShards:   uint8(self.parityShardNum),
+		CapsuleID:      capsuleID,
+		RepairGroupID:  repairGroupID,
+		OriginalLength: uint64(len(data)),
+	}
+	for i := range shards {
+		header.Index = uint8(i)
+		header.put(shards[i])
 	}
 
 	return shards, nil
 }
 
+// ShardsSize is the size of all the shards, with their headers, of dataLen
+// bytes coded into dataShards and parityShards.
+func ShardsSize(dataLen, dataShards, parityShards int) int {
+	bodyLen := (dataLen + dataShards - 1) / dataShards
+	return (ShardHeaderSize + bodyLen) * (dataShards + parityShards)
+}
+
 // Reconstruct rebuilds original data from available shards
 func (self *erasureCode) Reconstruct(shards [][]byte, dst io.Writer) error {
 	// Todo: Might have to reconsider if we returning shards or we take a dst. which means we need a writer.
 
-	//Todo: reindex shards so we know we have them in the right index
+	indexedShards, header, err := self.indexShards(shards)
+	if err != nil {
+		return err
+	}
+
+	err = self.encoder.Reconstruct(indexedShards)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to reconstruct shards: %w",
+			err,
+		)
+	}
+
+	isValid, err := self.encoder.Verify(indexedShards)
+	if err != nil {
+		return err
+	}
+
+	if !isValid {
+		return fmt.Errorf(
+			"Verification failed after reconstruction, data likely corrupted.",
+		)
+	}
+
+	err = self.encoder.Join(dst, indexedShards, int(header.OriginalLength))
+	if err != nil {
+		return fmt.Errorf(
+			"failed to join reconstructed shards: %w",
+			err,
+		)
+	}
+
+	return nil
+}
 
-	// Extract index and rebuild proper array
+// indexShards puts every shard at the index in its header, with the header
+// taken off, and returns the header of the block. A shard whose header is bad
+// is left out like a missing one, a shard of another block is an error.
+func (self *erasureCode) indexShards(shards [][]byte) ([][]byte, ShardHeader, error) {
 	totalShards := self.dataShardNum + self.parityShardNum
 	if len(shards) != totalShards {
-		return fmt.Errorf(
+		return nil, ShardHeader{}, fmt.Errorf(
 			"incorrect number of shards: expected '%d', but got '%d'/Tip: Make sure missing shards are nil but the length off the shards need to be %d /",
 			totalShards,
 			len(shards),
@@ -94,41 +166,71 @@ func (self *erasureCode) Reconstruct(shards [][]byte, dst io.Writer) error {
 		)
 	}
 
-	availableCount := 0
-	indexedShards := make([][]byte, totalShards)
+	var (
+		blockHeader    ShardHeader
+		availableCount int
+		indexedShards  = make([][]byte, totalShards)
+	)
 	for _, shard := range shards {
-		if len(shard) == 0 || shard == nil {
+		if len(shard) == 0 {
 			continue
 		}
 
-		indexByte := shard[0]
-		index := int(indexByte) // Explicit conversion
+		header, err := ParseShardHeader(shard)
+		if err != nil {
+			// todo: tell the caller which shard is bad, the holder of it
+			// should be audited.
+			continue
+		}
 
-		// Validate index is within bounds
-		if index < 0 || index >= totalShards {
-			return fmt.Errorf(
-				"shard index out of bounds: got %d, expected 0-%d",
-				index,
-				totalShards-1,
+		if int(header.DataShards) != self.dataShardNum || int(header.ParityShards) != self.parityShardNum {
+			return nil, ShardHeader{}, fmt.Errorf(
+				"shard is of %d data and %d parity shards, expected %d and %d",
+				header.DataShards,
+				header.ParityShards,
+				self.dataShardNum,
+				self.parityShardNum,
 			)
 		}
 
-		shardData := shard[1:]
-		indexedShards[index] = shardData
+		if availableCount == 0 {
+			blockHeader = header
+		} else if !header.isSameBlock(blockHeader) {
+			return nil, ShardHeader{}, fmt.Errorf(
+				"shard %d is of repair group %s, expected %s",
+				header.Index,
+				header.RepairGroupID,
+				blockHeader.RepairGroupID,
+			)
+		}
+
+		indexedShards[header.Index] = shard[ShardHeaderSize:]
 		availableCount++
 	}
 
 	if availableCount < self.dataShardNum {
-		return fmt.Errorf(
+		return nil, ShardHeader{}, fmt.Errorf(
 			"insufficient shards for reconstruction: have %d, need %d",
 			availableCount,
 			self.dataShardNum,
 		)
 	}
 
-	err := self.encoder.Reconstruct(indexedShards)
+	return indexedShards, blockHeader, nil
+}
+
+// Repair rebuilds the missing shards of shards, which are nil, and returns all
+// of them with their header in front like Erasure does. The rebuilt shards are
+// the same as the ones that went missing.
+func (self *erasureCode) Repair(shards [][]byte) ([][]byte, error) {
+	indexedShards, header, err := self.indexShards(shards)
 	if err != nil {
-		return fmt.Errorf(
+		return nil, err
+	}
+
+	err = self.encoder.Reconstruct(indexedShards)
+	if err != nil {
+		return nil, fmt.Errorf(
 			"failed to reconstruct shards: %w",
 			err,
 		)
@@ -136,34 +238,70 @@ func (self *erasureCode) Reconstruct(shards [][]byte, dst io.Writer) error {
 
 	isValid, err := self.encoder.Verify(indexedShards)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if !isValid {
-		return fmt.Errorf(
+		return nil, fmt.Errorf(
 			"Verification failed after reconstruction, data likely corrupted.",
 		)
 	}
 
-	shardLen := len(indexedShards[0])
+	return withHeaders(header, indexedShards), nil
+}
 
-	var buf bytes.Buffer
-	err = self.encoder.Join(&buf, indexedShards, shardLen*self.dataShardNum)
-	if err != nil {
-		return fmt.Errorf(
-			"failed to join reconstructed shards: %w",
-			err,
-		)
+// RecoverBlock rebuilds the block of shards into dst from their headers alone,
+// without knowing how the block was coded. shards are in any order, a recovery
+// tool can give it the raw files of a CAS dir that are of one repair group.
+func RecoverBlock(shards [][]byte, dst io.Writer) (ShardHeader, error) {
+	var (
+		header ShardHeader
+		placed [][]byte
+	)
+	for _, shard := range shards {
+		h, err := ParseShardHeader(shard)
+		if err != nil {
+			continue
+		}
+
+		if placed == nil {
+			header = h
+			placed = make([][]byte, int(h.DataShards)+int(h.ParityShards))
+		}
+		if !h.isSameBlock(header) {
+			return ShardHeader{}, fmt.Errorf(
+				"shard %d is of repair group %s, expected %s",
+				h.Index,
+				h.RepairGroupID,
+				header.RepairGroupID,
+			)
+		}
+
+		placed[h.Index] = shard
 	}
 
-	reconstructed := buf.Bytes()
-	originalLen := binary.BigEndian.Uint64(reconstructed[:headerLength])
-	data := reconstructed[headerLength : headerLength+originalLen]
+	if placed == nil {
+		return ShardHeader{}, fmt.Errorf("%w: no shard has a good header", ErrBadShardHeader)
+	}
 
-	_, err = dst.Write(data)
+	coder, err := NewReedSolomonCoder(int(header.DataShards), int(header.ParityShards))
 	if err != nil {
-		return fmt.Errorf("failed to write data: %w", err)
+		return ShardHeader{}, err
 	}
 
-	return nil
+	return header, coder.Reconstruct(placed, dst)
+}
+
+// withHeaders puts a header of the block of header in front of every one of
+// bodies, at its index.
+func withHeaders(header ShardHeader, bodies [][]byte) [][]byte {
+	shards := make([][]byte, len(bodies))
+	for i, body := range bodies {
+		header.Index = uint8(i)
+		shards[i] = make([]byte, ShardHeaderSize+len(body))
+		copy(shards[i][ShardHeaderSize:], body)
+		header.put(shards[i])
+	}
+
+	return shards
 }
@@ -2,8 +2,10 @@ package dataredundancy
 
 import (
 	"bytes"
+	"io"
 	"testing"
 
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -73,7 +75,7 @@ func TestErasure(t *testing.T) {
 			coder, err := NewReedSolomonCoder(tt.dataShards, tt.parityShards)
 			require.NoError(t, err)
 
-			shards, err := coder.Erasure(tt.data)
+			shards, err := coder.Erasure(uuid.New(), uuid.New(), tt.data)
 			require.NoError(t, err)
 
 			for i := range tt.corruptShardsCount {
@@ -93,3 +95,106 @@ func TestErasure(t *testing.T) {
 		})
 	}
 }
+
+func TestRepair(t *testing.T) {
+	coder, err := NewReedSolomonCoder(5, 3)
+	require.NoError(t, err)
+
+	shards, err := coder.Erasure(uuid.New(), uuid.New(), bytes.Repeat([]byte("data is testing"), 50))
+	require.NoError(t, err)
+
+	missing := make([][]byte, len(shards))
+	copy(missing, shards)
+	missing[0], missing[4], missing[7] = nil, nil, nil
+
+	repaired, err := coder.Repair(missing)
+	require.NoError(t, err)
+	assert.Equal(t, shards, repaired)
+
+	missing[1] = nil
+	_, err = coder.Repair(missing)
+	require.ErrorContains(t, err, "insufficient shards for reconstruction")
+}
+
+func TestErasureInto(t *testing.T) {
+	coder, err := NewReedSolomonCoder(5, 3)
+	require.NoError(t, err)
+
+	capsuleID, repairGroupID := uuid.New(), uuid.New()
+	big := bytes.Repeat([]byte("a bigger block "), 100)
+	small := []byte("a small block after it")
+
+	buf := make([]byte, ShardsSize(len(big), 5, 3))
+	_, err = coder.ErasureInto(buf, capsuleID, repairGroupID, big)
+	require.NoError(t, err)
+
+	// The small block is coded in the memory of the big one, what is left of
+	// it must not end up in the small one.
+	shards, err := coder.ErasureInto(buf, capsuleID, repairGroupID, small)
+	require.NoError(t, err)
+	assert.Same(t, &buf[0], &shards[0][0], "buf is used")
+
+	want, err := coder.Erasure(capsuleID, repairGroupID, small)
+	require.NoError(t, err)
+	assert.Equal(t, want, shards)
+
+	shards[0], shards[6] = nil, nil
+	var got bytes.Buffer
+	require.NoError(t, coder.Reconstruct(shards, &got))
+	assert.Equal(t, small, got.Bytes())
+
+	_, err = coder.ErasureInto(buf, capsuleID, repairGroupID, nil)
+	assert.Error(t, err)
+}
+
+// A block is 1mb coded into 32 data and 22 parity shards, like a capsule does.
+// BenchmarkCapsuleStream in capsule streams whole capsules of them.
+func BenchmarkErasure(b *testing.B) {
+	coder, err := NewReedSolomonCoder(32, 22)
+	require.NoError(b, err)
+
+	block := bytes.Repeat([]byte{7}, 1<<20)
+	capsuleID, repairGroupID := uuid.New(), uuid.New()
+
+	b.Run("alloc", func(b *testing.B) {
+		b.SetBytes(int64(len(block)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := coder.Erasure(capsuleID, repairGroupID, block); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("into", func(b *testing.B) {
+		buf := make([]byte, ShardsSize(len(block), 32, 22))
+		b.SetBytes(int64(len(block)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := coder.ErasureInto(buf, capsuleID, repairGroupID, block); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkReconstruct(b *testing.B) {
+	coder, err := NewReedSolomonCoder(32, 22)
+	require.NoError(b, err)
+
+	block := bytes.Repeat([]byte{7}, 1<<20)
+	shards, err := coder.Erasure(uuid.New(), uuid.New(), block)
+	require.NoError(b, err)
+
+	b.SetBytes(int64(len(block)))
+	b.ReportAllocs()
+	missing := make([][]byte, len(shards))
+	for b.Loop() {
+		// The most shards a block can lose.
+		copy(missing, shards)
+		clear(missing[:22])
+		if err := coder.Reconstruct(missing, io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
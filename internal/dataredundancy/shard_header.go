@@ -0,0 +1,118 @@
+package dataredundancy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/google/uuid"
+)
+
+// A shard is a ShardHeader then its part of the coded block. The header is
+// enough to put the shards of a block back together without anything else,
+// like from the raw files of a CAS dir when the db is gone.
+//
+// Version 1, big endian:
+//
+//   - byte[0:4]   = shardMagic
+//   - byte[4]     = version
+//   - byte[5]     = index of the shard
+//   - byte[6]     = data shards
+//   - byte[7]     = parity shards
+//   - byte[8:24]  = capsule ID
+//   - byte[24:40] = repair group ID
+//   - byte[40:48] = original length of the block
+//   - byte[48:52] = crc32c of byte[0:48] and the rest of the shard
+const (
+	ShardHeaderVersion uint8 = 1
+	ShardHeaderSize          = 52
+)
+
+var (
+	shardMagic = [4]byte{'D', 'G', 'S', 'H'}
+	crc32c     = crc32.MakeTable(crc32.Castagnoli)
+
+	ErrBadShardHeader = errors.New("bad shard header")
+	ErrShardChecksum  = errors.New("shard checksum mismatch")
+)
+
+// ShardHeader is in front of every shard Erasure codes.
+type ShardHeader struct {
+	Version                  uint8
+	Index                    uint8
+	DataShards, ParityShards uint8
+	CapsuleID                uuid.UUID
+	RepairGroupID            uuid.UUID
+	OriginalLength           uint64
+	Checksum                 uint32
+}
+
+// ParseShardHeader reads the header of shard and checks the shard against its
+// checksum.
+func ParseShardHeader(shard []byte) (ShardHeader, error) {
+	if len(shard) < ShardHeaderSize {
+		return ShardHeader{}, fmt.Errorf("%w: shard is %d bytes, less than a header", ErrBadShardHeader, len(shard))
+	}
+	if !bytes.Equal(shard[0:4], shardMagic[:]) {
+		return ShardHeader{}, fmt.Errorf("%w: not a shard", ErrBadShardHeader)
+	}
+
+	h := ShardHeader{
+		Version:        shard[4],
+		Index:          shard[5],
+		DataShards:     shard[6],
+		ParityShards:   shard[7],
+		CapsuleID:      uuid.UUID(shard[8:24]),
+		RepairGroupID:  uuid.UUID(shard[24:40]),
+		OriginalLength: binary.BigEndian.Uint64(shard[40:48]),
+		Checksum:       binary.BigEndian.Uint32(shard[48:52]),
+	}
+
+	switch {
+	case h.Version != ShardHeaderVersion:
+		return ShardHeader{}, fmt.Errorf("%w: version %d is not supported", ErrBadShardHeader, h.Version)
+
+	case h.DataShards == 0 || h.ParityShards == 0 || int(h.Index) >= int(h.DataShards)+int(h.ParityShards):
+		return ShardHeader{}, fmt.Errorf(
+			"%w: shard %d of %d data and %d parity shards",
+			ErrBadShardHeader,
+			h.Index,
+			h.DataShards,
+			h.ParityShards,
+		)
+
+	case h.Checksum != shardChecksum(shard[:48], shard[ShardHeaderSize:]):
+		return ShardHeader{}, ErrShardChecksum
+	}
+
+	return h, nil
+}
+
+// put writes h in front of the body already in shard, with the checksum of
+// both.
+func (h ShardHeader) put(shard []byte) {
+	copy(shard[0:4], shardMagic[:])
+	shard[4] = h.Version
+	shard[5] = h.Index
+	shard[6] = h.DataShards
+	shard[7] = h.ParityShards
+	copy(shard[8:24], h.CapsuleID[:])
+	copy(shard[24:40], h.RepairGroupID[:])
+	binary.BigEndian.PutUint64(shard[40:48], h.OriginalLength)
+	binary.BigEndian.PutUint32(shard[48:52], shardChecksum(shard[:48], shard[ShardHeaderSize:]))
+}
+
+// isSameBlock reports whether h and other are shards of the same block.
+func (h ShardHeader) isSameBlock(other ShardHeader) bool {
+	return h.CapsuleID == other.CapsuleID &&
+		h.RepairGroupID == other.RepairGroupID &&
+		h.DataShards == other.DataShards &&
+		h.ParityShards == other.ParityShards &&
+		h.OriginalLength == other.OriginalLength
+}
+
+func shardChecksum(header, body []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header, crc32c), crc32c, body)
+}
@@ -0,0 +1,99 @@
+package dataredundancy
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardHeader(t *testing.T) {
+	coder, err := NewReedSolomonCoder(5, 3)
+	require.NoError(t, err)
+
+	capsuleID, repairGroupID := uuid.New(), uuid.New()
+	data := bytes.Repeat([]byte("data is testing"), 50)
+	shards, err := coder.Erasure(capsuleID, repairGroupID, data)
+	require.NoError(t, err)
+
+	for i, shard := range shards {
+		header, err := ParseShardHeader(shard)
+		require.NoError(t, err)
+		assert.Equal(t, ShardHeader{
+			Version:        ShardHeaderVersion,
+			Index:          uint8(i),
+			DataShards:     5,
+			ParityShards:   3,
+			CapsuleID:      capsuleID,
+			RepairGroupID:  repairGroupID,
+			OriginalLength: uint64(len(data)),
+			Checksum:       header.Checksum,
+		}, header)
+	}
+
+	t.Run("bad shards", func(t *testing.T) {
+		_, err := ParseShardHeader(shards[0][:ShardHeaderSize-1])
+		assert.ErrorIs(t, err, ErrBadShardHeader)
+
+		notShard := bytes.Clone(shards[0])
+		notShard[0] = 'X'
+		_, err = ParseShardHeader(notShard)
+		assert.ErrorIs(t, err, ErrBadShardHeader)
+
+		newer := bytes.Clone(shards[0])
+		newer[4] = ShardHeaderVersion + 1
+		_, err = ParseShardHeader(newer)
+		assert.ErrorIs(t, err, ErrBadShardHeader)
+
+		flipped := bytes.Clone(shards[0])
+		flipped[len(flipped)-1] ^= 1
+		_, err = ParseShardHeader(flipped)
+		assert.ErrorIs(t, err, ErrShardChecksum)
+	})
+
+	t.Run("corrupt shard is left out", func(t *testing.T) {
+		corrupt := make([][]byte, len(shards))
+		copy(corrupt, shards)
+		corrupt[2] = bytes.Clone(shards[2])
+		corrupt[2][ShardHeaderSize] ^= 1
+
+		var buf bytes.Buffer
+		require.NoError(t, coder.Reconstruct(corrupt, &buf))
+		assert.Equal(t, data, buf.Bytes())
+	})
+
+	t.Run("shard of another block", func(t *testing.T) {
+		other, err := coder.Erasure(capsuleID, uuid.New(), data)
+		require.NoError(t, err)
+
+		mixed := make([][]byte, len(shards))
+		copy(mixed, shards)
+		mixed[1] = other[1]
+
+		var buf bytes.Buffer
+		assert.ErrorContains(t, coder.Reconstruct(mixed, &buf), "is of repair group")
+	})
+
+	t.Run("recover from shards alone", func(t *testing.T) {
+		raw := make([][]byte, 0, len(shards))
+		for _, i := range rand.Perm(len(shards))[:5] {
+			raw = append(raw, shards[i])
+		}
+
+		var buf bytes.Buffer
+		header, err := RecoverBlock(raw, &buf)
+		require.NoError(t, err)
+		assert.Equal(t, data, buf.Bytes())
+		assert.Equal(t, capsuleID, header.CapsuleID)
+		assert.Equal(t, repairGroupID, header.RepairGroupID)
+
+		_, err = RecoverBlock(raw[:4], &buf)
+		assert.ErrorContains(t, err, "insufficient shards for reconstruction")
+
+		_, err = RecoverBlock([][]byte{[]byte("not a shard")}, &buf)
+		assert.ErrorIs(t, err, ErrBadShardHeader)
+	})
+}
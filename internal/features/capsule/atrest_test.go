@@ -0,0 +1,276 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSealedAtRest(t *testing.T) {
+	capsuleID := uuid.New()
+	c := &capsule{OwnerID: uuid.New(), GuardianIDs: []uuid.UUID{uuid.New(), uuid.New()}}
+	share := &masterKeyShare{CapsuleID: capsuleID, Share: []byte("share of the master key"), TotalShares: 3, ThresholdShares: 2}
+
+	assertReadable := func(t *testing.T, s dbStorer) {
+		t.Helper()
+
+		var gotC capsule
+		exists, err := s.find(database.CollCapsules, capsuleID.String(), &gotC)
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Equal(t, c.OwnerID, gotC.OwnerID)
+		assert.Equal(t, c.GuardianIDs, gotC.GuardianIDs)
+
+		var gotShare masterKeyShare
+		exists, err = s.find(database.CollKeyShares, capsuleID.String(), &gotShare)
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Equal(t, share.Share, gotShare.Share)
+	}
+
+	t.Run(storage.DriverBBolt, func(t *testing.T) {
+		db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+
+		// Written plain, as before there was sealing.
+		require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+			for coll, v := range map[database.Collection]any{database.CollCapsules: c, database.CollKeyShares: share} {
+				b, err := tx.CreateBucketIfNotExists([]byte(coll.BucketName()))
+				if err != nil {
+					return err
+				}
+				bv, err := json.Marshal(v)
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(capsuleID.String()), bv); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+
+		keyring := newTestKeyring(1)
+		s := NewDBStore(&DBStoreConfig{DB: db, Keyring: keyring})
+		assertReadable(t, s)
+
+		raw := func() []byte {
+			var v []byte
+			require.NoError(t, db.View(func(tx *bolt.Tx) error {
+				v = bytes.Clone(tx.Bucket([]byte(database.CollCapsules.BucketName())).Get([]byte(capsuleID.String())))
+				return nil
+			}))
+			return v
+		}
+		assertSealedWith(t, raw(), 1, c.OwnerID.String())
+
+		t.Run("moved value", func(t *testing.T) {
+			movedTo := uuid.NewString()
+			require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+				return tx.Bucket([]byte(database.CollCapsules.BucketName())).Put([]byte(movedTo), raw())
+			}))
+
+			var got capsule
+			_, err := s.find(database.CollCapsules, movedTo, &got)
+			require.ErrorIs(t, err, customcrypto.ErrSealBroken)
+
+			require.NoError(t, s.delete(database.CollCapsules, movedTo))
+		})
+
+		t.Run("rotation", func(t *testing.T) {
+			rotateTestKeyring(t, keyring, 2)
+
+			resealed, err := s.reseal()
+			require.NoError(t, err)
+			assert.Equal(t, 2, resealed)
+
+			keyring.Retire()
+			assertReadable(t, s)
+			assertSealedWith(t, raw(), 2, c.OwnerID.String())
+		})
+	})
+
+	t.Run(storage.DriverSQLite, func(t *testing.T) {
+		db := storage.NewSQLite(t.TempDir(), slog.Default())
+		t.Cleanup(func() { db.Close() })
+
+		keyring := newTestKeyring(1)
+		s := NewSQLiteDBStore(&SQLiteDBStoreConfig{DB: db, Keyring: keyring})
+		require.NoError(t, s.createOrUpdate(database.CollCapsules, capsuleID.String(), c))
+		require.NoError(t, s.createOrUpdate(database.CollKeyShares, capsuleID.String(), share))
+		assertReadable(t, s)
+
+		raw := func(table, column, where string, args ...any) []byte {
+			var v []byte
+			require.NoError(t, db.NewSelect().
+				Table(table).
+				Column(column).
+				Where(where, args...).
+				Limit(1).
+				Scan(context.Background(), &v))
+			return v
+		}
+		assertSealedWith(t, raw("capsules", "owner_id", "id = ?", capsuleID), 1, c.OwnerID.String())
+		assertSealedWith(t, raw("capsule_guardians", "guardian_id", "capsule_id = ?", capsuleID), 1, c.GuardianIDs[0].String())
+		assertSealedWith(t, raw("key_shares", "share", "capsule_id = ?", capsuleID), 1, string(share.Share))
+
+		t.Run("plain values from before", func(t *testing.T) {
+			_, err := db.NewUpdate().
+				Table("capsules").
+				Set("owner_id = ?", c.OwnerID.String()).
+				Where("id = ?", capsuleID).
+				Exec(context.Background())
+			require.NoError(t, err)
+
+			s := NewSQLiteDBStore(&SQLiteDBStoreConfig{DB: db, Keyring: keyring})
+			assertReadable(t, s)
+			assertSealedWith(t, raw("capsules", "owner_id", "id = ?", capsuleID), 1, c.OwnerID.String())
+		})
+
+		t.Run("rotation", func(t *testing.T) {
+			rotateTestKeyring(t, keyring, 2)
+
+			resealed, err := s.reseal()
+			require.NoError(t, err)
+			// The owner, the 2 guardians and the share.
+			assert.Equal(t, 4, resealed)
+
+			keyring.Retire()
+			assertReadable(t, s)
+			assertSealedWith(t, raw("capsules", "owner_id", "id = ?", capsuleID), 2, c.OwnerID.String())
+		})
+
+		t.Run("no index on sealed columns", func(t *testing.T) {
+			var indices []string
+			err := db.NewRaw("SELECT name FROM sqlite_master WHERE type = 'index' AND name IN (?)",
+				bun.In([]string{"capsules_owner_id_idx", "capsule_guardians_guardian_id_idx"}),
+			).Scan(context.Background(), &indices)
+			require.NoError(t, err)
+			assert.Empty(t, indices)
+		})
+	})
+
+	t.Run("CAS", func(t *testing.T) {
+		rootDir := t.TempDir()
+		keyring := newTestKeyring(1)
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: keyring})
+
+		data := []byte("a shard nobody should read off the disk")
+		hash := sha256.Sum256(data)
+		require.NoError(t, objects.SaveCAS(hash, data))
+
+		staged := []byte("a staged shard")
+		stagedHash := sha256.Sum256(staged)
+		stagingID := uuid.New()
+		require.NoError(t, objects.stageCAS(stagingID, stagedHash, staged))
+
+		rawObject := func(path string) []byte {
+			v, err := os.ReadFile(path)
+			require.NoError(t, err)
+			return v
+		}
+		stagedPath := filepath.Join(objects.stagingDir(stagingID), filepath.Base(objects.casPath(stagedHash)))
+		assertSealedWith(t, rawObject(objects.casPath(hash)), 1, string(data))
+		assertSealedWith(t, rawObject(stagedPath), 1, string(staged))
+
+		t.Run("plain objects from before", func(t *testing.T) {
+			plain := []byte("a shard from before")
+			plainHash := sha256.Sum256(plain)
+			require.NoError(t, os.MkdirAll(filepath.Dir(objects.casPath(plainHash)), 0700))
+			require.NoError(t, os.WriteFile(objects.casPath(plainHash), plain, 0600))
+
+			_, err := objects.GetCAS(plainHash)
+			require.ErrorIs(t, err, ErrObjectCorrupted)
+
+			objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: keyring})
+			got, err := objects.GetCAS(plainHash)
+			require.NoError(t, err)
+			assert.Equal(t, plain, got)
+		})
+
+		t.Run("flipped bit", func(t *testing.T) {
+			other := []byte("another shard")
+			otherHash := sha256.Sum256(other)
+			require.NoError(t, objects.SaveCAS(otherHash, other))
+
+			v := rawObject(objects.casPath(otherHash))
+			v[len(v)-1] ^= 1
+			require.NoError(t, os.WriteFile(objects.casPath(otherHash), v, 0600))
+
+			_, err := objects.VerifyCAS(otherHash)
+			require.ErrorIs(t, err, ErrObjectCorrupted)
+			require.NoError(t, os.Remove(objects.casPath(otherHash)))
+		})
+
+		t.Run("rotation", func(t *testing.T) {
+			rotateTestKeyring(t, keyring, 2)
+
+			info, err := os.Stat(objects.casPath(hash))
+			require.NoError(t, err)
+
+			resealed, err := objects.resealCAS()
+			require.NoError(t, err)
+			// The object, the one from before and the staged one.
+			assert.Equal(t, 3, resealed)
+
+			keyring.Retire()
+			got, err := objects.GetCAS(hash)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+			assertSealedWith(t, rawObject(objects.casPath(hash)), 2, string(data))
+			assertSealedWith(t, rawObject(stagedPath), 2, string(staged))
+
+			resealedInfo, err := os.Stat(objects.casPath(hash))
+			require.NoError(t, err)
+			assert.Equal(t, info.ModTime(), resealedInfo.ModTime(), "the gc goes by the mod time")
+
+			require.NoError(t, objects.commitStaged(stagingID))
+			got, err = objects.GetCAS(stagedHash)
+			require.NoError(t, err)
+			assert.Equal(t, staged, got)
+		})
+	})
+}
+
+// assertSealedWith asserts raw is sealed with the key of keyID, and that plain
+// is nowhere in it.
+func assertSealedWith(t *testing.T, raw []byte, keyID uint32, plain string) {
+	t.Helper()
+
+	id, isSealed := customcrypto.SealedKeyID(raw)
+	require.True(t, isSealed, "not sealed")
+	assert.Equal(t, keyID, id)
+	assert.NotContains(t, string(raw), plain)
+}
+
+// rotateTestKeyring makes a new key of id the current one of keyring.
+func rotateTestKeyring(t *testing.T, keyring *customcrypto.Keyring, id uint32) {
+	t.Helper()
+
+	key, err := customcrypto.NewDataKey()
+	require.NoError(t, err)
+	require.NoError(t, keyring.Add(id, key))
+	require.NoError(t, keyring.SetCurrent(id))
+}
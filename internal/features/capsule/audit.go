@@ -0,0 +1,374 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+)
+
+/*
+An audit checks a guardian or a storage provider still holds the shards it was
+given. The owner puts the Merkle root of every shard in the manifest, over
+leaves of message.AuditLeafSize. Whoever holds the manifest picks random shards
+of a holder and random leaves of them, and the holder has to send the leaves
+with their Merkle paths:
+
+	auditor  AuditChallenge
+	holder   AuditProof
+
+A holder that lost a shard can't make up its leaves, so a few leaves of a few
+shards are enough to catch one that kept little of what it holds. Any peer can
+ask for the leaves of a shard it knows the hash of, same as with
+ProviderFetchShard, a leaf is a piece of a sealed block.
+
+Every audit is kept in the holder's auditScore, which is what its reliability
+is from.
+
+todo: the owner keeps no manifest, so only the guardians can audit for now.
+todo: the repair audits every holder on its schedule (see repair.go), but only
+moves the shards of one that fails then, not of one that keeps failing.
+*/
+
+var (
+	ErrNothingToAudit = errors.New("nothing to audit")
+	ErrAuditFailed    = errors.New("audit failed")
+)
+
+const (
+	// auditShardsPerRound is how many shards of a holder an audit challenges.
+	auditShardsPerRound = 4
+	// auditLeavesPerShard is how many leaves of a shard are challenged.
+	auditLeavesPerShard = 4
+)
+
+// auditTarget is a shard of a holder that can be audited.
+type auditTarget struct {
+	hash       [32]byte
+	size       uint32
+	merkleRoot [32]byte
+}
+
+func (s *service) AuditHolder(
+	ctx context.Context, capsuleID uuid.UUID, holder transport.RemotePeer,
+) (*AuditReportDTO, error) {
+	var manifest message.CapsuleIncomingManifestStream
+	isFound, err := s.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find capsule manifest to audit",
+			err,
+			featureCapsule,
+		)
+	}
+	if !isFound {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("no manifest of capsule %s to audit with", capsuleID),
+			ErrCapsuleNotFound,
+			featureCapsule,
+		)
+	}
+
+	targets := auditTargetsOf(&manifest, holder.PublicKey())
+	if len(targets) == 0 {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("holder holds no shard of capsule %s that can be audited", capsuleID),
+			ErrNothingToAudit,
+			featureCapsule,
+		)
+	}
+
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	targets = targets[:min(auditShardsPerRound, len(targets))]
+
+	report := &AuditReportDTO{CapsuleID: capsuleID}
+	for _, target := range targets {
+		report.Audited++
+
+		// NOTICE IMPORTANT: A holder we can't reach fails too, to whoever
+		// recovers the capsule a shard it can't get is as good as lost.
+		if err := challengeShard(holder, target); err != nil {
+			s.Logger.Warn("holder failed audit", "capsuleID", capsuleID, "hash", fmt.Sprintf("%x", target.hash), "err", err)
+			report.Failed++
+			continue
+		}
+		report.Passed++
+	}
+
+	reliability, err := s.recordAudit(holder.PublicKeyStr(), holder.PublicKey(), report.Passed, report.Failed)
+	if err != nil {
+		return nil, err
+	}
+	report.Reliability = *reliability
+
+	return report, nil
+}
+
+// auditTargetsOf is the shards of manifest held by the holder of publicKey. The
+// ones from before audits have no Merkle root and are left out.
+func auditTargetsOf(manifest *message.CapsuleIncomingManifestStream, publicKey []byte) []auditTarget {
+	var targets []auditTarget
+	for _, sm := range manifest.Shards {
+		if sm.MerkleRoot != [32]byte{} && bytes.Equal(sm.GuardianPublicKey, publicKey) {
+			targets = append(targets, auditTarget{sm.Hash, sm.Size, sm.MerkleRoot})
+		}
+	}
+	for _, ps := range manifest.ProviderShards {
+		if ps.MerkleRoot != [32]byte{} && bytes.Equal(ps.ProviderPublicKey, publicKey) {
+			targets = append(targets, auditTarget{ps.Hash, ps.Size, ps.MerkleRoot})
+		}
+	}
+
+	return targets
+}
+
+// challengeShard has holder prove it holds the shard of target.
+func challengeShard(holder transport.RemotePeer, target auditTarget) error {
+	n := numOfLeaves(target.size)
+	leaves := rand.Perm(n)[:min(auditLeavesPerShard, n)]
+
+	challenge := &message.AuditChallenge{Hash: target.hash, Leaves: make([]uint32, len(leaves))}
+	for i, leaf := range leaves {
+		challenge.Leaves[i] = uint32(leaf)
+	}
+
+	if _, err := holder.Send(challenge, nil); err != nil {
+		return err
+	}
+
+	var proof message.AuditProof
+	if _, err := holder.Receive(&proof, nil); err != nil {
+		return err
+	}
+
+	switch {
+	case proof.Hash != target.hash:
+		return fmt.Errorf("%w: proof is of shard %x", ErrAuditFailed, proof.Hash)
+	case !proof.IsOK:
+		return fmt.Errorf("%w: %s (code %d): %s", ErrAuditFailed, proof.Code, proof.Code, proof.Message)
+	case len(proof.Leaves) != len(leaves):
+		return fmt.Errorf("%w: %d leaves proved of %d", ErrAuditFailed, len(proof.Leaves), len(leaves))
+	}
+
+	for i, leaf := range proof.Leaves {
+		if leaf.Index != challenge.Leaves[i] {
+			return fmt.Errorf("%w: leaf %d proved instead of %d", ErrAuditFailed, leaf.Index, challenge.Leaves[i])
+		}
+		if !verifyMerklePath(target.merkleRoot, target.size, int(leaf.Index), leaf.Data, leaf.Path) {
+			return fmt.Errorf("%w: leaf %d is not of the shard", ErrAuditFailed, leaf.Index)
+		}
+	}
+
+	return nil
+}
+
+func (s *service) AnswerAudit(
+	ctx context.Context, remotePeer transport.RemotePeer, msg *message.AuditChallenge,
+) error {
+	if msg == nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"received nil audit challenge message",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	leaves, err := s.proveShard(msg)
+
+	proof := &message.AuditProof{Hash: msg.Hash, IsOK: err == nil, Leaves: leaves}
+	var isRefusal bool
+	if err != nil {
+		proof.Code, proof.Message, isRefusal = refusalOf(err, "audit failed")
+	}
+
+	if _, sendErr := remotePeer.Send(proof, nil); sendErr != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to send audit proof of shard %x", msg.Hash),
+			errors.Join(sendErr, err),
+			featureCapsule,
+		)
+	}
+
+	if isRefusal {
+		s.Logger.Info("refused audit", "remotePeer", remotePeer.ID(), "err", err)
+		return nil
+	}
+
+	return err
+}
+
+// proveShard makes the Merkle proofs of the leaves of the shard msg asks for.
+func (s *service) proveShard(msg *message.AuditChallenge) ([]message.AuditLeaf, error) {
+	if len(msg.Leaves) == 0 || len(msg.Leaves) > message.MaxAuditLeaves {
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("an audit asks for 1 to %d leaves, not %d", message.MaxAuditLeaves, len(msg.Leaves)),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	// A shard that rotted on our disk is told as such, its leaves would fail
+	// the audit anyway.
+	isValid, err := s.FileStore.VerifyCAS(msg.Hash)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrShardNotFound,
+			fmt.Sprintf("we hold no shard of hash %x", msg.Hash),
+			nil,
+			featureCapsule,
+		)
+	case errors.Is(err, ErrObjectCorrupted) || (err == nil && !isValid):
+		// todo: have the repair get it again from the rest of its repair group.
+		s.Logger.Error("shard we hold is corrupted", "hash", fmt.Sprintf("%x", msg.Hash), "err", err)
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrShardCorrupted,
+			fmt.Sprintf("our shard of hash %x is corrupted", msg.Hash),
+			nil,
+			featureCapsule,
+		)
+	case err != nil:
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to verify shard %x", msg.Hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	shard, err := s.FileStore.GetCAS(msg.Hash)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to get shard %x from CAS", msg.Hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	tree := newMerkleTree(shard)
+	n := numOfLeaves(uint32(len(shard)))
+	leaves := make([]message.AuditLeaf, len(msg.Leaves))
+	for i, leaf := range msg.Leaves {
+		if int(leaf) >= n {
+			return nil, peererrors.New(
+				peererrors.ScopeRemotePeer,
+				peererrors.ErrBadRequest,
+				fmt.Sprintf("shard %x has %d leaves, there is no leaf %d", msg.Hash, n, leaf),
+				nil,
+				featureCapsule,
+			)
+		}
+
+		leaves[i] = message.AuditLeaf{
+			Index: leaf,
+			Data:  leafOf(shard, int(leaf)),
+			Path:  tree.path(int(leaf)),
+		}
+	}
+
+	return leaves, nil
+}
+
+// recordAudit adds an audit of the holder of publicKey to its auditScore.
+func (s *service) recordAudit(
+	publicKeyStr customcrypto.PublicKeyStr, publicKey []byte, passed, failed int,
+) (*ReliabilityDTO, error) {
+	var score auditScore
+	_, err := s.DBStore.find(database.CollAuditScores, string(publicKeyStr), &score)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find audit score",
+			err,
+			featureCapsule,
+		)
+	}
+
+	now := s.Clock.Now()
+	score.PublicKey = publicKey
+	score.Passed += uint32(passed)
+	score.Failed += uint32(failed)
+	score.LastAuditAt = now
+	if failed > 0 {
+		score.LastFailedAt = now
+	}
+
+	// todo: a find then a write is not atomic, two audits of the same holder
+	// at once can lose one.
+	if err := s.DBStore.createOrUpdate(database.CollAuditScores, string(publicKeyStr), &score); err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to store audit score",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return score.reliability(), nil
+}
+
+func (s *service) GetReliability(publicKeyStr customcrypto.PublicKeyStr) (*ReliabilityDTO, error) {
+	var score auditScore
+	_, err := s.DBStore.find(database.CollAuditScores, string(publicKeyStr), &score)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find audit score",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return score.reliability(), nil
+}
+
+// reliability scores a holder by the share of audits it passed, counting one
+// passed and one failed that never happened. A holder never audited is 0.5,
+// and a few audits don't take a holder all the way to 0 or 1.
+func (a *auditScore) reliability() *ReliabilityDTO {
+	return &ReliabilityDTO{
+		PublicKey:    a.PublicKey,
+		Passed:       a.Passed,
+		Failed:       a.Failed,
+		Score:        float64(a.Passed+1) / float64(a.Passed+a.Failed+2),
+		LastAuditAt:  a.LastAuditAt,
+		LastFailedAt: a.LastFailedAt,
+	}
+}
@@ -0,0 +1,179 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestMerkleTree(t *testing.T) {
+	for _, size := range []int{1, message.AuditLeafSize, message.AuditLeafSize + 1, 3 * message.AuditLeafSize, 19*message.AuditLeafSize + 7} {
+		shard := make([]byte, size)
+		rand.Read(shard)
+
+		tree := newMerkleTree(shard)
+		root := tree.root()
+		require.Equal(t, root, merkleRoot(shard))
+
+		n := numOfLeaves(uint32(size))
+		for leaf := range n {
+			data, path := leafOf(shard, leaf), tree.path(leaf)
+			require.True(t, verifyMerklePath(root, uint32(size), leaf, data, path), "size %d leaf %d", size, leaf)
+
+			tampered := append([]byte(nil), data...)
+			tampered[0] ^= 1
+			assert.False(t, verifyMerklePath(root, uint32(size), leaf, tampered, path), "tampered leaf")
+
+			if n > 1 {
+				assert.False(t, verifyMerklePath(root, uint32(size), leaf, data, path[1:]), "short path")
+				assert.False(t, verifyMerklePath(root, uint32(size), (leaf+1)%n, data, path), "other leaf")
+			}
+		}
+
+		assert.False(t, verifyMerklePath(root, uint32(size), n, nil, nil), "no such leaf")
+	}
+}
+
+func TestAudit(t *testing.T) {
+	dbStores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt: func(t *testing.T) dbStorer {
+			db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			return NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+		},
+	}
+
+	for driver, newDBStore := range dbStores {
+		t.Run(driver, func(t *testing.T) {
+			// s is both the guardian auditing and the holder, over the link.
+			s := newTestQuotaService(t, newDBStore(t), &QuotaConfig{
+				MaxBytesPerOwner:    1 << 20,
+				MaxBytesTotal:       1 << 20,
+				MaxShardsPerCapsule: 4,
+			})
+			capsuleID := uuid.New()
+
+			shards := make([][]byte, 2)
+			for i := range shards {
+				shards[i] = make([]byte, 5*message.AuditLeafSize+100)
+				rand.Read(shards[i])
+				require.NoError(t, s.FileStore.SaveCAS(sha256.Sum256(shards[i]), shards[i]))
+			}
+
+			require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{
+				OwnerID:   uuid.New(),
+				CreatedAt: time.Now(),
+			}))
+			require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsuleManifests, capsuleID.String(), &message.CapsuleIncomingManifestStream{
+				CapsuleID: capsuleID,
+				Shards: []message.ShardManifest{{
+					ShardID:           uuid.New(),
+					RepairGroupID:     uuid.New(),
+					Hash:              sha256.Sum256(shards[0]),
+					Size:              uint32(len(shards[0])),
+					MerkleRoot:        merkleRoot(shards[0]),
+					GuardianPublicKey: []byte("provider"),
+				}},
+				ProviderShards: []message.ProviderShardManifest{{
+					ShardID:           uuid.New(),
+					RepairGroupID:     uuid.New(),
+					Hash:              sha256.Sum256(shards[1]),
+					Size:              uint32(len(shards[1])),
+					MerkleRoot:        merkleRoot(shards[1]),
+					ProviderPublicKey: []byte("provider"),
+					ProviderAddr:      "127.0.0.1:4040",
+				}},
+			}))
+
+			audit := func(t *testing.T) *AuditReportDTO {
+				t.Helper()
+
+				link := newTestProviderLink(t, s, uuid.New())
+				link.serveAll = true
+				report, err := s.AuditHolder(context.Background(), capsuleID, link.provider)
+				require.NoError(t, err)
+				return report
+			}
+
+			report := audit(t)
+			assert.Equal(t, 2, report.Audited)
+			assert.Equal(t, 2, report.Passed)
+			assert.Equal(t, uint32(2), report.Reliability.Passed)
+			assert.InDelta(t, 0.75, report.Reliability.Score, 1e-9)
+
+			t.Run("corrupted shard fails", func(t *testing.T) {
+				objects := s.FileStore.(*objectStore)
+				require.NoError(t, os.WriteFile(objects.casPath(sha256.Sum256(shards[0])), []byte("bit rot"), 0600))
+
+				report := audit(t)
+				assert.Equal(t, 1, report.Passed)
+				assert.Equal(t, 1, report.Failed)
+
+				reliability, err := s.GetReliability("provider")
+				require.NoError(t, err)
+				assert.Equal(t, uint32(3), reliability.Passed)
+				assert.Equal(t, uint32(1), reliability.Failed)
+				assert.False(t, reliability.LastFailedAt.IsZero())
+			})
+
+			t.Run("lost shard fails", func(t *testing.T) {
+				objects := s.FileStore.(*objectStore)
+				require.NoError(t, os.Remove(objects.casPath(sha256.Sum256(shards[1]))))
+
+				report := audit(t)
+				assert.Equal(t, 2, report.Failed)
+				// 3 passed and 3 failed.
+				assert.InDelta(t, 0.5, report.Reliability.Score, 1e-9)
+			})
+
+			t.Run("nothing to audit", func(t *testing.T) {
+				stranger := new(mockRemotePeer)
+				stranger.On("PublicKey").Return([]byte("stranger"))
+
+				_, err := s.AuditHolder(context.Background(), capsuleID, stranger)
+				pErr, isPErr := errors.AsType[*peererrors.PeerError](err)
+				require.True(t, isPErr, "not a peer error: %v", err)
+				assert.Equal(t, peererrors.ScopeLocalPeer, pErr.Scope())
+			})
+
+			t.Run("bad challenges are refused", func(t *testing.T) {
+				hash := sha256.Sum256(shards[0])
+
+				_, err := s.proveShard(&message.AuditChallenge{Hash: hash})
+				assertRefused(t, err, peererrors.ErrBadRequest)
+
+				_, err = s.proveShard(&message.AuditChallenge{Hash: hash, Leaves: make([]uint32, message.MaxAuditLeaves+1)})
+				assertRefused(t, err, peererrors.ErrBadRequest)
+
+				_, err = s.proveShard(&message.AuditChallenge{Hash: sha256.Sum256([]byte("unknown")), Leaves: []uint32{0}})
+				assertRefused(t, err, peererrors.ErrShardNotFound)
+
+				_, err = s.proveShard(&message.AuditChallenge{Hash: hash, Leaves: []uint32{0}})
+				assertRefused(t, err, peererrors.ErrShardCorrupted)
+			})
+		})
+	}
+}
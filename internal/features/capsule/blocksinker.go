@@ -1,12 +1,17 @@
 package capsule
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
 
 	"github.com/cespare/xxhash"
+	"github.com/engr-sjb/diogel/internal/archive"
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/dataredundancy"
 	"github.com/engr-sjb/diogel/internal/message"
@@ -15,166 +20,589 @@ import (
 	"github.com/google/uuid"
 )
 
-// blockSinkEncoder accumulates data in write method into a block then encrypts the
-// block which is then erasure coded into
+// blockBufPool and shardBufPool have the memory a block and its shards are
+// in, a block at a time.
+var (
+	blockBufPool = sync.Pool{
+		New: func() any {
+			buf := make([]byte, 0, blockSinkBufSize)
+			return &buf
+		},
+	}
+	shardBufPool = sync.Pool{
+		New: func() any {
+			return new([]byte)
+		},
+	}
+)
+
+/*
+blockSinkEncoder accumulates data in write method into a block then encrypts the
+block which is then erasure coded into shards, sent to the guardians and storage
+providers. A block goes through:
+
+	Write      fills a block, a full one is handed to the workers.
+	workers    encrypt, erasure code and hash blocks, archive.NumOfWorkers of
+	           them at once.
+	sequencer  takes the blocks back in the order they were written, puts
+	           shards with the storage providers and the rest on the send
+	           queues of the guardians. The manifest is filled here, in order.
+	senders    one a guardian, sends the shards in its queue in order on a
+	           stream, see shardStream. So the final shard of a guardian is
+	           the last it gets.
+
+No more than maxBlocksInFlight blocks are between Write and their last shard
+sent, Write waits for one to be done before it hands another. A block is
+about 1mb and its shards, so that is what the capsule takes in memory however
+big it is.
+
+todo: the storage providers are put with one shard at a time by the sequencer,
+a request and its ack. a queue a provider would let it go on with the next
+block.
+*/
 type blockSinkEncoder struct {
+	// ctx ends the streams to the guardians.
+	ctx             context.Context
 	blockID         uint64
 	capsuleManifest capsuleManifest
-	blockBuf        []byte // todo: not sure if i need to make this an array of blockBuffSize or just use a slice of blockBuffSize. cause if the caller of our write method gives us a big slice more than our blockBufsize, append will grow the slice.
+	blockBuf        *[]byte // never more than blockSinkBufSize, see Write.
 	erasureFunc     dataredundancy.ErasureFunc
+	// profile is what erasureFunc codes a block with.
+	profile ErasureProfile
 	// rendezvousHasher
 	capsuleID        uuid.UUID
 	capsuleMasterKey []byte
-	blockKey         [32]byte
 	cCrypto          customcrypto.CCrypto
 	remotePeers      []transport.RemotePeer
+	// storageProviders only get shards, see provider.go.
+	storageProviders []transport.RemotePeer
+	// holders is remotePeers and storageProviders, what a shard is put with.
+	holders []transport.RemotePeer
+
+	// workers is how many blocks are encoded at once.
+	workers           int
+	maxBlocksInFlight int
+	isStarted         bool
+	isClosed          bool
+	toEncode          chan *sinkBlock // to the workers.
+	toPlace           chan *sinkBlock // to the sequencer, in order.
+	inFlight          chan struct{}   // a token a block till its last shard is sent.
+	sendQueues        map[uuid.UUID]chan shardSend
+	wg                sync.WaitGroup
+	errMu             sync.Mutex
+	err               error // the first one, the rest of the blocks are dropped.
+}
+
+// sinkBlock is a block on its way through the pipeline of a blockSinkEncoder.
+type sinkBlock struct {
+	id      uint64
+	isFinal bool
+	data    *[]byte // from blockBufPool, given back once encrypted.
+	encoded chan struct{}
+
+	// Set by a worker, before encoded is closed.
+	err           error
+	nonce         []byte
+	repairGroupID uuid.UUID
+	shardBuf      *[]byte // from shardBufPool, given back with the last shard sent.
+	shards        [][]byte
+	hashes        [][32]byte
+	merkleRoots   [][32]byte
+
+	unsent atomic.Int32 // shards not sent yet.
+}
+
+// shardSend is a shard on the send queue of a guardian.
+type shardSend struct {
+	block *sinkBlock
+	msg   message.CapsuleStreamShard
+	shard []byte
 }
 
-func NewBlockSinkEncoder(capsuleID uuid.UUID, capsuleMasterKey []byte, eF dataredundancy.ErasureFunc, rps []transport.RemotePeer) *blockSinkEncoder {
+func NewBlockSinkEncoder(ctx context.Context, capsuleID uuid.UUID, capsuleMasterKey []byte, eF dataredundancy.ErasureFunc, profile ErasureProfile, rps []transport.RemotePeer, storageProviders []transport.RemotePeer) *blockSinkEncoder {
+	workers := archive.NumOfWorkers()
+
 	return &blockSinkEncoder{
-		blockID:          1,
-		blockBuf:         make([]byte, 0, blockSinkBufSize),
-		erasureFunc:      eF,
-		capsuleID:        capsuleID,
-		capsuleMasterKey: capsuleMasterKey,
-		cCrypto:          customcrypto.NewCCrypto(),
-		remotePeers:      rps,
+		ctx:               ctx,
+		blockID:           1,
+		erasureFunc:       eF,
+		profile:           profile,
+		capsuleID:         capsuleID,
+		capsuleMasterKey:  capsuleMasterKey,
+		cCrypto:           customcrypto.NewCCrypto(),
+		remotePeers:       rps,
+		storageProviders:  storageProviders,
+		holders:           append(slices.Clone(rps), storageProviders...),
+		workers:           workers,
+		maxBlocksInFlight: 2 * workers,
 	}
 }
 
 func (self *blockSinkEncoder) Write(data []byte) (n int, err error) {
-	self.blockBuf = append(self.blockBuf, data...)
+	if self.isClosed {
+		return 0, io.ErrClosedPipe
+	}
 
-	for len(self.blockBuf) >= blockSinkBufSize {
-		if err := self.processBlock(self.blockBuf[:blockSinkBufSize], false); err != nil {
-			return 0, err
+	for len(data) > 0 {
+		if self.blockBuf == nil {
+			self.blockBuf = blockBufPool.Get().(*[]byte)
+			*self.blockBuf = (*self.blockBuf)[:0]
+		}
+
+		// A full block is only handed on once there is more to write, the
+		// last block is handed on by Close, as the final one.
+		if len(*self.blockBuf) == blockSinkBufSize {
+			if err := self.handBlock(false); err != nil {
+				return n, err
+			}
+			continue
 		}
 
-		self.blockBuf = self.blockBuf[:blockSinkBufSize]
+		block := *self.blockBuf
+		copied := copy(block[len(block):blockSinkBufSize], data)
+		*self.blockBuf = block[:len(block)+copied]
+		data = data[copied:]
+		n += copied
 	}
 
-	return len(data), nil
+	return n, nil
 }
 
+// Close hands on the last block, as the final one, and waits for every shard
+// to be sent. It returns the first error of any block.
 func (self *blockSinkEncoder) Close() error {
+	if self.isClosed {
+		return self.firstErr()
+	}
+	self.isClosed = true
+
 	//flushes remaining data in block
-	if len(self.blockBuf) > 0 {
-		log.Println("close running")
-		if err := self.processBlock(self.blockBuf, true); err != nil {
-			return err
+	if self.blockBuf != nil && len(*self.blockBuf) > 0 {
+		if err := self.handBlock(true); err != nil {
+			self.setErr(err)
 		}
-		self.blockBuf = self.blockBuf[:0]
 	}
-	return nil
+	if self.blockBuf != nil {
+		blockBufPool.Put(self.blockBuf)
+		self.blockBuf = nil
+	}
+
+	if self.isStarted {
+		close(self.toEncode)
+		close(self.toPlace)
+		self.wg.Wait()
+	}
+
+	return self.firstErr()
 }
 
 func (self *blockSinkEncoder) GetManifest() {
 
 }
 
-func (self *blockSinkEncoder) processBlock(blockData []byte, isFinal bool) error {
+// handBlock hands blockBuf on to the workers and the sequencer, once there is
+// room for another block in flight.
+func (self *blockSinkEncoder) handBlock(isFinal bool) error {
+	self.start()
+
+	if err := self.firstErr(); err != nil {
+		return err
+	}
+
+	self.inFlight <- struct{}{}
+
+	block := &sinkBlock{
+		id:      self.blockID,
+		isFinal: isFinal,
+		data:    self.blockBuf,
+		encoded: make(chan struct{}),
+	}
+	self.blockBuf = nil
+	self.blockID++
+
+	self.toEncode <- block
+	self.toPlace <- block
+	return nil
+}
+
+// start starts the workers, the sequencer and the senders the first time a
+// block is handed on.
+func (self *blockSinkEncoder) start() {
+	if self.isStarted {
+		return
+	}
+	self.isStarted = true
+
+	self.toEncode = make(chan *sinkBlock, self.maxBlocksInFlight)
+	self.toPlace = make(chan *sinkBlock, self.maxBlocksInFlight)
+	self.inFlight = make(chan struct{}, self.maxBlocksInFlight)
+
+	var workersWG sync.WaitGroup
+	for range max(1, self.workers) {
+		workersWG.Go(func() {
+			for block := range self.toEncode {
+				self.encodeBlock(block)
+			}
+		})
+	}
+
+	var sendersWG sync.WaitGroup
+	self.sendQueues = make(map[uuid.UUID]chan shardSend, len(self.remotePeers))
+	for _, remotePeer := range self.remotePeers {
+		// A queue of a block of shards for every guardian, so the
+		// sequencer is not held up by the slowest one right away.
+		queue := make(chan shardSend, self.profile.totalShards())
+		self.sendQueues[remotePeer.ID()] = queue
+		sendersWG.Go(func() {
+			self.streamShards(remotePeer, queue)
+		})
+	}
+
+	self.wg.Go(func() {
+		for block := range self.toPlace {
+			self.placeBlock(block)
+		}
+
+		for _, queue := range self.sendQueues {
+			close(queue)
+		}
+		workersWG.Wait()
+		sendersWG.Wait()
+	})
+}
+
+// encodeBlock encrypts, erasure codes and hashes block, on a worker.
+func (self *blockSinkEncoder) encodeBlock(block *sinkBlock) {
+	defer close(block.encoded)
+
+	if self.firstErr() != nil {
+		// The block is dropped by the sequencer.
+		blockBufPool.Put(block.data)
+		return
+	}
+
+	var blockKey [32]byte
 	err := deriveBlockKey(
-		self.blockID,
+		block.id,
 		self.capsuleMasterKey,
-		&self.blockKey,
+		&blockKey,
 	)
 	if err != nil {
-		return err
+		blockBufPool.Put(block.data)
+		block.err = err
+		return
 	}
 
+	// todo: Encrypt allocates a sealed block every block, it should seal into
+	// pooled memory like the shards are coded into.
 	encBlock, usedNonce, err := self.cCrypto.Cipher.Encrypt(
-		self.blockKey[:],
+		blockKey[:],
 		nil,
-		blockData,
+		*block.data,
 	)
+	blockBufPool.Put(block.data)
 	if err != nil {
-		return err
+		block.err = err
+		return
 	}
 
-	shards, err := self.erasureFunc(encBlock)
+	block.shardBuf = shardBufPool.Get().(*[]byte)
+	*block.shardBuf = slices.Grow((*block.shardBuf)[:0], dataredundancy.ShardsSize(
+		len(encBlock),
+		int(self.profile.DataShards),
+		int(self.profile.ParityShards),
+	))
+
+	block.nonce = usedNonce
+	block.repairGroupID = uuid.New()
+	block.shards, err = self.erasureFunc(*block.shardBuf, self.capsuleID, block.repairGroupID, encBlock)
 	if err != nil {
-		return peererrors.New(
+		block.err = peererrors.New(
 			peererrors.ScopeInternalPeer,
 			peererrors.CodeTodo,
 			"failed to erasure code block", //Todo: better error handling message.
 			err,
 			featureCapsule,
 		)
+		return
 	}
 
-	repairGroupID := uuid.New()
-	shardStreamMessage := &message.CapsuleIncomingShardStream{
-		CapsuleID:      self.capsuleID,
-		ShardID:        uuid.New(),
-		RepairGroupID:  repairGroupID,
-		Nonce:          usedNonce,
-		DataShardNum:   uint8(dataShardNum),
-		ParityShardNum: uint8(parityShardNum),
+	block.hashes = make([][32]byte, len(block.shards))
+	block.merkleRoots = make([][32]byte, len(block.shards))
+	for i, shard := range block.shards {
+		block.hashes[i] = sha256.Sum256(shard)
+		block.merkleRoots[i] = merkleRoot(shard)
 	}
+}
 
-	// Todo: This work for now but would need too be changed if we add storage providers.
-	for i := range shards {
-		// Todo: this thing might have to change.
-		bestRemotePeer := pickRemotePeer(
-			self.blockID,
-			i,
-			self.remotePeers,
-		)
+// placeBlock puts the shards of block with the storage providers and on the
+// send queues of the guardians, on the sequencer, in the order the blocks
+// were written.
+func (self *blockSinkEncoder) placeBlock(block *sinkBlock) {
+	<-block.encoded
 
-		shardStreamMessage.ShardID = uuid.New()
-		shardStreamMessage.Size = uint32(len(shards[i]))
-		shardStreamMessage.IsFinal = isFinal
+	if block.err != nil || self.firstErr() != nil {
+		self.setErr(block.err)
+		self.releaseBlock(block)
+		return
+	}
 
-		n, err := bestRemotePeer.Send(
-			shardStreamMessage,
-			shards[i],
-		)
+	shards := block.shards
 
-		if n != len(shards[i]) {
-			return peererrors.New(
-				peererrors.ScopeInternalPeer,
-				peererrors.CodeTodo,
-				fmt.Sprintf(
-					"failed to send shard: n'%d' is not equal to shard size '%d'",
-					n,
-					len(shards[i]),
-				),
-				nil,
-				featureCapsule,
+	// NOTICE: The profile is checked against the guardians before a capsule
+	// is made, see CreateCapsuleDTO.validate. A guardian left without a final
+	// shard would wait on the stream forever.
+	if block.isFinal && len(shards) < len(self.remotePeers) {
+		self.setErr(peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf(
+				"final block has %d shards, fewer than the %d guardians that each need one",
+				len(shards),
+				len(self.remotePeers),
+			),
+			ErrInvalidErasureProfile,
+			featureCapsule,
+		))
+		self.releaseBlock(block)
+		return
+	}
+
+	// Every shard goes to whoever of the guardians and storage providers
+	// scores best for it of the ones holding less than their share of the
+	// block, so losing any of them loses as few shards as it can, see
+	// ErasureProfileFor. A guardian stops receiving shards at its first
+	// IsFinal one, so the first shards of the final block go one to each
+	// guardian, then each guardian has a last shard of it to mark.
+	share := (len(shards) + len(self.holders) - 1) / len(self.holders)
+	shardsOf := make(map[uuid.UUID]int, len(self.holders))
+	bestRemotePeers := make([]transport.RemotePeer, len(shards))
+	for i := range shards {
+		if block.isFinal && i < len(self.remotePeers) {
+			bestRemotePeers[i] = self.remotePeers[i]
+		} else {
+			bestRemotePeers[i] = pickRemotePeerUnder(
+				block.id,
+				i,
+				self.holders,
+				shardsOf,
+				share,
 			)
 		}
+		shardsOf[bestRemotePeers[i].ID()]++
+	}
+
+	// The storage providers go first, a shard one of them doesn't take goes to
+	// a guardian instead. Only then is it known which shard of the final block
+	// is the last a guardian gets.
+	for i := range shards {
+		if !slices.Contains(self.storageProviders, bestRemotePeers[i]) {
+			continue
+		}
 
+		providerShard, err := storeWithProvider(bestRemotePeers[i], shards[i])
 		if err != nil {
-			return peererrors.New(
-				peererrors.ScopeInternalPeer,
-				peererrors.CodeTodo,
-				"failed to send shard: err occurred",
-				err,
-				featureCapsule,
-			)
+			// The shard goes to a guardian still under its share. When none
+			// is, one of them would hold more than the profile lets it, so the
+			// block fails rather than fall short of its fault tolerance.
+			// todo: tell the owner, a provider that keeps refusing should be
+			// dropped.
+			shardsOf[bestRemotePeers[i].ID()]--
+			bestRemotePeers[i] = pickRemotePeerUnder(block.id, i, self.remotePeers, shardsOf, share)
+			if bestRemotePeers[i] == nil {
+				self.setErr(peererrors.New(
+					peererrors.ScopeRemotePeer,
+					peererrors.CodeTodo,
+					fmt.Sprintf(
+						"storage provider refused shard %d of block %d and every guardian holds its share of it",
+						i,
+						block.id,
+					),
+					err,
+					featureCapsule,
+				))
+				self.releaseBlock(block)
+				return
+			}
+			shardsOf[bestRemotePeers[i].ID()]++
+			continue
 		}
 
+		providerShard.ShardID = uuid.New()
+		providerShard.RepairGroupID = block.repairGroupID
+		providerShard.Nonce = block.nonce
+		self.capsuleManifest.providerShards = append(self.capsuleManifest.providerShards, providerShard)
+		bestRemotePeers[i] = nil
+	}
+
+	lastShardOf := make(map[uuid.UUID]int, len(self.remotePeers))
+	unsent := int32(0)
+	for i, bestRemotePeer := range bestRemotePeers {
+		if bestRemotePeer != nil {
+			lastShardOf[bestRemotePeer.ID()] = i
+			unsent++
+		}
 	}
 
 	// Track repair group in manifest
 	self.capsuleManifest.blocks = append(self.capsuleManifest.blocks, message.BlockManifest{
-		RepairGroupID:  repairGroupID,
-		DataShardNum:   uint8(dataShardNum),
-		ParityShardNum: uint8(parityShardNum),
+		RepairGroupID:  block.repairGroupID,
+		DataShardNum:   self.profile.DataShards,
+		ParityShardNum: self.profile.ParityShards,
+		Nonce:          block.nonce,
 	})
-	self.capsuleManifest.totalBlocks = self.blockID
+	self.capsuleManifest.totalBlocks = block.id
 
-	self.blockID++
-	return nil
+	// NOTICE IMPORTANT: unsent is set before the first shard is queued, a
+	// sender can be done with it before the rest are.
+	block.unsent.Store(unsent + 1)
+	for i := range shards {
+		bestRemotePeer := bestRemotePeers[i]
+		if bestRemotePeer == nil {
+			// With a storage provider.
+			continue
+		}
+
+		send := shardSend{
+			block: block,
+			msg: message.CapsuleStreamShard{
+				CapsuleID:      self.capsuleID,
+				ShardID:        uuid.New(),
+				RepairGroupID:  block.repairGroupID,
+				Nonce:          block.nonce,
+				DataShardNum:   self.profile.DataShards,
+				ParityShardNum: self.profile.ParityShards,
+				Size:           uint32(len(shards[i])),
+				IsFinal:        block.isFinal && lastShardOf[bestRemotePeer.ID()] == i,
+			},
+			shard: shards[i],
+		}
+		self.capsuleManifest.shards = append(self.capsuleManifest.shards, message.ShardManifest{
+			ShardID:           send.msg.ShardID,
+			RepairGroupID:     block.repairGroupID,
+			Hash:              block.hashes[i],
+			Size:              send.msg.Size,
+			MerkleRoot:        block.merkleRoots[i],
+			GuardianPublicKey: bestRemotePeer.PublicKey(),
+			GuardianAddr:      bestRemotePeer.Addr().String(),
+		})
+
+		// Only a guardian has a queue, a shard a provider refused went to one
+		// of them.
+		self.sendQueues[bestRemotePeer.ID()] <- send
+	}
+	self.shardDone(block)
 }
 
-// Todo: For Storage Providers
+// streamShards sends the shards on the queue of remotePeer on a stream, on its
+// sender.
+func (self *blockSinkEncoder) streamShards(remotePeer transport.RemotePeer, queue chan shardSend) {
+	shards := &shardStream{
+		sinker:     self,
+		remotePeer: remotePeer,
+		queue:      queue,
+	}
 
-// type shardMessage struct { //Todo: Move too message and this is imported here and send to guardians or storage providers.
-// 	capsuleID     uuid.UUID // Todo: I think storage providers don't need to know this. Only Guardians.
-// 	shardID       uuid.UUID
-// 	repairGroupID uuid.UUID
-// }
+	_, err := remotePeer.SendStream(self.ctx, shards)
+	if shards.send != nil {
+		self.shardDone(shards.send.block)
+	}
+	if err != nil {
+		self.setErr(peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf(
+				"failed to stream shards to guardian with ID: %s",
+				remotePeer.ID(),
+			),
+			err,
+			featureCapsule,
+		))
+	}
+
+	// A failed stream leaves shards on the queue, they are dropped as the
+	// sequencer has them.
+	for send := range queue {
+		self.shardDone(send.block)
+	}
+}
+
+/*
+shardStream is the stream of shards of a guardian, read off its send queue as
+SendStream takes it. Each shard is read on its own, after a CapsuleStreamShard
+for it is sent, so the guardian always has the message of a shard before the
+shard. It ends once the queue is closed.
+*/
+type shardStream struct {
+	sinker     *blockSinkEncoder
+	remotePeer transport.RemotePeer
+	queue      chan shardSend
+	send       *shardSend // being read, nil between shards.
+	rest       []byte     // of the shard of send.
+}
+
+func (self *shardStream) Read(p []byte) (int, error) {
+	if self.send == nil {
+		send, isOpen := <-self.queue
+		if !isOpen {
+			return 0, io.EOF
+		}
+
+		if err := self.sinker.firstErr(); err != nil {
+			self.sinker.shardDone(send.block)
+			return 0, err
+		}
+
+		if _, err := self.remotePeer.Send(&send.msg, nil); err != nil {
+			self.sinker.shardDone(send.block)
+			return 0, err
+		}
+		self.send, self.rest = &send, send.shard
+	}
+
+	n := copy(p, self.rest)
+	self.rest = self.rest[n:]
+	if len(self.rest) == 0 {
+		self.sinker.shardDone(self.send.block)
+		self.send = nil
+	}
+
+	return n, nil
+}
+
+// shardDone marks a shard of block sent, the last one gives the memory of the
+// block back.
+func (self *blockSinkEncoder) shardDone(block *sinkBlock) {
+	if block.unsent.Add(-1) == 0 {
+		self.releaseBlock(block)
+	}
+}
+
+func (self *blockSinkEncoder) releaseBlock(block *sinkBlock) {
+	if block.shardBuf != nil {
+		shardBufPool.Put(block.shardBuf)
+		block.shardBuf, block.shards = nil, nil
+	}
+	<-self.inFlight
+}
+
+func (self *blockSinkEncoder) setErr(err error) {
+	if err == nil {
+		return
+	}
+
+	self.errMu.Lock()
+	defer self.errMu.Unlock()
+	if self.err == nil {
+		self.err = err
+	}
+}
+
+func (self *blockSinkEncoder) firstErr() error {
+	self.errMu.Lock()
+	defer self.errMu.Unlock()
+	return self.err
+}
 
 type shardMetaData struct {
 	// blockID                      uuid.UUID
@@ -185,6 +613,9 @@ type shardMetaData struct {
 	hash                         [32]byte
 	size                         uint32
 	dataShardNum, parityShardNum uint8
+	// isLost is set on shards we only have the ID of, see
+	// migrateShardMetaData. The repair rebuilds them.
+	isLost bool
 }
 
 // For the Guardians
@@ -195,9 +626,11 @@ type blockManifest struct {
 }
 
 type capsuleManifest struct {
-	capsuleID   uuid.UUID
-	totalBlocks uint64
-	blocks      []message.BlockManifest
+	capsuleID      uuid.UUID
+	totalBlocks    uint64
+	blocks         []message.BlockManifest
+	providerShards []message.ProviderShardManifest
+	shards         []message.ShardManifest
 }
 
 func deriveBlockKey(blockID uint64, capsuleMasterKey []byte, blockKey *[32]byte) error {
@@ -269,10 +702,20 @@ func (bw *blockWriter) Close() error {
 }
 
 func pickRemotePeer(block uint64, shard int, peers []transport.RemotePeer) transport.RemotePeer {
+	return pickRemotePeerUnder(block, shard, peers, nil, 0)
+}
+
+// pickRemotePeerUnder is pickRemotePeer of the peers holding fewer than share
+// shards in shardsOf. A share of 0 leaves none out.
+func pickRemotePeerUnder(block uint64, shard int, peers []transport.RemotePeer, shardsOf map[uuid.UUID]int, share int) transport.RemotePeer {
 	//Todo: rethink how we distribute shards to peers and on what bases. Not sure.
 	var bestScore uint64
 	var bestPeer transport.RemotePeer
 	for _, p := range peers {
+		if share > 0 && shardsOf[p.ID()] >= share {
+			continue
+		}
+
 		score := xxhash.Sum64String(
 			fmt.Sprintf("%d:%d:%s", block, shard, p.ID().String()),
 		)
@@ -0,0 +1,172 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sendFuncRemotePeer is a guardian that hands what it is sent to send, see
+// guardianStreams.
+type sendFuncRemotePeer struct {
+	discardRemotePeer
+	streams *guardianStreams
+}
+
+func newSendFuncRemotePeer(p discardRemotePeer, send func(msg message.Msg, data []byte) (int, error)) *sendFuncRemotePeer {
+	return &sendFuncRemotePeer{
+		discardRemotePeer: p,
+		streams:           &guardianStreams{send: send},
+	}
+}
+
+func (p *sendFuncRemotePeer) Send(msg message.Msg, data []byte) (int, error) {
+	return p.streams.Send(msg, data)
+}
+
+func (p *sendFuncRemotePeer) SendStream(ctx context.Context, r io.Reader) (int64, error) {
+	return p.streams.SendStream(ctx, r)
+}
+
+func newTestPipelineSinker(t *testing.T, workers int, guardians []transport.RemotePeer) *blockSinkEncoder {
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+	require.NoError(t, err)
+
+	masterKey := make([]byte, 32)
+	crand.Read(masterKey)
+
+	sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, DefaultErasureProfile, guardians, nil)
+	sinker.workers, sinker.maxBlocksInFlight = workers, 2*workers
+	return sinker
+}
+
+func TestBlockSinkEncoderPipeline(t *testing.T) {
+	const numOfBlocks = 9
+
+	t.Run("every guardian gets its shards in block order, the final last", func(t *testing.T) {
+		sent := make([][]message.CapsuleStreamShard, 3)
+		guardians := make([]transport.RemotePeer, len(sent))
+		for i := range guardians {
+			guardians[i] = newSendFuncRemotePeer(
+				discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{Port: 4000 + i}},
+				func(msg message.Msg, data []byte) (int, error) {
+					// Some guardians are slower than others.
+					time.Sleep(time.Duration(rand.IntN(200)) * time.Microsecond)
+					sent[i] = append(sent[i], *msg.(*message.CapsuleStreamShard))
+					return len(data), nil
+				},
+			)
+		}
+
+		sinker := newTestPipelineSinker(t, 4, guardians)
+		data := make([]byte, numOfBlocks*blockSinkBufSize-1)
+		crand.Read(data)
+		_, err := sinker.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, sinker.Close())
+
+		require.Len(t, sinker.capsuleManifest.blocks, numOfBlocks)
+		assert.Equal(t, uint64(numOfBlocks), sinker.capsuleManifest.totalBlocks)
+		blockOf := make(map[uuid.UUID]int, numOfBlocks)
+		for i, block := range sinker.capsuleManifest.blocks {
+			blockOf[block.RepairGroupID] = i
+		}
+
+		total := 0
+		for i := range sent {
+			require.NotEmpty(t, sent[i])
+			total += len(sent[i])
+			for j, msg := range sent[i] {
+				assert.Equal(t, j == len(sent[i])-1, msg.IsFinal, "guardian %d shard %d", i, j)
+				if j > 0 {
+					assert.LessOrEqual(t, blockOf[sent[i][j-1].RepairGroupID], blockOf[msg.RepairGroupID], "guardian %d shard %d", i, j)
+				}
+			}
+		}
+		assert.Equal(t, numOfBlocks*(dataShardNum+parityShardNum), total)
+		assert.Len(t, sinker.capsuleManifest.shards, total)
+	})
+
+	t.Run("no more than the blocks in flight are held", func(t *testing.T) {
+		gate := make(chan struct{})
+		guardians := []transport.RemotePeer{newSendFuncRemotePeer(
+			discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{Port: 4000}},
+			func(msg message.Msg, data []byte) (int, error) {
+				<-gate
+				return len(data), nil
+			},
+		)}
+
+		sinker := newTestPipelineSinker(t, 1, guardians)
+
+		var written atomic.Int64
+		done := make(chan error, 1)
+		go func() {
+			block := make([]byte, blockSinkBufSize)
+			for range numOfBlocks {
+				if _, err := sinker.Write(block); err != nil {
+					done <- err
+					return
+				}
+				written.Add(1)
+			}
+			done <- sinker.Close()
+		}()
+
+		// A block being sent, the ones in flight and the one Write holds.
+		assert.Eventually(t, func() bool { return written.Load() > 0 }, 5*time.Second, 10*time.Millisecond)
+		assert.Never(t, func() bool { return written.Load() > int64(sinker.maxBlocksInFlight+1) }, 200*time.Millisecond, 10*time.Millisecond)
+
+		close(gate)
+		require.NoError(t, <-done)
+		assert.Len(t, sinker.capsuleManifest.blocks, numOfBlocks)
+	})
+
+	t.Run("a failed send fails the capsule", func(t *testing.T) {
+		errSend := errors.New("conn reset")
+		guardians := []transport.RemotePeer{
+			&discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{Port: 4000}},
+			newSendFuncRemotePeer(
+				discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{Port: 4001}},
+				func(msg message.Msg, data []byte) (int, error) {
+					return 0, errSend
+				},
+			),
+		}
+
+		sinker := newTestPipelineSinker(t, 2, guardians)
+		data := make([]byte, numOfBlocks*blockSinkBufSize)
+
+		// Write gives it once it is known, Close always does.
+		_, writeErr := sinker.Write(data)
+		closeErr := sinker.Close()
+		require.Error(t, closeErr)
+		assert.ErrorContains(t, closeErr, "failed to stream shards")
+		if writeErr != nil {
+			assert.Equal(t, closeErr, writeErr)
+		}
+
+		_, err := sinker.Write(data)
+		assert.Error(t, err, "closed")
+	})
+}
@@ -0,0 +1,138 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+)
+
+// FetchBlockShardsFunc returns the shards of block at their index, the ones it
+// couldn't get are nil.
+type FetchBlockShardsFunc func(block message.BlockManifest) ([][]byte, error)
+
+// blockSourceDecoder reads back what a blockSinkEncoder wrote, a block at a
+// time. The shards of a block are fetched, rebuilt into the sealed block and
+// opened, only then is the next one fetched, so a capsule of any size is read
+// with about a block of it in memory.
+//
+// The guardians read a capsule back with it in RecoverCapsule.
+type blockSourceDecoder struct {
+	blockID          uint64 // of the block being read, blocks[blockID-1].
+	blocks           []message.BlockManifest
+	fetchShards      FetchBlockShardsFunc
+	newErasureCoder  dataredundancy.NewErasureCoderFunc
+	erasureCoder     dataredundancy.ErasureCoder
+	profile          ErasureProfile // of erasureCoder.
+	capsuleMasterKey []byte
+	blockKey         [32]byte
+	cCrypto          customcrypto.CCrypto
+	encBlock         bytes.Buffer
+	block            []byte // what is left to read of the block.
+}
+
+func NewBlockSourceDecoder(
+	capsuleMasterKey []byte,
+	blocks []message.BlockManifest,
+	fetchShards FetchBlockShardsFunc,
+	newErasureCoder dataredundancy.NewErasureCoderFunc,
+) *blockSourceDecoder {
+	return &blockSourceDecoder{
+		blockID:          1,
+		blocks:           blocks,
+		fetchShards:      fetchShards,
+		newErasureCoder:  newErasureCoder,
+		capsuleMasterKey: capsuleMasterKey,
+		cCrypto:          customcrypto.NewCCrypto(),
+	}
+}
+
+func (self *blockSourceDecoder) Read(p []byte) (int, error) {
+	for len(self.block) == 0 {
+		if self.blockID > uint64(len(self.blocks)) {
+			return 0, io.EOF
+		}
+
+		if err := self.nextBlock(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, self.block)
+	self.block = self.block[n:]
+	return n, nil
+}
+
+func (self *blockSourceDecoder) nextBlock() error {
+	block := self.blocks[self.blockID-1]
+
+	shards, err := self.fetchShards(block)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to fetch shards of block %d", self.blockID),
+			err,
+			featureCapsule,
+		)
+	}
+
+	// Blocks of a capsule are coded with one profile, the coder is only made
+	// again when one isn't.
+	profile := ErasureProfile{DataShards: block.DataShardNum, ParityShards: block.ParityShardNum}
+	if self.erasureCoder == nil || self.profile != profile {
+		self.erasureCoder, err = self.newErasureCoder(int(profile.DataShards), int(profile.ParityShards))
+		if err != nil {
+			return peererrors.New(
+				peererrors.ScopeInternalPeer,
+				peererrors.CodeTodo,
+				"failed to create a new erasure coder",
+				err,
+				featureCapsule,
+			)
+		}
+		self.profile = profile
+	}
+
+	self.encBlock.Reset()
+	err = self.erasureCoder.Reconstruct(shards, &self.encBlock)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to rebuild block %d", self.blockID),
+			err,
+			featureCapsule,
+		)
+	}
+
+	err = deriveBlockKey(self.blockID, self.capsuleMasterKey, &self.blockKey)
+	if err != nil {
+		return err
+	}
+
+	self.block, err = self.cCrypto.Cipher.Decrypt(self.blockKey[:], block.Nonce, self.encBlock.Bytes())
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to open block %d", self.blockID),
+			err,
+			featureCapsule,
+		)
+	}
+
+	self.blockID++
+	return nil
+}
@@ -0,0 +1,298 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/archive"
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestSinkGuardians returns guardians that keep every shard sent to them by
+// its hash in shards, if it isn't nil, and count the final ones in finals.
+func newTestSinkGuardians(n int, shards map[[32]byte][]byte, finals []int) []transport.RemotePeer {
+	// The guardians are sent to at once.
+	var shardsMu sync.Mutex
+	guardians := make([]transport.RemotePeer, n)
+	for i := range guardians {
+		guardian := new(mockRemotePeer)
+		guardian.On("ID").Return(uuid.New())
+		guardian.On("PublicKey").Return([]byte(fmt.Sprintf("guardian-%d", i)))
+		guardian.On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i})
+		guardian.onGuardianSend(func(msg message.Msg, data []byte) (int, error) {
+			if shards != nil {
+				shardsMu.Lock()
+				shards[sha256.Sum256(data)] = slices.Clone(data)
+				shardsMu.Unlock()
+			}
+			if finals != nil && msg.(*message.CapsuleStreamShard).IsFinal {
+				finals[i]++
+			}
+			return len(data), nil
+		})
+		guardians[i] = guardian
+	}
+
+	return guardians
+}
+
+func TestBlockSinkSourceRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int
+	}{
+		{name: "less than a block", size: 1000, chunkSize: 100},
+		{name: "a block", size: blockSinkBufSize, chunkSize: blockSinkBufSize},
+		{name: "whole blocks in one write", size: 2 * blockSinkBufSize, chunkSize: 2 * blockSinkBufSize},
+		{name: "blocks and a bit in odd writes", size: 2*blockSinkBufSize + 12345, chunkSize: 77777},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+			require.NoError(t, err)
+
+			held := make(map[[32]byte][]byte)
+			finals := make([]int, 3)
+			guardians := newTestSinkGuardians(len(finals), held, finals)
+
+			masterKey := make([]byte, 32)
+			rand.Read(masterKey)
+			sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, DefaultErasureProfile, guardians, nil)
+
+			data := make([]byte, tt.size)
+			rand.Read(data)
+			for chunk := range slices.Chunk(data, tt.chunkSize) {
+				n, err := sinker.Write(chunk)
+				require.NoError(t, err)
+				require.Equal(t, len(chunk), n)
+			}
+			require.NoError(t, sinker.Close())
+
+			wantBlocks := (tt.size + blockSinkBufSize - 1) / blockSinkBufSize
+			require.Len(t, sinker.capsuleManifest.blocks, wantBlocks)
+			for i := range finals {
+				assert.Equal(t, 1, finals[i], "guardian %d gets one final shard", i)
+			}
+
+			// Every block lost as many shards as it can.
+			shardsOf := make(map[uuid.UUID][][]byte)
+			for _, sm := range sinker.capsuleManifest.shards {
+				shard := held[sm.Hash]
+				header, err := dataredundancy.ParseShardHeader(shard)
+				require.NoError(t, err)
+				if header.Index < uint8(parityShardNum) {
+					continue
+				}
+				if shardsOf[sm.RepairGroupID] == nil {
+					shardsOf[sm.RepairGroupID] = make([][]byte, dataShardNum+parityShardNum)
+				}
+				shardsOf[sm.RepairGroupID][header.Index] = shard
+			}
+
+			source := NewBlockSourceDecoder(
+				masterKey,
+				sinker.capsuleManifest.blocks,
+				func(block message.BlockManifest) ([][]byte, error) {
+					return shardsOf[block.RepairGroupID], nil
+				},
+				dataredundancy.NewReedSolomonCoder,
+			)
+
+			got, err := io.ReadAll(source)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(data, got), "read back what was written")
+		})
+	}
+}
+
+// discardRemotePeer is a guardian that drops what is sent to it, a mock
+// formats every shard it is given.
+type discardRemotePeer struct {
+	transport.RemotePeer
+	id   uuid.UUID
+	addr net.Addr
+}
+
+func (p *discardRemotePeer) ID() uuid.UUID                                { return p.id }
+func (p *discardRemotePeer) PublicKey() customcrypto.PublicKeyBytes       { return p.id[:] }
+func (p *discardRemotePeer) Addr() net.Addr                               { return p.addr }
+func (p *discardRemotePeer) Send(_ message.Msg, data []byte) (int, error) { return len(data), nil }
+func (p *discardRemotePeer) SendStream(_ context.Context, r io.Reader) (int64, error) {
+	return io.Copy(io.Discard, r)
+}
+
+// BenchmarkBlockSinkEncoder streams a capsule of b.N blocks, 1mb each, through
+// the encoder to guardians that drop the shards. Memory per block stays the
+// same however big the capsule is, -benchtime=4096x streams a 4gb one, like a
+// lifetime of photos.
+func BenchmarkBlockSinkEncoder(b *testing.B) {
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+	require.NoError(b, err)
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+	guardians := make([]transport.RemotePeer, 5)
+	for i := range guardians {
+		guardians[i] = &discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i}}
+	}
+	sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, DefaultErasureProfile, guardians, nil)
+
+	// Written in the chunks the archive writes in.
+	chunk := make([]byte, bufSize)
+	rand.Read(chunk)
+
+	b.SetBytes(blockSinkBufSize)
+	b.ReportAllocs()
+	for b.Loop() {
+		for range blockSinkBufSize / bufSize {
+			if _, err := sinker.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	require.NoError(b, sinker.Close())
+}
+
+// BenchmarkCapsuleStream streams a capsule through the whole of create and
+// recover, archive and all, like a lifetime of photos. The gb ones take a
+// while, run them with -benchtime=1x, -short skips them.
+//
+// B/op is everything allocated on the way, not what is held at once, which
+// stays about the blocks in flight however big the capsule is.
+// todo: most of B/op is the Cipher handing back a new slice for every block it
+// seals or opens. an Encrypt/Decrypt into a buffer of ours would drop it.
+func BenchmarkCapsuleStream(b *testing.B) {
+	const guardians = 5
+
+	newGuardians := func() []transport.RemotePeer {
+		rps := make([]transport.RemotePeer, guardians)
+		for i := range rps {
+			rps[i] = &discardRemotePeer{id: uuid.New(), addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i}}
+		}
+		return rps
+	}
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	for _, size := range []int64{64 << 20, 1 << 30, 4 << 30} {
+		b.Run(fmt.Sprintf("create/%dmb", size>>20), func(b *testing.B) {
+			if testing.Short() && size > 64<<20 {
+				b.Skip("gb capsules take a while")
+			}
+
+			erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+			require.NoError(b, err)
+
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for b.Loop() {
+				sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, DefaultErasureProfile, newGuardians(), nil)
+				err := archive.NewArchive().ArchiveStream(context.Background(), []ports.File{newBenchFile(size)}, sinker)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	// Recovering needs the shards of the capsule, so it is held in memory and
+	// kept smaller.
+	b.Run("recover/64mb", func(b *testing.B) {
+		const size = 64 << 20
+
+		erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+		require.NoError(b, err)
+
+		held := make(map[[32]byte][]byte)
+		sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, DefaultErasureProfile, newTestSinkGuardians(guardians, held, nil), nil)
+		require.NoError(b, archive.NewArchive().ArchiveStream(context.Background(), []ports.File{newBenchFile(size)}, sinker))
+
+		// Only the data shards, the parity ones are what the guardians down
+		// held.
+		shardsOf := make(map[uuid.UUID][][]byte)
+		for _, sm := range sinker.capsuleManifest.shards {
+			shard := held[sm.Hash]
+			header, err := dataredundancy.ParseShardHeader(shard)
+			require.NoError(b, err)
+			if header.Index < uint8(parityShardNum) {
+				continue
+			}
+			if shardsOf[sm.RepairGroupID] == nil {
+				shardsOf[sm.RepairGroupID] = make([][]byte, dataShardNum+parityShardNum)
+			}
+			shardsOf[sm.RepairGroupID][header.Index] = shard
+		}
+
+		b.SetBytes(size)
+		b.ReportAllocs()
+		for b.Loop() {
+			source := NewBlockSourceDecoder(
+				masterKey,
+				sinker.capsuleManifest.blocks,
+				func(block message.BlockManifest) ([][]byte, error) {
+					// Reconstruct fills in the missing ones, the next run
+					// needs them missing again.
+					return slices.Clone(shardsOf[block.RepairGroupID]), nil
+				},
+				dataredundancy.NewReedSolomonCoder,
+			)
+			if err := archive.NewArchive().UnArchiveStream(context.Background(), source, discardFileStore{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// newBenchFile is a file of size random bytes, made as it is read.
+func newBenchFile(size int64) ports.File {
+	var seed [32]byte
+	rand.Read(seed[:])
+
+	return &ports.FileMem{
+		Name:    "photos.tar",
+		Content: io.NopCloser(io.LimitReader(mathrand.NewChaCha8(seed), size)),
+		Mode:    0644,
+		Size:    size,
+	}
+}
+
+// discardFileStore drops the files written to it.
+type discardFileStore struct{}
+
+func (discardFileStore) Create(path string) (ports.File, error) {
+	return &ports.FileMem{Name: path, Content: discardFile{}}, nil
+}
+
+func (discardFileStore) MkdirAll(path string) error { return nil }
+
+type discardFile struct{}
+
+func (discardFile) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (discardFile) Write(p []byte) (int, error) { return len(p), nil }
+func (discardFile) Close() error                { return nil }
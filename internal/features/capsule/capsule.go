@@ -7,8 +7,68 @@
 
 package capsule
 
+import (
+	"context"
+
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/transport"
+)
+
 // Capsule hold all user use-cases and stores interfaces for usage outside of this package.
 type Capsule struct {
 	Service servicer
 	DBStore dbStorer
 }
+
+// RegisterHandlers registers the handlers of the messages the capsule feature
+// receives into router.
+func (c *Capsule) RegisterHandlers(router *transport.Router) error {
+	// The capsule comes in on streams, its handler runs for as long as they
+	// take.
+	err := router.HandleStream(
+		message.IDCapsuleIncomingStream,
+		func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.CapsuleIncomingStream)
+
+			// Todo: add the capsule to the heartbeat feature once it exists.
+			return c.Service.ReceiveCapsuleStream(ctx, remotePeer, &newMsg)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	handlers := map[message.ID]transport.Handler{
+		// Storage provider, see provider.go.
+		message.IDProviderStoreShard: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.ProviderStoreShard)
+			return c.Service.ReceiveProviderShard(ctx, remotePeer, &newMsg)
+		},
+		message.IDProviderFetchShard: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.ProviderFetchShard)
+			return c.Service.SendProviderShard(ctx, remotePeer, &newMsg)
+		},
+		// Audits, see audit.go.
+		message.IDAuditChallenge: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.AuditChallenge)
+			return c.Service.AnswerAudit(ctx, remotePeer, &newMsg)
+		},
+		// Repair, see repair.go.
+		message.IDRepairStoreShard: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.RepairStoreShard)
+			return c.Service.ReceiveRepairShard(ctx, remotePeer, &newMsg)
+		},
+		message.IDRepairManifest: func(ctx context.Context, remotePeer transport.RemotePeer, msg message.Msg) error {
+			newMsg := msg.(message.RepairManifest)
+			return c.Service.ReceiveRepairManifest(ctx, remotePeer, &newMsg)
+		},
+	}
+
+	for id, h := range handlers {
+		if err := router.Handle(id, h); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
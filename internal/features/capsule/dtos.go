@@ -13,9 +13,12 @@ import (
 	"os"
 	"time"
 
+	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/engr-sjb/diogel/internal/message"
 	"github.com/engr-sjb/diogel/internal/peererrors"
 	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
 )
 
 // incoming
@@ -31,6 +34,13 @@ type CreateCapsuleDTO struct {
 	Letter                            ports.File
 	FilePaths                         []string
 	CapsuleMasterKeyRecoveryThreshold int
+	// ErasureProfile is how the blocks of the capsule are erasure coded.
+	// Optional, defaults to DefaultErasureProfile.
+	ErasureProfile *ErasureProfile
+	// FaultTolerance is how many of the guardians and storage providers can be
+	// lost without losing the capsule, the ErasureProfile is derived from it.
+	// Optional, it can't be set with ErasureProfile.
+	FaultTolerance int
 }
 
 func (cc *CreateCapsuleDTO) validate(d Defaults) error {
@@ -60,6 +70,79 @@ func (cc *CreateCapsuleDTO) validate(d Defaults) error {
 		)
 	}
 
+	// A storage provider that is also a guardian would learn the capsule of
+	// the shards it holds.
+	for _, provider := range cc.RemotePeerStorageProviders {
+		for _, guardian := range cc.RemotePeerGuardians {
+			if provider.PublicKeyStr() == guardian.PublicKeyStr() {
+				return peererrors.New(
+					peererrors.ScopeLocalPeer,
+					peererrors.ErrBadRequest,
+					fmt.Sprintf("storage provider %s is a guardian too", provider.PublicKeyStr()),
+					ErrInvalidStorageProviders,
+					featureCapsule,
+				)
+			}
+		}
+	}
+
+	switch {
+	case cc.ErasureProfile != nil && cc.FaultTolerance != 0:
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			"an erasure profile and a fault tolerance can't both be set",
+			ErrInvalidErasureProfile,
+			featureCapsule,
+		)
+
+	case cc.FaultTolerance != 0:
+		profile, err := ErasureProfileFor(
+			len(cc.RemotePeerGuardians)+len(cc.RemotePeerStorageProviders),
+			cc.FaultTolerance,
+		)
+		if err != nil {
+			return peererrors.New(
+				peererrors.ScopeLocalPeer,
+				peererrors.ErrBadRequest,
+				err.Error(),
+				err,
+				featureCapsule,
+			)
+		}
+		cc.ErasureProfile = &profile
+
+	case cc.ErasureProfile == nil:
+		profile := DefaultErasureProfile
+		cc.ErasureProfile = &profile
+	}
+
+	if err := cc.ErasureProfile.validate(); err != nil {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			err.Error(),
+			err,
+			featureCapsule,
+		)
+	}
+
+	// Every guardian gets a shard of the final block to mark the end of its
+	// stream with.
+	if cc.ErasureProfile.totalShards() < len(cc.RemotePeerGuardians) {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf(
+				"a block has %d shards, fewer than the %d guardians",
+				cc.ErasureProfile.totalShards(),
+				len(cc.RemotePeerGuardians),
+			),
+			ErrInvalidErasureProfile,
+			featureCapsule,
+		)
+	}
+
 	if cc.SilencePeriod == 0 {
 		cc.SilencePeriod = defaultSilencePeriod
 	}
@@ -228,3 +311,41 @@ func calculateDefaultThreshold(numGuardians int) int {
 }
 
 // outgoing
+
+// HeldCapsuleDTO is what a guardian holds of a capsule.
+type HeldCapsuleDTO struct {
+	CapsuleID   uuid.UUID
+	OwnerID     uuid.UUID
+	GuardianIDs []uuid.UUID
+	TotalBlocks uint64 // zero till the manifest is received.
+	// ProviderShards are the shards of the capsule the owner put with storage
+	// providers, nil till the manifest is received.
+	ProviderShards []message.ProviderShardManifest
+	// Shards are the shards of the capsule the guardians hold, nil till the
+	// manifest is received.
+	Shards             []message.ShardManifest
+	IsKeyShareReceived bool
+	KeyShare           []byte
+	TotalShares        int
+	ThresholdShares    int
+}
+
+// AuditReportDTO is how a holder did in an audit of the shards it holds of a
+// capsule.
+type AuditReportDTO struct {
+	CapsuleID   uuid.UUID
+	Audited     int // shards challenged.
+	Passed      int
+	Failed      int
+	Reliability ReliabilityDTO // after this audit.
+}
+
+// ReliabilityDTO is how a holder did in every audit we ran on it.
+type ReliabilityDTO struct {
+	PublicKey    customcrypto.PublicKeyBytes
+	Passed       uint32
+	Failed       uint32
+	Score        float64 // 0 to 1, 0.5 for a holder never audited.
+	LastAuditAt  time.Time
+	LastFailedAt time.Time
+}
@@ -8,6 +8,7 @@
 package capsule
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
@@ -37,6 +38,68 @@ func (c *capsule) toDB(id uuid.UUID) *capsuleDB {
 	}
 }
 
+// capsuleDB is how a capsule is kept in the database.
+type capsuleDB struct {
+	ID                 uuid.UUID
+	OwnerID            uuid.UUID
+	CreatedAt          time.Time
+	CompletedAt        time.Time
+	IsKeyShareReceived bool
+	IsComplete         bool
+}
+
+// shardMetaDataDB is how a shardMetaData is kept in the bbolt store.
+// shardMetaData has no exported fields and used to be kept as {}, see
+// migrateShardMetaData.
+type shardMetaDataDB struct {
+	CapsuleID      uuid.UUID
+	ShardID        uuid.UUID
+	RepairGroupID  uuid.UUID
+	Nonce          []byte
+	Hash           [32]byte
+	Size           uint32
+	DataShardNum   uint8
+	ParityShardNum uint8
+	IsLost         bool
+}
+
+func (sm shardMetaData) MarshalJSON() ([]byte, error) {
+	return json.Marshal(
+		shardMetaDataDB{
+			CapsuleID:      sm.capsuleID,
+			ShardID:        sm.shardID,
+			RepairGroupID:  sm.repairGroupID,
+			Nonce:          sm.nonce,
+			Hash:           sm.hash,
+			Size:           sm.size,
+			DataShardNum:   sm.dataShardNum,
+			ParityShardNum: sm.parityShardNum,
+			IsLost:         sm.isLost,
+		},
+	)
+}
+
+func (sm *shardMetaData) UnmarshalJSON(b []byte) error {
+	var smDB shardMetaDataDB
+	if err := json.Unmarshal(b, &smDB); err != nil {
+		return err
+	}
+
+	*sm = shardMetaData{
+		capsuleID:      smDB.CapsuleID,
+		shardID:        smDB.ShardID,
+		repairGroupID:  smDB.RepairGroupID,
+		nonce:          smDB.Nonce,
+		hash:           smDB.Hash,
+		size:           smDB.Size,
+		dataShardNum:   smDB.DataShardNum,
+		parityShardNum: smDB.ParityShardNum,
+		isLost:         smDB.IsLost,
+	}
+
+	return nil
+}
+
 type masterKeyShare struct {
 	CapsuleID       uuid.UUID
 	Share           []byte
@@ -44,6 +107,41 @@ type masterKeyShare struct {
 	ThresholdShares int
 }
 
+// providerShard is a shard we hold as a storage provider. Its hash, size and
+// who put it with us is all we ever learn of it. It is kept under the hex of
+// its hash.
+type providerShard struct {
+	Hash       [32]byte
+	Size       uint32
+	OwnerID    uuid.UUID
+	ReceivedAt time.Time
+}
+
+// auditScore is how a peer holding shards for us did in the audits we ran on
+// it, see audit.go. It is kept under the peer's PublicKeyStr.
+type auditScore struct {
+	PublicKey    []byte
+	Passed       uint32 // shards it proved it holds.
+	Failed       uint32 // shards it didn't.
+	LastAuditAt  time.Time
+	LastFailedAt time.Time
+}
+
+// heartbeat is the last we heard of a capsule's owner.
+type heartbeat struct {
+	CapsuleID     uuid.UUID
+	LastSeenAt    time.Time
+	SilencePeriod time.Duration
+}
+
+// knownPeer is a remote peer we have been connected to.
+type knownPeer struct {
+	ID         uuid.UUID
+	PublicKey  []byte
+	Addr       string
+	LastSeenAt time.Time
+}
+
 type owner struct {
 	ID   uuid.UUID
 	Name string
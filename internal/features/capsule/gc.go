@@ -0,0 +1,150 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"errors"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/peererrors"
+)
+
+/*
+The gc deletes the objects in the CAS that no shard in CollCapsulesActiveShards
+has the hash of. It is mark and sweep:
+
+	mark   the hashes of every shard in the db.
+	sweep  every object in the CAS not marked, and older than the grace period.
+
+An object is put in place only after its shard is committed to the db (see
+unitOfWork), so an object newer than the mark and not in it yet is always newer
+than the grace period too.
+*/
+
+type GCConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	// Interval is how often the gc runs.
+	Interval time.Duration
+	// GracePeriod is how old an object no shard has must be before it is
+	// deleted.
+	GracePeriod time.Duration
+}
+
+// GCReport is what a gc run did.
+type GCReport struct {
+	Scanned int
+	// Kept is the objects a shard has.
+	Kept int
+	// Young is the objects no shard has that are in their grace period.
+	Young          int
+	Deleted        int
+	ReclaimedBytes int64
+	Took           time.Duration
+}
+
+// CollectGarbage runs the gc once.
+func (s *service) CollectGarbage() (GCReport, error) {
+	began := s.Clock.Now()
+
+	hashes, err := s.DBStore.findShardHashes()
+	if err != nil {
+		return GCReport{}, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"gc failed to find the shards in use",
+			err,
+			featureCapsule,
+		)
+	}
+
+	inUse := make(map[[32]byte]struct{}, len(hashes))
+	for _, hash := range hashes {
+		inUse[hash] = struct{}{}
+	}
+
+	var (
+		report    GCReport
+		olderThan = began.Add(-s.GC.GracePeriod)
+		errs      []error
+	)
+	err = s.FileStore.walkCAS(func(hash [32]byte, size int64, modTime time.Time) error {
+		report.Scanned++
+
+		if _, isInUse := inUse[hash]; isInUse {
+			report.Kept++
+			return nil
+		}
+		if !modTime.Before(olderThan) {
+			report.Young++
+			return nil
+		}
+
+		freed, err := s.FileStore.collectCAS(hash, olderThan)
+		if err != nil {
+			// One object failing must not keep the rest from being collected.
+			errs = append(errs, err)
+			return nil
+		}
+		if freed > 0 {
+			report.Deleted++
+			report.ReclaimedBytes += freed
+		}
+
+		return nil
+	})
+	errs = append(errs, err)
+
+	report.Took = s.Clock.Since(began)
+
+	if err := errors.Join(errs...); err != nil {
+		return report, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"gc failed to sweep the CAS",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return report, nil
+}
+
+// StartGC runs the gc every GC.Interval till Ctx is done.
+func (s *service) StartGC() {
+	s.Shutdown.Add(1)
+	go func() {
+		defer s.Shutdown.Done()
+
+		ticker := s.Clock.NewTicker(s.GC.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.Ctx.Done():
+				return
+
+			case <-ticker.C():
+				report, err := s.CollectGarbage()
+				if err != nil {
+					s.Logger.Error("gc failed", "err", err)
+				}
+
+				s.Logger.Info(
+					"gc done",
+					"scanned", report.Scanned,
+					"kept", report.Kept,
+					"young", report.Young,
+					"deleted", report.Deleted,
+					"reclaimedBytes", report.ReclaimedBytes,
+					"took", report.Took,
+				)
+			}
+		}
+	}()
+}
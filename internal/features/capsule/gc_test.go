@@ -0,0 +1,152 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testGracePeriod = 24 * time.Hour
+
+func TestCollectGarbage(t *testing.T) {
+	s, objects, clk := newTestGCService(t, context.Background())
+	capsuleID := uuid.New()
+	require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New()}))
+
+	// A shard we hold.
+	kept := saveTestObject(t, s, capsuleID, clk.Now().Add(-2*testGracePeriod), true)
+	// Left by a capsule that is gone.
+	orphan := saveTestObject(t, s, capsuleID, clk.Now().Add(-2*testGracePeriod), false)
+	// Left too, but too new to tell.
+	young := saveTestObject(t, s, capsuleID, clk.Now().Add(-testGracePeriod/2), false)
+	// Staged objects are the unit of work's to clean up.
+	staged, stagedData := newTestShardWithData(capsuleID)
+	require.NoError(t, objects.stageCAS(uuid.New(), staged.hash, stagedData))
+
+	orphanInfo, err := os.Stat(objects.casPath(orphan.hash))
+	require.NoError(t, err)
+
+	report, err := s.CollectGarbage()
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Scanned)
+	assert.Equal(t, 1, report.Kept)
+	assert.Equal(t, 1, report.Young)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, orphanInfo.Size(), report.ReclaimedBytes)
+
+	assertObjectExists(t, objects, kept.hash, true)
+	assertObjectExists(t, objects, orphan.hash, false)
+	assertObjectExists(t, objects, young.hash, true)
+
+	stagingIDs, err := objects.findStaged()
+	require.NoError(t, err)
+	assert.Len(t, stagingIDs, 1)
+
+	t.Run("empty dirs are removed", func(t *testing.T) {
+		_, err := os.Stat(filepath.Dir(objects.casPath(orphan.hash)))
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("young objects are deleted after their grace period", func(t *testing.T) {
+		clk.Advance(testGracePeriod)
+
+		report, err := s.CollectGarbage()
+		require.NoError(t, err)
+		assert.Equal(t, 1, report.Deleted)
+		assertObjectExists(t, objects, young.hash, false)
+		assertObjectExists(t, objects, kept.hash, true)
+	})
+}
+
+func TestStartGC(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s, objects, clk := newTestGCService(t, ctx)
+	capsuleID := uuid.New()
+	require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New()}))
+
+	orphan := saveTestObject(t, s, capsuleID, clk.Now().Add(-2*testGracePeriod), false)
+
+	s.StartGC()
+	clk.BlockUntil(1)
+
+	clk.Advance(s.GC.Interval - time.Second)
+	assertObjectExists(t, objects, orphan.hash, true)
+
+	clk.Advance(time.Second)
+	assert.Eventually(t, func() bool {
+		exists, err := objects.ExistsCAS(orphan.hash)
+		return err == nil && !exists
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	s.Shutdown.Wait()
+}
+
+func newTestGCService(t *testing.T, ctx context.Context) (*service, *objectStore, *clock.Fake) {
+	t.Helper()
+
+	objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+	clk := clock.NewFake(time.Now())
+
+	s := &service{
+		ServiceConfig: &ServiceConfig{
+			Ctx:       ctx,
+			Shutdown:  &sync.WaitGroup{},
+			DBStore:   newTestSQLiteDBStore(t),
+			FileStore: objects,
+			Clock:     clk,
+			GC: &GCConfig{
+				Interval:    time.Hour,
+				GracePeriod: testGracePeriod,
+			},
+			Logger: slog.Default(),
+		},
+	}
+
+	return s, objects, clk
+}
+
+// saveTestObject puts an object in the CAS as last modified at modTime, with a
+// shard in the db if isInUse.
+func saveTestObject(t *testing.T, s *service, capsuleID uuid.UUID, modTime time.Time, isInUse bool) shardMetaData {
+	t.Helper()
+
+	shard, data := newTestShardWithData(capsuleID)
+
+	uow := newUnitOfWork(s.FileStore, s.DBStore, s.Clock.Now)
+	require.NoError(t, uow.saveCAS(shard.hash, data))
+	if isInUse {
+		uow.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard)
+	}
+	require.NoError(t, uow.commit())
+
+	objects := s.FileStore.(*objectStore)
+	require.NoError(t, os.Chtimes(objects.casPath(shard.hash), modTime, modTime))
+
+	return shard
+}
+
+func assertObjectExists(t *testing.T, objects *objectStore, hash [32]byte, want bool) {
+	t.Helper()
+
+	exists, err := objects.ExistsCAS(hash)
+	require.NoError(t, err)
+	assert.Equal(t, want, exists)
+}
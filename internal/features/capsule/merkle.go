@@ -0,0 +1,127 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"crypto/sha256"
+
+	"github.com/engr-sjb/diogel/internal/message"
+)
+
+// merkleTree is the Merkle tree of a shard, over leaves of
+// message.AuditLeafSize. A node without a sibling is carried up as is. Leaves
+// and nodes are hashed with a different prefix, so a node can't be passed off
+// as a leaf.
+type merkleTree struct {
+	levels [][][32]byte // the leaves first, the root last.
+}
+
+func newMerkleTree(shard []byte) merkleTree {
+	level := make([][32]byte, numOfLeaves(uint32(len(shard))))
+	for i := range level {
+		level[i] = hashLeaf(leafOf(shard, i))
+	}
+
+	t := merkleTree{levels: [][][32]byte{level}}
+	for len(level) > 1 {
+		next := make([][32]byte, (len(level)+1)/2)
+		for i := range next {
+			if 2*i+1 < len(level) {
+				next[i] = hashNode(level[2*i], level[2*i+1])
+			} else {
+				next[i] = level[2*i]
+			}
+		}
+
+		t.levels = append(t.levels, next)
+		level = next
+	}
+
+	return t
+}
+
+func merkleRoot(shard []byte) [32]byte {
+	return newMerkleTree(shard).root()
+}
+
+func (t merkleTree) root() [32]byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// path is the hashes of the siblings from leaf up to the root.
+func (t merkleTree) path(leaf int) [][32]byte {
+	var path [][32]byte
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := leaf ^ 1; sibling < len(level) {
+			path = append(path, level[sibling])
+		}
+		leaf /= 2
+	}
+
+	return path
+}
+
+// verifyMerklePath checks data is leaf of the shard of size with root.
+func verifyMerklePath(root [32]byte, size uint32, leaf int, data []byte, path [][32]byte) bool {
+	n := numOfLeaves(size)
+	if leaf < 0 || leaf >= n || len(data) != leafSize(size, leaf) {
+		return false
+	}
+
+	h := hashLeaf(data)
+	for ; n > 1; n = (n + 1) / 2 {
+		if sibling := leaf ^ 1; sibling < n {
+			if len(path) == 0 {
+				return false
+			}
+			if leaf%2 == 0 {
+				h = hashNode(h, path[0])
+			} else {
+				h = hashNode(path[0], h)
+			}
+			path = path[1:]
+		}
+		leaf /= 2
+	}
+
+	return len(path) == 0 && h == root
+}
+
+// numOfLeaves is how many leaves a shard of size has. An empty shard has one
+// empty leaf.
+func numOfLeaves(size uint32) int {
+	return max(1, (int(size)+message.AuditLeafSize-1)/message.AuditLeafSize)
+}
+
+func leafSize(size uint32, leaf int) int {
+	return min(message.AuditLeafSize, int(size)-leaf*message.AuditLeafSize)
+}
+
+func leafOf(shard []byte, leaf int) []byte {
+	start := leaf * message.AuditLeafSize
+	return shard[start : start+leafSize(uint32(len(shard)), leaf)]
+}
+
+// hashLeaf hashes the leaf where it is, a copy with the 0 in front would be
+// the size of the shard for every shard of every block.
+func hashLeaf(data []byte) [32]byte {
+	var sum [32]byte
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	h.Sum(sum[:0])
+	return sum
+}
+
+func hashNode(left, right [32]byte) [32]byte {
+	var node [1 + 2*32]byte
+	node[0] = 1
+	copy(node[1:], left[:])
+	copy(node[33:], right[:])
+	return sha256.Sum256(node[:])
+}
@@ -0,0 +1,263 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+	bolt "go.etcd.io/bbolt"
+)
+
+// NOTICE IMPORTANT: Read the rules at the top of storage/migrate.go before
+// adding a migration. Guardians hold capsules for years, whatever a guardian
+// wrote must still load.
+
+var bboltMigrations = []storage.BBoltMigration{
+	{Version: 1, Name: "shard metadata", Up: migrateShardMetaData},
+	{Version: 2, Name: "capsule flags", Up: migrateCapsuleFlags},
+}
+
+var sqliteMigrations = []storage.SQLiteMigration{
+	{Version: 1, Name: "create schema", Up: createSchema},
+	{Version: 2, Name: "units of work", Up: createUnitsOfWork},
+	{Version: 3, Name: "sealed columns", Up: dropSealedIndices},
+	{Version: 4, Name: "storage providers", Up: createStorageProviders},
+	{Version: 5, Name: "audits", Up: createAudits},
+	{Version: 6, Name: "repair", Up: addRepairColumns},
+}
+
+// migrateShardMetaData rewrites the shards kept as {}, before shardMetaData
+// had a json form. The key is the shard ID, so that is all we get back. The
+// rest is gone, so they are marked lost and the repair rebuilds them from the
+// other holders of their repair group, see lostShardsOf.
+func migrateShardMetaData(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(database.CollCapsulesActiveShards.BucketName()))
+	if b == nil {
+		return nil
+	}
+
+	// NOTICE IMPORTANT: A bucket must not be written to in its own ForEach.
+	upgraded := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var smDB shardMetaDataDB
+		if err := json.Unmarshal(v, &smDB); err != nil {
+			return fmt.Errorf("shard %s: %w", k, err)
+		}
+		if smDB.ShardID != uuid.Nil {
+			return nil
+		}
+
+		shardID, err := uuid.ParseBytes(k)
+		if err != nil {
+			return fmt.Errorf("shard %s: %w", k, err)
+		}
+		smDB.ShardID = shardID
+		smDB.IsLost = true
+
+		bv, err := json.Marshal(smDB)
+		if err != nil {
+			return err
+		}
+		upgraded[string(k)] = bv
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range upgraded {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrateCapsuleFlags sets back the flags of capsules whose record was
+// overwritten by the last write of the stream. The manifest only comes after
+// the last shard, and the key share after the manifest.
+func migrateCapsuleFlags(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(database.CollCapsules.BucketName()))
+	if b == nil {
+		return nil
+	}
+
+	has := func(coll database.Collection, k []byte) bool {
+		cb := tx.Bucket([]byte(coll.BucketName()))
+		return cb != nil && cb.Get(k) != nil
+	}
+
+	upgraded := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		var c capsule
+		if err := json.Unmarshal(v, &c); err != nil {
+			return fmt.Errorf("capsule %s: %w", k, err)
+		}
+
+		if has(database.CollCapsuleManifests, k) {
+			c.AreShardsReceived = true
+			c.IsManifestReceived = true
+			c.IsComplete = true
+		}
+		if has(database.CollKeyShares, k) {
+			c.IsKeyMasterShareReceived = true
+		}
+
+		bv, err := json.Marshal(&c)
+		if err != nil {
+			return err
+		}
+		upgraded[string(k)] = bv
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for k, v := range upgraded {
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createSchema(ctx context.Context, tx bun.Tx) error {
+	for _, table := range schema {
+		q := tx.NewCreateTable().Model(table.model).IfNotExists()
+		for _, fk := range table.foreignKeys {
+			q = q.ForeignKey(fk)
+		}
+		if _, err := q.Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range indices {
+		_, err := tx.NewCreateIndex().
+			Model(index.model).
+			Index(index.name).
+			Column(index.columns...).
+			IfNotExists().
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createUnitsOfWork(ctx context.Context, tx bun.Tx) error {
+	_, err := tx.NewCreateTable().Model((*unitOfWorkRow)(nil)).IfNotExists().Exec(ctx)
+	return err
+}
+
+// dropSealedIndices drops the indices on columns that are sealed now. A sealed
+// value is different every time it is sealed, there is nothing to look up by.
+// The values are sealed by the store, which has the keyring.
+func dropSealedIndices(ctx context.Context, tx bun.Tx) error {
+	for _, index := range []string{"capsules_owner_id_idx", "capsule_guardians_guardian_id_idx"} {
+		if _, err := tx.NewDropIndex().Index(index).IfExists().Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createStorageProviders makes the tables of the shards we hold as a storage
+// provider, and of the shards a manifest has with storage providers.
+func createStorageProviders(ctx context.Context, tx bun.Tx) error {
+	_, err := tx.NewCreateTable().Model((*providerShardRow)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NewCreateTable().
+		Model((*manifestProviderShardRow)(nil)).
+		IfNotExists().
+		ForeignKey(`("capsule_id") REFERENCES "manifests" ("capsule_id") ON DELETE CASCADE`).
+		Exec(ctx)
+
+	return err
+}
+
+// createAudits makes the tables audits need, and gives the shards with storage
+// providers a merkle_root. The rows from before are left without one, those
+// shards can't be audited.
+func createAudits(ctx context.Context, tx bun.Tx) error {
+	var columns []string
+	err := tx.NewRaw("SELECT name FROM pragma_table_info(?)", "manifest_provider_shards").Scan(ctx, &columns)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(columns, "merkle_root") {
+		_, err := tx.NewAddColumn().
+			Model((*manifestProviderShardRow)(nil)).
+			ColumnExpr("merkle_root BLOB").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.NewCreateTable().
+		Model((*manifestShardRow)(nil)).
+		IfNotExists().
+		ForeignKey(`("capsule_id") REFERENCES "manifests" ("capsule_id") ON DELETE CASCADE`).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NewCreateTable().Model((*auditScoreRow)(nil)).IfNotExists().Exec(ctx)
+	return err
+}
+
+// addRepairColumns adds what the repair needs of a manifest, the nonce of its
+// blocks and the addr of the guardians of its shards. Manifests from before
+// it have neither, they are NULL and sealed as empty by the reseal on start.
+func addRepairColumns(ctx context.Context, tx bun.Tx) error {
+	for _, add := range []struct {
+		model  any
+		table  string
+		column string
+		expr   string
+	}{
+		{(*manifestBlockRow)(nil), "manifest_blocks", "nonce", "nonce BLOB"},
+		{(*manifestShardRow)(nil), "manifest_shards", "guardian_addr", "guardian_addr VARCHAR"},
+	} {
+		var columns []string
+		err := tx.NewRaw("SELECT name FROM pragma_table_info(?)", add.table).Scan(ctx, &columns)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(columns, add.column) {
+			continue
+		}
+
+		_, err = tx.NewAddColumn().Model(add.model).ColumnExpr(add.expr).Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
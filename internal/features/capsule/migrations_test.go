@@ -0,0 +1,185 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The corpus in testdata/migrations is dumps of dbs written by older versions,
+// one bucket to a key, values as they were written. v0 is before migrations.
+
+func TestMigrateV0Guardian(t *testing.T) {
+	db := loadBBoltDump(t, "testdata/migrations/v0_guardian.json")
+
+	from, to, err := storage.MigrateBBolt(db, string(featureCapsule), bboltMigrations)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), from)
+	assert.Equal(t, uint64(len(bboltMigrations)), to)
+
+	// NOTICE: The store seals everything once made, migrations only ever run
+	// on what was there before.
+	t.Run("migrations are idempotent", func(t *testing.T) {
+		before := dumpBBolt(t, db)
+		for _, m := range bboltMigrations {
+			require.NoError(t, db.Update(m.Up))
+		}
+		assert.Equal(t, before, dumpBBolt(t, db))
+	})
+
+	s := NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+	capsuleID := uuid.MustParse("6f1c2a9e-2b1d-4c3e-9a57-0d1f8b7e4a21")
+
+	t.Run("capsule", func(t *testing.T) {
+		var c capsule
+		exists, err := s.find(database.CollCapsules, capsuleID.String(), &c)
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		assert.Len(t, c.GuardianIDs, 3)
+		assert.True(t, c.AreShardsReceived)
+		assert.True(t, c.IsManifestReceived)
+		assert.True(t, c.IsKeyMasterShareReceived)
+		assert.True(t, c.IsComplete)
+	})
+
+	t.Run("capsule without manifest", func(t *testing.T) {
+		var c capsule
+		exists, err := s.find(database.CollCapsules, "8a01e4a0-bcaf-4bdc-8ef0-7f8293a4b52c", &c)
+		require.NoError(t, err)
+		require.True(t, exists)
+
+		assert.False(t, c.IsManifestReceived)
+		assert.False(t, c.IsKeyMasterShareReceived)
+	})
+
+	t.Run("shards", func(t *testing.T) {
+		for _, shardID := range []string{
+			"5adeb16d-8f7c-4eaf-9bcd-4c5f60718293",
+			"6befc27e-9a8d-4fba-8cde-5d607182930a",
+			"7cf0d38f-ab9e-4acb-9def-6e718293a41b",
+		} {
+			var sm shardMetaData
+			exists, err := s.find(database.CollCapsulesActiveShards, shardID, &sm)
+			require.NoError(t, err)
+			require.True(t, exists)
+			assert.Equal(t, shardID, sm.shardID.String())
+			assert.True(t, sm.isLost)
+		}
+	})
+
+	t.Run("manifest and key share", func(t *testing.T) {
+		var manifest message.CapsuleIncomingManifestStream
+		exists, err := s.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Len(t, manifest.Blocks, int(manifest.TotalBlocks))
+
+		var keyShare masterKeyShare
+		exists, err = s.find(database.CollKeyShares, capsuleID.String(), &keyShare)
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Equal(t, "share of the master key", string(keyShare.Share))
+		assert.Equal(t, 2, keyShare.ThresholdShares)
+	})
+
+	t.Run("runs once", func(t *testing.T) {
+		from, to, err := storage.MigrateBBolt(db, string(featureCapsule), bboltMigrations)
+		require.NoError(t, err)
+		assert.Equal(t, to, from)
+	})
+
+	t.Run("sealed", func(t *testing.T) {
+		for bucket, kvs := range dumpBBolt(t, db) {
+			if bucket == "meta" {
+				continue
+			}
+			for k, v := range kvs {
+				assert.True(t, customcrypto.IsSealed([]byte(v)), "%s %s", bucket, k)
+			}
+		}
+	})
+}
+
+func TestShardMetaDataJSON(t *testing.T) {
+	shard := newTestShard(uuid.New(), uuid.New())
+
+	bv, err := json.Marshal(shard)
+	require.NoError(t, err)
+	assert.NotEqual(t, "{}", string(bv))
+
+	var got shardMetaData
+	require.NoError(t, json.Unmarshal(bv, &got))
+	assert.Equal(t, shard, got)
+}
+
+// loadBBoltDump makes a bbolt db in a temp dir out of the dump at path.
+func loadBBoltDump(t *testing.T, path string) *bolt.DB {
+	t.Helper()
+
+	bv, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var dump map[string]map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(bv, &dump))
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for bucket, kvs := range dump {
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			for k, v := range kvs {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return db
+}
+
+func dumpBBolt(t *testing.T, db *bolt.DB) map[string]map[string]string {
+	t.Helper()
+
+	dump := make(map[string]map[string]string)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			kvs := make(map[string]string)
+			dump[string(name)] = kvs
+
+			return b.ForEach(func(k, v []byte) error {
+				kvs[string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	require.NoError(t, err)
+
+	return dump
+}
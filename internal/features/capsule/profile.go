@@ -0,0 +1,138 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+)
+
+const (
+	// blockOverhead is what a block grows by before it is split into shards,
+	// the gcm tag.
+	blockOverhead = 16
+
+	// maxTotalShardNum is the most shards a block can be split into, the
+	// index of a shard is one byte.
+	maxTotalShardNum = 256
+)
+
+var (
+	ErrInvalidErasureProfile = errors.New("invalid erasure profile")
+
+	// DefaultErasureProfile is what a capsule is erasure coded with when the
+	// owner picks nothing.
+	DefaultErasureProfile = ErasureProfile{
+		DataShards:   uint8(dataShardNum),
+		ParityShards: uint8(parityShardNum),
+	}
+)
+
+// ErasureProfile is how the blocks of a capsule are erasure coded. A block is
+// split into DataShards shards, any DataShards of which rebuild it, and
+// ParityShards more are coded from them. Every block records the profile it
+// was coded with in the manifest, see message.BlockManifest.
+type ErasureProfile struct {
+	DataShards   uint8
+	ParityShards uint8
+}
+
+// ErasureProfileFor returns the smallest profile that loses no block when
+// faultTolerance of holders, the guardians and storage providers of a capsule,
+// are lost. Every holder gets the same number of shards of a block, so
+// faultTolerance of them never hold more than the parity shards.
+//
+// A small capsule with 3 guardians that can lose one of them is split into 27
+// shards a block, not the 54 of the default profile.
+func ErasureProfileFor(holders, faultTolerance int) (ErasureProfile, error) {
+	if faultTolerance < 1 || faultTolerance >= holders {
+		return ErasureProfile{}, fmt.Errorf(
+			"%w: fault tolerance must be between 1 and %d for %d holders, got %d",
+			ErrInvalidErasureProfile,
+			holders-1,
+			holders,
+			faultTolerance,
+		)
+	}
+
+	// The data shards of a full block must each fit a shard message, see
+	// shardSize.
+	minDataShards := 1
+	for shardSizeOf(minDataShards) > math.MaxUint16 {
+		minDataShards++
+	}
+
+	remaining := holders - faultTolerance
+	shardsPerHolder := (minDataShards + remaining - 1) / remaining
+	if shardsPerHolder*holders > maxTotalShardNum {
+		return ErasureProfile{}, fmt.Errorf(
+			"%w: %d holders with %d shards a block each is more than %d shards",
+			ErrInvalidErasureProfile,
+			holders,
+			shardsPerHolder,
+			maxTotalShardNum,
+		)
+	}
+
+	return ErasureProfile{
+		DataShards:   uint8(shardsPerHolder * remaining),
+		ParityShards: uint8(shardsPerHolder * faultTolerance),
+	}, nil
+}
+
+// validate checks the profile can code a full block. A guardian refuses a
+// shard with no parity shards, see ReceiveCapsuleStream.
+func (p ErasureProfile) validate() error {
+	switch {
+	case p.DataShards == 0 || p.ParityShards == 0:
+		return fmt.Errorf(
+			"%w: data and parity shards must be at least 1, got %d and %d",
+			ErrInvalidErasureProfile,
+			p.DataShards,
+			p.ParityShards,
+		)
+
+	case p.totalShards() > maxTotalShardNum:
+		return fmt.Errorf(
+			"%w: %d shards is more than %d",
+			ErrInvalidErasureProfile,
+			p.totalShards(),
+			maxTotalShardNum,
+		)
+
+	case p.shardSize() > math.MaxUint16:
+		return fmt.Errorf(
+			"%w: a shard of %d data shards is %d bytes, more than %d",
+			ErrInvalidErasureProfile,
+			p.DataShards,
+			p.shardSize(),
+			math.MaxUint16,
+		)
+	}
+
+	return nil
+}
+
+func (p ErasureProfile) totalShards() int {
+	return int(p.DataShards) + int(p.ParityShards)
+}
+
+// shardSize is the size of the shards of a full block, the most a guardian
+// receives in one shard message.
+func (p ErasureProfile) shardSize() int {
+	return shardSizeOf(int(p.DataShards))
+}
+
+// shardSizeOf is the size of a shard of a full block split into dataShards,
+// with its header in front.
+func shardSizeOf(dataShards int) int {
+	return (blockSinkBufSize+blockOverhead+dataShards-1)/dataShards + dataredundancy.ShardHeaderSize
+}
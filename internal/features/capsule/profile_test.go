@@ -0,0 +1,186 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErasureProfileFor(t *testing.T) {
+	tests := []struct {
+		name                    string
+		holders, faultTolerance int
+		want                    ErasureProfile
+		errMsg                  string
+	}{
+		{
+			name:    "3 holders lose 1",
+			holders: 3, faultTolerance: 1,
+			want: ErasureProfile{DataShards: 18, ParityShards: 9},
+		},
+		{
+			name:    "3 holders lose 2",
+			holders: 3, faultTolerance: 2,
+			want: ErasureProfile{DataShards: 17, ParityShards: 34},
+		},
+		{
+			name:    "20 holders lose 5",
+			holders: 20, faultTolerance: 5,
+			want: ErasureProfile{DataShards: 30, ParityShards: 10},
+		},
+		{
+			name:    "no fault tolerance",
+			holders: 3, faultTolerance: 0,
+			errMsg: "fault tolerance must be between 1 and 2",
+		},
+		{
+			name:    "lose every holder",
+			holders: 3, faultTolerance: 3,
+			errMsg: "fault tolerance must be between 1 and 2",
+		},
+		{
+			name:    "too many shards",
+			holders: 100, faultTolerance: 99,
+			errMsg: "more than 256 shards",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ErasureProfileFor(tt.holders, tt.faultTolerance)
+			if tt.errMsg != "" {
+				require.ErrorIs(t, err, ErrInvalidErasureProfile)
+				assert.ErrorContains(t, err, tt.errMsg)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			require.NoError(t, got.validate())
+			assert.LessOrEqual(t, got.shardSize(), math.MaxUint16)
+		})
+	}
+
+	t.Run("validate", func(t *testing.T) {
+		require.NoError(t, DefaultErasureProfile.validate())
+		assert.ErrorIs(t, ErasureProfile{DataShards: 16, ParityShards: 1}.validate(), ErrInvalidErasureProfile, "a shard doesn't fit a shard message")
+		assert.ErrorIs(t, ErasureProfile{DataShards: 200, ParityShards: 100}.validate(), ErrInvalidErasureProfile)
+		assert.ErrorIs(t, ErasureProfile{DataShards: 32}.validate(), ErrInvalidErasureProfile)
+	})
+}
+
+func TestBlockSinkEncoderErasureProfile(t *testing.T) {
+	profile, err := ErasureProfileFor(3, 1)
+	require.NoError(t, err)
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(int(profile.DataShards), int(profile.ParityShards))
+	require.NoError(t, err)
+
+	guardians := make([]transport.RemotePeer, 3)
+	received := make([][][]byte, len(guardians))
+	for i := range guardians {
+		guardian := new(mockRemotePeer)
+		guardian.On("ID").Return(uuid.New())
+		guardian.On("PublicKey").Return([]byte(fmt.Sprintf("guardian-%d", i)))
+		guardian.On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i})
+		guardian.onGuardianSend(func(msg message.Msg, data []byte) (int, error) {
+			shardMsg := msg.(*message.CapsuleStreamShard)
+			assert.Equal(t, profile.DataShards, shardMsg.DataShardNum)
+			assert.Equal(t, profile.ParityShards, shardMsg.ParityShardNum)
+			assert.LessOrEqual(t, len(data), profile.shardSize())
+			received[i] = append(received[i], slices.Clone(data))
+			return len(data), nil
+		})
+		guardians[i] = guardian
+	}
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, profile, guardians, nil)
+	data := make([]byte, blockSinkBufSize/2)
+	rand.Read(data)
+	_, err = sinker.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, sinker.Close())
+
+	require.Len(t, sinker.capsuleManifest.blocks, 1)
+	block := sinker.capsuleManifest.blocks[0]
+	assert.Equal(t, profile.DataShards, block.DataShardNum)
+	assert.Equal(t, profile.ParityShards, block.ParityShardNum)
+
+	// Every guardian has its share of the block, so the block is rebuilt
+	// without any one of them.
+	for i := range guardians {
+		assert.Len(t, received[i], profile.totalShards()/len(guardians), "guardian %d", i)
+	}
+
+	for lost := range guardians {
+		shards := make([][]byte, profile.totalShards())
+		for i := range guardians {
+			if i == lost {
+				continue
+			}
+			for _, shard := range received[i] {
+				header, err := dataredundancy.ParseShardHeader(shard)
+				require.NoError(t, err)
+				shards[header.Index] = shard
+			}
+		}
+
+		var encBlock bytes.Buffer
+		require.NoError(t, erasureCoder.Reconstruct(shards, &encBlock), "without guardian %d", lost)
+
+		var blockKey [32]byte
+		require.NoError(t, deriveBlockKey(1, masterKey, &blockKey))
+		got, err := sinker.cCrypto.Cipher.Decrypt(blockKey[:], block.Nonce, encBlock.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+}
+
+func TestBlockSinkEncoderFewerShardsThanGuardians(t *testing.T) {
+	// Fewer shards than guardians leaves one of them without a final shard.
+	profile := ErasureProfile{DataShards: 17, ParityShards: 1}
+	require.NoError(t, profile.validate())
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(int(profile.DataShards), int(profile.ParityShards))
+	require.NoError(t, err)
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	guardians := newTestSinkGuardians(profile.totalShards()+1, nil, nil)
+	sinker := NewBlockSinkEncoder(context.Background(), uuid.New(), masterKey, erasureCoder.ErasureInto, profile, guardians, nil)
+	_, err = sinker.Write([]byte("letter"))
+	require.NoError(t, err)
+	err = sinker.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fewer than the 19 guardians")
+
+	dto := &CreateCapsuleDTO{
+		RemotePeerGuardians: guardians,
+		Letter:              &mockLetter{data: []byte("test")},
+		ErasureProfile:      &profile,
+	}
+	err = dto.validate(Defaults{MinNumOfGuardians: 3, MaxNumOfGuardians: 20})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fewer than the 19 guardians")
+}
@@ -0,0 +1,393 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/transport"
+)
+
+/*
+A storage provider is a peer, paid or volunteering, that holds shards for
+owners and nothing else. It never gets a CapsuleIncomingStream, so it never
+learns the capsule of a shard, its guardians or which shards go together. All
+it sees of a shard is its hash and size:
+
+	owner     ProviderStoreShard, then ProviderShard + the shard
+	provider  ProviderAck
+
+The guardians get where each shard went in the manifest, and fetch them back
+from the providers during recovery:
+
+	guardian  ProviderFetchShard
+	provider  ProviderAck, then ProviderShard + the shard if it holds it
+
+A guardian answers a ProviderFetchShard too, it is how the repair gets the
+shards of a repair group back from the guardians (see repair.go).
+
+SECURITY: A shard starts with its header, see dataredundancy.ShardHeader, which
+has the IDs of its capsule and repair group. A provider that reads the shards
+it holds learns which go together, not whose they are or what is in them.
+todo: seal the header from providers, the guardians still need to read it
+without the db.
+
+A provider answers every request with a ProviderAck, refusals too, so the
+other side is never left waiting on an answer that is not coming. The hash is
+all it takes to fetch a shard, a shard is a piece of a sealed block so whoever
+fetches it can't read it.
+
+todo: paid providers need a payment and an agreement on how long they hold.
+todo: a provider never learns a shard is not needed anymore, so it holds them
+till it is told. there is no message to tell it yet.
+todo: Receive has no deadline, a provider that never acks holds up the owner.
+*/
+
+var (
+	ErrInvalidStorageProviders = errors.New("invalid storage providers")
+	ErrProviderRefused         = errors.New("storage provider refused")
+	ErrProviderShardMismatch   = errors.New("shard does not match its hash")
+)
+
+// storeWithProvider puts shard with provider, and returns where it is for the
+// manifest.
+func storeWithProvider(provider transport.RemotePeer, shard []byte) (message.ProviderShardManifest, error) {
+	hash := sha256.Sum256(shard)
+	size := uint32(len(shard))
+
+	_, err := provider.Send(&message.ProviderStoreShard{Hash: hash, Size: size}, nil)
+	if err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+	_, err = provider.Send(&message.ProviderShard{Hash: hash, Size: size}, shard)
+	if err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+
+	if err := receiveProviderAck(provider, hash); err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+
+	return message.ProviderShardManifest{
+		Hash:              hash,
+		Size:              size,
+		MerkleRoot:        merkleRoot(shard),
+		ProviderPublicKey: provider.PublicKey(),
+		// todo: a quic provider is reached with a "quic://" addr, which Addr
+		// doesn't have.
+		ProviderAddr: provider.Addr().String(),
+	}, nil
+}
+
+func receiveProviderAck(provider transport.RemotePeer, hash [32]byte) error {
+	var ack message.ProviderAck
+	if _, err := provider.Receive(&ack, nil); err != nil {
+		return err
+	}
+
+	switch {
+	case ack.Hash != hash:
+		return fmt.Errorf("%w: ack is of shard %x, not %x", ErrProviderRefused, ack.Hash, hash)
+	case !ack.IsOK:
+		return fmt.Errorf("%w: %s (code %d): %s", ErrProviderRefused, ack.Code, ack.Code, ack.Message)
+	}
+
+	return nil
+}
+
+func (s *service) ReceiveProviderShard(
+	ctx context.Context, remotePeer transport.RemotePeer, msg *message.ProviderStoreShard,
+) error {
+	if msg == nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"received nil provider store shard message",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	return s.ackProvider(remotePeer, msg.Hash, s.storeProviderShard(remotePeer, msg))
+}
+
+func (s *service) storeProviderShard(remotePeer transport.RemotePeer, msg *message.ProviderStoreShard) error {
+	if msg.Size == 0 || msg.Size > message.MaxChunkDataSize {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard size %d is not between 1 and %d", msg.Size, message.MaxChunkDataSize),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	// NOTICE IMPORTANT: The shard is read before anything is checked, or it is
+	// left on the conn and read as the next message.
+	var (
+		shardMsg message.ProviderShard
+		shard    = make([]byte, msg.Size)
+	)
+	n, err := remotePeer.Receive(&shardMsg, shard)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.ErrBadRequest,
+			"failed to receive provider shard",
+			err,
+			featureCapsule,
+		)
+	}
+	shard = shard[:n]
+
+	if shardMsg.Hash != msg.Hash || sha256.Sum256(shard) != msg.Hash {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard is not the one of hash %x", msg.Hash),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	if !s.IsStorageProvider {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrNotStorageProvider,
+			"we are not a storage provider",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	// A shard is admitted like a capsule of one shard, under the quotas of
+	// the owner that put it with us.
+	admission, err := s.admitCapsule(remotePeer.ID())
+	if err != nil {
+		return err
+	}
+	defer admission.done()
+
+	if err := admission.admitShard(int64(n)); err != nil {
+		return err
+	}
+
+	uow := newUnitOfWork(s.FileStore, s.DBStore, s.Clock.Now)
+	if err := uow.saveCAS(msg.Hash, shard); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to save provider shard to CAS",
+			errors.Join(err, uow.rollback()),
+			featureCapsule,
+		)
+	}
+
+	// todo: a shard of the same hash from another owner takes it over, which
+	// with sealed blocks is only ever the same owner again.
+	uow.createOrUpdate(
+		database.CollProviderShards,
+		hex.EncodeToString(msg.Hash[:]),
+		&providerShard{
+			Hash:       msg.Hash,
+			Size:       uint32(n),
+			OwnerID:    remotePeer.ID(),
+			ReceivedAt: s.Clock.Now(),
+		},
+	)
+	if err := uow.commit(); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to store provider shard %x", msg.Hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
+
+func (s *service) SendProviderShard(
+	ctx context.Context, remotePeer transport.RemotePeer, msg *message.ProviderFetchShard,
+) error {
+	if msg == nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"received nil provider fetch shard message",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	shard, err := s.findShard(msg.Hash)
+	if err := s.ackProvider(remotePeer, msg.Hash, err); err != nil || shard == nil {
+		return err
+	}
+
+	_, err = remotePeer.Send(
+		&message.ProviderShard{Hash: msg.Hash, Size: uint32(len(shard))},
+		shard,
+	)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to send provider shard %x", msg.Hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
+
+// findShard gets the shard of hash from the CAS, whether we hold it as a
+// guardian or a storage provider.
+func (s *service) findShard(hash [32]byte) ([]byte, error) {
+	shard, err := s.FileStore.GetCAS(hash)
+	switch {
+	case errors.Is(err, ErrObjectNotFound):
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrShardNotFound,
+			fmt.Sprintf("we hold no shard of hash %x", hash),
+			nil,
+			featureCapsule,
+		)
+	case err != nil:
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to get shard %x from CAS", hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	return shard, nil
+}
+
+// ackProvider answers remotePeer with how its request for the shard of hash
+// went, err being how. A refusal is told in the ack only, the remote peer
+// reads an ack and not an ErrorMessage, so it is not returned.
+func (s *service) ackProvider(remotePeer transport.RemotePeer, hash [32]byte, err error) error {
+	ack := &message.ProviderAck{Hash: hash, IsOK: err == nil}
+
+	var isRefusal bool
+	if err != nil {
+		ack.Code, ack.Message, isRefusal = refusalOf(err, "storage provider failed")
+	}
+
+	if _, sendErr := remotePeer.Send(ack, nil); sendErr != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to send provider ack of shard %x", hash),
+			errors.Join(sendErr, err),
+			featureCapsule,
+		)
+	}
+
+	if isRefusal {
+		s.Logger.Info("refused provider request", "remotePeer", remotePeer.ID(), "err", err)
+		return nil
+	}
+
+	return err
+}
+
+// refusalOf is what a remote peer is told of err. Only a ScopeRemotePeer error
+// is a refusal, what went wrong on our side is none of theirs and they are
+// told failed instead.
+func refusalOf(err error, failed string) (code peererrors.Code, msg string, isRefusal bool) {
+	pErr, isPErr := errors.AsType[*peererrors.PeerError](err)
+	if !isPErr || pErr.Scope() != peererrors.ScopeRemotePeer {
+		return 0, failed, false
+	}
+
+	return pErr.Code(), pErr.Message(), true
+}
+
+func (s *service) FetchProviderShard(
+	ctx context.Context, provider transport.RemotePeer, shard message.ProviderShardManifest,
+) ([]byte, error) {
+	return fetchShard(provider, shard.Hash, shard.Size)
+}
+
+// fetchShard fetches the shard of hash and size back from holder, a storage
+// provider or a guardian.
+func fetchShard(holder transport.RemotePeer, hash [32]byte, size uint32) ([]byte, error) {
+	if size == 0 || size > message.MaxChunkDataSize {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard size %d is not between 1 and %d", size, message.MaxChunkDataSize),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	_, err := holder.Send(&message.ProviderFetchShard{Hash: hash}, nil)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			"failed to ask holder for shard",
+			err,
+			featureCapsule,
+		)
+	}
+
+	if err := receiveProviderAck(holder, hash); err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("holder did not send shard %x", hash),
+			err,
+			featureCapsule,
+		)
+	}
+
+	var (
+		shardMsg message.ProviderShard
+		data     = make([]byte, size)
+	)
+	n, err := holder.Receive(&shardMsg, data)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			"failed to receive shard from holder",
+			err,
+			featureCapsule,
+		)
+	}
+	data = data[:n]
+
+	// SECURITY: Whatever a holder sends is checked against the manifest.
+	if shardMsg.Hash != hash || sha256.Sum256(data) != hash {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("holder sent a shard that is not the one of hash %x", hash),
+			ErrProviderShardMismatch,
+			featureCapsule,
+		)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,390 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStorageProvider(t *testing.T) {
+	dbStores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt: func(t *testing.T) dbStorer {
+			db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			return NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+		},
+	}
+
+	for driver, newDBStore := range dbStores {
+		t.Run(driver, func(t *testing.T) {
+			s := newTestQuotaService(t, newDBStore(t), &QuotaConfig{
+				MaxBytesPerOwner:    1 << 20,
+				MaxBytesTotal:       1 << 20,
+				MaxShardsPerCapsule: 4,
+			})
+			s.IsStorageProvider = true
+			owner := uuid.New()
+
+			shard := make([]byte, 1000)
+			rand.Read(shard)
+
+			link := newTestProviderLink(t, s, owner)
+			stored, err := storeWithProvider(link.provider, shard)
+			require.NoError(t, err)
+			require.NoError(t, link.wait())
+
+			assert.Equal(t, sha256.Sum256(shard), stored.Hash)
+			assert.Equal(t, uint32(len(shard)), stored.Size)
+			assert.Equal(t, []byte("provider"), []byte(stored.ProviderPublicKey))
+			assert.Equal(t, "127.0.0.1:4040", stored.ProviderAddr)
+
+			t.Run("held under the owner's quota", func(t *testing.T) {
+				usage, err := s.DBStore.findUsageByOwner()
+				require.NoError(t, err)
+				assert.Equal(t, map[uuid.UUID]int64{owner: int64(len(shard))}, usage)
+
+				// So the gc keeps it.
+				hashes, err := s.DBStore.findShardHashes()
+				require.NoError(t, err)
+				assert.Contains(t, hashes, stored.Hash)
+			})
+
+			t.Run("fetched back", func(t *testing.T) {
+				link := newTestProviderLink(t, s, uuid.New())
+				data, err := s.FetchProviderShard(context.Background(), link.provider, stored)
+				require.NoError(t, err)
+				require.NoError(t, link.wait())
+				assert.Equal(t, shard, data)
+			})
+
+			t.Run("not found", func(t *testing.T) {
+				unknown := stored
+				unknown.Hash = sha256.Sum256([]byte("unknown"))
+
+				link := newTestProviderLink(t, s, uuid.New())
+				_, err := s.FetchProviderShard(context.Background(), link.provider, unknown)
+				require.Error(t, err)
+				// A refusal is told in the ack, not returned.
+				require.NoError(t, link.wait())
+			})
+
+			t.Run("shard not of its hash", func(t *testing.T) {
+				link := newTestProviderLink(t, s, owner)
+				hash := sha256.Sum256([]byte("something else"))
+				_, err := link.provider.Send(&message.ProviderStoreShard{Hash: hash, Size: uint32(len(shard))}, nil)
+				require.NoError(t, err)
+				_, err = link.provider.Send(&message.ProviderShard{Hash: hash, Size: uint32(len(shard))}, shard)
+				require.NoError(t, err)
+
+				require.ErrorIs(t, receiveProviderAck(link.provider, hash), ErrProviderRefused)
+				require.NoError(t, link.wait())
+
+				isFound, err := s.DBStore.find(database.CollProviderShards, hex.EncodeToString(hash[:]), &providerShard{})
+				require.NoError(t, err)
+				assert.False(t, isFound)
+			})
+
+			t.Run("provider sends a shard not of its hash", func(t *testing.T) {
+				link := newTestProviderLink(t, nil, uuid.New())
+				link.toOwner <- testFrame{msg: &message.ProviderAck{Hash: stored.Hash, IsOK: true}}
+				link.toOwner <- testFrame{
+					msg:  &message.ProviderShard{Hash: stored.Hash, Size: stored.Size},
+					data: make([]byte, stored.Size),
+				}
+
+				_, err := s.FetchProviderShard(context.Background(), link.provider, stored)
+				assert.ErrorContains(t, err, "not the one of hash")
+			})
+
+			t.Run("not a storage provider", func(t *testing.T) {
+				s := newTestQuotaService(t, newDBStore(t), s.Quota)
+				owner := uuid.New()
+
+				link := newTestProviderLink(t, s, owner)
+				_, err := storeWithProvider(link.provider, shard)
+				require.ErrorIs(t, err, ErrProviderRefused)
+				require.NoError(t, link.wait())
+
+				usage, err := s.DBStore.findUsageByOwner()
+				require.NoError(t, err)
+				assert.Zero(t, usage[owner])
+			})
+		})
+	}
+}
+
+func TestBlockSinkEncoderStorageProviders(t *testing.T) {
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShardNum, parityShardNum)
+	require.NoError(t, err)
+
+	guardians := make([]transport.RemotePeer, 3)
+	received := make([]int, len(guardians))
+	finals := make([]int, len(guardians))
+	for i := range guardians {
+		guardian := new(mockRemotePeer)
+		guardian.On("ID").Return(uuid.New())
+		guardian.On("PublicKey").Return([]byte(fmt.Sprintf("guardian-%d", i)))
+		guardian.On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i})
+		guardian.onGuardianSend(func(msg message.Msg, data []byte) (int, error) {
+			shardMsg := msg.(*message.CapsuleStreamShard)
+			received[i]++
+			if shardMsg.IsFinal {
+				finals[i]++
+			}
+			return len(data), nil
+		})
+		guardians[i] = guardian
+	}
+
+	provider := newTestQuotaService(t, newTestSQLiteDBStore(t), &QuotaConfig{
+		MaxBytesPerOwner:    1 << 30,
+		MaxBytesTotal:       1 << 30,
+		MaxShardsPerCapsule: 1 << 10,
+	})
+	provider.IsStorageProvider = true
+
+	masterKey := make([]byte, 32)
+	rand.Read(masterKey)
+
+	data := make([]byte, blockSinkBufSize/2)
+	rand.Read(data)
+
+	t.Run("provider holds its share", func(t *testing.T) {
+		// Serves every shard put with it.
+		accepting := newTestProviderLink(t, provider, uuid.New())
+		accepting.serveAll = true
+
+		sinker := NewBlockSinkEncoder(
+			context.Background(),
+			uuid.New(),
+			masterKey,
+			erasureCoder.ErasureInto,
+			DefaultErasureProfile,
+			guardians,
+			[]transport.RemotePeer{accepting.provider},
+		)
+
+		_, err := sinker.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, sinker.Close())
+
+		share := (dataShardNum + parityShardNum + len(sinker.holders) - 1) / len(sinker.holders)
+		total := 0
+		for i := range guardians {
+			total += received[i]
+			assert.LessOrEqual(t, received[i], share, "guardian %d holds no more than its share", i)
+			assert.Equal(t, 1, finals[i], "guardian %d gets one final shard", i)
+		}
+
+		providerShards := sinker.capsuleManifest.providerShards
+		require.NotEmpty(t, providerShards)
+		assert.LessOrEqual(t, len(providerShards), share, "a provider gets no more than its share")
+		assert.Equal(t, dataShardNum+parityShardNum, total+len(providerShards), "every shard went somewhere")
+
+		usage, err := provider.DBStore.findUsageByOwner()
+		require.NoError(t, err)
+		var held int64
+		for _, n := range usage {
+			held += n
+		}
+		var want int64
+		for _, ps := range providerShards {
+			assert.Equal(t, []byte("provider"), []byte(ps.ProviderPublicKey))
+			want += int64(ps.Size)
+		}
+		assert.Equal(t, want, held, "the provider holds its shards")
+	})
+
+	t.Run("refused shards don't fit the guardians", func(t *testing.T) {
+		clear(received)
+		clear(finals)
+
+		// Refuses every shard put with it. What it refuses can only go to
+		// a guardian under its share, and there is less room left with them
+		// than it was picked for.
+		refusing := newTestProviderLink(t, newTestQuotaService(t, newTestSQLiteDBStore(t), provider.Quota), uuid.New())
+		refusing.serveAll = true
+
+		sinker := NewBlockSinkEncoder(
+			context.Background(),
+			uuid.New(),
+			masterKey,
+			erasureCoder.ErasureInto,
+			DefaultErasureProfile,
+			guardians,
+			[]transport.RemotePeer{refusing.provider},
+		)
+
+		_, err := sinker.Write(data)
+		require.NoError(t, err)
+		err = sinker.Close()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "every guardian holds its share")
+
+		for i := range guardians {
+			assert.Zero(t, received[i], "guardian %d was sent none of the failed block", i)
+		}
+	})
+}
+
+type testFrame struct {
+	msg  message.Msg
+	data []byte
+}
+
+// testProviderLink is a conn between an owner or guardian and the storage
+// provider or holder s, with s serving it like the transport would.
+type testProviderLink struct {
+	t        *testing.T
+	s        *service
+	provider *mockRemotePeer // the provider, as the owner sees it.
+	owner    *mockRemotePeer // the owner, as the provider sees it.
+
+	toProvider chan testFrame
+	toOwner    chan testFrame
+
+	// serveAll serves every request on the link, not only the first.
+	serveAll bool
+	once     sync.Once
+	errs     chan error
+}
+
+// newTestProviderLink links up with s, a nil s serves nothing and what the
+// provider sends is pushed on toOwner by the test.
+func newTestProviderLink(t *testing.T, s *service, ownerID uuid.UUID) *testProviderLink {
+	t.Helper()
+
+	link := &testProviderLink{
+		t:          t,
+		s:          s,
+		provider:   new(mockRemotePeer),
+		owner:      new(mockRemotePeer),
+		toProvider: make(chan testFrame, 4),
+		toOwner:    make(chan testFrame, 4),
+		errs:       make(chan error, 1),
+	}
+
+	link.provider.On("ID").Return(uuid.New())
+	link.provider.On("PublicKey").Return([]byte("provider"))
+	link.provider.On("PublicKeyStr").Return("provider")
+	link.provider.On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4040})
+	link.provider.On("Send", mock.Anything, mock.Anything).Return(link.send(link.toProvider))
+	link.provider.On("Receive", mock.Anything, mock.Anything).Return(link.receive(link.toOwner))
+
+	link.owner.On("ID").Return(ownerID)
+	link.owner.On("Send", mock.Anything, mock.Anything).Return(link.send(link.toOwner))
+	link.owner.On("Receive", mock.Anything, mock.Anything).Return(link.receive(link.toProvider))
+
+	return link
+}
+
+func (l *testProviderLink) send(to chan testFrame) func(message.Msg, []byte) (int, error) {
+	return func(msg message.Msg, data []byte) (int, error) {
+		if to == l.toProvider {
+			l.once.Do(func() {
+				if l.s != nil {
+					go l.serve()
+				}
+			})
+		}
+
+		to <- testFrame{msg: msg, data: append([]byte(nil), data...)}
+		return len(data), nil
+	}
+}
+
+func (l *testProviderLink) receive(from chan testFrame) func(message.Msg, []byte) (int, error) {
+	return func(msg message.Msg, data []byte) (int, error) {
+		var frame testFrame
+		select {
+		case frame = <-from:
+		case <-time.After(5 * time.Second):
+			return 0, errors.New("nothing received")
+		}
+
+		if reflect.TypeOf(frame.msg) != reflect.TypeOf(msg) {
+			return 0, fmt.Errorf("received a %T, not a %T", frame.msg, msg)
+		}
+		if len(frame.data) > len(data) {
+			return 0, fmt.Errorf("data of %d does not fit %d", len(frame.data), len(data))
+		}
+		reflect.ValueOf(msg).Elem().Set(reflect.ValueOf(frame.msg).Elem())
+
+		return copy(data, frame.data), nil
+	}
+}
+
+// serve dispatches the first frame of every request to s like the router.
+func (l *testProviderLink) serve() {
+	for {
+		var frame testFrame
+		select {
+		case frame = <-l.toProvider:
+		case <-time.After(5 * time.Second):
+			l.errs <- errors.New("no request received")
+			return
+		}
+
+		var err error
+		switch msg := frame.msg.(type) {
+		case *message.ProviderStoreShard:
+			err = l.s.ReceiveProviderShard(context.Background(), l.owner, msg)
+		case *message.ProviderFetchShard:
+			err = l.s.SendProviderShard(context.Background(), l.owner, msg)
+		case *message.AuditChallenge:
+			err = l.s.AnswerAudit(context.Background(), l.owner, msg)
+		case *message.RepairStoreShard:
+			err = l.s.ReceiveRepairShard(context.Background(), l.owner, msg)
+		case *message.RepairManifest:
+			err = l.s.ReceiveRepairManifest(context.Background(), l.owner, msg)
+		default:
+			err = fmt.Errorf("unexpected request %T", msg)
+		}
+
+		if !l.serveAll || err != nil {
+			l.errs <- err
+			return
+		}
+	}
+}
+
+// wait returns what serving the request returned.
+func (l *testProviderLink) wait() error {
+	l.t.Helper()
+
+	select {
+	case err := <-l.errs:
+		return err
+	case <-time.After(5 * time.Second):
+		return errors.New("request was not served")
+	}
+}
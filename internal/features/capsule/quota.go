@@ -0,0 +1,211 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/google/uuid"
+)
+
+/*
+A guardian admits a capsule only if it has room for it. Before it takes a
+capsule and again before every shard, it checks:
+
+	owner  what the owner already has with us, in the db and in flight.
+	total  what every owner has with us, in the db and in flight.
+	disk   the free space left on the disk of the CAS after the shard.
+
+The usage in the db is read once when a capsule comes in, what comes in after
+is counted in flight till the capsule is done. So two capsules of an owner
+coming in at once can count each other's shards twice, which only refuses
+early.
+
+A refusal is a ScopeRemotePeer error, so the owner is told with an
+ErrorMessage.
+*/
+
+type QuotaConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	// MaxBytesPerOwner is how much of the shards of one owner we hold.
+	MaxBytesPerOwner int64
+	// MaxBytesTotal is how much of the shards of every owner we hold.
+	MaxBytesTotal int64
+	// MaxShardsPerCapsule is how many shards one capsule can have.
+	MaxShardsPerCapsule int
+	// MinFreeBytes is how much of the disk must be left free after a shard.
+	// Optional, 0 leaves it to fill up.
+	MinFreeBytes int64
+}
+
+// usage is what the shards of the owners we hold take, as bytes.
+type usage struct {
+	byOwner map[uuid.UUID]int64
+	total   int64
+}
+
+func newUsage(byOwner map[uuid.UUID]int64) usage {
+	u := usage{byOwner: byOwner}
+	for _, n := range byOwner {
+		u.total += n
+	}
+	return u
+}
+
+// inFlight counts the shards of the capsules coming in that the usage read
+// from the db when they came in doesn't have.
+type inFlight struct {
+	mu      sync.Mutex
+	byOwner map[uuid.UUID]int64
+	total   int64
+}
+
+func (f *inFlight) add(ownerID uuid.UUID, n int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.byOwner == nil {
+		f.byOwner = make(map[uuid.UUID]int64)
+	}
+	f.byOwner[ownerID] += n
+	if f.byOwner[ownerID] == 0 {
+		delete(f.byOwner, ownerID)
+	}
+	f.total += n
+}
+
+func (f *inFlight) get(ownerID uuid.UUID) (owner, total int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.byOwner[ownerID], f.total
+}
+
+// admission is the room one incoming capsule has.
+type admission struct {
+	s       *service
+	ownerID uuid.UUID
+	// used is from the db when the capsule came in.
+	used usage
+	// received is the shards of this capsule so far.
+	received int64
+	shards   int
+}
+
+// admitCapsule checks ownerID has room for a capsule. Call done on the
+// admission when the capsule is done, whether it failed or not.
+func (s *service) admitCapsule(ownerID uuid.UUID) (*admission, error) {
+	byOwner, err := s.DBStore.findUsageByOwner()
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find the usage of the owners",
+			err,
+			featureCapsule,
+		)
+	}
+
+	a := &admission{
+		s:       s,
+		ownerID: ownerID,
+		used:    newUsage(byOwner),
+	}
+
+	// A capsule has at least one shard, so there must be room for one.
+	if err := a.check(1); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// admitShard checks there is room for a shard of size and counts it.
+func (a *admission) admitShard(size int64) error {
+	if a.shards >= a.s.Quota.MaxShardsPerCapsule {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrQuotaExceeded,
+			fmt.Sprintf("capsule has more than %d shards", a.s.Quota.MaxShardsPerCapsule),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	if err := a.check(size); err != nil {
+		return err
+	}
+
+	a.shards++
+	a.received += size
+	a.s.inFlight.add(a.ownerID, size)
+
+	return nil
+}
+
+// done stops counting the shards of the capsule in flight, they are in the db
+// or thrown away by now.
+func (a *admission) done() {
+	a.s.inFlight.add(a.ownerID, -a.received)
+}
+
+func (a *admission) check(size int64) error {
+	quota := a.s.Quota
+	ownerInFlight, totalInFlight := a.s.inFlight.get(a.ownerID)
+
+	if a.used.byOwner[a.ownerID]+ownerInFlight+size > quota.MaxBytesPerOwner {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrQuotaExceeded,
+			fmt.Sprintf("owner would hold more than %d bytes with us", quota.MaxBytesPerOwner),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	if a.used.total+totalInFlight+size > quota.MaxBytesTotal {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrQuotaExceeded,
+			"we hold as much as we can for every owner",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	free, err := a.s.FileStore.freeSpace()
+	switch {
+	case errors.Is(err, ErrFreeSpaceUnknown):
+		// Nothing to check it by, the quotas still hold.
+		return nil
+	case err != nil:
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find the free space of the disk",
+			err,
+			featureCapsule,
+		)
+	}
+
+	if free-size < quota.MinFreeBytes {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrInsufficientStorage,
+			"guardian is out of disk space",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testQuotaShardSize = 100
+
+func TestQuota(t *testing.T) {
+	dbStores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt: func(t *testing.T) dbStorer {
+			db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			return NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+		},
+	}
+
+	for driver, newDBStore := range dbStores {
+		t.Run(driver, func(t *testing.T) {
+			quota := &QuotaConfig{
+				MaxBytesPerOwner:    5 * testQuotaShardSize,
+				MaxBytesTotal:       10 * testQuotaShardSize,
+				MaxShardsPerCapsule: 4,
+			}
+			s := newTestQuotaService(t, newDBStore(t), quota)
+			owner, otherOwner := uuid.New(), uuid.New()
+
+			_, err := sendTestCapsule(s, owner, 3)
+			require.NoError(t, err)
+
+			assertUsage := func(t *testing.T, want map[uuid.UUID]int64) {
+				t.Helper()
+
+				usage, err := s.DBStore.findUsageByOwner()
+				require.NoError(t, err)
+				assert.Equal(t, want, usage)
+
+				_, inFlight := s.inFlight.get(owner)
+				assert.Zero(t, inFlight, "nothing is left in flight")
+			}
+			assertUsage(t, map[uuid.UUID]int64{owner: 3 * testQuotaShardSize})
+
+			t.Run("owner over quota", func(t *testing.T) {
+				_, err := sendTestCapsule(s, owner, 3)
+				assertRefused(t, err, peererrors.ErrQuotaExceeded)
+
+				// The shards that fit were kept, same as any stream cut short.
+				assertUsage(t, map[uuid.UUID]int64{owner: 5 * testQuotaShardSize})
+
+				_, err = sendTestCapsule(s, owner, 1)
+				assertRefused(t, err, peererrors.ErrQuotaExceeded)
+			})
+
+			t.Run("too many shards", func(t *testing.T) {
+				_, err := sendTestCapsule(s, uuid.New(), quota.MaxShardsPerCapsule+1)
+				assertRefused(t, err, peererrors.ErrQuotaExceeded)
+				assert.ErrorContains(t, err, "shards")
+			})
+
+			t.Run("over the total", func(t *testing.T) {
+				usage, err := s.DBStore.findUsageByOwner()
+				require.NoError(t, err)
+				var total int64
+				for _, n := range usage {
+					total += n
+				}
+				left := int((quota.MaxBytesTotal - total) / testQuotaShardSize)
+
+				_, err = sendTestCapsule(s, otherOwner, left+1)
+				assertRefused(t, err, peererrors.ErrQuotaExceeded)
+
+				_, err = sendTestCapsule(s, uuid.New(), 1)
+				assertRefused(t, err, peererrors.ErrQuotaExceeded)
+			})
+
+			t.Run("disk full", func(t *testing.T) {
+				s := newTestQuotaService(t, newDBStore(t), &QuotaConfig{
+					MaxBytesPerOwner:    math.MaxInt64 / 4,
+					MaxBytesTotal:       math.MaxInt64 / 4,
+					MaxShardsPerCapsule: 4,
+					// No test disk has this much left.
+					MinFreeBytes: math.MaxInt64 / 4,
+				})
+
+				capsuleID, err := sendTestCapsule(s, owner, 1)
+				assertRefused(t, err, peererrors.ErrInsufficientStorage)
+
+				// It was refused before anything was kept.
+				exists, err := s.DBStore.find(database.CollCapsules, capsuleID.String(), &capsule{})
+				require.NoError(t, err)
+				assert.False(t, exists)
+			})
+		})
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+
+	free, err := objects.freeSpace()
+	if errors.Is(err, ErrFreeSpaceUnknown) {
+		t.Skip(err)
+	}
+	require.NoError(t, err)
+	assert.Positive(t, free)
+}
+
+func newTestQuotaService(t *testing.T, db dbStorer, quota *QuotaConfig) *service {
+	t.Helper()
+
+	return &service{
+		ServiceConfig: &ServiceConfig{
+			Ctx:       context.Background(),
+			Shutdown:  &sync.WaitGroup{},
+			DBStore:   db,
+			FileStore: NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring}),
+			Serialize: serialize.New(),
+			Clock:     clock.New(),
+			Quota:     quota,
+			Logger:    slog.Default(),
+		},
+		inFlight: &inFlight{},
+	}
+}
+
+// sendTestCapsule has ownerID send s a capsule of numOfShards shards of
+// testQuotaShardSize.
+func sendTestCapsule(s *service, ownerID uuid.UUID, numOfShards int) (uuid.UUID, error) {
+	capsuleID := uuid.New()
+	keyShare := []byte("share")
+
+	remotePeer := new(mockRemotePeer)
+	remotePeer.On("ID").Return(ownerID)
+
+	// A block of 2 data shards of testQuotaShardSize.
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(2, 1)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	block := make([]byte, 2*(testQuotaShardSize-dataredundancy.ShardHeaderSize))
+
+	// The shards go on the first stream as their messages are received, the
+	// manifest is the second.
+	sent := 0
+	shards := make(chan []byte, numOfShards)
+	streams := 0
+	remotePeer.On("ReceiveStream", mock.Anything, mock.Anything).Return(
+		func(ctx context.Context, w io.Writer) (int64, error) {
+			streams++
+			if streams > 1 {
+				var manifest bytes.Buffer
+				err := serialize.New().Encode(&manifest, &message.CapsuleIncomingManifestStream{CapsuleID: capsuleID})
+				if err != nil {
+					return 0, err
+				}
+				return manifest.WriteTo(w)
+			}
+
+			var total int64
+			for {
+				select {
+				case shard, isOpen := <-shards:
+					if !isOpen {
+						return total, nil
+					}
+					n, err := w.Write(shard)
+					total += int64(n)
+					if err != nil {
+						return total, err
+					}
+				case <-ctx.Done():
+					return total, ctx.Err()
+				}
+			}
+		},
+	)
+
+	remotePeer.On("Receive", mock.Anything, mock.Anything).Return(
+		func(msg message.Msg, data []byte) (int, error) {
+			switch m := msg.(type) {
+			case *message.CapsuleStreamShard:
+				sent++
+				*m = message.CapsuleStreamShard{
+					ShardID:        uuid.New(),
+					CapsuleID:      capsuleID,
+					RepairGroupID:  uuid.New(),
+					DataShardNum:   2,
+					ParityShardNum: 1,
+					Size:           testQuotaShardSize,
+					IsFinal:        sent == numOfShards,
+				}
+				rand.Read(block)
+				blockShards, err := erasureCoder.Erasure(capsuleID, m.RepairGroupID, block)
+				if err != nil {
+					return 0, err
+				}
+				shards <- blockShards[0]
+				if m.IsFinal {
+					close(shards)
+				}
+				return 0, nil
+
+			case *message.CapsuleMasterKeyShare:
+				*m = message.CapsuleMasterKeyShare{CapsuleID: capsuleID, TotalShares: 3, ThresholdShares: 2}
+				return copy(data, keyShare), nil
+			}
+
+			return 0, errors.New("unexpected message")
+		},
+	)
+
+	err = s.ReceiveCapsuleStream(context.Background(), remotePeer, &message.CapsuleIncomingStream{
+		CapsuleID:    capsuleID,
+		ShardSize:    testQuotaShardSize,
+		KeyShareSize: uint8(len(keyShare)),
+		CreatedAt:    time.Now(),
+	})
+
+	return capsuleID, err
+}
+
+// assertRefused asserts err is one the remote peer is told of, with code.
+func assertRefused(t *testing.T, err error, code peererrors.Code) {
+	t.Helper()
+
+	pErr, isPErr := errors.AsType[*peererrors.PeerError](err)
+	require.True(t, isPErr, "not a peer error: %v", err)
+	assert.Equal(t, peererrors.ScopeRemotePeer, pErr.Scope())
+	assert.Equal(t, code, pErr.Code())
+}
@@ -0,0 +1,107 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/google/uuid"
+)
+
+/*
+The recovery reads a capsule we are a guardian of back once its owner went
+silent, with the master key the guardians' key shares combine into:
+
+	probe    every holder of its shards, like the repair does.
+	fetch    DataShardNum shards of a block from the holders up, ours from our
+	         CAS.
+	open     the block, rebuilt from them with blockSourceDecoder, then fetch
+	         the next one.
+	extract  the files from the archive the blocks make up.
+
+So a capsule of any size is read back with about a block of it in memory.
+
+todo: who the files go to is up to the beneficiaries feature, the caller
+hands us where to write them.
+*/
+
+// RecoverCapsule reads the capsule of capsuleID back with capsuleMasterKey and
+// writes its files to fileStore.
+func (s *service) RecoverCapsule(
+	ctx context.Context, capsuleID uuid.UUID, capsuleMasterKey []byte, fileStore ports.FileStorer,
+) error {
+	var manifest message.CapsuleIncomingManifestStream
+	isFound, err := s.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find held capsule manifest",
+			err,
+			featureCapsule,
+		)
+	}
+	if !isFound || !isRepairable(&manifest) {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("no manifest to recover capsule with ID: %s", capsuleID),
+			ErrCapsuleNotFound,
+			featureCapsule,
+		)
+	}
+
+	holders := s.probeHolders(&manifest)
+	defer func() {
+		for _, holder := range holders {
+			if holder.conn != nil {
+				holder.conn.Close()
+			}
+		}
+	}()
+
+	lost, err := s.lostShardsOf(&manifest)
+	if err != nil {
+		return err
+	}
+
+	fetchShards := func(block message.BlockManifest) ([][]byte, error) {
+		up, _ := repairGroupShards(&manifest, block.RepairGroupID, holders, lost)
+		return s.fetchRepairGroup(
+			up,
+			block.RepairGroupID,
+			int(block.DataShardNum)+int(block.ParityShardNum),
+			int(block.DataShardNum),
+		)
+	}
+
+	blockSource := NewBlockSourceDecoder(
+		capsuleMasterKey,
+		manifest.Blocks,
+		fetchShards,
+		s.NewErasureCoderFunc,
+	)
+
+	err = s.Archive.UnArchiveStream(ctx, blockSource, fileStore)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			"failed to recover capsule files",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
@@ -0,0 +1,965 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+)
+
+/*
+The repair keeps every repair group of the capsules we are a guardian of
+from losing more shards than it can. On a schedule, for every capsule we have
+the manifest of:
+
+	probe    every holder of its shards with an audit. One we can't reach or
+	         that fails is down, and so are the shards it holds.
+	lead     only the guardian with the lowest public key of the ones up
+	         repairs, the others leave the capsule to it.
+	rebuild  the missing shards of every repair group that has less than
+	         DataShardNum + SafetyMargin shards up, from DataShardNum of the
+	         ones up.
+	place    every rebuilt shard with a holder that is up and holds less
+	         than its share of the group, picked with pickRemotePeerUnder.
+	         The storage providers of RepairConfig that aren't holders yet
+	         are holders too. We keep ours, another guardian gets it with
+	         RepairStoreShard, a storage provider like from an owner.
+	update   the manifest, and send it to the other guardians up.
+
+A rebuilt shard is the same as the one that went missing, so it keeps its hash
+and Merkle root, only its holder and ShardID change. Shards of ours we only
+have the ID of are down too, see lostShardsOf, and their records are dropped
+once they are rebuilt.
+
+	repairer  RepairStoreShard, then ProviderShard + the shard
+	guardian  ProviderAck
+
+	repairer  RepairManifest
+
+Capsules from before the repair have no nonce of their blocks and no addr of
+their guardians in their manifest, they are left as they are.
+
+todo: guardians only agree on who leads when they see the same holders up, two
+of them can repair the same capsule at once. the shards end up held twice.
+todo: any guardian of a capsule can change where its shards are said to be, the
+owner should sign the manifest.
+todo: a holder that comes back still holds the shards that were moved, there is
+no message to tell it to drop them.
+todo: the owner is not told, its manifest is not kept anyway.
+*/
+
+type RepairConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	// Interval is how often the repair runs.
+	Interval time.Duration
+	// SafetyMargin is how many shards more than it needs to be rebuilt a repair
+	// group must have up, or the repair rebuilds the rest.
+	SafetyMargin int
+	// ConnectToPeer connects to the peer on addr, for the repair to reach the
+	// holders of a capsule.
+	ConnectToPeer func(addr string) (transport.RemotePeerConn, error)
+	// StorageProviders are the addrs of the storage providers rebuilt shards
+	// can go to besides the holders of a capsule. Optional.
+	StorageProviders []string
+}
+
+// RepairReport is what a repair run did.
+type RepairReport struct {
+	Capsules int
+	// Skipped is the capsules from before the repair, or another guardian
+	// leads.
+	Skipped int
+	Groups  int
+	// Degraded is the repair groups with less than DataShardNum + SafetyMargin
+	// shards up.
+	Degraded int
+	// Lost is the repair groups with less than DataShardNum shards up, they
+	// can't be rebuilt.
+	Lost    int
+	Rebuilt int // shards rebuilt and placed.
+	Took    time.Duration
+}
+
+// repairHolder is a holder of shards of a capsule, as the repair found it.
+type repairHolder struct {
+	publicKey  []byte
+	addr       string
+	isProvider bool
+	isUs       bool
+	isUp       bool
+	conn       transport.RemotePeerConn // nil when it is us or is down.
+}
+
+// repairShard is a shard of a repair group in the manifest.
+type repairShard struct {
+	shardID uuid.UUID
+	hash    [32]byte
+	size    uint32
+	holder  *repairHolder
+}
+
+// RepairCapsules runs the repair once.
+func (s *service) RepairCapsules() (RepairReport, error) {
+	began := s.Clock.Now()
+
+	capsuleIDs, err := s.DBStore.findManifestCapsuleIDs()
+	if err != nil {
+		return RepairReport{}, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"repair failed to find the capsules to repair",
+			err,
+			featureCapsule,
+		)
+	}
+
+	var (
+		report RepairReport
+		errs   []error
+	)
+	for _, capsuleID := range capsuleIDs {
+		if s.Ctx.Err() != nil {
+			break
+		}
+
+		report.Capsules++
+		// One capsule failing must not keep the rest from being repaired.
+		if err := s.repairCapsule(capsuleID, &report); err != nil {
+			errs = append(errs, fmt.Errorf("capsule %s: %w", capsuleID, err))
+		}
+	}
+
+	report.Took = s.Clock.Since(began)
+
+	if err := errors.Join(errs...); err != nil {
+		return report, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"repair failed",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return report, nil
+}
+
+func (s *service) repairCapsule(capsuleID uuid.UUID, report *RepairReport) error {
+	var manifest message.CapsuleIncomingManifestStream
+	isFound, err := s.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+	if err != nil {
+		return err
+	}
+	if !isFound || !isRepairable(&manifest) {
+		report.Skipped++
+		return nil
+	}
+
+	holders := s.probeHolders(&manifest)
+	defer func() {
+		for _, holder := range holders {
+			if holder.conn != nil {
+				holder.conn.Close()
+			}
+		}
+	}()
+
+	lost, err := s.lostShardsOf(&manifest)
+	if err != nil {
+		return err
+	}
+
+	if !s.isRepairLeader(holders) {
+		report.Skipped++
+		return nil
+	}
+	s.addNewHolders(manifest.CapsuleID, holders)
+
+	var (
+		replaced = make(map[uuid.UUID]bool)
+		errs     []error
+	)
+	for i, block := range manifest.Blocks {
+		report.Groups++
+		if err := s.repairGroup(&manifest, i, block, holders, lost, replaced, report); err != nil {
+			errs = append(errs, fmt.Errorf("repair group %s: %w", block.RepairGroupID, err))
+		}
+	}
+
+	if len(replaced) == 0 {
+		return errors.Join(errs...)
+	}
+
+	manifest.Shards = slices.DeleteFunc(manifest.Shards, func(sm message.ShardManifest) bool {
+		return replaced[sm.ShardID]
+	})
+	manifest.ProviderShards = slices.DeleteFunc(manifest.ProviderShards, func(ps message.ProviderShardManifest) bool {
+		return replaced[ps.ShardID]
+	})
+
+	if err := s.DBStore.createOrUpdate(database.CollCapsuleManifests, capsuleID.String(), &manifest); err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+
+	for shardID := range lost {
+		if !replaced[shardID] {
+			continue
+		}
+		if err := s.DBStore.delete(database.CollCapsulesActiveShards, shardID.String()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// The other guardians keep theirs if they don't get it, they only need it
+	// to repair or recover, and another repair sends it again.
+	for _, holder := range holders {
+		if holder.conn == nil || holder.isProvider {
+			continue
+		}
+		if _, err := holder.conn.Send(&message.RepairManifest{Manifest: manifest}, nil); err != nil {
+			s.Logger.Warn("failed to send repaired manifest", "capsuleID", capsuleID, "addr", holder.addr, "err", err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isRepairable tells if manifest has what the repair needs, manifests from
+// before it don't.
+func isRepairable(manifest *message.CapsuleIncomingManifestStream) bool {
+	if len(manifest.Shards) == 0 {
+		return false
+	}
+	for _, block := range manifest.Blocks {
+		if len(block.Nonce) == 0 {
+			return false
+		}
+	}
+	for _, sm := range manifest.Shards {
+		if sm.GuardianAddr == "" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// probeHolders finds which holders of the shards of manifest are up, and
+// keeps the conns to the ones that are. A probe is an audit, so it counts
+// towards their reliability too.
+func (s *service) probeHolders(manifest *message.CapsuleIncomingManifestStream) map[string]*repairHolder {
+	holders := make(map[string]*repairHolder)
+	add := func(publicKey []byte, addr string, isProvider bool) {
+		if _, isFound := holders[string(publicKey)]; !isFound {
+			holders[string(publicKey)] = &repairHolder{
+				publicKey:  publicKey,
+				addr:       addr,
+				isProvider: isProvider,
+				isUs:       bytes.Equal(publicKey, s.PublicKey),
+			}
+		}
+	}
+	for _, sm := range manifest.Shards {
+		add(sm.GuardianPublicKey, sm.GuardianAddr, false)
+	}
+	for _, ps := range manifest.ProviderShards {
+		add(ps.ProviderPublicKey, ps.ProviderAddr, true)
+	}
+
+	for _, holder := range holders {
+		if holder.isUs {
+			holder.isUp = true
+			continue
+		}
+
+		conn, err := s.Repair.ConnectToPeer(holder.addr)
+		if err != nil {
+			s.Logger.Info("holder is down", "capsuleID", manifest.CapsuleID, "addr", holder.addr, "err", err)
+			continue
+		}
+
+		// SECURITY: Whoever is on the addr now might not be the holder the
+		// shards were put with.
+		if !bytes.Equal(conn.PublicKey(), holder.publicKey) {
+			s.Logger.Warn("peer on holder addr is not the holder", "capsuleID", manifest.CapsuleID, "addr", holder.addr)
+			conn.Close()
+			continue
+		}
+
+		report, err := s.AuditHolder(s.Ctx, manifest.CapsuleID, conn)
+		if err != nil || report.Failed > 0 {
+			s.Logger.Info("holder failed repair probe", "capsuleID", manifest.CapsuleID, "addr", holder.addr, "err", err)
+			conn.Close()
+			continue
+		}
+
+		holder.isUp = true
+		holder.conn = conn
+	}
+
+	return holders
+}
+
+// addNewHolders adds the storage providers of the repair that don't hold
+// shards of the capsule yet to holders, the ones that are up.
+func (s *service) addNewHolders(capsuleID uuid.UUID, holders map[string]*repairHolder) {
+	for _, addr := range s.Repair.StorageProviders {
+		isHolder := false
+		for _, holder := range holders {
+			isHolder = isHolder || holder.addr == addr
+		}
+		if isHolder {
+			continue
+		}
+
+		conn, err := s.Repair.ConnectToPeer(addr)
+		if err != nil {
+			s.Logger.Info("storage provider is down", "capsuleID", capsuleID, "addr", addr, "err", err)
+			continue
+		}
+		if _, isFound := holders[string(conn.PublicKey())]; isFound || bytes.Equal(conn.PublicKey(), s.PublicKey) {
+			conn.Close()
+			continue
+		}
+
+		holders[string(conn.PublicKey())] = &repairHolder{
+			publicKey:  conn.PublicKey(),
+			addr:       addr,
+			isProvider: true,
+			isUp:       true,
+			conn:       conn,
+		}
+	}
+}
+
+// isRepairLeader tells if we lead the repair of a capsule, which is when we
+// have the lowest public key of its guardians that are up. We must hold shards
+// of it too, the other guardians only take a repair from one that does.
+func (s *service) isRepairLeader(holders map[string]*repairHolder) bool {
+	if us, isFound := holders[string(s.PublicKey)]; !isFound || us.isProvider {
+		return false
+	}
+
+	for _, holder := range holders {
+		if holder.isUp && !holder.isProvider && bytes.Compare(holder.publicKey, s.PublicKey) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// repairGroup rebuilds the missing shards of the repair group of block, the
+// blockIndex-th of manifest, if it has too few up. The rebuilt shards are
+// added to manifest, and the ShardIDs of the ones they replace to replaced.
+func (s *service) repairGroup(
+	manifest *message.CapsuleIncomingManifestStream,
+	blockIndex int,
+	block message.BlockManifest,
+	holders map[string]*repairHolder,
+	lost map[uuid.UUID]bool,
+	replaced map[uuid.UUID]bool,
+	report *RepairReport,
+) error {
+	up, down := repairGroupShards(manifest, block.RepairGroupID, holders, lost)
+
+	dataShards, parityShards := int(block.DataShardNum), int(block.ParityShardNum)
+	switch {
+	case len(down) == 0 || len(up) >= dataShards+s.Repair.SafetyMargin:
+		return nil
+	case len(up) < dataShards:
+		report.Lost++
+		s.Logger.Error(
+			"repair group is lost",
+			"capsuleID", manifest.CapsuleID,
+			"repairGroupID", block.RepairGroupID,
+			"up", len(up),
+			"needed", dataShards,
+		)
+		return nil
+	}
+	report.Degraded++
+
+	// Every holder up gets the same share of the group, like the owner placed
+	// it, so losing any one of them loses no more of it than before, see
+	// ErasureProfileFor. One that holds its share already gets none.
+	var (
+		candidates = make([]transport.RemotePeer, 0, len(holders))
+		holderOf   = make(map[transport.RemotePeer]*repairHolder, len(holders))
+		candidate  = make(map[*repairHolder]transport.RemotePeer, len(holders))
+		shardsOf   = make(map[uuid.UUID]int, len(holders))
+	)
+	for _, holder := range holders {
+		if !holder.isUp {
+			continue
+		}
+		var c transport.RemotePeer = holder.conn
+		if holder.isUs {
+			c = selfCandidate{id: uuid.New()}
+		}
+		candidates = append(candidates, c)
+		holderOf[c] = holder
+		candidate[holder] = c
+	}
+	for _, shard := range up {
+		shardsOf[candidate[shard.holder].ID()]++
+	}
+	share := (dataShards + parityShards + len(candidates) - 1) / len(candidates)
+
+	room := 0
+	for _, candidate := range candidates {
+		room += max(share-shardsOf[candidate.ID()], 0)
+	}
+	if room < len(down) {
+		return fmt.Errorf(
+			"%d shards to place and room for %d with the holders up under their share of %d",
+			len(down),
+			room,
+			share,
+		)
+	}
+
+	shards, err := s.fetchRepairGroup(up, block.RepairGroupID, dataShards+parityShards, dataShards)
+	if err != nil {
+		return err
+	}
+
+	erasureCoder, err := s.NewErasureCoderFunc(dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	shards, err = erasureCoder.Repair(shards)
+	if err != nil {
+		return err
+	}
+
+	rebuilt := make(map[[32]byte][]byte, len(shards))
+	for _, shard := range shards {
+		rebuilt[sha256.Sum256(shard)] = shard
+	}
+
+	var errs []error
+	for _, missing := range down {
+		shard, isFound := rebuilt[missing.hash]
+		if !isFound {
+			errs = append(errs, fmt.Errorf("no shard rebuilt is of hash %x", missing.hash))
+			continue
+		}
+
+		header, err := dataredundancy.ParseShardHeader(shard)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		picked := pickRemotePeerUnder(uint64(blockIndex), int(header.Index), candidates, shardsOf, share)
+		if picked == nil {
+			errs = append(errs, fmt.Errorf("every holder up holds its share of %d", share))
+			break
+		}
+		holder := holderOf[picked]
+		switch {
+		case holder.isUs:
+			sm, err := s.keepRepairShard(holder, manifest.CapsuleID, block, shard)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			manifest.Shards = append(manifest.Shards, sm)
+
+		case holder.isProvider:
+			ps, err := storeWithProvider(holder.conn, shard)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			ps.ShardID = uuid.New()
+			ps.RepairGroupID = block.RepairGroupID
+			ps.Nonce = block.Nonce
+			manifest.ProviderShards = append(manifest.ProviderShards, ps)
+
+		default:
+			sm, err := storeWithGuardian(holder, manifest.CapsuleID, block, shard)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			manifest.Shards = append(manifest.Shards, sm)
+		}
+
+		shardsOf[picked.ID()]++
+		replaced[missing.shardID] = true
+		report.Rebuilt++
+	}
+
+	return errors.Join(errs...)
+}
+
+// selfCandidate stands in for us among the holders pickRemotePeerUnder picks
+// from, only its ID is ever called.
+type selfCandidate struct {
+	transport.RemotePeer
+	id uuid.UUID
+}
+
+func (c selfCandidate) ID() uuid.UUID {
+	return c.id
+}
+
+// repairGroupShards splits the shards of the repair group of repairGroupID in
+// manifest into the ones with holders up and the ones with holders down. The
+// lost ones of ours are down.
+func repairGroupShards(
+	manifest *message.CapsuleIncomingManifestStream,
+	repairGroupID uuid.UUID,
+	holders map[string]*repairHolder,
+	lost map[uuid.UUID]bool,
+) (up, down []repairShard) {
+	for _, sm := range manifest.Shards {
+		if sm.RepairGroupID == repairGroupID {
+			shard := repairShard{sm.ShardID, sm.Hash, sm.Size, holders[string(sm.GuardianPublicKey)]}
+			if shard.holder.isUp && !lost[sm.ShardID] {
+				up = append(up, shard)
+			} else {
+				down = append(down, shard)
+			}
+		}
+	}
+	for _, ps := range manifest.ProviderShards {
+		if ps.RepairGroupID == repairGroupID {
+			shard := repairShard{ps.ShardID, ps.Hash, ps.Size, holders[string(ps.ProviderPublicKey)]}
+			if shard.holder.isUp {
+				up = append(up, shard)
+			} else {
+				down = append(down, shard)
+			}
+		}
+	}
+
+	return up, down
+}
+
+// lostShardsOf finds the shards of manifest we are said to hold but only have
+// the ID of, the ones migrateShardMetaData marked lost.
+func (s *service) lostShardsOf(manifest *message.CapsuleIncomingManifestStream) (map[uuid.UUID]bool, error) {
+	lost := make(map[uuid.UUID]bool)
+	for _, sm := range manifest.Shards {
+		if !bytes.Equal(sm.GuardianPublicKey, s.PublicKey) {
+			continue
+		}
+
+		var held shardMetaData
+		isFound, err := s.DBStore.find(database.CollCapsulesActiveShards, sm.ShardID.String(), &held)
+		if err != nil {
+			return nil, err
+		}
+		if isFound && held.isLost {
+			lost[sm.ShardID] = true
+		}
+	}
+
+	return lost, nil
+}
+
+// fetchRepairGroup fetches needed of the shards up of a repair group of total
+// shards. The shards are at their index, the rest are nil.
+func (s *service) fetchRepairGroup(up []repairShard, repairGroupID uuid.UUID, total, needed int) ([][]byte, error) {
+	var (
+		shards  = make([][]byte, total)
+		fetched int
+	)
+	for _, shard := range up {
+		if fetched == needed {
+			break
+		}
+
+		var (
+			data []byte
+			err  error
+		)
+		if shard.holder.isUs {
+			data, err = s.findShard(shard.hash)
+			if err == nil && sha256.Sum256(data) != shard.hash {
+				err = ErrObjectCorrupted
+			}
+		} else {
+			data, err = fetchShard(shard.holder.conn, shard.hash, shard.size)
+		}
+		if err != nil {
+			// Another shard of the group does just as well.
+			s.Logger.Warn("failed to fetch shard to repair with", "hash", fmt.Sprintf("%x", shard.hash), "err", err)
+			continue
+		}
+
+		header, err := dataredundancy.ParseShardHeader(data)
+		if err != nil || header.RepairGroupID != repairGroupID || int(header.Index) >= total || shards[header.Index] != nil {
+			s.Logger.Warn("shard to repair with has a bad header", "hash", fmt.Sprintf("%x", shard.hash), "err", err)
+			continue
+		}
+
+		shards[header.Index] = data
+		fetched++
+	}
+
+	if fetched < needed {
+		return nil, fmt.Errorf("fetched %d shards of the %d needed to rebuild", fetched, needed)
+	}
+
+	return shards, nil
+}
+
+// storeWithGuardian puts shard, a shard of the repair group of block rebuilt
+// by the repair, with the guardian holder, and returns where it is for the
+// manifest.
+func storeWithGuardian(
+	holder *repairHolder, capsuleID uuid.UUID, block message.BlockManifest, shard []byte,
+) (message.ShardManifest, error) {
+	msg := newRepairStoreShard(capsuleID, block, shard)
+
+	if _, err := holder.conn.Send(msg, nil); err != nil {
+		return message.ShardManifest{}, err
+	}
+	if _, err := holder.conn.Send(&message.ProviderShard{Hash: msg.Hash, Size: msg.Size}, shard); err != nil {
+		return message.ShardManifest{}, err
+	}
+
+	if err := receiveProviderAck(holder.conn, msg.Hash); err != nil {
+		return message.ShardManifest{}, err
+	}
+
+	return repairShardManifest(msg, shard, holder), nil
+}
+
+// keepRepairShard is storeWithGuardian for when the guardian is us.
+func (s *service) keepRepairShard(
+	holder *repairHolder, capsuleID uuid.UUID, block message.BlockManifest, shard []byte,
+) (message.ShardManifest, error) {
+	msg := newRepairStoreShard(capsuleID, block, shard)
+
+	if err := s.saveRepairShard(msg, shard); err != nil {
+		return message.ShardManifest{}, err
+	}
+
+	return repairShardManifest(msg, shard, holder), nil
+}
+
+func newRepairStoreShard(capsuleID uuid.UUID, block message.BlockManifest, shard []byte) *message.RepairStoreShard {
+	return &message.RepairStoreShard{
+		CapsuleID:      capsuleID,
+		ShardID:        uuid.New(),
+		RepairGroupID:  block.RepairGroupID,
+		Hash:           sha256.Sum256(shard),
+		Size:           uint32(len(shard)),
+		Nonce:          block.Nonce,
+		DataShardNum:   block.DataShardNum,
+		ParityShardNum: block.ParityShardNum,
+	}
+}
+
+func repairShardManifest(msg *message.RepairStoreShard, shard []byte, holder *repairHolder) message.ShardManifest {
+	return message.ShardManifest{
+		ShardID:           msg.ShardID,
+		RepairGroupID:     msg.RepairGroupID,
+		Hash:              msg.Hash,
+		Size:              msg.Size,
+		MerkleRoot:        merkleRoot(shard),
+		GuardianPublicKey: holder.publicKey,
+		GuardianAddr:      holder.addr,
+	}
+}
+
+func (s *service) ReceiveRepairShard(
+	ctx context.Context, remotePeer transport.RemotePeer, msg *message.RepairStoreShard,
+) error {
+	if msg == nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"received nil repair store shard message",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	return s.ackProvider(remotePeer, msg.Hash, s.storeRepairShard(remotePeer, msg))
+}
+
+func (s *service) storeRepairShard(remotePeer transport.RemotePeer, msg *message.RepairStoreShard) error {
+	if msg.Size == 0 || msg.Size > message.MaxChunkDataSize {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard size %d is not between 1 and %d", msg.Size, message.MaxChunkDataSize),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	// NOTICE IMPORTANT: The shard is read before anything is checked, or it is
+	// left on the conn and read as the next message.
+	var (
+		shardMsg message.ProviderShard
+		shard    = make([]byte, msg.Size)
+	)
+	n, err := remotePeer.Receive(&shardMsg, shard)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.ErrBadRequest,
+			"failed to receive repaired shard",
+			err,
+			featureCapsule,
+		)
+	}
+	shard = shard[:n]
+
+	switch {
+	case shardMsg.Hash != msg.Hash || sha256.Sum256(shard) != msg.Hash:
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard is not the one of hash %x", msg.Hash),
+			nil,
+			featureCapsule,
+		)
+	case msg.DataShardNum == 0 || msg.ParityShardNum == 0:
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			"invalid erasure coding parameters: data or parity shard count is zero",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	err = checkShardHeader(shard, msg.CapsuleID, msg.RepairGroupID, msg.DataShardNum, msg.ParityShardNum)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.findRepairedCapsule(remotePeer, msg.CapsuleID)
+	if err != nil {
+		return err
+	}
+
+	// A rebuilt shard is admitted under the quotas of the owner of the
+	// capsule, like the shards it sent us.
+	admission, err := s.admitCapsule(c.OwnerID)
+	if err != nil {
+		return err
+	}
+	defer admission.done()
+
+	if err := admission.admitShard(int64(n)); err != nil {
+		return err
+	}
+
+	return s.saveRepairShard(msg, shard)
+}
+
+// saveRepairShard keeps shard, rebuilt by the repair, with its metadata.
+func (s *service) saveRepairShard(msg *message.RepairStoreShard, shard []byte) error {
+	uow := newUnitOfWork(s.FileStore, s.DBStore, s.Clock.Now)
+	if err := uow.saveCAS(msg.Hash, shard); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to save repaired shard to CAS",
+			errors.Join(err, uow.rollback()),
+			featureCapsule,
+		)
+	}
+
+	uow.createOrUpdate(
+		database.CollCapsulesActiveShards,
+		msg.ShardID.String(),
+		shardMetaData{
+			capsuleID:      msg.CapsuleID,
+			shardID:        msg.ShardID,
+			repairGroupID:  msg.RepairGroupID,
+			hash:           msg.Hash,
+			nonce:          msg.Nonce,
+			size:           uint32(len(shard)),
+			dataShardNum:   msg.DataShardNum,
+			parityShardNum: msg.ParityShardNum,
+		},
+	)
+	if err := uow.commit(); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			fmt.Sprintf("failed to store repaired shard '%s' of capsule '%s'", msg.ShardID, msg.CapsuleID),
+			err,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
+
+func (s *service) ReceiveRepairManifest(
+	ctx context.Context, remotePeer transport.RemotePeer, msg *message.RepairManifest,
+) error {
+	if msg == nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"received nil repair manifest message",
+			nil,
+			featureCapsule,
+		)
+	}
+
+	if _, err := s.findRepairedCapsule(remotePeer, msg.Manifest.CapsuleID); err != nil {
+		return err
+	}
+
+	var current message.CapsuleIncomingManifestStream
+	_, err := s.DBStore.find(database.CollCapsuleManifests, msg.Manifest.CapsuleID.String(), &current)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find capsule manifest to repair",
+			err,
+			featureCapsule,
+		)
+	}
+
+	// A repair moves shards, it never changes the blocks.
+	isSameBlocks := slices.EqualFunc(current.Blocks, msg.Manifest.Blocks, func(a, b message.BlockManifest) bool {
+		return a.RepairGroupID == b.RepairGroupID
+	})
+	if !isSameBlocks || current.TotalBlocks != msg.Manifest.TotalBlocks {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("repaired manifest of capsule %s is not of the same blocks", msg.Manifest.CapsuleID),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	err = s.DBStore.createOrUpdate(database.CollCapsuleManifests, msg.Manifest.CapsuleID.String(), &msg.Manifest)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to store repaired capsule manifest",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
+
+// findRepairedCapsule finds the capsule of capsuleID for a repair remotePeer
+// asks of us. We must be a guardian of the capsule, and remotePeer must be one
+// that holds shards of it.
+func (s *service) findRepairedCapsule(remotePeer transport.RemotePeer, capsuleID uuid.UUID) (*capsule, error) {
+	var c capsule
+	isFound, err := s.DBStore.find(database.CollCapsules, capsuleID.String(), &c)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find capsule to repair",
+			err,
+			featureCapsule,
+		)
+	}
+	if !isFound {
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrNotGuardian,
+			fmt.Sprintf("we are not a guardian of capsule %s", capsuleID),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	var manifest message.CapsuleIncomingManifestStream
+	_, err = s.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find capsule manifest to repair",
+			err,
+			featureCapsule,
+		)
+	}
+
+	// SECURITY: Only the guardians of a capsule repair it.
+	isGuardian := slices.ContainsFunc(manifest.Shards, func(sm message.ShardManifest) bool {
+		return bytes.Equal(sm.GuardianPublicKey, remotePeer.PublicKey())
+	})
+	if !isGuardian {
+		return nil, peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrNotGuardian,
+			fmt.Sprintf("remote peer is not a guardian of capsule %s", capsuleID),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	return &c, nil
+}
+
+// StartRepair runs the repair every Repair.Interval till Ctx is done.
+func (s *service) StartRepair() {
+	s.Shutdown.Add(1)
+	go func() {
+		defer s.Shutdown.Done()
+
+		ticker := s.Clock.NewTicker(s.Repair.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.Ctx.Done():
+				return
+
+			case <-ticker.C():
+				report, err := s.RepairCapsules()
+				if err != nil {
+					s.Logger.Error("repair failed", "err", err)
+				}
+
+				s.Logger.Info(
+					"repair done",
+					"capsules", report.Capsules,
+					"skipped", report.Skipped,
+					"groups", report.Groups,
+					"degraded", report.Degraded,
+					"lost", report.Lost,
+					"rebuilt", report.Rebuilt,
+					"took", report.Took,
+				)
+			}
+		}
+	}()
+}
@@ -0,0 +1,280 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/dataredundancy"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRepair(t *testing.T) {
+	dbStores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt: func(t *testing.T) dbStorer {
+			db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+			require.NoError(t, err)
+			t.Cleanup(func() { db.Close() })
+			return NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+		},
+	}
+
+	quota := &QuotaConfig{
+		MaxBytesPerOwner:    1 << 20,
+		MaxBytesTotal:       1 << 20,
+		MaxShardsPerCapsule: 8,
+	}
+
+	for driver, newDBStore := range dbStores {
+		t.Run(driver, func(t *testing.T) {
+			const dataShards, parityShards = 4, 2
+
+			// repairer is us, a guardian holding the first 3 shards. holder is
+			// another guardian, up and holding the next 2, reached over link.
+			// The last shard is with a guardian that is down.
+			repairer := newTestQuotaService(t, newDBStore(t), quota)
+			repairer.PublicKey = []byte("guardian")
+			repairer.NewErasureCoderFunc = dataredundancy.NewReedSolomonCoder
+			holder := newTestQuotaService(t, newDBStore(t), quota)
+
+			link := newTestProviderLink(t, holder, uuid.New())
+			link.serveAll = true
+			link.owner.On("PublicKey").Return([]byte("guardian"))
+			link.provider.On("Close").Return(nil)
+
+			peers := map[string]transport.RemotePeerConn{link.provider.Addr().String(): link.provider}
+			repairer.Repair = &RepairConfig{
+				SafetyMargin: parityShards,
+				ConnectToPeer: func(addr string) (transport.RemotePeerConn, error) {
+					if conn, isFound := peers[addr]; isFound {
+						return conn, nil
+					}
+					return nil, errors.New("peer is down")
+				},
+			}
+
+			erasureCoder, err := dataredundancy.NewReedSolomonCoder(dataShards, parityShards)
+			require.NoError(t, err)
+			block := make([]byte, 3*message.AuditLeafSize)
+			rand.Read(block)
+			capsuleID, repairGroupID := uuid.New(), uuid.New()
+			shards, err := erasureCoder.Erasure(capsuleID, repairGroupID, block)
+			require.NoError(t, err)
+
+			manifest := &message.CapsuleIncomingManifestStream{
+				CapsuleID:   capsuleID,
+				TotalBlocks: 1,
+				Blocks: []message.BlockManifest{{
+					RepairGroupID:  repairGroupID,
+					DataShardNum:   dataShards,
+					ParityShardNum: parityShards,
+					Nonce:          []byte("nonce"),
+				}},
+			}
+			for i, shard := range shards {
+				sm := message.ShardManifest{
+					ShardID:           uuid.New(),
+					RepairGroupID:     manifest.Blocks[0].RepairGroupID,
+					Hash:              sha256.Sum256(shard),
+					Size:              uint32(len(shard)),
+					MerkleRoot:        merkleRoot(shard),
+					GuardianPublicKey: []byte("guardian"),
+					GuardianAddr:      "127.0.0.1:4041",
+				}
+				switch {
+				case i < 3:
+					require.NoError(t, repairer.FileStore.SaveCAS(sm.Hash, shard))
+				case i < 5:
+					sm.GuardianPublicKey, sm.GuardianAddr = []byte("provider"), link.provider.Addr().String()
+					require.NoError(t, holder.FileStore.SaveCAS(sm.Hash, shard))
+				default:
+					sm.GuardianPublicKey, sm.GuardianAddr = []byte("down"), "127.0.0.1:4042"
+				}
+				manifest.Shards = append(manifest.Shards, sm)
+			}
+
+			for _, s := range []*service{repairer, holder} {
+				require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{
+					OwnerID:   uuid.New(),
+					CreatedAt: time.Now(),
+				}))
+				require.NoError(t, s.DBStore.createOrUpdate(database.CollCapsuleManifests, capsuleID.String(), manifest))
+			}
+
+			report, err := repairer.RepairCapsules()
+			require.NoError(t, err)
+			assert.Equal(t, 1, report.Degraded)
+			assert.Equal(t, 1, report.Rebuilt)
+			assert.Zero(t, report.Lost)
+
+			var repaired message.CapsuleIncomingManifestStream
+			_, err = repairer.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &repaired)
+			require.NoError(t, err)
+			require.Len(t, repaired.Shards, len(shards))
+			moved := repaired.Shards[len(shards)-1]
+			assert.Equal(t, manifest.Shards[len(shards)-1].Hash, moved.Hash)
+			assert.Equal(t, manifest.Shards[len(shards)-1].MerkleRoot, moved.MerkleRoot)
+			assert.Equal(t, []byte("provider"), []byte(moved.GuardianPublicKey))
+			assert.Equal(t, link.provider.Addr().String(), moved.GuardianAddr)
+
+			// Both holders up hold their share of 3, the holder down none.
+			held := make(map[string]int)
+			for _, sm := range repaired.Shards {
+				held[string(sm.GuardianPublicKey)]++
+			}
+			assert.Equal(t, map[string]int{"guardian": 3, "provider": 3}, held)
+
+			// The holder keeps the rebuilt shard like one from the owner, and
+			// gets the repaired manifest.
+			heldShards, err := holder.DBStore.findShardsByRepairGroup(manifest.Blocks[0].RepairGroupID)
+			require.NoError(t, err)
+			require.Len(t, heldShards, 1)
+			assert.Equal(t, moved.ShardID, heldShards[0].shardID)
+			assert.Equal(t, moved.Hash, heldShards[0].hash)
+			assert.Equal(t, []byte("nonce"), heldShards[0].nonce)
+
+			assert.Eventually(t, func() bool {
+				var got message.CapsuleIncomingManifestStream
+				_, err := holder.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &got)
+				return err == nil && len(got.Shards) == len(shards) && got.Shards[len(shards)-1].ShardID == moved.ShardID
+			}, 5*time.Second, 10*time.Millisecond)
+
+			t.Run("healthy group is left alone", func(t *testing.T) {
+				report, err := repairer.RepairCapsules()
+				require.NoError(t, err)
+				assert.Zero(t, report.Degraded)
+				assert.Zero(t, report.Rebuilt)
+			})
+
+			// markLost leaves the shard of ours like migrateShardMetaData does
+			// one it only got the ID of.
+			markLost := func(t *testing.T, ours message.ShardManifest) {
+				t.Helper()
+
+				if driver != storage.DriverBBolt {
+					t.Skip("only bbolt kept shards as {}")
+				}
+				require.NoError(t, repairer.DBStore.createOrUpdate(
+					database.CollCapsulesActiveShards,
+					ours.ShardID.String(),
+					&shardMetaData{shardID: ours.ShardID, isLost: true},
+				))
+			}
+			findRepaired := func(t *testing.T) message.CapsuleIncomingManifestStream {
+				t.Helper()
+
+				var got message.CapsuleIncomingManifestStream
+				_, err := repairer.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &got)
+				require.NoError(t, err)
+				return got
+			}
+
+			t.Run("lost shard of ours is rebuilt", func(t *testing.T) {
+				ours := repaired.Shards[0]
+				markLost(t, ours)
+
+				// The holder up holds its share, we are under ours and keep it.
+				report, err := repairer.RepairCapsules()
+				require.NoError(t, err)
+				assert.Equal(t, 1, report.Rebuilt)
+
+				exists, err := repairer.DBStore.find(database.CollCapsulesActiveShards, ours.ShardID.String(), &shardMetaData{})
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				got := findRepaired(t)
+				require.Len(t, got.Shards, len(shards))
+				for _, sm := range got.Shards {
+					assert.NotEqual(t, ours.ShardID, sm.ShardID)
+				}
+				kept := got.Shards[len(shards)-1]
+				assert.Equal(t, ours.Hash, kept.Hash)
+				assert.Equal(t, []byte("guardian"), []byte(kept.GuardianPublicKey))
+
+				shard, err := repairer.findShard(kept.Hash)
+				require.NoError(t, err)
+				assert.Equal(t, kept.Hash, sha256.Sum256(shard))
+			})
+
+			t.Run("new storage provider takes what the holders up can't", func(t *testing.T) {
+				ours := findRepaired(t).Shards[0]
+				require.Equal(t, []byte("guardian"), []byte(ours.GuardianPublicKey))
+				markLost(t, ours)
+
+				newProvider := newTestQuotaService(t, newDBStore(t), quota)
+				newProvider.IsStorageProvider = true
+				newLink := newTestProviderLink(t, newProvider, uuid.New())
+				newLink.serveAll = true
+				newLink.provider.ExpectedCalls = slices.DeleteFunc(newLink.provider.ExpectedCalls, func(c *mock.Call) bool {
+					return c.Method == "PublicKey" || c.Method == "Addr"
+				})
+				newLink.provider.On("PublicKey").Return([]byte("new-provider"))
+				newLink.provider.On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4043})
+				newLink.provider.On("Close").Return(nil)
+				peers["127.0.0.1:4043"] = newLink.provider
+				repairer.Repair.StorageProviders = []string{"127.0.0.1:4043"}
+				defer func() { repairer.Repair.StorageProviders = nil }()
+
+				// With 3 holders up the share is 2: we are left with 2 and the
+				// holder has 3, only the new provider is under it.
+				report, err := repairer.RepairCapsules()
+				require.NoError(t, err)
+				assert.Equal(t, 1, report.Rebuilt)
+
+				got := findRepaired(t)
+				require.Len(t, got.Shards, len(shards)-1)
+				require.Len(t, got.ProviderShards, 1)
+				assert.Equal(t, []byte("new-provider"), []byte(got.ProviderShards[0].ProviderPublicKey))
+				assert.Equal(t, ours.Hash, got.ProviderShards[0].Hash)
+
+				held := make(map[string]int)
+				for _, sm := range got.Shards {
+					held[string(sm.GuardianPublicKey)]++
+				}
+				assert.Equal(t, map[string]int{"guardian": 2, "provider": 3}, held, "the holders up got none")
+			})
+
+			t.Run("only guardians of the capsule repair it", func(t *testing.T) {
+				stranger := new(mockRemotePeer)
+				stranger.On("PublicKey").Return([]byte("stranger"))
+
+				_, err := holder.findRepairedCapsule(stranger, capsuleID)
+				assertRefused(t, err, peererrors.ErrNotGuardian)
+
+				_, err = holder.findRepairedCapsule(link.owner, uuid.New())
+				assertRefused(t, err, peererrors.ErrNotGuardian)
+			})
+
+			t.Run("repaired manifest of other blocks is refused", func(t *testing.T) {
+				other := *manifest
+				other.Blocks = []message.BlockManifest{{RepairGroupID: uuid.New(), DataShardNum: dataShards, ParityShardNum: parityShards}}
+
+				err := holder.ReceiveRepairManifest(context.Background(), link.owner, &message.RepairManifest{Manifest: other})
+				assertRefused(t, err, peererrors.ErrBadRequest)
+			})
+		})
+	}
+}
@@ -8,16 +8,20 @@
 package capsule
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"sync"
 	"time"
 
 	"github.com/engr-sjb/diogel/internal/archive"
+	"github.com/engr-sjb/diogel/internal/clock"
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/dataredundancy"
 	"github.com/engr-sjb/diogel/internal/features"
@@ -33,6 +37,7 @@ import (
 var (
 	ErrInvalidGuardiansCount    = errors.New("invalid guardians count")
 	ErrInvalidCreateCapsuleData = errors.New("invalid create capsule data")
+	ErrCapsuleNotFound          = errors.New("capsule not found")
 )
 
 const (
@@ -49,11 +54,15 @@ const (
 
 	bufSize = 1 << 15 //32kb
 
+	// dataShardNum and parityShardNum are the DefaultErasureProfile.
 	dataShardNum   int = 32
 	parityShardNum int = 22
 
 	blockSinkBufSize = 1 << 20 // 1mb
-	maxShardSize     = blockSinkBufSize / (dataShardNum + parityShardNum)
+
+	// maxManifestSize is the most of a manifest a guardian takes from the
+	// owner's stream.
+	maxManifestSize = 64 << 20 // 64mb
 )
 
 type servicer interface {
@@ -66,6 +75,49 @@ type servicer interface {
 		ctx context.Context, remotePeer transport.RemotePeer, msg message.CapsuleReStream,
 	) error
 	GetDefaults() Defaults // GetDefaults retrieves default values of this service.
+	// GetHeldCapsule returns what we hold of a capsule we are a guardian of.
+	GetHeldCapsule(capsuleID uuid.UUID) (*HeldCapsuleDTO, error)
+	// ReceiveProviderShard holds a shard an owner puts with us as a storage
+	// provider.
+	ReceiveProviderShard(ctx context.Context, remotePeer transport.RemotePeer, msg *message.ProviderStoreShard) error
+	// SendProviderShard sends a shard we hold as a storage provider to whoever
+	// asks for it.
+	SendProviderShard(ctx context.Context, remotePeer transport.RemotePeer, msg *message.ProviderFetchShard) error
+	// FetchProviderShard fetches a shard of a capsule we are a guardian of
+	// back from the storage provider it was put with.
+	FetchProviderShard(ctx context.Context, provider transport.RemotePeer, shard message.ProviderShardManifest) ([]byte, error)
+	// AuditHolder has holder prove it still holds its shards of a capsule we
+	// are a guardian of, and keeps how it did.
+	AuditHolder(ctx context.Context, capsuleID uuid.UUID, holder transport.RemotePeer) (*AuditReportDTO, error)
+	// AnswerAudit proves to whoever asks that we hold a shard.
+	AnswerAudit(ctx context.Context, remotePeer transport.RemotePeer, msg *message.AuditChallenge) error
+	// GetReliability is how the holder of publicKeyStr did in our audits.
+	GetReliability(publicKeyStr customcrypto.PublicKeyStr) (*ReliabilityDTO, error)
+	// RecoverUnfinishedWrites finishes or drops the writes a crash or kill
+	// left half done. Run it on start, before anything else writes.
+	RecoverUnfinishedWrites() (finished, dropped int, err error)
+	// CollectGarbage deletes the objects in the CAS no shard has anymore.
+	CollectGarbage() (GCReport, error)
+	// StartGC runs CollectGarbage on a schedule till the service's Ctx is done.
+	StartGC()
+	// RepairCapsules rebuilds the shards the capsules we are a guardian of
+	// lost with their holders, when too few of a repair group are left.
+	RepairCapsules() (RepairReport, error)
+	// StartRepair runs RepairCapsules on a schedule till the service's Ctx is
+	// done.
+	StartRepair()
+	// ReceiveRepairShard holds a shard the repair of another guardian rebuilt.
+	ReceiveRepairShard(ctx context.Context, remotePeer transport.RemotePeer, msg *message.RepairStoreShard) error
+	// ReceiveRepairManifest keeps the manifest the repair of another guardian
+	// changed instead of ours.
+	ReceiveRepairManifest(ctx context.Context, remotePeer transport.RemotePeer, msg *message.RepairManifest) error
+	// RecoverCapsule reads a capsule we are a guardian of back with its master
+	// key, from the shards of its holders up, and writes its files to
+	// fileStore.
+	RecoverCapsule(ctx context.Context, capsuleID uuid.UUID, capsuleMasterKey []byte, fileStore ports.FileStorer) error
+	// ResealAtRest seals everything kept at rest again with the current key of
+	// the keyring the stores were made with, so older keys can be retired.
+	ResealAtRest() (resealed int, err error)
 }
 
 var _ servicer = (*service)(nil)
@@ -82,6 +134,7 @@ type Defaults struct {
 // TestHooks hold all Hooks needed for tests that are generated internally and need for tests that we need multiple moving parts for verification.
 type TestHooks struct {
 	OnMasterKeyGenerated func([]byte)
+	OnCapsuleCreated     func(capsuleID uuid.UUID)
 }
 
 type ServiceConfig struct {
@@ -101,12 +154,21 @@ type ServiceConfig struct {
 	CCrypto             customcrypto.CCrypto
 	Archive             archive.Archiver
 	NewErasureCoderFunc dataredundancy.NewErasureCoderFunc
-	TestHooks           *TestHooks
+	Clock               clock.Clock
+	GC                  *GCConfig
+	Quota               *QuotaConfig
+	Repair              *RepairConfig
+	// IsStorageProvider has us hold shards owners put with us as a storage
+	// provider. Optional.
+	IsStorageProvider bool
+	Logger            *slog.Logger
+	TestHooks         *TestHooks
 	// erasureCode dataredundancy.ErasureCoder
 }
 
 type service struct {
 	*ServiceConfig
+	inFlight *inFlight
 }
 
 func NewService(cfg *ServiceConfig) *service {
@@ -136,10 +198,31 @@ func NewService(cfg *ServiceConfig) *service {
 		log.Fatal("Archive cannot be nil")
 	case cfg.NewErasureCoderFunc == nil:
 		log.Fatal("NewErasureCoder cannot be nil")
+	case cfg.Clock == nil:
+		log.Fatal("Clock cannot be nil")
+	case cfg.GC == nil:
+		log.Fatal("GC cannot be nil")
+	case cfg.GC.Interval <= 0 || cfg.GC.GracePeriod <= 0:
+		log.Fatal("GC Interval and GracePeriod must be more than 0")
+	case cfg.Quota == nil:
+		log.Fatal("Quota cannot be nil")
+	case cfg.Quota.MaxBytesPerOwner <= 0 || cfg.Quota.MaxBytesTotal <= 0 || cfg.Quota.MaxShardsPerCapsule <= 0:
+		log.Fatal("Quota MaxBytesPerOwner, MaxBytesTotal and MaxShardsPerCapsule must be more than 0")
+	case cfg.Quota.MinFreeBytes < 0:
+		log.Fatal("Quota MinFreeBytes cannot be negative")
+	case cfg.Repair == nil:
+		log.Fatal("Repair cannot be nil")
+	case cfg.Repair.Interval <= 0 || cfg.Repair.ConnectToPeer == nil:
+		log.Fatal("Repair Interval must be more than 0 and ConnectToPeer cannot be nil")
+	case cfg.Repair.SafetyMargin < 0:
+		log.Fatal("Repair SafetyMargin cannot be negative")
+	case cfg.Logger == nil:
+		log.Fatal("Logger cannot be nil")
 	}
 
 	return &service{
 		ServiceConfig: cfg,
+		inFlight:      &inFlight{},
 	}
 }
 
@@ -162,7 +245,7 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 	files := make([]ports.File, numOfFiles)
 	if len(payload.FilePaths) > 0 {
 		err := s.FileStore.Open(
-			localDisk,
+			ObjectStoreDisk,
 			payload.FilePaths,
 			files,
 		)
@@ -212,6 +295,9 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 	if s.TestHooks != nil && s.TestHooks.OnMasterKeyGenerated != nil {
 		s.TestHooks.OnMasterKeyGenerated(capsuleMasterKey)
 	}
+	if s.TestHooks != nil && s.TestHooks.OnCapsuleCreated != nil {
+		s.TestHooks.OnCapsuleCreated(capsuleID)
+	}
 
 	// split capsuleMasterKey for guardians
 	masterKeySplitShares, err := s.CCrypto.SecretSharer.Split(
@@ -234,7 +320,7 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 		CapsuleID:            capsuleID,
 		GuardiansIDs:         remotePeersIDs,
 		HeartbeatGracePeriod: payload.SilencePeriod,
-		ShardSize:            uint16(maxShardSize),
+		ShardSize:            uint16(payload.ErasureProfile.shardSize()),
 		KeyShareSize:         uint8(len(masterKeySplitShares[0])),
 	}
 
@@ -288,9 +374,12 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 	payload.RemotePeerGuardians = payload.RemotePeerGuardians[:activeRemotePeerCount]
 	//TODO: We need to find a way to send the msgErrs(need to change the name since i would use it for non breaking errors) back to the caller. Might have to send a pointer in here which is checked later or return an err slice. Not sure.
 
+	// todo: a guardian we couldn't send to above is a holder less, a profile
+	// derived from a fault tolerance is then short of it. derive it again from
+	// the active ones?
 	erasureCoder, err := s.NewErasureCoderFunc(
-		dataShardNum,
-		parityShardNum,
+		int(payload.ErasureProfile.DataShards),
+		int(payload.ErasureProfile.ParityShards),
 	)
 	if err != nil {
 		return peererrors.New(
@@ -303,10 +392,13 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 	}
 
 	blockSinker := NewBlockSinkEncoder(
+		ctx,
 		capsuleID,
 		capsuleMasterKey,
-		erasureCoder.Erasure,
+		erasureCoder.ErasureInto,
+		*payload.ErasureProfile,
 		payload.RemotePeerGuardians,
+		payload.RemotePeerStorageProviders,
 	)
 
 	err = s.Archive.ArchiveStream(ctx, files, blockSinker)
@@ -322,13 +414,31 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 
 	// Todo: We can check block for block manifest details i think.
 	manifestMsg := &message.CapsuleIncomingManifestStream{
-		CapsuleID:   capsuleID,
-		TotalBlocks: blockSinker.capsuleManifest.totalBlocks,
-		Blocks:      blockSinker.capsuleManifest.blocks,
+		CapsuleID:      capsuleID,
+		TotalBlocks:    blockSinker.capsuleManifest.totalBlocks,
+		Blocks:         blockSinker.capsuleManifest.blocks,
+		ProviderShards: blockSinker.capsuleManifest.providerShards,
+		Shards:         blockSinker.capsuleManifest.shards,
+	}
+
+	// A manifest grows with the capsule, so it goes on a stream of its own.
+	var manifest bytes.Buffer
+	err = s.Serialize.Encode(&manifest, manifestMsg)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to encode manifest",
+			err,
+			featureCapsule,
+		)
 	}
 
 	for i := range payload.RemotePeerGuardians {
-		_, err := payload.RemotePeerGuardians[i].Send(manifestMsg, nil)
+		_, err := payload.RemotePeerGuardians[i].SendStream(
+			ctx,
+			bytes.NewReader(manifest.Bytes()),
+		)
 		if err != nil {
 			return peererrors.New(
 				peererrors.ScopeLocalPeer,
@@ -352,6 +462,7 @@ func (s *service) CreateAndSendCapsule(ctx context.Context, payload *CreateCapsu
 			// ShareNumber: uint16(i),
 			// Share:     make([]byte, len(masterKeySplitShares[i])),
 			ThresholdShares: uint8(payload.CapsuleMasterKeyRecoveryThreshold),
+			Size:            uint32(len(masterKeySplitShares[i])),
 		}
 		n, err := rp.Send(capsuleKeyShareMsg, masterKeySplitShares[i])
 		if n != len(masterKeySplitShares[i]) {
@@ -421,20 +532,29 @@ func (s *service) ReceiveCapsuleStream(
 		)
 	}
 
+	// A guardian that has no room says so before it takes anything.
+	admission, err := s.admitCapsule(remotePeer.ID())
+	if err != nil {
+		return err
+	}
+	defer admission.done()
+
 	//- we create the metadata in our database to hold info on the capsule.
 	// - create temp metadata for current in stream capsule for continuation, and shard organization.
-	err := s.DBStore.createOrUpdate(
-		// todo: I might have to rethink about the value. Not sure capsule is right value here.
+	// NOTICE IMPORTANT: c is the whole record, every later write of the capsule
+	// saves c again so it doesn't wipe what was written before.
+	// todo: I might have to rethink about the value. Not sure capsule is right value here.
+	c := &capsule{
+		OwnerID:     remotePeer.ID(),
+		GuardianIDs: msg.GuardiansIDs,
+		CreatedAt:   msg.CreatedAt,
+		ReceivedAt:  s.Clock.Now(),
+		IsComplete:  false,
+	}
+	err = s.DBStore.createOrUpdate(
 		database.CollCapsules,
 		msg.CapsuleID.String(),
-		// todo: I might have to rethink about the value. Not sure capsule is right value here.
-		&capsule{
-			OwnerID:     remotePeer.ID(),
-			GuardianIDs: msg.GuardiansIDs,
-			CreatedAt:   msg.CreatedAt,
-			ReceivedAt:  time.Now(),
-			IsComplete:  false,
-		},
+		c,
 	)
 	if err != nil {
 		return peererrors.New(
@@ -451,11 +571,22 @@ func (s *service) ReceiveCapsuleStream(
 	}
 
 	// - Now handle capsule shards.
+	// They come on a stream, a CapsuleStreamShard ahead of each says how much
+	// of the stream is its shard.
+	shardsCtx, cancelShards := context.WithCancel(ctx)
+	defer cancelShards()
+	shards, shardsWriter := io.Pipe()
+	defer shards.Close()
+	shardsErr := make(chan error, 1)
+	go func() {
+		_, err := remotePeer.ReceiveStream(shardsCtx, shardsWriter)
+		shardsWriter.CloseWithError(err)
+		shardsErr <- err
+	}()
+
 	var (
-		receivedShardMetaDataMsg message.CapsuleIncomingShardStream
+		receivedShardMetaDataMsg message.CapsuleStreamShard
 		receivedShardData        = make([]byte, msg.ShardSize)
-		shardsReceived           = 0    // IMPROVEMENT: Track progress
-		maxShards                = 1000 // SECURITY: Prevent DoS attacks
 	)
 
 	for {
@@ -466,20 +597,32 @@ func (s *service) ReceiveCapsuleStream(
 		default:
 		}
 
-		if shardsReceived >= maxShards {
+		_, err := remotePeer.Receive(&receivedShardMetaDataMsg, nil)
+		if err != nil {
 			return peererrors.New(
 				peererrors.ScopeInternalPeer,
-				peererrors.CodeTodo,
-				fmt.Sprintf("exceeded maximum shards limit: %d /Possible DoS attack/", maxShards),
+				peererrors.ErrBadRequest,
+				"failed to receive capsule chunk",
+				err,
+				featureCapsule,
+			)
+		}
+
+		if receivedShardMetaDataMsg.Size == 0 || int(receivedShardMetaDataMsg.Size) > len(receivedShardData) {
+			return peererrors.New(
+				peererrors.ScopeInternalPeer,
+				peererrors.ErrBadRequest,
+				fmt.Sprintf(
+					"shard size %d is not in what the capsule said, 1 to %d",
+					receivedShardMetaDataMsg.Size,
+					len(receivedShardData),
+				),
 				nil,
 				featureCapsule,
 			)
 		}
 
-		nShardMsg, err := remotePeer.Receive(
-			&receivedShardMetaDataMsg,
-			receivedShardData,
-		)
+		nShardMsg, err := io.ReadFull(shards, receivedShardData[:receivedShardMetaDataMsg.Size])
 		if err != nil {
 			return peererrors.New(
 				peererrors.ScopeInternalPeer,
@@ -528,17 +671,35 @@ func (s *service) ReceiveCapsuleStream(
 			)
 		}
 
+		err = checkShardHeader(
+			receivedShardData[:nShardMsg],
+			msg.CapsuleID,
+			receivedShardMetaDataMsg.RepairGroupID,
+			receivedShardMetaDataMsg.DataShardNum,
+			receivedShardMetaDataMsg.ParityShardNum,
+		)
+		if err != nil {
+			return err
+		}
+
+		// SECURITY: The quotas are what keep an owner from filling our disk.
+		if err := admission.admitShard(int64(nShardMsg)); err != nil {
+			return err
+		}
+
 		// - Store shard and the
 		// Compute hash for CAS storage
-		//todo: saving shard in CAS and db should be transactional, if one fails the other has too be reversed.
+		// The shard, its metadata and the capsule record on the final shard are
+		// kept together or not at all.
 		shardHash := sha256.Sum256(receivedShardData[:nShardMsg])
-		err = s.FileStore.SaveCAS(shardHash, receivedShardData[:nShardMsg])
+		uow := newUnitOfWork(s.FileStore, s.DBStore, s.Clock.Now)
+		err = uow.saveCAS(shardHash, receivedShardData[:nShardMsg])
 		if err != nil {
 			return peererrors.New(
 				peererrors.ScopeInternalPeer,
 				peererrors.CodeTodo,
 				"failed to save received capsule shard to CAS",
-				err,
+				errors.Join(err, uow.rollback()),
 				featureCapsule,
 			)
 		}
@@ -554,58 +715,68 @@ func (s *service) ReceiveCapsuleStream(
 			dataShardNum:   receivedShardMetaDataMsg.DataShardNum,
 			parityShardNum: receivedShardMetaDataMsg.ParityShardNum,
 		}
-		err = s.DBStore.createOrUpdate(
+		uow.createOrUpdate(
 			database.CollCapsulesActiveShards,
 			receivedShardMetaDataMsg.ShardID.String(),
 			shardMeta,
 		)
-		if err != nil {
-			//Todo: Should delete shard
 
+		if receivedShardMetaDataMsg.IsFinal {
+			c.AreShardsReceived = true
+			c.IsComplete = true
+			c.CompletedAt = s.Clock.Now()
+			uow.createOrUpdate(
+				database.CollCapsules,
+				msg.CapsuleID.String(),
+				c,
+			)
+		}
+
+		if err := uow.commit(); err != nil {
 			return peererrors.New(
 				peererrors.ScopeInternalPeer,
 				peererrors.CodeTodo,
-				"failed to store shard metadata",
+				fmt.Sprintf(
+					"failed to store shard '%s' of incoming capsule stream: CapsuleID '%s' by RemotePeerID '%s' ",
+					receivedShardMetaDataMsg.ShardID.String(),
+					msg.CapsuleID.String(),
+					remotePeer.ID(),
+				),
 				err,
 				featureCapsule,
 			)
 		}
 
 		if receivedShardMetaDataMsg.IsFinal {
-			err = s.DBStore.createOrUpdate(
-				database.CollCapsules,
-				msg.CapsuleID.String(),
-				&capsule{
-					OwnerID:     remotePeer.ID(),
-					GuardianIDs: msg.GuardiansIDs,
-					IsComplete:  true,
-					CompletedAt: time.Now(),
-				},
-			)
-			if err != nil {
-				return peererrors.New(
-					peererrors.ScopeInternalPeer,
-					peererrors.CodeTodo,
-					fmt.Sprintf(
-						"failed ailed to mark capsule as complete for incoming capsule stream: CapsuleID '%s' by RemotePeerID '%s' ",
-						msg.CapsuleID.String(),
-						remotePeer.ID(),
-					),
-					err,
-					featureCapsule,
-				)
-			}
-
 			break
 		}
+	}
 
-		shardsReceived++
+	// The final shard is the end of the stream.
+	var extra [1]byte
+	if n, _ := shards.Read(extra[:]); n != 0 {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.ErrBadRequest,
+			"capsule stream has more than its shards",
+			nil,
+			featureCapsule,
+		)
+	}
+	if err := <-shardsErr; err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.ErrBadRequest,
+			"failed to receive capsule stream",
+			err,
+			featureCapsule,
+		)
 	}
 
 	// - Now handle capsule manifest.
 	// This tells us all the repair group IDs we need to look for during recovery
-	var manifestMsg message.CapsuleIncomingManifestStream
-	_, err = remotePeer.Receive(&manifestMsg, nil)
+	manifest := &cappedBuffer{max: maxManifestSize}
+	_, err = remotePeer.ReceiveStream(ctx, manifest)
 	if err != nil {
 		return peererrors.New(
 			peererrors.ScopeInternalPeer,
@@ -616,6 +787,18 @@ func (s *service) ReceiveCapsuleStream(
 		)
 	}
 
+	var manifestMsg message.CapsuleIncomingManifestStream
+	err = s.Serialize.Decode(&manifest.Buffer, &manifestMsg)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.ErrBadRequest,
+			"failed to decode capsule manifest",
+			err,
+			featureCapsule,
+		)
+	}
+
 	if manifestMsg.CapsuleID != msg.CapsuleID {
 		return peererrors.New(
 			peererrors.ScopeInternalPeer,
@@ -697,16 +880,23 @@ func (s *service) ReceiveCapsuleStream(
 		)
 	}
 
+	c.IsManifestReceived = true
+	c.IsKeyMasterShareReceived = true
+	c.CompletedAt = s.Clock.Now()
 	err = s.DBStore.createOrUpdate(
 		database.CollCapsules,
 		msg.CapsuleID.String(),
-		&capsule{
-			OwnerID:                  remotePeer.ID(),
-			GuardianIDs:              msg.GuardiansIDs,
-			IsKeyMasterShareReceived: true,
-			CompletedAt:              time.Now(),
-		},
+		c,
 	)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to mark master key share as received",
+			err,
+			featureCapsule,
+		)
+	}
 
 	return nil
 }
@@ -728,6 +918,165 @@ func (s service) GetDefaults() Defaults {
 	return *s.Defaults
 }
 
+func (s *service) RecoverUnfinishedWrites() (finished, dropped int, err error) {
+	finished, dropped, err = recoverUnitsOfWork(s.FileStore, s.DBStore)
+	if err != nil {
+		return finished, dropped, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to recover unfinished writes",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return finished, dropped, nil
+}
+
+func (s *service) ResealAtRest() (resealed int, err error) {
+	resealed, err = s.DBStore.reseal()
+	if err != nil {
+		return resealed, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to reseal db",
+			err,
+			featureCapsule,
+		)
+	}
+
+	objects, err := s.FileStore.resealCAS()
+	resealed += objects
+	if err != nil {
+		return resealed, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to reseal CAS",
+			err,
+			featureCapsule,
+		)
+	}
+
+	return resealed, nil
+}
+
+func (s *service) GetHeldCapsule(capsuleID uuid.UUID) (*HeldCapsuleDTO, error) {
+	var c capsule
+	isFound, err := s.DBStore.find(database.CollCapsules, capsuleID.String(), &c)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find held capsule",
+			err,
+			featureCapsule,
+		)
+	}
+	if !isFound {
+		return nil, peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("no held capsule with ID: %s", capsuleID),
+			ErrCapsuleNotFound,
+			featureCapsule,
+		)
+	}
+
+	held := &HeldCapsuleDTO{
+		CapsuleID:          capsuleID,
+		OwnerID:            c.OwnerID,
+		GuardianIDs:        c.GuardianIDs,
+		IsKeyShareReceived: c.IsKeyMasterShareReceived,
+	}
+
+	// The manifest and key share come in after the capsule, so they might not
+	// be here yet.
+	var manifest message.CapsuleIncomingManifestStream
+	isFound, err = s.DBStore.find(database.CollCapsuleManifests, capsuleID.String(), &manifest)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find held capsule manifest",
+			err,
+			featureCapsule,
+		)
+	}
+	if isFound {
+		held.TotalBlocks = manifest.TotalBlocks
+		held.ProviderShards = manifest.ProviderShards
+		held.Shards = manifest.Shards
+	}
+
+	var keyShare masterKeyShare
+	isFound, err = s.DBStore.find(database.CollKeyShares, capsuleID.String(), &keyShare)
+	if err != nil {
+		return nil, peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find held capsule key share",
+			err,
+			featureCapsule,
+		)
+	}
+	if isFound {
+		held.KeyShare = keyShare.Share
+		held.TotalShares = keyShare.TotalShares
+		held.ThresholdShares = keyShare.ThresholdShares
+	}
+
+	return held, nil
+}
+
+// cappedBuffer is a bytes.Buffer that doesn't grow past max, for what a remote
+// peer streams to us.
+type cappedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if b.Len()+len(p) > b.max {
+		return 0, fmt.Errorf("more than %d bytes", b.max)
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// checkShardHeader checks shard is whole and of the block it is sent for, its
+// header is what puts the block back together when our db is gone.
+func checkShardHeader(shard []byte, capsuleID, repairGroupID uuid.UUID, dataShardNum, parityShardNum uint8) error {
+	header, err := dataredundancy.ParseShardHeader(shard)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf("shard is not a valid shard: %v", err),
+			err,
+			featureCapsule,
+		)
+	}
+
+	if header.CapsuleID != capsuleID ||
+		header.RepairGroupID != repairGroupID ||
+		header.DataShards != dataShardNum ||
+		header.ParityShards != parityShardNum {
+		return peererrors.New(
+			peererrors.ScopeRemotePeer,
+			peererrors.ErrBadRequest,
+			fmt.Sprintf(
+				"shard header is of capsule %s and repair group %s, not of the one it is sent for",
+				header.CapsuleID,
+				header.RepairGroupID,
+			),
+			nil,
+			featureCapsule,
+		)
+	}
+
+	return nil
+}
+
 func (s *service) deriveShardKey(capsuleMasterKey []byte, shardIndex int, derivedKey []byte) error {
 	//Todo: maybe do research on how to get string bytes as i know i would make it a byte slice for salt.
 	info := fmt.Sprintf("capsule-shard-%d", shardIndex)
@@ -740,5 +1089,3 @@ func (s *service) deriveShardKey(capsuleMasterKey []byte, shardIndex int, derive
 /*
 	- files > archive > compress > block sink(encrypt 1mb block) > shard (32|22)54 > a shard to RemotePeer
 */
-
-// todo: so i want to use sqlite and bun orm for rather than bolt. so what svhema will be for my application. design the shcemas with the right relatios. explain everything in the code with commets // for agent
@@ -11,6 +11,7 @@ import (
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/dataredundancy"
 	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/engr-sjb/diogel/internal/peererrors"
 	"github.com/engr-sjb/diogel/internal/transport"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -130,6 +131,46 @@ func TestCreateCapsuleDTO_Validate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "recovery threshold cannot exceed number of guardians",
 		},
+		{
+			name: "fault tolerance of 1 of 3 guardians",
+			dto: &CreateCapsuleDTO{
+				RemotePeerGuardians: make([]transport.RemotePeer, 3),
+				Letter:              &mockLetter{data: []byte("test")},
+				FaultTolerance:      1,
+			},
+			wantErr: false,
+		},
+		{
+			name: "fault tolerance of every guardian",
+			dto: &CreateCapsuleDTO{
+				RemotePeerGuardians: make([]transport.RemotePeer, 3),
+				Letter:              &mockLetter{data: []byte("test")},
+				FaultTolerance:      3,
+			},
+			wantErr: true,
+			errMsg:  "fault tolerance must be between 1 and 2",
+		},
+		{
+			name: "erasure profile and fault tolerance",
+			dto: &CreateCapsuleDTO{
+				RemotePeerGuardians: make([]transport.RemotePeer, 3),
+				Letter:              &mockLetter{data: []byte("test")},
+				ErasureProfile:      &DefaultErasureProfile,
+				FaultTolerance:      1,
+			},
+			wantErr: true,
+			errMsg:  "an erasure profile and a fault tolerance can't both be set",
+		},
+		{
+			name: "erasure profile with no parity",
+			dto: &CreateCapsuleDTO{
+				RemotePeerGuardians: make([]transport.RemotePeer, 3),
+				Letter:              &mockLetter{data: []byte("test")},
+				ErasureProfile:      &ErasureProfile{DataShards: 32},
+			},
+			wantErr: true,
+			errMsg:  "data and parity shards must be at least 1",
+		},
 	}
 
 	// Defaults used for validation
@@ -561,3 +602,20 @@ func TestCapsuleRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckShardHeader(t *testing.T) {
+	erasureCoder, err := dataredundancy.NewReedSolomonCoder(2, 1)
+	require.NoError(t, err)
+
+	capsuleID, repairGroupID := uuid.New(), uuid.New()
+	shards, err := erasureCoder.Erasure(capsuleID, repairGroupID, []byte("a block of a capsule"))
+	require.NoError(t, err)
+
+	require.NoError(t, checkShardHeader(shards[0], capsuleID, repairGroupID, 2, 1))
+	assertRefused(t, checkShardHeader(shards[0], uuid.New(), repairGroupID, 2, 1), peererrors.ErrBadRequest)
+	assertRefused(t, checkShardHeader(shards[0], capsuleID, uuid.New(), 2, 1), peererrors.ErrBadRequest)
+	assertRefused(t, checkShardHeader(shards[0], capsuleID, repairGroupID, 3, 1), peererrors.ErrBadRequest)
+
+	shards[0][len(shards[0])-1] ^= 1
+	assertRefused(t, checkShardHeader(shards[0], capsuleID, repairGroupID, 2, 1), peererrors.ErrBadRequest)
+}
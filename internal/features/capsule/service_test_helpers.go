@@ -2,14 +2,20 @@ package capsule
 
 import (
 	"context"
+	"errors"
+	"log/slog"
+	"net"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/engr-sjb/diogel/internal/archive"
+	"github.com/engr-sjb/diogel/internal/clock"
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/dataredundancy"
 	"github.com/engr-sjb/diogel/internal/message"
 	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/engr-sjb/diogel/internal/transport"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/mock"
 )
@@ -84,6 +90,24 @@ func (h *testHelper) CreateTestService(opts ...ServiceOption) *service {
 		Archive:    archive.NewArchive(),
 		// Use real erasure coding - we want to test actual shard reconstruction
 		NewErasureCoderFunc: dataredundancy.NewReedSolomonCoder,
+		Clock:               clock.New(),
+		GC: &GCConfig{
+			Interval:    time.Hour,
+			GracePeriod: time.Hour,
+		},
+		Quota: &QuotaConfig{
+			MaxBytesPerOwner:    1 << 30,
+			MaxBytesTotal:       1 << 30,
+			MaxShardsPerCapsule: 1000,
+		},
+		Repair: &RepairConfig{
+			Interval:     time.Hour,
+			SafetyMargin: parityShardNum / 2,
+			ConnectToPeer: func(addr string) (transport.RemotePeerConn, error) {
+				return nil, errors.New("no network in tests")
+			},
+		},
+		Logger: slog.Default(),
 	}
 
 	// Apply custom options (like mocks) after defaults
@@ -102,7 +126,7 @@ func (h *testHelper) CreateTestService(opts ...ServiceOption) *service {
 // In tests, we capture it in memory for easy verification.
 type GuardianInMemStorage struct {
 	InitialMsg *message.CapsuleIncomingStream         // The first message with metadata
-	Shards     []message.CapsuleIncomingShardStream   // All shard metadata
+	Shards     []message.CapsuleStreamShard           // All shard metadata
 	ShardData  [][]byte                               // Actual shard bytes (encrypted)
 	Manifest   *message.CapsuleIncomingManifestStream // The final manifest
 	KeyShare   []byte                                 // The Shamir secret share
@@ -122,6 +146,9 @@ func (h *testHelper) CreateMockGuardians(count int) ([]*mockRemotePeer, []uuid.U
 		ids[i] = uuid.New()
 		// Setup ID() to return consistent value - this is called multiple times
 		peers[i].On("ID").Return(ids[i])
+		// The manifest says which guardian has which shard by its public key.
+		peers[i].On("PublicKey").Return(ids[i][:])
+		peers[i].On("Addr").Return(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000 + i})
 	}
 
 	return peers, ids
@@ -136,7 +163,7 @@ func (h *testHelper) CreateMockGuardians(count int) ([]*mockRemotePeer, []uuid.U
 // 2. Easier to debug - we can inspect captured data
 // 3. Enables round-trip testing - we can use captured data for reconstruction
 func (h *testHelper) SetupGuardianCapture(peer *mockRemotePeer, storage *GuardianInMemStorage) {
-	peer.On("Send", mock.Anything, mock.Anything).Return(
+	peer.onGuardianSend(
 		func(msg message.Msg, data []byte) (int, error) {
 			// Use type switch to handle different message types
 			// Each message type represents a phase of capsule distribution
@@ -145,7 +172,7 @@ func (h *testHelper) SetupGuardianCapture(peer *mockRemotePeer, storage *Guardia
 				// Phase 1: Initial metadata (capsule ID, guardians, grace period)
 				storage.InitialMsg = m
 
-			case *message.CapsuleIncomingShardStream:
+			case *message.CapsuleStreamShard:
 				// Phase 2: Encrypted data shards (the actual capsule content)
 				// We make a copy because the message might be reused
 				shardCopy := *m
@@ -194,9 +221,13 @@ func (h *testHelper) SetupMockDBAndFileStore() (*mockDBStore, *mockFileStore) {
 
 	// Accept any createOrUpdate call - we trust the DB implementation
 	mockDB.On("createOrUpdate", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockDB.On("commit", mock.Anything).Return(nil)
 
 	// Accept any SaveCAS call - we trust the FileStore implementation
 	mockFS.On("SaveCAS", mock.Anything, mock.Anything).Return(nil)
+	mockFS.On("stageCAS", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	mockFS.On("commitStaged", mock.Anything).Return(nil)
+	mockFS.On("discardStaged", mock.Anything).Return(nil)
 
 	// Accept any MkdirAll call - needed for unarchiving
 	mockFS.On("MkdirAll", mock.Anything).Return(nil)
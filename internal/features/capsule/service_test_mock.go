@@ -2,15 +2,19 @@ package capsule
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/features/ports"
 	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/serialize"
 	"github.com/engr-sjb/diogel/internal/shared/database"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/mock"
@@ -36,6 +40,46 @@ func (m *mockDBStore) delete(col database.Collection, key string) error {
 	return args.Error(0)
 }
 
+func (m *mockDBStore) findShardsByRepairGroup(repairGroupID uuid.UUID) ([]shardMetaData, error) {
+	args := m.Called(repairGroupID)
+	shards, _ := args.Get(0).([]shardMetaData)
+	return shards, args.Error(1)
+}
+
+func (m *mockDBStore) findShardHashes() ([][32]byte, error) {
+	args := m.Called()
+	hashes, _ := args.Get(0).([][32]byte)
+	return hashes, args.Error(1)
+}
+
+func (m *mockDBStore) findManifestCapsuleIDs() ([]uuid.UUID, error) {
+	args := m.Called()
+	capsuleIDs, _ := args.Get(0).([]uuid.UUID)
+	return capsuleIDs, args.Error(1)
+}
+
+func (m *mockDBStore) findUsageByOwner() (map[uuid.UUID]int64, error) {
+	args := m.Called()
+	usage, _ := args.Get(0).(map[uuid.UUID]int64)
+	return usage, args.Error(1)
+}
+
+func (m *mockDBStore) commit(writes []dbWrite) error {
+	args := m.Called(writes)
+	return args.Error(0)
+}
+
+func (m *mockDBStore) findUnitsOfWork() ([]unitOfWorkRecord, error) {
+	args := m.Called()
+	records, _ := args.Get(0).([]unitOfWorkRecord)
+	return records, args.Error(1)
+}
+
+func (m *mockDBStore) reseal() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
 // mockFileStore
 type mockFileStore struct {
 	mock.Mock
@@ -51,16 +95,73 @@ func (m *mockFileStore) SaveCAS(hash [32]byte, data []byte) error {
 	return args.Error(0)
 }
 
+func (m *mockFileStore) stageCAS(stagingID uuid.UUID, hash [32]byte, data []byte) error {
+	args := m.Called(stagingID, hash, data)
+	return args.Error(0)
+}
+
+func (m *mockFileStore) commitStaged(stagingID uuid.UUID) error {
+	args := m.Called(stagingID)
+	return args.Error(0)
+}
+
+func (m *mockFileStore) discardStaged(stagingID uuid.UUID) error {
+	args := m.Called(stagingID)
+	return args.Error(0)
+}
+
+func (m *mockFileStore) findStaged() ([]uuid.UUID, error) {
+	args := m.Called()
+	stagingIDs, _ := args.Get(0).([]uuid.UUID)
+	return stagingIDs, args.Error(1)
+}
+
+func (m *mockFileStore) walkCAS(fn func(hash [32]byte, size int64, modTime time.Time) error) error {
+	args := m.Called(fn)
+	return args.Error(0)
+}
+
+func (m *mockFileStore) collectCAS(hash [32]byte, olderThan time.Time) (int64, error) {
+	args := m.Called(hash, olderThan)
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func (m *mockFileStore) GetCAS(hash [32]byte) ([]byte, error) {
 	args := m.Called(hash)
 	return args.Get(0).([]byte), args.Error(1)
 }
 
+func (m *mockFileStore) SaveCASFrom(r io.Reader) ([32]byte, int64, error) {
+	args := m.Called(r)
+	return args.Get(0).([32]byte), args.Get(1).(int64), args.Error(2)
+}
+
+func (m *mockFileStore) OpenCAS(hash [32]byte) (io.ReadCloser, error) {
+	args := m.Called(hash)
+	r, _ := args.Get(0).(io.ReadCloser)
+	return r, args.Error(1)
+}
+
+func (m *mockFileStore) WriteCASTo(hash [32]byte, w io.Writer) (int64, error) {
+	args := m.Called(hash, w)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockFileStore) resealCAS() (int, error) {
+	args := m.Called()
+	return args.Int(0), args.Error(1)
+}
+
 func (m *mockFileStore) VerifyCAS(hash [32]byte) (bool, error) {
 	args := m.Called(hash)
 	return args.Bool(0), args.Error(1)
 }
 
+func (m *mockFileStore) freeSpace() (int64, error) {
+	args := m.Called()
+	return args.Get(0).(int64), args.Error(1)
+}
+
 func (m *mockFileStore) Create(pathName string) (ports.File, error) {
 	args := m.Called(pathName)
 	return args.Get(0).(ports.File), args.Error(1)
@@ -125,6 +226,21 @@ func (m *mockRemotePeer) Close() error {
 	return args.Error(0)
 }
 
+func (m *mockRemotePeer) IsStale(threshold time.Duration) bool {
+	args := m.Called(threshold)
+	return args.Bool(0)
+}
+
+func (m *mockRemotePeer) Session() protocol.Session {
+	args := m.Called()
+	return args.Get(0).(protocol.Session)
+}
+
+func (m *mockRemotePeer) ReadMsg() (message.Msg, error) {
+	args := m.Called()
+	return args.Get(0), args.Error(1)
+}
+
 func (m *mockRemotePeer) Send(msg message.Msg, data []byte) (int, error) {
 	args := m.Called(msg, data)
 	fn, isValid := args.Get(0).(func(message.Msg, []byte) (int, error))
@@ -145,6 +261,114 @@ func (m *mockRemotePeer) Receive(msg message.Msg, data []byte) (int, error) {
 	return fn(msg, data)
 }
 
+func (m *mockRemotePeer) SendStream(ctx context.Context, r io.Reader) (int64, error) {
+	args := m.Called(ctx, r)
+	fn, isValid := args.Get(0).(func(context.Context, io.Reader) (int64, error))
+	if !isValid {
+		return args.Get(0).(int64), args.Error(1)
+	}
+
+	return fn(ctx, r)
+}
+
+func (m *mockRemotePeer) ReceiveStream(ctx context.Context, w io.Writer) (int64, error) {
+	args := m.Called(ctx, w)
+	fn, isValid := args.Get(0).(func(context.Context, io.Writer) (int64, error))
+	if !isValid {
+		return args.Get(0).(int64), args.Error(1)
+	}
+
+	return fn(ctx, w)
+}
+
+// onGuardianSend has m take what an owner sends a guardian and hand it to send
+// a message at a time, see guardianStreams.
+func (m *mockRemotePeer) onGuardianSend(send func(msg message.Msg, data []byte) (int, error)) {
+	streams := &guardianStreams{send: send}
+	m.On("Send", mock.Anything, mock.Anything).Return(streams.Send)
+	m.On("SendStream", mock.Anything, mock.Anything).Return(streams.SendStream)
+}
+
+/*
+guardianStreams splits what an owner sends a guardian back into a message at a
+time for send, the way ReceiveCapsuleStream reads it:
+
+  - a CapsuleStreamShard with its shard, off the stream of shards.
+  - the manifest, a stream of its own, as a CapsuleIncomingManifestStream.
+  - anything else as it was sent.
+*/
+type guardianStreams struct {
+	mu     sync.Mutex
+	shards []message.CapsuleStreamShard // sent, their shards not streamed yet.
+	send   func(msg message.Msg, data []byte) (int, error)
+}
+
+func (g *guardianStreams) Send(msg message.Msg, data []byte) (int, error) {
+	if shardMsg, isShardMsg := msg.(*message.CapsuleStreamShard); isShardMsg {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.shards = append(g.shards, *shardMsg)
+		return 0, nil
+	}
+
+	return g.send(msg, data)
+}
+
+func (g *guardianStreams) SendStream(ctx context.Context, r io.Reader) (int64, error) {
+	var (
+		total    int64
+		buf      []byte
+		isShards bool
+		chunk    = make([]byte, 32*1024)
+	)
+
+	for {
+		n, readErr := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		total += int64(n)
+
+		// The message of a shard is sent before any of the shard is read.
+		for {
+			g.mu.Lock()
+			if len(g.shards) == 0 || len(buf) < int(g.shards[0].Size) {
+				g.mu.Unlock()
+				break
+			}
+			shardMsg := g.shards[0]
+			g.shards = g.shards[1:]
+			g.mu.Unlock()
+
+			isShards = true
+			if _, err := g.send(&shardMsg, buf[:shardMsg.Size]); err != nil {
+				return total, err
+			}
+			buf = buf[shardMsg.Size:]
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+
+	if isShards {
+		if len(buf) != 0 {
+			return total, errors.New("stream has more than its shards")
+		}
+		return total, nil
+	}
+
+	var manifest message.CapsuleIncomingManifestStream
+	if err := serialize.New().Decode(bytes.NewReader(buf), &manifest); err != nil {
+		return total, err
+	}
+
+	_, err := g.send(&manifest, nil)
+	return total, err
+}
+
 func (m *mockRemotePeer) ID() uuid.UUID {
 	args := m.Called()
 	return args.Get(0).(uuid.UUID)
@@ -10,9 +10,13 @@ package capsule
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 
+	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
 	bolt "go.etcd.io/bbolt"
 	boltErr "go.etcd.io/bbolt/errors"
 )
@@ -25,12 +29,34 @@ type dbStorer interface {
 	createOrUpdate(col database.Collection, key string, v any) error
 	find(col database.Collection, key string, value any) (exists bool, err error)
 	delete(col database.Collection, key string) error
+	// findShardsByRepairGroup finds every shard we hold of a repair group.
+	findShardsByRepairGroup(repairGroupID uuid.UUID) ([]shardMetaData, error)
+	// findShardHashes finds the hashes of every shard we hold, as a guardian
+	// or a storage provider, which are the objects in the CAS that are in use.
+	findShardHashes() ([][32]byte, error)
+	// findManifestCapsuleIDs finds the IDs of every capsule we have the
+	// manifest of.
+	findManifestCapsuleIDs() ([]uuid.UUID, error)
+	// findUsageByOwner finds how many bytes of shards we hold for each owner.
+	// Shards of a capsule we have no record of are under uuid.Nil.
+	findUsageByOwner() (map[uuid.UUID]int64, error)
+	// commit does all of writes in one tx, so either all or none of them are
+	// done. Use it through a unitOfWork.
+	commit(writes []dbWrite) error
+	// findUnitsOfWork finds the units of work that were committed but might
+	// not be finished.
+	findUnitsOfWork() ([]unitOfWorkRecord, error)
+	// reseal seals again everything that is not sealed with the current key
+	// of the keyring, or not sealed at all. It returns how many it sealed.
+	reseal() (int, error)
 }
 
 type DBStoreConfig struct {
 	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
 
 	DB *bolt.DB
+	// Keyring seals every value. It must have its current key already.
+	Keyring *customcrypto.Keyring
 }
 
 type dbStore struct {
@@ -44,37 +70,58 @@ func NewDBStore(cfg *DBStoreConfig) *dbStore {
 		log.Fatalln("store config is nil")
 	case cfg.DB == nil:
 		log.Fatalln("invalid store config: DB is nil")
+	case cfg.Keyring == nil || cfg.Keyring.Current() == 0:
+		log.Fatalln("invalid store config: Keyring is nil or has no current key")
 	}
 
-	return &dbStore{
+	// NOTICE IMPORTANT: Migrations run on what is in the db before it is
+	// sealed again below, so they only ever see plain values from peers that
+	// did not seal yet. A migration that has to read sealed values needs the
+	// keyring.
+	_, _, err := storage.MigrateBBolt(cfg.DB, string(featureCapsule), bboltMigrations)
+	if err != nil {
+		log.Fatalf("failed to migrate capsule db: %v", err)
+	}
+
+	s := &dbStore{
 		DBStoreConfig: cfg,
 	}
+
+	if _, err := s.reseal(); err != nil {
+		log.Fatalf("failed to seal capsule db: %v", err)
+	}
+
+	return s
 }
 
 func (s *dbStore) createOrUpdate(coll database.Collection, key string, v any) error {
+	return s.DB.Update(
+		func(tx *bolt.Tx) error {
+			return s.put(tx, coll, key, v)
+		},
+	)
+}
+
+func (s *dbStore) put(tx *bolt.Tx, coll database.Collection, key string, v any) error {
 	//Todo: Use a bytes format here instead of marshalling every time.
 	bv, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
 
-	err = s.DB.Update(
-		func(tx *bolt.Tx) error {
-			b, err := tx.CreateBucketIfNotExists(
-				[]byte(coll.BucketName()),
-			)
-			if err != nil {
-				return err
-			}
+	bv, err = s.Keyring.Seal(bv, sealedValueAD(coll, []byte(key)))
+	if err != nil {
+		return err
+	}
 
-			return b.Put([]byte(key), bv)
-		},
+	b, err := tx.CreateBucketIfNotExists(
+		[]byte(coll.BucketName()),
 	)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return b.Put([]byte(key), bv)
 }
 
 // find populates into `value` a []byte. So you are to pass the right type as a pointer value in 'value'.
@@ -95,7 +142,7 @@ func (s *dbStore) find(coll database.Collection, key string, value any) (exists
 				return ErrDataNotFound
 			}
 
-			return json.Unmarshal(out, value)
+			return s.unmarshal(coll, []byte(key), out, value)
 		},
 	)
 	if err != nil {
@@ -111,21 +158,334 @@ func (s *dbStore) find(coll database.Collection, key string, value any) (exists
 }
 
 func (s *dbStore) delete(coll database.Collection, key string) error {
-	err := s.DB.Update(
+	return s.DB.Update(
+		func(tx *bolt.Tx) error {
+			return del(tx, coll, key)
+		},
+	)
+}
+
+func del(tx *bolt.Tx, coll database.Collection, key string) error {
+	b := tx.Bucket(
+		[]byte(coll.BucketName()),
+	)
+	if b == nil {
+		return boltErr.ErrBucketNotFound
+	}
+
+	return b.Delete([]byte(key))
+}
+
+func (s *dbStore) findManifestCapsuleIDs() ([]uuid.UUID, error) {
+	var capsuleIDs []uuid.UUID
+	err := s.DB.View(
 		func(tx *bolt.Tx) error {
 			b := tx.Bucket(
-				[]byte(coll.BucketName()),
+				[]byte(database.CollCapsuleManifests.BucketName()),
 			)
 			if b == nil {
-				return boltErr.ErrBucketNotFound
+				return nil
 			}
 
-			return b.Delete([]byte(key))
+			return b.ForEach(func(k, v []byte) error {
+				capsuleID, err := uuid.ParseBytes(k)
+				if err != nil {
+					return fmt.Errorf("manifest %s: %w", k, err)
+				}
+				capsuleIDs = append(capsuleIDs, capsuleID)
+
+				return nil
+			})
 		},
 	)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return capsuleIDs, nil
+}
+
+func (s *dbStore) findShardHashes() ([][32]byte, error) {
+	var hashes [][32]byte
+	err := s.DB.View(
+		func(tx *bolt.Tx) error {
+			b := tx.Bucket(
+				[]byte(database.CollCapsulesActiveShards.BucketName()),
+			)
+			if b != nil {
+				err := b.ForEach(func(k, v []byte) error {
+					var sm shardMetaData
+					if err := s.unmarshal(database.CollCapsulesActiveShards, k, v, &sm); err != nil {
+						return err
+					}
+					hashes = append(hashes, sm.hash)
+
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			b = tx.Bucket(
+				[]byte(database.CollProviderShards.BucketName()),
+			)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				var ps providerShard
+				if err := s.unmarshal(database.CollProviderShards, k, v, &ps); err != nil {
+					return err
+				}
+				hashes = append(hashes, ps.Hash)
+
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+// findUsageByOwner has to look at every capsule and shard, bbolt only finds by
+// key.
+func (s *dbStore) findUsageByOwner() (map[uuid.UUID]int64, error) {
+	usage := make(map[uuid.UUID]int64)
+	err := s.DB.View(
+		func(tx *bolt.Tx) error {
+			owners := make(map[uuid.UUID]uuid.UUID)
+			if b := tx.Bucket([]byte(database.CollCapsules.BucketName())); b != nil {
+				err := b.ForEach(func(k, v []byte) error {
+					capsuleID, err := uuid.ParseBytes(k)
+					if err != nil {
+						return err
+					}
+
+					var c capsule
+					if err := s.unmarshal(database.CollCapsules, k, v, &c); err != nil {
+						return err
+					}
+					owners[capsuleID] = c.OwnerID
+
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			if b := tx.Bucket([]byte(database.CollCapsulesActiveShards.BucketName())); b != nil {
+				err := b.ForEach(func(k, v []byte) error {
+					var sm shardMetaData
+					if err := s.unmarshal(database.CollCapsulesActiveShards, k, v, &sm); err != nil {
+						return err
+					}
+					usage[owners[sm.capsuleID]] += int64(sm.size)
+
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			// Shards we hold as a storage provider have their owner on them.
+			b := tx.Bucket(
+				[]byte(database.CollProviderShards.BucketName()),
+			)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				var ps providerShard
+				if err := s.unmarshal(database.CollProviderShards, k, v, &ps); err != nil {
+					return err
+				}
+				usage[ps.OwnerID] += int64(ps.Size)
+
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+func (s *dbStore) commit(writes []dbWrite) error {
+	return s.DB.Update(
+		func(tx *bolt.Tx) error {
+			for _, w := range writes {
+				var err error
+				if w.isDelete {
+					err = del(tx, w.coll, w.key)
+				} else {
+					err = s.put(tx, w.coll, w.key, w.v)
+				}
+				if err != nil {
+					return fmt.Errorf("%s %s: %w", w.coll.BucketName(), w.key, err)
+				}
+			}
+
+			return nil
+		},
+	)
+}
+
+func (s *dbStore) findUnitsOfWork() ([]unitOfWorkRecord, error) {
+	var records []unitOfWorkRecord
+	err := s.DB.View(
+		func(tx *bolt.Tx) error {
+			b := tx.Bucket(
+				[]byte(database.CollUnitsOfWork.BucketName()),
+			)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				var r unitOfWorkRecord
+				if err := s.unmarshal(database.CollUnitsOfWork, k, v, &r); err != nil {
+					return err
+				}
+				records = append(records, r)
+
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return records, nil
+}
+
+// findShardsByRepairGroup has to look at every shard, bbolt only finds by key.
+func (s *dbStore) findShardsByRepairGroup(repairGroupID uuid.UUID) ([]shardMetaData, error) {
+	var shards []shardMetaData
+	err := s.DB.View(
+		func(tx *bolt.Tx) error {
+			b := tx.Bucket(
+				[]byte(database.CollCapsulesActiveShards.BucketName()),
+			)
+			if b == nil {
+				return nil
+			}
+
+			return b.ForEach(func(k, v []byte) error {
+				var sm shardMetaData
+				if err := s.unmarshal(database.CollCapsulesActiveShards, k, v, &sm); err != nil {
+					return err
+				}
+				if sm.repairGroupID == repairGroupID {
+					shards = append(shards, sm)
+				}
+
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return shards, nil
+}
+
+// unmarshal opens the sealed value v of key in coll into value.
+func (s *dbStore) unmarshal(coll database.Collection, key, v []byte, value any) error {
+	bv, err := s.Keyring.Open(v, sealedValueAD(coll, key))
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", coll.BucketName(), key, err)
+	}
+
+	return json.Unmarshal(bv, value)
+}
+
+// sealedCollections are the buckets whose values are sealed, which is every
+// bucket the capsule feature keeps.
+var sealedCollections = []database.Collection{
+	database.CollCapsules,
+	database.CollCapsulesActiveShards,
+	database.CollCapsuleManifests,
+	database.CollCapsulesRecovery,
+	database.CollKeyShares,
+	database.CollHeartbeats,
+	database.CollGuardians,
+	database.CollPeers,
+	database.CollUnitsOfWork,
+	database.CollProviderShards,
+	database.CollAuditScores,
+}
+
+func (s *dbStore) reseal() (int, error) {
+	current := s.Keyring.Current()
+
+	var resealed int
+	err := s.DB.Update(
+		func(tx *bolt.Tx) error {
+			for _, coll := range sealedCollections {
+				b := tx.Bucket([]byte(coll.BucketName()))
+				if b == nil {
+					continue
+				}
+
+				// NOTICE IMPORTANT: A bucket must not be written to in its own ForEach.
+				sealed := make(map[string][]byte)
+				err := b.ForEach(func(k, v []byte) error {
+					if id, isSealed := customcrypto.SealedKeyID(v); isSealed && id == current {
+						return nil
+					}
+
+					ad := sealedValueAD(coll, k)
+					if customcrypto.IsSealed(v) {
+						var err error
+						if v, err = s.Keyring.Open(v, ad); err != nil {
+							return fmt.Errorf("%s %s: %w", coll.BucketName(), k, err)
+						}
+					}
+
+					sv, err := s.Keyring.Seal(v, ad)
+					if err != nil {
+						return err
+					}
+					sealed[string(k)] = sv
+
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+
+				for k, v := range sealed {
+					if err := b.Put([]byte(k), v); err != nil {
+						return err
+					}
+				}
+				resealed += len(sealed)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	return resealed, nil
+}
+
+// sealedValueAD ties a sealed value to where it is kept, so it can't be moved
+// to another key.
+func sealedValueAD(coll database.Collection, key []byte) []byte {
+	return append([]byte(coll.BucketName()+"/"), key...)
 }
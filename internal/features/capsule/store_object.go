@@ -8,43 +8,118 @@
 package capsule
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/google/uuid"
 )
 
+/*
+The CAS keeps every object under ObjectsDir/objects, named after the hex of
+its sha256 and fanned out into dirs by the first chars of that hex:
+
+	objects/ab/cd/abcd1234...   FanOutLevels 2, FanOutWidth 2
+	objects/staging/<id>/       objects of a unitOfWork till it commits
+	objects/tmp/                objects being written by SaveCAS
+
+Objects are written to a temp file, synced, then renamed in place, so an
+object in the CAS is always whole.
+
+Objects are sealed with the keyring, the hash is of what was saved and not of
+what is on disk. They are sealed without associated data, the hash is checked
+by VerifyCAS.
+*/
+
 const (
 	objectDirName = "objects"
+	// stagingDirName and tmpDirName are in objectDirName. They can't clash
+	// with the CAS dirs, those are hex.
+	stagingDirName = "staging"
+	tmpDirName     = "tmp"
+
+	defaultFanOutLevels = 2
+	defaultFanOutWidth  = 2
 )
 
+// ObjectStoreKind is where objects are kept.
 type ObjectStoreKind uint8
 
 const (
-	localDisk   ObjectStoreKind = iota
-	googleCloud                 // example
+	// ObjectStoreDisk is a dir on a disk, which can be a NAS mount. See
+	// NewObjectStore.
+	ObjectStoreDisk ObjectStoreKind = iota
+	// ObjectStoreS3 is a bucket of an S3 compatible store. See
+	// NewRemoteObjectStore.
+	ObjectStoreS3
+	// ObjectStoreWebDAV is a collection on a WebDAV server. See
+	// NewRemoteObjectStore.
+	ObjectStoreWebDAV
 )
 
 var (
-	ErrFileStoreKind = errors.New("file store kind not supported")
+	ErrFileStoreKind      = errors.New("file store kind not supported")
+	ErrObjectNotFound     = errors.New("object not found in CAS")
+	ErrObjectCorrupted    = errors.New("object in CAS does not match its hash")
+	ErrObjectHashMismatch = errors.New("data does not match the hash it is saved under")
+	ErrFreeSpaceUnknown   = errors.New("free space of the disk is unknown on this os")
 )
 
 type objectStorer interface {
 	ports.FileStorer
 
-	// Open takes st (storageType eg. google cloud, local disk, etc. which are
-	// available as exported variables from this file), paths of the files to be
-	//  opened and filesHolder, an empty slice of type port.File to be populated
-	// with the opened files.
+	// Open takes st (the ObjectStoreKind the files are on, only ObjectStoreDisk
+	// for now), paths of the files to be opened and filesHolder, an empty slice
+	// of type port.File to be populated with the opened files.
 	Open(ost ObjectStoreKind, paths []string, filesHolder []ports.File) error // todo: rename this to open multiple or some.
 
+	// SaveCAS saves data under hash, which has to be the sha256 of data.
 	SaveCAS(hash [32]byte, data []byte) error
+	// SaveCASFrom saves what it reads from r till EOF under its sha256.
+	SaveCASFrom(r io.Reader) (hash [32]byte, n int64, err error)
 	GetCAS(hash [32]byte) ([]byte, error)
+	// OpenCAS opens the object of hash for reading. Close it when done.
+	OpenCAS(hash [32]byte) (io.ReadCloser, error)
+	// WriteCASTo writes the object of hash to w.
+	WriteCASTo(hash [32]byte, w io.Writer) (n int64, err error)
+	// VerifyCAS checks the object of hash still has that hash.
 	VerifyCAS(hash [32]byte) (bool, error)
+
+	// freeSpace is how many bytes the CAS can still take on its disk. It is
+	// ErrFreeSpaceUnknown where the os can't tell.
+	freeSpace() (int64, error)
+
+	// stageCAS writes data where only commitStaged of stagingID moves it into
+	// the CAS. Use it through a unitOfWork.
+	stageCAS(stagingID uuid.UUID, hash [32]byte, data []byte) error
+	// commitStaged moves every object staged under stagingID into the CAS. It
+	// can be run again if it fails midway.
+	commitStaged(stagingID uuid.UUID) error
+	discardStaged(stagingID uuid.UUID) error
+	// findStaged finds the staging IDs that have objects staged.
+	findStaged() ([]uuid.UUID, error)
+
+	// walkCAS calls fn with every object in the CAS.
+	walkCAS(fn func(hash [32]byte, size int64, modTime time.Time) error) error
+	// collectCAS deletes the object of hash if it was last modified before
+	// olderThan, and returns how many bytes that freed.
+	collectCAS(hash [32]byte, olderThan time.Time) (freed int64, err error)
+	// resealCAS seals again every object, staged or not, that is not sealed
+	// with the current key of the keyring, or not sealed at all. It returns
+	// how many it sealed.
+	resealCAS() (int, error)
 }
 
 var _ objectStorer = (*objectStore)(nil) // To catch methods mismatches.
@@ -52,23 +127,76 @@ var _ objectStorer = (*objectStore)(nil) // To catch methods mismatches.
 type FileStoreConfig struct {
 	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
 
-	// underline thing used to store object
-	// s3, localDisk ,oss, cloudStorage, etc
+	// The CAS on a disk. For S3 or WebDAV see RemoteStoreConfig.
 
 	RootDir string
+	// ObjectsDir is where objects are kept, like a dir on a NAS mount.
+	// Optional, defaults to RootDir.
+	ObjectsDir string
+	// FanOutLevels is how many levels of dirs objects are spread over.
+	// Optional, defaults to 2.
+	FanOutLevels int
+	// FanOutWidth is how many hex chars of the hash name a dir. Optional,
+	// defaults to 2, so 256 dirs a level.
+	FanOutWidth int
+	// Keyring seals every object. It must have its current key already.
+	Keyring *customcrypto.Keyring
 }
 
 type objectStore struct {
 	*FileStoreConfig
+
+	// casMu keeps collectCAS from deleting an object or its dirs while
+	// commitStaged moves an object with the same hash in place.
+	casMu sync.Mutex
 	// todo: if its system disk, we don't need to inject nothing, but if its some external cloud or such storage, then we will allow to inject that here.
 }
 
 func NewObjectStore(cfg *FileStoreConfig) *objectStore {
 	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("FileStoreConfig cannot be nil")
+	case cfg.RootDir == "":
+		log.Fatalln("RootDir cannot be empty")
+	case cfg.FanOutLevels < 0 || cfg.FanOutWidth < 0:
+		log.Fatalln("FanOutLevels and FanOutWidth cannot be negative")
+	case cfg.Keyring == nil || cfg.Keyring.Current() == 0:
+		log.Fatalln("Keyring cannot be nil and must have a current key")
+	}
+
+	if cfg.ObjectsDir == "" {
+		cfg.ObjectsDir = cfg.RootDir
+	}
+	if cfg.FanOutLevels == 0 {
+		cfg.FanOutLevels = defaultFanOutLevels
+	}
+	if cfg.FanOutWidth == 0 {
+		cfg.FanOutWidth = defaultFanOutWidth
+	}
+	if cfg.FanOutLevels*cfg.FanOutWidth >= hex.EncodedLen(sha256.Size) {
+		log.Fatalln("FanOutLevels * FanOutWidth must be less than the length of a hash in hex")
+	}
 
-	return &objectStore{
+	s := &objectStore{
 		FileStoreConfig: cfg,
 	}
+
+	// Nothing writes yet, so whatever is in tmp was left by a crash.
+	if err := os.RemoveAll(s.objectsPath(tmpDirName)); err != nil {
+		log.Fatalf("failed to clear CAS tmp dir: %v", err)
+	}
+	if err := os.MkdirAll(s.objectsPath(), 0700); err != nil {
+		log.Fatalf("failed to make CAS dir: %v", err)
+	}
+	if err := s.relayoutCAS(); err != nil {
+		log.Fatalf("failed to lay out CAS: %v", err)
+	}
+	if _, err := s.resealCAS(); err != nil {
+		log.Fatalf("failed to seal CAS: %v", err)
+	}
+
+	return s
 }
 
 func (s *objectStore) Save() {
@@ -76,10 +204,16 @@ func (s *objectStore) Save() {
 }
 
 func (s *objectStore) Open(kind ObjectStoreKind, paths []string, filesHolder []ports.File) error {
+	return openFiles(kind, paths, filesHolder)
+}
+
+// openFiles opens the files of a capsule, which are always on the disk, the
+// object stores only keep objects.
+func openFiles(kind ObjectStoreKind, paths []string, filesHolder []ports.File) error {
 	// openedFiles := make([]ports.File, 0, len(paths))
 
 	switch kind {
-	case localDisk:
+	case ObjectStoreDisk:
 		for i := range paths {
 			f, err := os.Open(paths[i])
 			if err != nil {
@@ -88,9 +222,6 @@ func (s *objectStore) Open(kind ObjectStoreKind, paths []string, filesHolder []p
 			filesHolder[i] = f
 		}
 
-	case googleCloud:
-		log.Print("google cloud is unavailable")
-
 	default:
 		return ErrFileStoreKind
 	}
@@ -100,53 +231,95 @@ func (s *objectStore) Open(kind ObjectStoreKind, paths []string, filesHolder []p
 
 // SaveCAS stores data in content-addressable manner using hash as key
 func (s *objectStore) SaveCAS(hash [32]byte, data []byte) error {
-	// Todo: do proper validation for hash
-	if len(hash) < 2 {
-		return errors.New("hash too short for CAS storage")
+	if sha256.Sum256(data) != hash {
+		return ErrObjectHashMismatch
 	}
 
-	// Create path: rootDir/objects/ab/cd1234...
-	pathKey := CASPathTransformFunc(hash)
+	_, _, err := s.SaveCASFrom(bytes.NewReader(data))
 
-	// Ensure directory exists
-	if err := os.MkdirAll(pathKey.dirPath, 0700); err != nil {
-		return err
+	return err
+}
+
+func (s *objectStore) SaveCASFrom(r io.Reader) (hash [32]byte, n int64, err error) {
+	tmpDir := s.objectsPath(tmpDirName)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return hash, 0, err
+	}
+
+	f, err := os.CreateTemp(tmpDir, "object-*")
+	if err != nil {
+		return hash, 0, err
 	}
+	// A no-op once it is renamed.
+	defer os.Remove(f.Name())
 
-	return os.WriteFile(pathKey.filename, data, 0600)
+	h := sha256.New()
+	n, err = s.writeSealed(f, io.TeeReader(r, h))
+	if err != nil {
+		return hash, n, err
+	}
+	h.Sum(hash[:0])
+
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	return hash, n, s.moveInPlace(f.Name(), hash)
 }
 
 // GetCAS retrieves data by its content hash
 func (s *objectStore) GetCAS(hash [32]byte) ([]byte, error) {
-	if len(hash) < 2 {
-		return nil, errors.New("hash too short for CAS storage")
+	r, err := s.OpenCAS(hash)
+	if err != nil {
+		return nil, err
 	}
+	defer r.Close()
 
-	pathKey := CASPathTransformFunc(hash)
+	return io.ReadAll(r)
+}
 
-	filePath := filepath.Join(
-		s.RootDir,
-		objectDirName,
-		pathKey.dirPath,
-		pathKey.filename,
-	)
-	return os.ReadFile(filePath)
+func (s *objectStore) OpenCAS(hash [32]byte) (io.ReadCloser, error) {
+	f, err := os.Open(s.casPath(hash))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %x", ErrObjectNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return openSealed(s.Keyring, hash, f)
 }
 
-// ExistsCAS checks if content exists in CAS
-func (s *objectStore) ExistsCAS(hash [32]byte) (bool, error) {
-	if len(hash) < 2 {
-		return false, errors.New("hash too short for CAS storage")
+// openSealed opens the sealed object of hash read from rc. rc is closed if it
+// fails.
+func openSealed(keyring *customcrypto.Keyring, hash [32]byte, rc io.ReadCloser) (io.ReadCloser, error) {
+	r, err := keyring.NewOpenReader(rc, nil)
+	if err != nil {
+		rc.Close()
+		if errors.Is(err, customcrypto.ErrNotSealed) {
+			return nil, fmt.Errorf("%w: %x: %w", ErrObjectCorrupted, hash, err)
+		}
+		return nil, err
 	}
-	pathKey := CASPathTransformFunc(hash)
 
-	filePath := filepath.Join(
-		s.RootDir,
-		objectDirName,
-		pathKey.dirPath,
-		pathKey.filename,
-	)
-	_, err := os.Stat(filePath)
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, rc}, nil
+}
+
+func (s *objectStore) WriteCASTo(hash [32]byte, w io.Writer) (n int64, err error) {
+	r, err := s.OpenCAS(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, r)
+}
+
+// ExistsCAS checks if content exists in CAS
+func (s *objectStore) ExistsCAS(hash [32]byte) (bool, error) {
+	_, err := os.Stat(s.casPath(hash))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return false, nil
@@ -158,45 +331,409 @@ func (s *objectStore) ExistsCAS(hash [32]byte) (bool, error) {
 
 // VerifyCAS retrieves data and verifies its integrity
 func (s *objectStore) VerifyCAS(hash [32]byte) (bool, error) {
-	// Get data
-	data, err := s.GetCAS(hash)
-	if err != nil {
+	return verifyCAS(s, hash)
+}
+
+func verifyCAS(s objectStorer, hash [32]byte) (bool, error) {
+	h := sha256.New()
+	if _, err := s.WriteCASTo(hash, h); err != nil {
+		if errors.Is(err, customcrypto.ErrSealBroken) {
+			return false, fmt.Errorf("%w: %x: %w", ErrObjectCorrupted, hash, err)
+		}
 		return false, err
 	}
 
-	// Compute hash of retrieved data
-	computedHash := sha256.Sum256(data)
-
-	// Compare with expected hash
-	if computedHash != hash {
-		return false, errors.New("hash verification failed: data corrupted or not available")
+	if [32]byte(h.Sum(nil)) != hash {
+		return false, fmt.Errorf("%w: %x", ErrObjectCorrupted, hash)
 	}
 
 	return true, nil
 }
 
-type pathKey struct {
-	dirPath  string
-	filename string
+func (s *objectStore) objectsPath(elem ...string) string {
+	return filepath.Join(append([]string{s.ObjectsDir, objectDirName}, elem...)...)
+}
+
+// casPath is where the object of hash is kept.
+func (s *objectStore) casPath(hash [32]byte) string {
+	name := hex.EncodeToString(hash[:])
+
+	elem := make([]string, 0, s.FanOutLevels+1)
+	for i := range s.FanOutLevels {
+		elem = append(elem, name[i*s.FanOutWidth:(i+1)*s.FanOutWidth])
+	}
+
+	return s.objectsPath(append(elem, name)...)
+}
+
+// moveInPlace renames the synced file at path to where the object of hash is
+// kept. It expects casMu to be held.
+func (s *objectStore) moveInPlace(path string, hash [32]byte) error {
+	dst := s.casPath(hash)
+	dir := filepath.Dir(dst)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(path, dst); err != nil {
+		return err
+	}
+
+	// The rename is only on disk once its dir is.
+	return syncDir(dir)
+}
+
+func (s *objectStore) stagingDir(stagingID uuid.UUID) string {
+	return s.objectsPath(stagingDirName, stagingID.String())
+}
+
+func (s *objectStore) stageCAS(stagingID uuid.UUID, hash [32]byte, data []byte) error {
+	if sha256.Sum256(data) != hash {
+		return ErrObjectHashMismatch
+	}
+
+	dir := s.stagingDir(stagingID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(
+		filepath.Join(dir, hex.EncodeToString(hash[:])),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
+		0600,
+	)
+	if err != nil {
+		return err
+	}
+
+	// NOTICE IMPORTANT: It has to be on disk before the db says it is there.
+	_, err = s.writeSealed(f, bytes.NewReader(data))
+
+	return err
+}
+
+func (s *objectStore) commitStaged(stagingID uuid.UUID) error {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	dir := s.stagingDir(stagingID)
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		// Already moved in a run before.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		hash, isObject := hashFromName(entry.Name())
+		if !isObject {
+			return fmt.Errorf("staged object %s is not named after its hash", entry.Name())
+		}
+
+		if err := s.moveInPlace(filepath.Join(dir, entry.Name()), hash); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func (s *objectStore) discardStaged(stagingID uuid.UUID) error {
+	return os.RemoveAll(s.stagingDir(stagingID))
+}
+
+func (s *objectStore) findStaged() ([]uuid.UUID, error) {
+	entries, err := os.ReadDir(s.objectsPath(stagingDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stagingIDs := make([]uuid.UUID, 0, len(entries))
+	for _, entry := range entries {
+		stagingID, err := uuid.Parse(entry.Name())
+		if err != nil {
+			// Not ours, leave it.
+			continue
+		}
+		stagingIDs = append(stagingIDs, stagingID)
+	}
+
+	return stagingIDs, nil
+}
+
+// walkObjects calls fn with the path of every object under objects, wherever
+// it is in there.
+func (s *objectStore) walkObjects(fn func(path string, hash [32]byte, d fs.DirEntry) error) error {
+	root := s.objectsPath()
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == s.objectsPath(stagingDirName) || path == s.objectsPath(tmpDirName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		hash, isObject := hashFromName(d.Name())
+		if !isObject {
+			// Before objects were named after their whole hash the path was
+			// the hex of the hash split up into dirs.
+			hash, isObject = hashFromName(strings.ReplaceAll(rel, string(filepath.Separator), ""))
+		}
+		if !isObject {
+			// Not an object, leave it.
+			return nil
+		}
+
+		return fn(path, hash, d)
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *objectStore) walkCAS(fn func(hash [32]byte, size int64, modTime time.Time) error) error {
+	return s.walkObjects(func(path string, hash [32]byte, d fs.DirEntry) error {
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(hash, info.Size(), info.ModTime())
+	})
+}
+
+// relayoutCAS moves every object that is not where casPath says, like the
+// objects of an older layout or of another fan-out.
+// todo: this walks the whole CAS on every start. keep the layout in a file in
+// objects and only walk when it changed.
+func (s *objectStore) relayoutCAS() error {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	var misplaced []string
+	err := s.walkObjects(func(path string, hash [32]byte, d fs.DirEntry) error {
+		if path != s.casPath(hash) {
+			misplaced = append(misplaced, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, path := range misplaced {
+		hash, isObject := hashFromName(filepath.Base(path))
+		if !isObject {
+			rel, err := filepath.Rel(s.objectsPath(), path)
+			if err != nil {
+				return err
+			}
+			hash, _ = hashFromName(strings.ReplaceAll(rel, string(filepath.Separator), ""))
+		}
+
+		if err := s.moveInPlace(path, hash); err != nil {
+			return err
+		}
+		s.removeEmptyDirs(filepath.Dir(path))
+	}
+
+	return nil
+}
+
+func (s *objectStore) collectCAS(hash [32]byte, olderThan time.Time) (freed int64, err error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	path := s.casPath(hash)
+
+	// Stat again, it might have been put in place again since it was walked.
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !info.ModTime().Before(olderThan) {
+		return 0, nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return 0, err
+	}
+	s.removeEmptyDirs(filepath.Dir(path))
+
+	return info.Size(), nil
+}
+
+// removeEmptyDirs removes dir and the dirs above it up to objects, till one is
+// not empty. It expects casMu to be held.
+func (s *objectStore) removeEmptyDirs(dir string) {
+	root := s.objectsPath()
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Remove fails on a dir that isn't empty.
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
 }
 
-// CASPathTransformFunc converts a hash into an 8-level directory structure
-func CASPathTransformFunc(hash [32]byte) pathKey {
-	hashStr := hex.EncodeToString(hash[:])
+// hashFromName parses the hex of a hash.
+func hashFromName(name string) (hash [32]byte, isHash bool) {
+	if hex.DecodedLen(len(name)) != len(hash) {
+		return hash, false
+	}
+	if _, err := hex.Decode(hash[:], []byte(name)); err != nil {
+		return hash, false
+	}
 
-	blockSize := 5
-	sliceLen := len(hashStr) / blockSize // 64/5 = 12 blocks (with 4 chars remaining)
-	paths := make([]string, sliceLen)
+	return hash, true
+}
 
-	for i := 0; i < sliceLen; i++ {
-		from, to := i*blockSize, (i*blockSize)+blockSize
-		paths[i] = hashStr[from:to]
+// writeSealed seals r into f, syncs and closes it. It returns how much of r it
+// sealed.
+func (s *objectStore) writeSealed(f *os.File, r io.Reader) (int64, error) {
+	w, err := s.Keyring.NewSealWriter(f, nil)
+	if err != nil {
+		return 0, errors.Join(err, f.Close())
 	}
 
-	return pathKey{
-		dirPath:  filepath.Join(paths...),
-		filename: hashStr[sliceLen*blockSize:], // remaining chars as filename
+	n, err := io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Sync()
 	}
+
+	return n, errors.Join(err, f.Close())
+}
+
+func (s *objectStore) resealCAS() (int, error) {
+	var paths []string
+	err := s.walkObjects(func(path string, hash [32]byte, d fs.DirEntry) error {
+		paths = append(paths, path)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	stagingIDs, err := s.findStaged()
+	if err != nil {
+		return 0, err
+	}
+	for _, stagingID := range stagingIDs {
+		entries, err := os.ReadDir(s.stagingDir(stagingID))
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			paths = append(paths, filepath.Join(s.stagingDir(stagingID), entry.Name()))
+		}
+	}
+
+	var resealed int
+	for _, path := range paths {
+		isResealed, err := s.resealObject(path)
+		if err != nil {
+			return resealed, fmt.Errorf("%s: %w", path, err)
+		}
+		if isResealed {
+			resealed++
+		}
+	}
+
+	return resealed, nil
+}
+
+// resealObject seals the object at path again if it is not sealed with the
+// current key. The object keeps its mod time, the gc goes by it.
+func (s *objectStore) resealObject(path string) (isResealed bool, err error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		// Collected since it was walked.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	header := make([]byte, customcrypto.SealHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	if id, isSealed := customcrypto.SealedKeyID(header[:n]); isSealed && id == s.Keyring.Current() {
+		return false, nil
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	var r io.Reader = f
+	if customcrypto.IsSealed(header[:n]) {
+		// Sealed with an older key.
+		if r, err = s.Keyring.NewOpenReader(f, nil); err != nil {
+			return false, err
+		}
+	}
+
+	tmpDir := s.objectsPath(tmpDirName)
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return false, err
+	}
+	tmp, err := os.CreateTemp(tmpDir, "object-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := s.writeSealed(tmp, r); err != nil {
+		return false, err
+	}
+	if err := os.Chtimes(tmp.Name(), info.ModTime(), info.ModTime()); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+
+	return true, syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(d.Sync(), d.Close())
 }
 
 func (s *objectStore) Create(pathName string) (ports.File, error) {
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+// todo: windows has GetDiskFreeSpaceEx.
+func (s *objectStore) freeSpace() (int64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
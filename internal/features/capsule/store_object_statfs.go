@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import "syscall"
+
+func (s *objectStore) freeSpace() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.ObjectsDir, &st); err != nil {
+		return 0, err
+	}
+
+	// Bavail and not Bfree, what is kept for root is not ours.
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
@@ -0,0 +1,182 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectStoreCAS(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		t.Chdir(t.TempDir())
+		rootDir := t.TempDir()
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: testKeyring})
+
+		data := []byte("a shard")
+		hash := sha256.Sum256(data)
+		require.NoError(t, objects.SaveCAS(hash, data))
+
+		got, err := objects.GetCAS(hash)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		ok, err := objects.VerifyCAS(hash)
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		name := hex.EncodeToString(hash[:])
+		assert.Equal(t, filepath.Join(rootDir, objectDirName, name[:2], name[2:4], name), objects.casPath(hash))
+		assert.FileExists(t, objects.casPath(hash))
+
+		// Nothing goes to the cwd.
+		entries, err := os.ReadDir(".")
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+
+		// Nor is any temp file left.
+		entries, err = os.ReadDir(objects.objectsPath(tmpDirName))
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("save under the wrong hash", func(t *testing.T) {
+		objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+
+		hash := sha256.Sum256([]byte("something else"))
+		require.ErrorIs(t, objects.SaveCAS(hash, []byte("a shard")), ErrObjectHashMismatch)
+
+		assertObjectExists(t, objects, hash, false)
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+
+		data := bytes.Repeat([]byte("block "), 1<<16)
+		hash, n, err := objects.SaveCASFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, sha256.Sum256(data), hash)
+		assert.Equal(t, int64(len(data)), n)
+
+		var buf bytes.Buffer
+		n, err = objects.WriteCASTo(hash, &buf)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), n)
+		assert.Equal(t, data, buf.Bytes())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+		hash := sha256.Sum256([]byte("never saved"))
+
+		_, err := objects.GetCAS(hash)
+		require.ErrorIs(t, err, ErrObjectNotFound)
+
+		_, err = objects.VerifyCAS(hash)
+		require.ErrorIs(t, err, ErrObjectNotFound)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+
+		data := []byte("a shard")
+		hash := sha256.Sum256(data)
+		require.NoError(t, objects.SaveCAS(hash, data))
+		require.NoError(t, os.WriteFile(objects.casPath(hash), []byte("bit rot"), 0600))
+
+		ok, err := objects.VerifyCAS(hash)
+		require.ErrorIs(t, err, ErrObjectCorrupted)
+		assert.False(t, ok)
+	})
+
+	t.Run("fan out", func(t *testing.T) {
+		rootDir := t.TempDir()
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, FanOutLevels: 3, FanOutWidth: 1, Keyring: testKeyring})
+
+		data := []byte("a shard")
+		hash := sha256.Sum256(data)
+		require.NoError(t, objects.SaveCAS(hash, data))
+
+		name := hex.EncodeToString(hash[:])
+		assert.FileExists(t, filepath.Join(rootDir, objectDirName, name[:1], name[1:2], name[2:3], name))
+
+		t.Run("changed", func(t *testing.T) {
+			objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: testKeyring})
+
+			got, err := objects.GetCAS(hash)
+			require.NoError(t, err)
+			assert.Equal(t, data, got)
+
+			_, err = os.Stat(filepath.Join(rootDir, objectDirName, name[:1]))
+			assert.True(t, os.IsNotExist(err), "old dirs are removed")
+		})
+	})
+
+	t.Run("old layout", func(t *testing.T) {
+		rootDir := t.TempDir()
+
+		// Before, the hex of the hash was split into 12 dirs of 5 chars and a
+		// file of the last 4.
+		data := []byte("a shard")
+		hash := sha256.Sum256(data)
+		name := hex.EncodeToString(hash[:])
+
+		var elem []string
+		for i := 0; i < len(name); i += 5 {
+			elem = append(elem, name[i:min(i+5, len(name))])
+		}
+		oldPath := filepath.Join(rootDir, objectDirName, filepath.Join(elem...))
+		require.NoError(t, os.MkdirAll(filepath.Dir(oldPath), 0700))
+		require.NoError(t, os.WriteFile(oldPath, data, 0600))
+
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: testKeyring})
+
+		got, err := objects.GetCAS(hash)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		entries, err := os.ReadDir(objects.objectsPath())
+		require.NoError(t, err)
+		for _, entry := range entries {
+			assert.False(t, strings.HasPrefix(name, entry.Name()) && len(entry.Name()) == 5, "old dirs are removed")
+		}
+	})
+
+	t.Run("objects dir", func(t *testing.T) {
+		rootDir, objectsDir := t.TempDir(), t.TempDir()
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, ObjectsDir: objectsDir, Keyring: testKeyring})
+
+		data := []byte("a shard")
+		hash := sha256.Sum256(data)
+		require.NoError(t, objects.SaveCAS(hash, data))
+
+		name := hex.EncodeToString(hash[:])
+		assert.FileExists(t, filepath.Join(objectsDir, objectDirName, name[:2], name[2:4], name))
+		assert.NoDirExists(t, filepath.Join(rootDir, objectDirName))
+	})
+
+	t.Run("left over temp files are cleared", func(t *testing.T) {
+		rootDir := t.TempDir()
+		objects := NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: testKeyring})
+		require.NoError(t, os.MkdirAll(objects.objectsPath(tmpDirName), 0700))
+		require.NoError(t, os.WriteFile(objects.objectsPath(tmpDirName, "object-1"), []byte("half a sh"), 0600))
+
+		NewObjectStore(&FileStoreConfig{RootDir: rootDir, Keyring: testKeyring})
+
+		_, err := os.Stat(objects.objectsPath(tmpDirName))
+		assert.True(t, os.IsNotExist(err))
+	})
+}
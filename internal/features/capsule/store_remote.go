@@ -0,0 +1,522 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/google/uuid"
+)
+
+/*
+A remote object store keeps the CAS in a store on the network, for guardians
+with little disk of their own. It is laid out like the CAS on disk, as keys:
+
+	ab/cd/abcd1234...     an object
+	staging/<id>/<hash>   objects of a unitOfWork till it commits
+
+Objects are sealed before they leave the peer, the store only ever sees the
+sealed objects and their hashes.
+
+A store can't be made to keep a mod time, so an object that is resealed looks
+new to the gc again. That only keeps it longer.
+*/
+
+const (
+	defaultS3Region = "us-east-1"
+	// remoteTimeout is how long one request to a remote store can take.
+	remoteTimeout = 2 * time.Minute // todo: reevaluate
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobClient is what a remote object store needs of a remote store. Keys are
+// '/' separated.
+type blobClient interface {
+	// put writes all of r under key, size is how long r is.
+	put(ctx context.Context, key string, r io.Reader, size int64) error
+	// get is errBlobNotFound if there is nothing under key.
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	// stat is errBlobNotFound if there is nothing under key.
+	stat(ctx context.Context, key string) (blobInfo, error)
+	// delete does nothing if there is nothing under key.
+	delete(ctx context.Context, key string) error
+	move(ctx context.Context, fromKey, toKey string) error
+	// list calls fn with every blob under dir, which is "" or ends in '/'.
+	list(ctx context.Context, dir string, fn func(blobInfo) error) error
+	// freeSpace is ErrFreeSpaceUnknown if the store can't tell.
+	freeSpace(ctx context.Context) (int64, error)
+}
+
+type blobInfo struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+type RemoteStoreConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	// RootDir is where what is not an object is kept, like the files of a
+	// capsule being unarchived.
+	RootDir string
+	// Keyring seals every object. It must have its current key already.
+	Keyring *customcrypto.Keyring
+	// Kind is ObjectStoreS3 or ObjectStoreWebDAV.
+	Kind ObjectStoreKind
+	// Endpoint is the url of the store, like https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000 for MinIO. For WebDAV it is the url of the
+	// collection the objects go in.
+	Endpoint string
+	// Bucket is the bucket the objects go in. S3 only.
+	Bucket string
+	// Region is the region of Bucket. S3 only, optional, defaults to
+	// us-east-1.
+	Region string
+	// User and Secret are the access key ID and secret access key for S3, or
+	// the user and password for WebDAV.
+	User   string
+	Secret string
+	// HTTPClient is what requests are made with. Optional.
+	HTTPClient *http.Client
+}
+
+type remoteObjectStore struct {
+	*RemoteStoreConfig
+	client blobClient
+
+	// casMu keeps collectCAS from deleting an object while it is put in place
+	// again.
+	casMu sync.Mutex
+}
+
+var _ objectStorer = (*remoteObjectStore)(nil) // To catch methods mismatches.
+
+func NewRemoteObjectStore(cfg *RemoteStoreConfig) *remoteObjectStore {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("RemoteStoreConfig cannot be nil")
+	case cfg.RootDir == "":
+		log.Fatalln("RootDir cannot be empty")
+	case cfg.Keyring == nil || cfg.Keyring.Current() == 0:
+		log.Fatalln("Keyring cannot be nil and must have a current key")
+	case cfg.Endpoint == "":
+		log.Fatalln("Endpoint cannot be empty")
+	case cfg.Kind == ObjectStoreS3 && (cfg.Bucket == "" || cfg.User == "" || cfg.Secret == ""):
+		log.Fatalln("Bucket, User and Secret cannot be empty for S3")
+	}
+
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: remoteTimeout}
+	}
+
+	s := &remoteObjectStore{
+		RemoteStoreConfig: cfg,
+	}
+
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	switch cfg.Kind {
+	case ObjectStoreS3:
+		if cfg.Region == "" {
+			cfg.Region = defaultS3Region
+		}
+		s.client = &s3Client{
+			httpClient: cfg.HTTPClient,
+			endpoint:   endpoint,
+			bucket:     cfg.Bucket,
+			region:     cfg.Region,
+			accessKey:  cfg.User,
+			secretKey:  cfg.Secret,
+			now:        time.Now,
+		}
+	case ObjectStoreWebDAV:
+		s.client = &webDAVClient{
+			httpClient: cfg.HTTPClient,
+			endpoint:   endpoint,
+			user:       cfg.User,
+			password:   cfg.Secret,
+		}
+	default:
+		log.Fatalf("Kind %d is not a remote object store", cfg.Kind)
+	}
+
+	// Nothing writes yet, so whatever is in tmp was left by a crash.
+	if err := os.RemoveAll(s.tmpDir()); err != nil {
+		log.Fatalf("failed to clear remote CAS tmp dir: %v", err)
+	}
+	if _, err := s.resealCAS(); err != nil {
+		log.Fatalf("failed to seal remote CAS: %v", err)
+	}
+
+	return s
+}
+
+func (s *remoteObjectStore) Open(kind ObjectStoreKind, paths []string, filesHolder []ports.File) error {
+	return openFiles(kind, paths, filesHolder)
+}
+
+func (s *remoteObjectStore) Create(pathName string) (ports.File, error) {
+	return os.Create(filepath.Join(s.RootDir, pathName))
+}
+
+func (s *remoteObjectStore) MkdirAll(dirPath string) error {
+	return os.MkdirAll(filepath.Join(s.RootDir, dirPath), 0700)
+}
+
+func (s *remoteObjectStore) SaveCAS(hash [32]byte, data []byte) error {
+	if sha256.Sum256(data) != hash {
+		return ErrObjectHashMismatch
+	}
+
+	_, _, err := s.SaveCASFrom(bytes.NewReader(data))
+
+	return err
+}
+
+func (s *remoteObjectStore) SaveCASFrom(r io.Reader) (hash [32]byte, n int64, err error) {
+	h := sha256.New()
+	f, n, err := s.sealToTemp(io.TeeReader(r, h))
+	if err != nil {
+		return hash, n, err
+	}
+	defer removeTemp(f)
+	h.Sum(hash[:0])
+
+	return hash, n, s.putFile(casKey(hash), f)
+}
+
+// sealToTemp seals r into a temp file and leaves it at its start, as a store
+// needs to know how big an object is before it takes it. It returns how much
+// of r it sealed.
+func (s *remoteObjectStore) sealToTemp(r io.Reader) (*os.File, int64, error) {
+	if err := os.MkdirAll(s.tmpDir(), 0700); err != nil {
+		return nil, 0, err
+	}
+	f, err := os.CreateTemp(s.tmpDir(), "object-*")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	w, err := s.Keyring.NewSealWriter(f, nil)
+	if err != nil {
+		removeTemp(f)
+		return nil, 0, err
+	}
+
+	n, err := io.Copy(w, r)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		removeTemp(f)
+		return nil, n, err
+	}
+
+	return f, n, nil
+}
+
+// putFile puts the sealed object in f under key.
+func (s *remoteObjectStore) putFile(key string, f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	return s.client.put(context.Background(), key, f, info.Size())
+}
+
+func removeTemp(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (s *remoteObjectStore) GetCAS(hash [32]byte) ([]byte, error) {
+	r, err := s.OpenCAS(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func (s *remoteObjectStore) OpenCAS(hash [32]byte) (io.ReadCloser, error) {
+	rc, err := s.client.get(context.Background(), casKey(hash))
+	if errors.Is(err, errBlobNotFound) {
+		return nil, fmt.Errorf("%w: %x", ErrObjectNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return openSealed(s.Keyring, hash, rc)
+}
+
+func (s *remoteObjectStore) WriteCASTo(hash [32]byte, w io.Writer) (n int64, err error) {
+	r, err := s.OpenCAS(hash)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return io.Copy(w, r)
+}
+
+func (s *remoteObjectStore) VerifyCAS(hash [32]byte) (bool, error) {
+	return verifyCAS(s, hash)
+}
+
+func (s *remoteObjectStore) freeSpace() (int64, error) {
+	return s.client.freeSpace(context.Background())
+}
+
+func (s *remoteObjectStore) stageCAS(stagingID uuid.UUID, hash [32]byte, data []byte) error {
+	if sha256.Sum256(data) != hash {
+		return ErrObjectHashMismatch
+	}
+
+	f, _, err := s.sealToTemp(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer removeTemp(f)
+
+	// NOTICE IMPORTANT: It has to be in the store before the db says it is
+	// there.
+	return s.putFile(stagedKey(stagingID, hash), f)
+}
+
+func (s *remoteObjectStore) commitStaged(stagingID uuid.UUID) error {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	ctx := context.Background()
+
+	var keys []string
+	err := s.client.list(ctx, stagingKeyDir(stagingID), func(info blobInfo) error {
+		keys = append(keys, info.key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Whatever was moved in a run before is not listed anymore.
+	for _, key := range keys {
+		hash, isObject := hashFromName(path.Base(key))
+		if !isObject {
+			return fmt.Errorf("staged object %s is not named after its hash", key)
+		}
+
+		if err := s.client.move(ctx, key, casKey(hash)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *remoteObjectStore) discardStaged(stagingID uuid.UUID) error {
+	ctx := context.Background()
+
+	return s.client.list(ctx, stagingKeyDir(stagingID), func(info blobInfo) error {
+		return s.client.delete(ctx, info.key)
+	})
+}
+
+func (s *remoteObjectStore) findStaged() ([]uuid.UUID, error) {
+	seen := make(map[uuid.UUID]struct{})
+	var stagingIDs []uuid.UUID
+	err := s.client.list(context.Background(), stagingDirName+"/", func(info blobInfo) error {
+		dir, _, _ := strings.Cut(strings.TrimPrefix(info.key, stagingDirName+"/"), "/")
+		stagingID, err := uuid.Parse(dir)
+		if err != nil {
+			// Not ours, leave it.
+			return nil
+		}
+		if _, isSeen := seen[stagingID]; !isSeen {
+			seen[stagingID] = struct{}{}
+			stagingIDs = append(stagingIDs, stagingID)
+		}
+		return nil
+	})
+
+	return stagingIDs, err
+}
+
+// walkObjects calls fn with every object in the CAS, and the staged ones too if
+// withStaged.
+func (s *remoteObjectStore) walkObjects(withStaged bool, fn func(info blobInfo, hash [32]byte) error) error {
+	return s.client.list(context.Background(), "", func(info blobInfo) error {
+		hash, isObject := hashFromName(path.Base(info.key))
+		switch {
+		case !isObject:
+			// Not an object, leave it.
+			return nil
+		case info.key == casKey(hash):
+		case withStaged && strings.HasPrefix(info.key, stagingDirName+"/"):
+		default:
+			return nil
+		}
+
+		return fn(info, hash)
+	})
+}
+
+func (s *remoteObjectStore) walkCAS(fn func(hash [32]byte, size int64, modTime time.Time) error) error {
+	return s.walkObjects(false, func(info blobInfo, hash [32]byte) error {
+		return fn(hash, info.size, info.modTime)
+	})
+}
+
+func (s *remoteObjectStore) collectCAS(hash [32]byte, olderThan time.Time) (freed int64, err error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	ctx := context.Background()
+
+	// Stat again, it might have been put in place again since it was walked.
+	info, err := s.client.stat(ctx, casKey(hash))
+	if errors.Is(err, errBlobNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !info.modTime.Before(olderThan) {
+		return 0, nil
+	}
+
+	if err := s.client.delete(ctx, info.key); err != nil {
+		return 0, err
+	}
+
+	return info.size, nil
+}
+
+func (s *remoteObjectStore) resealCAS() (int, error) {
+	var keys []string
+	err := s.walkObjects(true, func(info blobInfo, hash [32]byte) error {
+		keys = append(keys, info.key)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var resealed int
+	for _, key := range keys {
+		isResealed, err := s.resealObject(key)
+		if err != nil {
+			return resealed, fmt.Errorf("%s: %w", key, err)
+		}
+		if isResealed {
+			resealed++
+		}
+	}
+
+	return resealed, nil
+}
+
+// resealObject seals the object under key again if it is not sealed with the
+// current key.
+func (s *remoteObjectStore) resealObject(key string) (isResealed bool, err error) {
+	s.casMu.Lock()
+	defer s.casMu.Unlock()
+
+	ctx := context.Background()
+
+	rc, err := s.client.get(ctx, key)
+	if errors.Is(err, errBlobNotFound) {
+		// Collected since it was walked.
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+
+	header := make([]byte, customcrypto.SealHeaderSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+	if id, isSealed := customcrypto.SealedKeyID(header[:n]); isSealed && id == s.Keyring.Current() {
+		return false, nil
+	}
+
+	r := io.MultiReader(bytes.NewReader(header[:n]), rc)
+	if customcrypto.IsSealed(header[:n]) {
+		// Sealed with an older key.
+		if r, err = s.Keyring.NewOpenReader(r, nil); err != nil {
+			return false, err
+		}
+	}
+
+	f, _, err := s.sealToTemp(r)
+	if err != nil {
+		return false, err
+	}
+	defer removeTemp(f)
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// casMu is already held.
+	return true, s.client.put(ctx, key, f, info.Size())
+}
+
+func (s *remoteObjectStore) tmpDir() string {
+	return filepath.Join(s.RootDir, objectDirName, tmpDirName)
+}
+
+// casKey is the key of the object of hash, fanned out like the CAS on disk by
+// default.
+func casKey(hash [32]byte) string {
+	name := hex.EncodeToString(hash[:])
+
+	elem := make([]string, 0, defaultFanOutLevels+1)
+	for i := range defaultFanOutLevels {
+		elem = append(elem, name[i*defaultFanOutWidth:(i+1)*defaultFanOutWidth])
+	}
+
+	return path.Join(append(elem, name)...)
+}
+
+func stagingKeyDir(stagingID uuid.UUID) string {
+	return path.Join(stagingDirName, stagingID.String()) + "/"
+}
+
+func stagedKey(stagingID uuid.UUID, hash [32]byte) string {
+	return stagingKeyDir(stagingID) + hex.EncodeToString(hash[:])
+}
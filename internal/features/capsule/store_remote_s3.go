@@ -0,0 +1,365 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+/*
+s3Client speaks the part of the S3 api the remote object store needs, with
+path style urls so it works with MinIO and the like too:
+
+	put     PUT /<bucket>/<key>
+	get     GET /<bucket>/<key>
+	stat    HEAD /<bucket>/<key>
+	delete  DELETE /<bucket>/<key>
+	move    PUT /<bucket>/<to key> with x-amz-copy-source, then delete
+	list    GET /<bucket>?list-type=2&prefix=<dir>
+
+Every request is signed with AWS signature v4. The payload is not signed, the
+objects are sealed already and the connection is tls.
+*/
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3DateFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+type s3Client struct {
+	httpClient *http.Client
+	endpoint   string
+	bucket     string
+	region     string
+	accessKey  string
+	secretKey  string
+	now        func() time.Time
+}
+
+func (c *s3Client) put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := c.newRequest(ctx, http.MethodPut, key, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *s3Client) stat(ctx context.Context, key string) (blobInfo, error) {
+	req, err := c.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return blobInfo{}, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	if err != nil {
+		return blobInfo{}, fmt.Errorf("s3 %s: Last-Modified: %w", key, err)
+	}
+
+	return blobInfo{key: key, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	// S3 says 204 for a key that is not there too.
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *s3Client) move(ctx context.Context, fromKey, toKey string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, toKey, nil, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-amz-copy-source", s3EscapePath("/"+c.bucket+"/"+fromKey))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A copy can fail after the 200 is sent, it is then in the body.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(body, []byte("<Error>")) {
+		return fmt.Errorf("s3 copy %s to %s: %w", fromKey, toKey, s3ErrorFrom(resp.StatusCode, body))
+	}
+
+	return c.delete(ctx, fromKey)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		Size         int64  `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (c *s3Client) list(ctx context.Context, dir string, fn func(blobInfo) error) error {
+	var token string
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {dir},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		req, err := c.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list %s: %w", dir, err)
+		}
+
+		for _, obj := range result.Contents {
+			modTime, err := time.Parse(time.RFC3339, obj.LastModified)
+			if err != nil {
+				return fmt.Errorf("s3 list %s: LastModified: %w", dir, err)
+			}
+			if err := fn(blobInfo{key: obj.Key, size: obj.Size, modTime: modTime}); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// freeSpace can't be told, a bucket has no size of its own.
+func (c *s3Client) freeSpace(ctx context.Context) (int64, error) {
+	return 0, ErrFreeSpaceUnknown
+}
+
+func (c *s3Client) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	p := "/" + c.bucket
+	if key != "" {
+		p += "/" + key
+	}
+
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path += p
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	return http.NewRequestWithContext(ctx, method, u.String(), body)
+}
+
+// do signs req and sends it. A response that is not a 2xx is an error, and
+// errBlobNotFound if it is a 404.
+func (c *s3Client) do(req *http.Request) (*http.Response, error) {
+	c.sign(req, c.now())
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<10))
+	err = s3ErrorFrom(resp.StatusCode, body)
+	if resp.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: %w", errBlobNotFound, err)
+	}
+
+	return nil, fmt.Errorf("s3 %s %s: %w", req.Method, req.URL.Path, err)
+}
+
+func s3ErrorFrom(status int, body []byte) error {
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &s3Err) != nil || s3Err.Code == "" {
+		return fmt.Errorf("status %d", status)
+	}
+
+	return fmt.Errorf("status %d: %s: %s", status, s3Err.Code, s3Err.Message)
+}
+
+// sign signs req with AWS signature v4, over every header it has and its host.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format(s3DateFormat)
+	scope := strings.Join([]string{amzDate[:8], c.region, s3Service, "aws4_request"}, "/")
+
+	req.Header.Set("x-amz-date", amzDate)
+	if req.Header.Get("x-amz-content-sha256") == "" {
+		req.Header.Set("x-amz-content-sha256", s3UnsignedPayload)
+	}
+
+	headers := req.Header.Clone()
+	headers.Set("Host", req.URL.Host)
+	signedHeaders := make([]string, 0, len(headers))
+	for name := range headers {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	slices.Sort(signedHeaders)
+
+	canonical := s3CanonicalRequest(
+		req.Method, req.URL.EscapedPath(), req.URL.RawQuery,
+		headers, signedHeaders, req.Header.Get("x-amz-content-sha256"),
+	)
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, c.accessKey, scope, strings.Join(signedHeaders, ";"),
+		s3Signature(c.secretKey, amzDate, scope, canonical),
+	))
+}
+
+func s3CanonicalRequest(method, escapedPath, rawQuery string, headers http.Header, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		values := headers.Values(name)
+		for i := range values {
+			values[i] = strings.Join(strings.Fields(values[i]), " ")
+		}
+		fmt.Fprintf(&b, "%s:%s\n", name, strings.Join(values, ","))
+	}
+
+	return strings.Join([]string{
+		method,
+		escapedPath,
+		rawQuery,
+		b.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func s3Signature(secretKey, amzDate, scope, canonicalRequest string) string {
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(sum[:])}, "\n")
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		key = s3HMAC(key, part)
+	}
+
+	return hex.EncodeToString(s3HMAC(key, stringToSign))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery is query sorted and escaped the way v4 signs it, which is
+// also a fine query to send.
+func s3CanonicalQuery(query url.Values) string {
+	pairs := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(name)+"="+s3Escape(v))
+		}
+	}
+	slices.Sort(pairs)
+
+	return strings.Join(pairs, "&")
+}
+
+func s3EscapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i := range parts {
+		parts[i] = s3Escape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// s3Escape escapes everything but the unreserved chars, what v4 signs is
+// escaped like this and not like url.PathEscape does.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+var _ blobClient = (*s3Client)(nil)
@@ -0,0 +1,395 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+/*
+webDAVClient keeps blobs as files under the collection of its endpoint, with
+a collection for every dir of a key:
+
+	put     PUT to tmp/<id>, then MOVE in place, so a blob is never half there
+	get     GET
+	stat    PROPFIND with Depth 0
+	delete  DELETE
+	move    MOVE, making the collections of the key first
+	list    PROPFIND with Depth 1 on every collection under the dir, as
+	        servers often refuse Depth infinity
+
+freeSpace is quota-available-bytes (RFC 4331), if the server has it.
+*/
+
+const webDAVPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:quota-available-bytes/>
+</D:prop></D:propfind>`
+
+type webDAVClient struct {
+	httpClient *http.Client
+	endpoint   string
+	user       string
+	password   string
+
+	// hasTmp is whether the tmp collection was made.
+	hasTmp atomic.Bool
+}
+
+func (c *webDAVClient) put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if !c.hasTmp.Load() {
+		if err := c.mkcolAll(ctx, tmpDirName); err != nil {
+			return err
+		}
+		c.hasTmp.Store(true)
+	}
+
+	tmpKey := path.Join(tmpDirName, uuid.NewString())
+
+	// The caller closes r.
+	req, err := c.newRequest(ctx, http.MethodPut, tmpKey, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := c.do(req)
+	if errors.Is(err, errWebDAVConflict) {
+		// tmp was removed under us, it is made again on the next put.
+		c.hasTmp.Store(false)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if err := c.move(ctx, tmpKey, key); err != nil {
+		return errors.Join(err, c.delete(ctx, tmpKey))
+	}
+
+	return nil
+}
+
+func (c *webDAVClient) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+func (c *webDAVClient) stat(ctx context.Context, key string) (blobInfo, error) {
+	var info blobInfo
+	err := c.propfind(ctx, key, "0", func(r webDAVResponse) error {
+		if r.isCollection() {
+			return fmt.Errorf("webdav %s: %w: is a collection", key, errBlobNotFound)
+		}
+
+		var err error
+		info, err = r.blobInfo(key)
+		return err
+	})
+
+	return info, err
+}
+
+func (c *webDAVClient) delete(ctx context.Context, key string) error {
+	req, err := c.newRequest(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *webDAVClient) move(ctx context.Context, fromKey, toKey string) error {
+	if dir := path.Dir(toKey); dir != "." {
+		if err := c.mkcolAll(ctx, dir); err != nil {
+			return err
+		}
+	}
+
+	req, err := c.newRequest(ctx, "MOVE", fromKey, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", c.url(toKey).String())
+	req.Header.Set("Overwrite", "T")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (c *webDAVClient) list(ctx context.Context, dir string, fn func(blobInfo) error) error {
+	var subDirs []string
+	err := c.propfind(ctx, dir, "1", func(r webDAVResponse) error {
+		key, err := c.keyOf(r.Href)
+		if err != nil {
+			return err
+		}
+		if r.isCollection() {
+			if key != strings.TrimSuffix(dir, "/") {
+				subDirs = append(subDirs, key+"/")
+			}
+			return nil
+		}
+
+		info, err := r.blobInfo(key)
+		if err != nil {
+			return err
+		}
+
+		return fn(info)
+	})
+	if errors.Is(err, errBlobNotFound) {
+		// Nothing was ever put under dir.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, subDir := range subDirs {
+		if err := c.list(ctx, subDir, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *webDAVClient) freeSpace(ctx context.Context) (int64, error) {
+	free := int64(-1)
+	err := c.propfind(ctx, "", "0", func(r webDAVResponse) error {
+		if r.Prop.QuotaAvailableBytes == "" {
+			return nil
+		}
+
+		var err error
+		free, err = strconv.ParseInt(strings.TrimSpace(r.Prop.QuotaAvailableBytes), 10, 64)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if free < 0 {
+		return 0, ErrFreeSpaceUnknown
+	}
+
+	return free, nil
+}
+
+// mkcolAll makes the collection of dir and the ones above it.
+func (c *webDAVClient) mkcolAll(ctx context.Context, dir string) error {
+	var made string
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		made = path.Join(made, name)
+
+		req, err := c.newRequest(ctx, "MKCOL", made+"/", nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.do(req)
+		if errors.Is(err, errWebDAVExists) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
+
+type webDAVMultistatus struct {
+	Responses []webDAVResponse `xml:"DAV: response"`
+}
+
+type webDAVResponse struct {
+	Href string `xml:"DAV: href"`
+	// Prop is the props of the propstat that is a 200, the others are of
+	// props the server doesn't have.
+	Prop webDAVProp
+}
+
+type webDAVProp struct {
+	ResourceType struct {
+		Collection *struct{} `xml:"DAV: collection"`
+	} `xml:"DAV: resourcetype"`
+	ContentLength       string `xml:"DAV: getcontentlength"`
+	LastModified        string `xml:"DAV: getlastmodified"`
+	QuotaAvailableBytes string `xml:"DAV: quota-available-bytes"`
+}
+
+func (r *webDAVResponse) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var raw struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop   webDAVProp `xml:"DAV: prop"`
+			Status string     `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	}
+	if err := d.DecodeElement(&raw, &start); err != nil {
+		return err
+	}
+
+	r.Href = raw.Href
+	for _, ps := range raw.Propstats {
+		if strings.Contains(ps.Status, " 200 ") {
+			r.Prop = ps.Prop
+		}
+	}
+
+	return nil
+}
+
+func (r *webDAVResponse) isCollection() bool {
+	return r.Prop.ResourceType.Collection != nil
+}
+
+func (r *webDAVResponse) blobInfo(key string) (blobInfo, error) {
+	size, err := strconv.ParseInt(strings.TrimSpace(r.Prop.ContentLength), 10, 64)
+	if err != nil {
+		return blobInfo{}, fmt.Errorf("webdav %s: getcontentlength: %w", key, err)
+	}
+	modTime, err := http.ParseTime(r.Prop.LastModified)
+	if err != nil {
+		return blobInfo{}, fmt.Errorf("webdav %s: getlastmodified: %w", key, err)
+	}
+
+	return blobInfo{key: key, size: size, modTime: modTime}, nil
+}
+
+func (c *webDAVClient) propfind(ctx context.Context, key, depth string, fn func(webDAVResponse) error) error {
+	req, err := c.newRequest(ctx, "PROPFIND", key, strings.NewReader(webDAVPropfind))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var ms webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return fmt.Errorf("webdav propfind %s: %w", key, err)
+	}
+
+	for _, r := range ms.Responses {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var (
+	// errWebDAVConflict is a 409, the collection of a key is not there.
+	errWebDAVConflict = errors.New("webdav conflict")
+	// errWebDAVExists is a 405 to a MKCOL, the collection is there already.
+	errWebDAVExists = errors.New("webdav collection exists")
+)
+
+// do sends req. A response that is not a 2xx is an error, errBlobNotFound if
+// it is a 404.
+func (c *webDAVClient) do(req *http.Request) (*http.Response, error) {
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	err = fmt.Errorf("status %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = errBlobNotFound
+	case resp.StatusCode == http.StatusConflict:
+		err = errWebDAVConflict
+	case resp.StatusCode == http.StatusMethodNotAllowed && req.Method == "MKCOL":
+		err = errWebDAVExists
+	}
+
+	return nil, fmt.Errorf("webdav %s %s: %w", req.Method, req.URL.Path, err)
+}
+
+func (c *webDAVClient) newRequest(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, method, c.url(key).String(), body)
+}
+
+func (c *webDAVClient) url(key string) *url.URL {
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		// Checked when the store is made.
+		panic(err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+
+	return u
+}
+
+// keyOf is the key of href, which a server can send as a path or a whole url.
+func (c *webDAVClient) keyOf(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+
+	base := strings.TrimSuffix(c.url("").Path, "/")
+	key, isUnder := strings.CutPrefix(strings.TrimSuffix(u.Path, "/"), base)
+	if !isUnder {
+		return "", fmt.Errorf("webdav href %s is not under %s", href, base)
+	}
+
+	return strings.TrimPrefix(key, "/"), nil
+}
+
+var _ blobClient = (*webDAVClient)(nil)
@@ -0,0 +1,1239 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+var (
+	ErrUnsupportedValue = errors.New("value is not kept in this collection")
+)
+
+/*
+The sqlite schema. Every collection of the bbolt store is a table here, and the
+slices inside values (a capsule's guardians, a manifest's blocks) get their own
+tables so they can be queried.
+
+	capsules            a capsule we are a guardian of. the root, most tables hang off it.
+	capsule_guardians   the guardians of a capsule, in the order the owner sent them.
+	shards              the shards we hold. looked up by capsule and by repair group.
+	manifests           the manifest of a capsule, one per capsule.
+	manifest_blocks     the blocks of a manifest, each block being one repair group.
+	manifest_provider_shards
+	                    the shards of a manifest the owner put with storage providers.
+	manifest_shards     the shards of a manifest the owner put with the guardians.
+	key_shares          our share of a capsule's master key, one per capsule.
+	heartbeats          the last we heard of a capsule's owner, one per capsule.
+	guardians           other guardians we know of.
+	peers               remote peers we have been connected to.
+	units_of_work       units of work that are committed but might not be finished.
+	provider_shards     the shards we hold as a storage provider. they hang off no
+	                    capsule, a provider never knows the capsule of a shard.
+	audit_scores        how the peers holding shards for us did in our audits.
+
+The columns in sealedColumns are sealed with the keyring, the rest are left
+plain so they can still be queried. IDs are random and say nothing of who owns
+or guards a capsule, the owner and guardian IDs do and are sealed. sqlite keeps
+a blob in a text column as is, so sealed columns keep the type they had.
+
+NOTICE IMPORTANT: Everything hanging off a capsule is deleted with it (ON DELETE
+CASCADE). Upserts must be ON CONFLICT DO UPDATE and never INSERT OR REPLACE,
+sqlite does a replace as a delete and would take the capsule's shards with it.
+
+todo: capsule_guardians.guardian_id has no foreign key to guardians, the IDs
+we get from owners are not in guardians yet.
+*/
+
+type capsuleRow struct {
+	bun.BaseModel `bun:"table:capsules"`
+
+	ID                       uuid.UUID `bun:"id,pk,type:text"`
+	OwnerID                  []byte    `bun:"owner_id,notnull,type:text"`
+	CreatedAt                time.Time `bun:"created_at,nullzero"`
+	ReceivedAt               time.Time `bun:"received_at,nullzero"`
+	CompletedAt              time.Time `bun:"completed_at,nullzero"`
+	AreShardsReceived        bool      `bun:"are_shards_received,notnull"`
+	IsManifestReceived       bool      `bun:"is_manifest_received,notnull"`
+	IsKeyMasterShareReceived bool      `bun:"is_key_master_share_received,notnull"`
+	IsComplete               bool      `bun:"is_complete,notnull"`
+}
+
+type capsuleGuardianRow struct {
+	bun.BaseModel `bun:"table:capsule_guardians"`
+
+	CapsuleID  uuid.UUID `bun:"capsule_id,pk,type:text"`
+	Position   int       `bun:"position,pk"`
+	GuardianID []byte    `bun:"guardian_id,notnull,type:text"`
+}
+
+type shardRow struct {
+	bun.BaseModel `bun:"table:shards"`
+
+	ID             uuid.UUID `bun:"id,pk,type:text"`
+	CapsuleID      uuid.UUID `bun:"capsule_id,notnull,type:text"`
+	RepairGroupID  uuid.UUID `bun:"repair_group_id,notnull,type:text"`
+	Hash           []byte    `bun:"hash,notnull"`
+	Nonce          []byte    `bun:"nonce"`
+	Size           uint32    `bun:"size,notnull"`
+	DataShardNum   uint8     `bun:"data_shard_num,notnull"`
+	ParityShardNum uint8     `bun:"parity_shard_num,notnull"`
+}
+
+type manifestRow struct {
+	bun.BaseModel `bun:"table:manifests"`
+
+	CapsuleID   uuid.UUID `bun:"capsule_id,pk,type:text"`
+	TotalBlocks uint64    `bun:"total_blocks,notnull"`
+}
+
+type manifestBlockRow struct {
+	bun.BaseModel `bun:"table:manifest_blocks"`
+
+	CapsuleID      uuid.UUID `bun:"capsule_id,pk,type:text"`
+	Position       int       `bun:"position,pk"`
+	RepairGroupID  uuid.UUID `bun:"repair_group_id,notnull,type:text"`
+	DataShardNum   uint8     `bun:"data_shard_num,notnull"`
+	ParityShardNum uint8     `bun:"parity_shard_num,notnull"`
+	Nonce          []byte    `bun:"nonce"` // nil for blocks from before the repair.
+}
+
+type manifestProviderShardRow struct {
+	bun.BaseModel `bun:"table:manifest_provider_shards"`
+
+	CapsuleID         uuid.UUID `bun:"capsule_id,pk,type:text"`
+	Position          int       `bun:"position,pk"`
+	ShardID           uuid.UUID `bun:"shard_id,notnull,type:text"`
+	RepairGroupID     uuid.UUID `bun:"repair_group_id,notnull,type:text"`
+	Hash              []byte    `bun:"hash,notnull"`
+	Size              uint32    `bun:"size,notnull"`
+	Nonce             []byte    `bun:"nonce"`
+	ProviderPublicKey []byte    `bun:"provider_public_key,notnull"`
+	ProviderAddr      []byte    `bun:"provider_addr,notnull,type:varchar"`
+	MerkleRoot        []byte    `bun:"merkle_root"` // nil for shards from before audits.
+}
+
+type manifestShardRow struct {
+	bun.BaseModel `bun:"table:manifest_shards"`
+
+	CapsuleID         uuid.UUID `bun:"capsule_id,pk,type:text"`
+	Position          int       `bun:"position,pk"`
+	ShardID           uuid.UUID `bun:"shard_id,notnull,type:text"`
+	RepairGroupID     uuid.UUID `bun:"repair_group_id,notnull,type:text"`
+	Hash              []byte    `bun:"hash,notnull"`
+	Size              uint32    `bun:"size,notnull"`
+	MerkleRoot        []byte    `bun:"merkle_root,notnull"`
+	GuardianPublicKey []byte    `bun:"guardian_public_key,notnull"`
+	GuardianAddr      []byte    `bun:"guardian_addr,type:varchar"` // nil for shards from before the repair.
+}
+
+type keyShareRow struct {
+	bun.BaseModel `bun:"table:key_shares"`
+
+	CapsuleID       uuid.UUID `bun:"capsule_id,pk,type:text"`
+	Share           []byte    `bun:"share,notnull"`
+	TotalShares     int       `bun:"total_shares,notnull"`
+	ThresholdShares int       `bun:"threshold_shares,notnull"`
+}
+
+type heartbeatRow struct {
+	bun.BaseModel `bun:"table:heartbeats"`
+
+	CapsuleID     uuid.UUID     `bun:"capsule_id,pk,type:text"`
+	LastSeenAt    time.Time     `bun:"last_seen_at,nullzero"`
+	SilencePeriod time.Duration `bun:"silence_period,notnull"`
+}
+
+type guardianRow struct {
+	bun.BaseModel `bun:"table:guardians"`
+
+	ID   uuid.UUID `bun:"id,pk,type:text"`
+	Name []byte    `bun:"name,type:varchar"`
+	Type string    `bun:"type"`
+	Addr []byte    `bun:"addr,type:varchar"`
+}
+
+type peerRow struct {
+	bun.BaseModel `bun:"table:peers"`
+
+	ID         uuid.UUID `bun:"id,pk,type:text"`
+	PublicKey  []byte    `bun:"public_key,notnull,unique"`
+	Addr       []byte    `bun:"addr,type:varchar"`
+	LastSeenAt time.Time `bun:"last_seen_at,nullzero"`
+}
+
+type providerShardRow struct {
+	bun.BaseModel `bun:"table:provider_shards"`
+
+	Hash       string    `bun:"hash,pk"` // hex, the key it is kept under.
+	OwnerID    []byte    `bun:"owner_id,notnull,type:text"`
+	Size       uint32    `bun:"size,notnull"`
+	ReceivedAt time.Time `bun:"received_at,nullzero"`
+}
+
+type auditScoreRow struct {
+	bun.BaseModel `bun:"table:audit_scores"`
+
+	PublicKeyStr string    `bun:"public_key_str,pk"`
+	PublicKey    []byte    `bun:"public_key,notnull"`
+	Passed       uint32    `bun:"passed,notnull"`
+	Failed       uint32    `bun:"failed,notnull"`
+	LastAuditAt  time.Time `bun:"last_audit_at,nullzero"`
+	LastFailedAt time.Time `bun:"last_failed_at,nullzero"`
+}
+
+type unitOfWorkRow struct {
+	bun.BaseModel `bun:"table:units_of_work"`
+
+	ID        uuid.UUID `bun:"id,pk,type:text"`
+	CreatedAt time.Time `bun:"created_at,notnull"`
+}
+
+// schema is every table of the first migration with its foreign keys, parents
+// first. Tables added later are in their own migration.
+var schema = []struct {
+	model       any
+	foreignKeys []string
+}{
+	{model: (*capsuleRow)(nil)},
+	{
+		model:       (*capsuleGuardianRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "capsules" ("id") ON DELETE CASCADE`},
+	},
+	{
+		model:       (*shardRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "capsules" ("id") ON DELETE CASCADE`},
+	},
+	{
+		model:       (*manifestRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "capsules" ("id") ON DELETE CASCADE`},
+	},
+	{
+		model:       (*manifestBlockRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "manifests" ("capsule_id") ON DELETE CASCADE`},
+	},
+	{
+		model:       (*keyShareRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "capsules" ("id") ON DELETE CASCADE`},
+	},
+	{
+		model:       (*heartbeatRow)(nil),
+		foreignKeys: []string{`("capsule_id") REFERENCES "capsules" ("id") ON DELETE CASCADE`},
+	},
+	{model: (*guardianRow)(nil)},
+	{model: (*peerRow)(nil)},
+}
+
+var indices = []struct {
+	model   any
+	name    string
+	columns []string
+}{
+	{(*capsuleRow)(nil), "capsules_owner_id_idx", []string{"owner_id"}},
+	{(*capsuleGuardianRow)(nil), "capsule_guardians_guardian_id_idx", []string{"guardian_id"}},
+	{(*shardRow)(nil), "shards_capsule_id_idx", []string{"capsule_id"}},
+	{(*shardRow)(nil), "shards_repair_group_id_idx", []string{"repair_group_id"}},
+	{(*shardRow)(nil), "shards_hash_idx", []string{"hash"}},
+	{(*manifestBlockRow)(nil), "manifest_blocks_repair_group_id_idx", []string{"repair_group_id"}},
+}
+
+// sealedColumn is a column whose values are sealed, and the pk of its table.
+type sealedColumn struct {
+	table  string
+	column string
+	pk     []string
+}
+
+var (
+	sealedOwnerID    = sealedColumn{"capsules", "owner_id", []string{"id"}}
+	sealedGuardianID = sealedColumn{"capsule_guardians", "guardian_id", []string{"capsule_id", "position"}}
+	sealedShardNonce = sealedColumn{"shards", "nonce", []string{"id"}}
+	sealedKeyShare   = sealedColumn{"key_shares", "share", []string{"capsule_id"}}
+	sealedGuardName  = sealedColumn{"guardians", "name", []string{"id"}}
+	sealedGuardAddr  = sealedColumn{"guardians", "addr", []string{"id"}}
+	sealedPeerAddr   = sealedColumn{"peers", "addr", []string{"id"}}
+
+	sealedProviderShardNonce = sealedColumn{"manifest_provider_shards", "nonce", []string{"capsule_id", "position"}}
+	sealedProviderPublicKey  = sealedColumn{"manifest_provider_shards", "provider_public_key", []string{"capsule_id", "position"}}
+	sealedProviderAddr       = sealedColumn{"manifest_provider_shards", "provider_addr", []string{"capsule_id", "position"}}
+	sealedProviderOwnerID    = sealedColumn{"provider_shards", "owner_id", []string{"hash"}}
+	sealedGuardianPublicKey  = sealedColumn{"manifest_shards", "guardian_public_key", []string{"capsule_id", "position"}}
+	sealedGuardianAddr       = sealedColumn{"manifest_shards", "guardian_addr", []string{"capsule_id", "position"}}
+	sealedBlockNonce         = sealedColumn{"manifest_blocks", "nonce", []string{"capsule_id", "position"}}
+
+	sealedColumns = []sealedColumn{
+		sealedOwnerID,
+		sealedGuardianID,
+		sealedShardNonce,
+		sealedKeyShare,
+		sealedGuardName,
+		sealedGuardAddr,
+		sealedPeerAddr,
+		sealedProviderShardNonce,
+		sealedProviderPublicKey,
+		sealedProviderAddr,
+		sealedProviderOwnerID,
+		sealedGuardianPublicKey,
+		sealedGuardianAddr,
+		sealedBlockNonce,
+	}
+)
+
+// ad ties a sealed value to its row and column, so it can't be moved to
+// another.
+func (c sealedColumn) ad(pk ...any) []byte {
+	ad := c.table + "." + c.column
+	for _, v := range pk {
+		ad += "/" + fmt.Sprint(v)
+	}
+	return []byte(ad)
+}
+
+type SQLiteDBStoreConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	DB *bun.DB
+	// Keyring seals the columns in sealedColumns. It must have its current
+	// key already.
+	Keyring *customcrypto.Keyring
+}
+
+type sqliteDBStore struct {
+	*SQLiteDBStoreConfig
+}
+
+var _ dbStorer = (*sqliteDBStore)(nil)
+
+func NewSQLiteDBStore(cfg *SQLiteDBStoreConfig) *sqliteDBStore {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("store config is nil")
+	case cfg.DB == nil:
+		log.Fatalln("invalid store config: DB is nil")
+	case cfg.Keyring == nil || cfg.Keyring.Current() == 0:
+		log.Fatalln("invalid store config: Keyring is nil or has no current key")
+	}
+
+	s := &sqliteDBStore{
+		SQLiteDBStoreConfig: cfg,
+	}
+
+	_, _, err := storage.MigrateSQLite(context.Background(), cfg.DB, string(featureCapsule), sqliteMigrations)
+	if err != nil {
+		log.Fatalf("failed to migrate capsule db: %v", err)
+	}
+
+	if _, err := s.reseal(); err != nil {
+		log.Fatalf("failed to seal capsule db: %v", err)
+	}
+
+	return s
+}
+
+// todo: dbStorer doesn't take a ctx yet, so nothing here can be cancelled.
+
+func (s *sqliteDBStore) createOrUpdate(coll database.Collection, key string, v any) error {
+	return s.write(context.Background(), s.DB, coll, key, v)
+}
+
+func (s *sqliteDBStore) write(ctx context.Context, db bun.IDB, coll database.Collection, key string, v any) error {
+	switch v := v.(type) {
+	case *capsule:
+		id, err := uuid.Parse(key)
+		if err != nil {
+			return err
+		}
+		return s.upsertCapsule(ctx, db, id, v)
+
+	case shardMetaData:
+		row, err := s.shardToRow(&v)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, row, "id")
+	case *shardMetaData:
+		row, err := s.shardToRow(v)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, row, "id")
+
+	case *message.CapsuleIncomingManifestStream:
+		return s.upsertManifest(ctx, db, v)
+
+	case *masterKeyShare:
+		share, err := s.seal(sealedKeyShare, v.Share, v.CapsuleID)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, &keyShareRow{
+			CapsuleID:       v.CapsuleID,
+			Share:           share,
+			TotalShares:     v.TotalShares,
+			ThresholdShares: v.ThresholdShares,
+		}, "capsule_id")
+
+	case *heartbeat:
+		return upsert(ctx, db, &heartbeatRow{
+			CapsuleID:     v.CapsuleID,
+			LastSeenAt:    v.LastSeenAt,
+			SilencePeriod: v.SilencePeriod,
+		}, "capsule_id")
+
+	case *guardian:
+		name, err := s.seal(sealedGuardName, []byte(v.Name), v.ID)
+		if err != nil {
+			return err
+		}
+		addr, err := s.seal(sealedGuardAddr, []byte(v.Addr), v.ID)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, &guardianRow{ID: v.ID, Name: name, Type: v.Type, Addr: addr}, "id")
+
+	case *knownPeer:
+		addr, err := s.seal(sealedPeerAddr, []byte(v.Addr), v.ID)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, &peerRow{
+			ID:         v.ID,
+			PublicKey:  v.PublicKey,
+			Addr:       addr,
+			LastSeenAt: v.LastSeenAt,
+		}, "id")
+
+	case *unitOfWorkRecord:
+		return upsert(ctx, db, &unitOfWorkRow{ID: v.ID, CreatedAt: v.CreatedAt}, "id")
+
+	case *providerShard:
+		hash := hex.EncodeToString(v.Hash[:])
+		ownerID, err := s.seal(sealedProviderOwnerID, []byte(v.OwnerID.String()), hash)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, db, &providerShardRow{
+			Hash:       hash,
+			OwnerID:    ownerID,
+			Size:       v.Size,
+			ReceivedAt: v.ReceivedAt,
+		}, "hash")
+
+	case *auditScore:
+		return upsert(ctx, db, &auditScoreRow{
+			PublicKeyStr: key,
+			PublicKey:    v.PublicKey,
+			Passed:       v.Passed,
+			Failed:       v.Failed,
+			LastAuditAt:  v.LastAuditAt,
+			LastFailedAt: v.LastFailedAt,
+		}, "public_key_str")
+
+	default:
+		return fmt.Errorf("%w: %T in %s", ErrUnsupportedValue, v, coll.BucketName())
+	}
+}
+
+// upsert inserts row, or updates every column of the row with the same pk.
+func upsert(ctx context.Context, db bun.IDB, row any, pk string) error {
+	q := db.NewInsert().Model(row).On(fmt.Sprintf("CONFLICT (%s) DO UPDATE", pk))
+
+	for _, field := range db.Dialect().Tables().Get(reflect.TypeOf(row)).DataFields {
+		q = q.Set("? = EXCLUDED.?", field.SQLName, field.SQLName)
+	}
+
+	_, err := q.Exec(ctx)
+	return err
+}
+
+func (s *sqliteDBStore) upsertCapsule(ctx context.Context, db bun.IDB, id uuid.UUID, c *capsule) error {
+	ownerID, err := s.seal(sealedOwnerID, []byte(c.OwnerID.String()), id)
+	if err != nil {
+		return err
+	}
+
+	rows := make([]capsuleGuardianRow, len(c.GuardianIDs))
+	for i := range c.GuardianIDs {
+		guardianID, err := s.seal(sealedGuardianID, []byte(c.GuardianIDs[i].String()), id, i)
+		if err != nil {
+			return err
+		}
+		rows[i] = capsuleGuardianRow{CapsuleID: id, Position: i, GuardianID: guardianID}
+	}
+
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := upsert(ctx, tx, &capsuleRow{
+			ID:                       id,
+			OwnerID:                  ownerID,
+			CreatedAt:                c.CreatedAt,
+			ReceivedAt:               c.ReceivedAt,
+			CompletedAt:              c.CompletedAt,
+			AreShardsReceived:        c.AreShardsReceived,
+			IsManifestReceived:       c.IsManifestReceived,
+			IsKeyMasterShareReceived: c.IsKeyMasterShareReceived,
+			IsComplete:               c.IsComplete,
+		}, "id")
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewDelete().
+			Model((*capsuleGuardianRow)(nil)).
+			Where("capsule_id = ?", id).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		if len(rows) == 0 {
+			return nil
+		}
+		_, err = tx.NewInsert().Model(&rows).Exec(ctx)
+
+		return err
+	})
+}
+
+func (s *sqliteDBStore) upsertManifest(ctx context.Context, db bun.IDB, m *message.CapsuleIncomingManifestStream) error {
+	providerRows := make([]manifestProviderShardRow, len(m.ProviderShards))
+	for i, ps := range m.ProviderShards {
+		nonce, err := s.seal(sealedProviderShardNonce, ps.Nonce, m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+		publicKey, err := s.seal(sealedProviderPublicKey, ps.ProviderPublicKey, m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+		addr, err := s.seal(sealedProviderAddr, []byte(ps.ProviderAddr), m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+
+		providerRows[i] = manifestProviderShardRow{
+			CapsuleID:         m.CapsuleID,
+			Position:          i,
+			ShardID:           ps.ShardID,
+			RepairGroupID:     ps.RepairGroupID,
+			Hash:              ps.Hash[:],
+			Size:              ps.Size,
+			Nonce:             nonce,
+			ProviderPublicKey: publicKey,
+			ProviderAddr:      addr,
+			MerkleRoot:        ps.MerkleRoot[:],
+		}
+	}
+
+	shardRows := make([]manifestShardRow, len(m.Shards))
+	for i, sm := range m.Shards {
+		publicKey, err := s.seal(sealedGuardianPublicKey, sm.GuardianPublicKey, m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+		addr, err := s.seal(sealedGuardianAddr, []byte(sm.GuardianAddr), m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+
+		shardRows[i] = manifestShardRow{
+			CapsuleID:         m.CapsuleID,
+			Position:          i,
+			ShardID:           sm.ShardID,
+			RepairGroupID:     sm.RepairGroupID,
+			Hash:              sm.Hash[:],
+			Size:              sm.Size,
+			MerkleRoot:        sm.MerkleRoot[:],
+			GuardianPublicKey: publicKey,
+			GuardianAddr:      addr,
+		}
+	}
+
+	blockRows := make([]manifestBlockRow, len(m.Blocks))
+	for i, b := range m.Blocks {
+		nonce, err := s.seal(sealedBlockNonce, b.Nonce, m.CapsuleID, i)
+		if err != nil {
+			return err
+		}
+
+		blockRows[i] = manifestBlockRow{
+			CapsuleID:      m.CapsuleID,
+			Position:       i,
+			RepairGroupID:  b.RepairGroupID,
+			DataShardNum:   b.DataShardNum,
+			ParityShardNum: b.ParityShardNum,
+			Nonce:          nonce,
+		}
+	}
+
+	return db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := upsert(ctx, tx, &manifestRow{
+			CapsuleID:   m.CapsuleID,
+			TotalBlocks: m.TotalBlocks,
+		}, "capsule_id")
+		if err != nil {
+			return err
+		}
+
+		for _, model := range []any{(*manifestBlockRow)(nil), (*manifestProviderShardRow)(nil), (*manifestShardRow)(nil)} {
+			_, err = tx.NewDelete().
+				Model(model).
+				Where("capsule_id = ?", m.CapsuleID).
+				Exec(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(providerRows) > 0 {
+			if _, err := tx.NewInsert().Model(&providerRows).Exec(ctx); err != nil {
+				return err
+			}
+		}
+		if len(shardRows) > 0 {
+			if _, err := tx.NewInsert().Model(&shardRows).Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		if len(blockRows) == 0 {
+			return nil
+		}
+
+		_, err = tx.NewInsert().Model(&blockRows).Exec(ctx)
+
+		return err
+	})
+}
+
+// find fills value, which has to be a pointer to what was stored under key.
+func (s *sqliteDBStore) find(coll database.Collection, key string, value any) (exists bool, err error) {
+	ctx := context.Background()
+
+	switch v := value.(type) {
+	case *capsule:
+		var row capsuleRow
+		if exists, err := s.selectOne(ctx, &row, "id", key); !exists || err != nil {
+			return exists, err
+		}
+
+		var guardianRows []capsuleGuardianRow
+		err := s.DB.NewSelect().
+			Model(&guardianRows).
+			Where("capsule_id = ?", key).
+			Order("position").
+			Scan(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		ownerID, err := s.openUUID(sealedOwnerID, row.OwnerID, row.ID)
+		if err != nil {
+			return false, err
+		}
+
+		var guardianIDs []uuid.UUID
+		for _, g := range guardianRows {
+			guardianID, err := s.openUUID(sealedGuardianID, g.GuardianID, g.CapsuleID, g.Position)
+			if err != nil {
+				return false, err
+			}
+			guardianIDs = append(guardianIDs, guardianID)
+		}
+
+		*v = capsule{
+			OwnerID:                  ownerID,
+			GuardianIDs:              guardianIDs,
+			CreatedAt:                row.CreatedAt,
+			ReceivedAt:               row.ReceivedAt,
+			CompletedAt:              row.CompletedAt,
+			AreShardsReceived:        row.AreShardsReceived,
+			IsManifestReceived:       row.IsManifestReceived,
+			IsKeyMasterShareReceived: row.IsKeyMasterShareReceived,
+			IsComplete:               row.IsComplete,
+		}
+
+	case *shardMetaData:
+		var row shardRow
+		if exists, err := s.selectOne(ctx, &row, "id", key); !exists || err != nil {
+			return exists, err
+		}
+		if *v, err = s.rowToShard(&row); err != nil {
+			return false, err
+		}
+
+	case *message.CapsuleIncomingManifestStream:
+		var row manifestRow
+		if exists, err := s.selectOne(ctx, &row, "capsule_id", key); !exists || err != nil {
+			return exists, err
+		}
+
+		var blockRows []manifestBlockRow
+		err := s.DB.NewSelect().
+			Model(&blockRows).
+			Where("capsule_id = ?", key).
+			Order("position").
+			Scan(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		var providerRows []manifestProviderShardRow
+		err = s.DB.NewSelect().
+			Model(&providerRows).
+			Where("capsule_id = ?", key).
+			Order("position").
+			Scan(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		var shardRows []manifestShardRow
+		err = s.DB.NewSelect().
+			Model(&shardRows).
+			Where("capsule_id = ?", key).
+			Order("position").
+			Scan(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		*v = message.CapsuleIncomingManifestStream{
+			CapsuleID:   row.CapsuleID,
+			TotalBlocks: row.TotalBlocks,
+		}
+		for _, b := range blockRows {
+			nonce, err := s.open(sealedBlockNonce, b.Nonce, b.CapsuleID, b.Position)
+			if err != nil {
+				return false, err
+			}
+			v.Blocks = append(v.Blocks, message.BlockManifest{
+				RepairGroupID:  b.RepairGroupID,
+				DataShardNum:   b.DataShardNum,
+				ParityShardNum: b.ParityShardNum,
+				Nonce:          nonce,
+			})
+		}
+		for _, p := range providerRows {
+			ps, err := s.rowToProviderShardManifest(&p)
+			if err != nil {
+				return false, err
+			}
+			v.ProviderShards = append(v.ProviderShards, ps)
+		}
+		for _, r := range shardRows {
+			publicKey, err := s.open(sealedGuardianPublicKey, r.GuardianPublicKey, r.CapsuleID, r.Position)
+			if err != nil {
+				return false, err
+			}
+			addr, err := s.open(sealedGuardianAddr, r.GuardianAddr, r.CapsuleID, r.Position)
+			if err != nil {
+				return false, err
+			}
+			sm := message.ShardManifest{
+				ShardID:           r.ShardID,
+				RepairGroupID:     r.RepairGroupID,
+				Size:              r.Size,
+				GuardianPublicKey: publicKey,
+				GuardianAddr:      string(addr),
+			}
+			copy(sm.Hash[:], r.Hash)
+			copy(sm.MerkleRoot[:], r.MerkleRoot)
+			v.Shards = append(v.Shards, sm)
+		}
+
+	case *masterKeyShare:
+		var row keyShareRow
+		if exists, err := s.selectOne(ctx, &row, "capsule_id", key); !exists || err != nil {
+			return exists, err
+		}
+		share, err := s.open(sealedKeyShare, row.Share, row.CapsuleID)
+		if err != nil {
+			return false, err
+		}
+		*v = masterKeyShare{
+			CapsuleID:       row.CapsuleID,
+			Share:           share,
+			TotalShares:     row.TotalShares,
+			ThresholdShares: row.ThresholdShares,
+		}
+
+	case *heartbeat:
+		var row heartbeatRow
+		if exists, err := s.selectOne(ctx, &row, "capsule_id", key); !exists || err != nil {
+			return exists, err
+		}
+		*v = heartbeat{
+			CapsuleID:     row.CapsuleID,
+			LastSeenAt:    row.LastSeenAt,
+			SilencePeriod: row.SilencePeriod,
+		}
+
+	case *guardian:
+		var row guardianRow
+		if exists, err := s.selectOne(ctx, &row, "id", key); !exists || err != nil {
+			return exists, err
+		}
+		name, err := s.open(sealedGuardName, row.Name, row.ID)
+		if err != nil {
+			return false, err
+		}
+		addr, err := s.open(sealedGuardAddr, row.Addr, row.ID)
+		if err != nil {
+			return false, err
+		}
+		*v = guardian{ID: row.ID, Name: string(name), Type: row.Type, Addr: string(addr)}
+
+	case *knownPeer:
+		var row peerRow
+		if exists, err := s.selectOne(ctx, &row, "id", key); !exists || err != nil {
+			return exists, err
+		}
+		addr, err := s.open(sealedPeerAddr, row.Addr, row.ID)
+		if err != nil {
+			return false, err
+		}
+		*v = knownPeer{
+			ID:         row.ID,
+			PublicKey:  row.PublicKey,
+			Addr:       string(addr),
+			LastSeenAt: row.LastSeenAt,
+		}
+
+	case *providerShard:
+		var row providerShardRow
+		if exists, err := s.selectOne(ctx, &row, "hash", key); !exists || err != nil {
+			return exists, err
+		}
+		hash, err := hex.DecodeString(row.Hash)
+		if err != nil || len(hash) != 32 {
+			return false, fmt.Errorf("provider shard hash %q is not a sha256", row.Hash)
+		}
+		ownerID, err := s.openUUID(sealedProviderOwnerID, row.OwnerID, row.Hash)
+		if err != nil {
+			return false, err
+		}
+		*v = providerShard{
+			Hash:       [32]byte(hash),
+			Size:       row.Size,
+			OwnerID:    ownerID,
+			ReceivedAt: row.ReceivedAt,
+		}
+
+	case *auditScore:
+		var row auditScoreRow
+		if exists, err := s.selectOne(ctx, &row, "public_key_str", key); !exists || err != nil {
+			return exists, err
+		}
+		*v = auditScore{
+			PublicKey:    row.PublicKey,
+			Passed:       row.Passed,
+			Failed:       row.Failed,
+			LastAuditAt:  row.LastAuditAt,
+			LastFailedAt: row.LastFailedAt,
+		}
+
+	default:
+		return false, fmt.Errorf("%w: %T in %s", ErrUnsupportedValue, value, coll.BucketName())
+	}
+
+	return true, nil
+}
+
+func (s *sqliteDBStore) selectOne(ctx context.Context, row any, pk string, key string) (exists bool, err error) {
+	err = s.DB.NewSelect().Model(row).Where("? = ?", bun.Ident(pk), key).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (s *sqliteDBStore) delete(coll database.Collection, key string) error {
+	return remove(context.Background(), s.DB, coll, key)
+}
+
+func remove(ctx context.Context, db bun.IDB, coll database.Collection, key string) error {
+	var (
+		model any
+		pk    = "capsule_id"
+	)
+
+	switch coll {
+	case database.CollCapsules:
+		model, pk = (*capsuleRow)(nil), "id"
+	case database.CollCapsulesActiveShards:
+		model, pk = (*shardRow)(nil), "id"
+	case database.CollCapsuleManifests:
+		model = (*manifestRow)(nil)
+	case database.CollKeyShares:
+		model = (*keyShareRow)(nil)
+	case database.CollHeartbeats:
+		model = (*heartbeatRow)(nil)
+	case database.CollGuardians:
+		model, pk = (*guardianRow)(nil), "id"
+	case database.CollPeers:
+		model, pk = (*peerRow)(nil), "id"
+	case database.CollUnitsOfWork:
+		model, pk = (*unitOfWorkRow)(nil), "id"
+	case database.CollProviderShards:
+		model, pk = (*providerShardRow)(nil), "hash"
+	case database.CollAuditScores:
+		model, pk = (*auditScoreRow)(nil), "public_key_str"
+	default:
+		return fmt.Errorf("%w: nothing is kept in %s", ErrUnsupportedValue, coll.BucketName())
+	}
+
+	_, err := db.NewDelete().
+		Model(model).
+		Where("? = ?", bun.Ident(pk), key).
+		Exec(ctx)
+
+	return err
+}
+
+func (s *sqliteDBStore) commit(writes []dbWrite) error {
+	return s.DB.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		for _, w := range writes {
+			var err error
+			if w.isDelete {
+				err = remove(ctx, tx, w.coll, w.key)
+			} else {
+				err = s.write(ctx, tx, w.coll, w.key, w.v)
+			}
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", w.coll.BucketName(), w.key, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *sqliteDBStore) findUnitsOfWork() ([]unitOfWorkRecord, error) {
+	var rows []unitOfWorkRow
+	err := s.DB.NewSelect().Model(&rows).Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]unitOfWorkRecord, len(rows))
+	for i := range rows {
+		records[i] = unitOfWorkRecord{ID: rows[i].ID, CreatedAt: rows[i].CreatedAt}
+	}
+
+	return records, nil
+}
+
+func (s *sqliteDBStore) findShardsByRepairGroup(repairGroupID uuid.UUID) ([]shardMetaData, error) {
+	var rows []shardRow
+	err := s.DB.NewSelect().
+		Model(&rows).
+		Where("repair_group_id = ?", repairGroupID).
+		Scan(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([]shardMetaData, len(rows))
+	for i := range rows {
+		if shards[i], err = s.rowToShard(&rows[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return shards, nil
+}
+
+func (s *sqliteDBStore) findManifestCapsuleIDs() ([]uuid.UUID, error) {
+	var capsuleIDs []uuid.UUID
+	err := s.DB.NewSelect().
+		Model((*manifestRow)(nil)).
+		Column("capsule_id").
+		Scan(context.Background(), &capsuleIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	return capsuleIDs, nil
+}
+
+func (s *sqliteDBStore) findShardHashes() ([][32]byte, error) {
+	var rows [][]byte
+	err := s.DB.NewSelect().
+		Model((*shardRow)(nil)).
+		Column("hash").
+		Scan(context.Background(), &rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var providerHashes []string
+	err = s.DB.NewSelect().
+		Model((*providerShardRow)(nil)).
+		Column("hash").
+		Scan(context.Background(), &providerHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][32]byte, 0, len(rows)+len(providerHashes))
+	for _, hash := range rows {
+		if len(hash) != 32 {
+			return nil, fmt.Errorf("shard hash is %d bytes", len(hash))
+		}
+		hashes = append(hashes, [32]byte(hash))
+	}
+	for _, hexHash := range providerHashes {
+		hash, err := hex.DecodeString(hexHash)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("provider shard hash %q is not a sha256", hexHash)
+		}
+		hashes = append(hashes, [32]byte(hash))
+	}
+
+	return hashes, nil
+}
+
+// findUsageByOwner sums the shards by capsule in sql, the owners are sealed so
+// they are put together here.
+func (s *sqliteDBStore) findUsageByOwner() (map[uuid.UUID]int64, error) {
+	ctx := context.Background()
+
+	var byCapsule []struct {
+		CapsuleID uuid.UUID `bun:"capsule_id"`
+		Size      int64     `bun:"size"`
+	}
+	err := s.DB.NewSelect().
+		Model((*shardRow)(nil)).
+		Column("capsule_id").
+		ColumnExpr("SUM(size) AS size").
+		Group("capsule_id").
+		Scan(ctx, &byCapsule)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []capsuleRow
+	err = s.DB.NewSelect().
+		Model(&rows).
+		Column("id", "owner_id").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[uuid.UUID]uuid.UUID, len(rows))
+	for _, row := range rows {
+		if owners[row.ID], err = s.openUUID(sealedOwnerID, row.OwnerID, row.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	usage := make(map[uuid.UUID]int64)
+	for _, c := range byCapsule {
+		usage[owners[c.CapsuleID]] += c.Size
+	}
+
+	// Shards we hold as a storage provider have their owner on them.
+	var providerRows []providerShardRow
+	err = s.DB.NewSelect().
+		Model(&providerRows).
+		Column("hash", "owner_id", "size").
+		Scan(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range providerRows {
+		ownerID, err := s.openUUID(sealedProviderOwnerID, row.OwnerID, row.Hash)
+		if err != nil {
+			return nil, err
+		}
+		usage[ownerID] += int64(row.Size)
+	}
+
+	return usage, nil
+}
+
+func (s *sqliteDBStore) shardToRow(sm *shardMetaData) (*shardRow, error) {
+	nonce, err := s.seal(sealedShardNonce, sm.nonce, sm.shardID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shardRow{
+		ID:             sm.shardID,
+		CapsuleID:      sm.capsuleID,
+		RepairGroupID:  sm.repairGroupID,
+		Hash:           sm.hash[:],
+		Nonce:          nonce,
+		Size:           sm.size,
+		DataShardNum:   sm.dataShardNum,
+		ParityShardNum: sm.parityShardNum,
+	}, nil
+}
+
+func (s *sqliteDBStore) rowToShard(row *shardRow) (shardMetaData, error) {
+	nonce, err := s.open(sealedShardNonce, row.Nonce, row.ID)
+	if err != nil {
+		return shardMetaData{}, err
+	}
+
+	sm := shardMetaData{
+		capsuleID:      row.CapsuleID,
+		shardID:        row.ID,
+		repairGroupID:  row.RepairGroupID,
+		nonce:          nonce,
+		size:           row.Size,
+		dataShardNum:   row.DataShardNum,
+		parityShardNum: row.ParityShardNum,
+	}
+	copy(sm.hash[:], row.Hash)
+
+	return sm, nil
+}
+
+func (s *sqliteDBStore) rowToProviderShardManifest(row *manifestProviderShardRow) (message.ProviderShardManifest, error) {
+	nonce, err := s.open(sealedProviderShardNonce, row.Nonce, row.CapsuleID, row.Position)
+	if err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+	publicKey, err := s.open(sealedProviderPublicKey, row.ProviderPublicKey, row.CapsuleID, row.Position)
+	if err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+	addr, err := s.open(sealedProviderAddr, row.ProviderAddr, row.CapsuleID, row.Position)
+	if err != nil {
+		return message.ProviderShardManifest{}, err
+	}
+
+	ps := message.ProviderShardManifest{
+		ShardID:           row.ShardID,
+		RepairGroupID:     row.RepairGroupID,
+		Size:              row.Size,
+		Nonce:             nonce,
+		ProviderPublicKey: publicKey,
+		ProviderAddr:      string(addr),
+	}
+	copy(ps.Hash[:], row.Hash)
+	copy(ps.MerkleRoot[:], row.MerkleRoot)
+
+	return ps, nil
+}
+
+func (s *sqliteDBStore) seal(c sealedColumn, v []byte, pk ...any) ([]byte, error) {
+	return s.Keyring.Seal(v, c.ad(pk...))
+}
+
+func (s *sqliteDBStore) open(c sealedColumn, v []byte, pk ...any) ([]byte, error) {
+	opened, err := s.Keyring.Open(v, c.ad(pk...))
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s %v: %w", c.table, c.column, pk, err)
+	}
+	return opened, nil
+}
+
+func (s *sqliteDBStore) openUUID(c sealedColumn, v []byte, pk ...any) (uuid.UUID, error) {
+	opened, err := s.open(c, v, pk...)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return uuid.ParseBytes(opened)
+}
+
+// reseal seals every value of sealedColumns that is not sealed with the current
+// key. Values from before there was sealing are sealed as they are, which is
+// what they are sealed as now too.
+func (s *sqliteDBStore) reseal() (int, error) {
+	current := s.Keyring.Current()
+
+	var resealed int
+	err := s.DB.RunInTx(context.Background(), nil, func(ctx context.Context, tx bun.Tx) error {
+		for _, c := range sealedColumns {
+			var rows []map[string]any
+			err := tx.NewSelect().
+				Table(c.table).
+				Column(append(slices.Clone(c.pk), c.column)...).
+				Scan(ctx, &rows)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range rows {
+				v := sqlBytes(row[c.column])
+				if id, isSealed := customcrypto.SealedKeyID(v); isSealed && id == current {
+					continue
+				}
+
+				pk := make([]any, len(c.pk))
+				for i, name := range c.pk {
+					pk[i] = row[name]
+					if b, isBytes := pk[i].([]byte); isBytes {
+						pk[i] = string(b)
+					}
+				}
+
+				if customcrypto.IsSealed(v) {
+					if v, err = s.open(c, v, pk...); err != nil {
+						return err
+					}
+				}
+				sealed, err := s.seal(c, v, pk...)
+				if err != nil {
+					return err
+				}
+
+				q := tx.NewUpdate().Table(c.table).Set("? = ?", bun.Ident(c.column), sealed)
+				for _, name := range c.pk {
+					q = q.Where("? = ?", bun.Ident(name), row[name])
+				}
+				if _, err := q.Exec(ctx); err != nil {
+					return err
+				}
+				resealed++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return resealed, nil
+}
+
+// sqlBytes is a value scanned into any as bytes. sqlite gives text as a string.
+func sqlBytes(v any) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,242 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestSQLiteDBStoreRoundTrip(t *testing.T) {
+	s := newTestSQLiteDBStore(t)
+	capsuleID := uuid.New()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	c := &capsule{
+		OwnerID:     uuid.New(),
+		GuardianIDs: []uuid.UUID{uuid.New(), uuid.New(), uuid.New()},
+		CreatedAt:   now,
+		ReceivedAt:  now,
+	}
+	require.NoError(t, s.createOrUpdate(database.CollCapsules, capsuleID.String(), c))
+
+	var gotCapsule capsule
+	exists, err := s.find(database.CollCapsules, capsuleID.String(), &gotCapsule)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, c.GuardianIDs, gotCapsule.GuardianIDs)
+	assert.True(t, c.ReceivedAt.Equal(gotCapsule.ReceivedAt))
+	assert.Equal(t, c.OwnerID, gotCapsule.OwnerID)
+
+	shard := newTestShard(capsuleID, uuid.New())
+	// The service hands shards over by value.
+	require.NoError(t, s.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard))
+
+	var gotShard shardMetaData
+	exists, err = s.find(database.CollCapsulesActiveShards, shard.shardID.String(), &gotShard)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, shard, gotShard)
+
+	manifest := &message.CapsuleIncomingManifestStream{
+		CapsuleID:   capsuleID,
+		TotalBlocks: 2,
+		Blocks: []message.BlockManifest{
+			{RepairGroupID: uuid.New(), DataShardNum: 32, ParityShardNum: 22, Nonce: []byte("nonce")},
+			{RepairGroupID: uuid.New(), DataShardNum: 32, ParityShardNum: 22},
+		},
+		Shards: []message.ShardManifest{{
+			ShardID:           uuid.New(),
+			RepairGroupID:     uuid.New(),
+			Hash:              sha256.Sum256([]byte("shard")),
+			Size:              5,
+			MerkleRoot:        merkleRoot([]byte("shard")),
+			GuardianPublicKey: []byte("guardian"),
+			GuardianAddr:      "127.0.0.1:4041",
+		}},
+	}
+	require.NoError(t, s.createOrUpdate(database.CollCapsuleManifests, capsuleID.String(), manifest))
+
+	var gotManifest message.CapsuleIncomingManifestStream
+	exists, err = s.find(database.CollCapsuleManifests, capsuleID.String(), &gotManifest)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, *manifest, gotManifest)
+
+	keyShare := &masterKeyShare{CapsuleID: capsuleID, Share: []byte("share"), TotalShares: 3, ThresholdShares: 2}
+	require.NoError(t, s.createOrUpdate(database.CollKeyShares, capsuleID.String(), keyShare))
+
+	var gotKeyShare masterKeyShare
+	exists, err = s.find(database.CollKeyShares, capsuleID.String(), &gotKeyShare)
+	require.NoError(t, err)
+	require.True(t, exists)
+	assert.Equal(t, *keyShare, gotKeyShare)
+
+	t.Run("not found", func(t *testing.T) {
+		exists, err := s.find(database.CollCapsules, uuid.NewString(), &capsule{})
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("unsupported value", func(t *testing.T) {
+		err := s.createOrUpdate(database.CollCapsulesRecovery, capsuleID.String(), &struct{}{})
+		require.ErrorIs(t, err, ErrUnsupportedValue)
+	})
+}
+
+func TestSQLiteDBStoreForeignKeys(t *testing.T) {
+	s := newTestSQLiteDBStore(t)
+	capsuleID := uuid.New()
+
+	t.Run("shard of an unknown capsule", func(t *testing.T) {
+		shard := newTestShard(capsuleID, uuid.New())
+		require.Error(t, s.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard))
+	})
+
+	require.NoError(t, s.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New()}))
+	shard := newTestShard(capsuleID, uuid.New())
+	require.NoError(t, s.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard))
+	require.NoError(t, s.createOrUpdate(database.CollKeyShares, capsuleID.String(), &masterKeyShare{CapsuleID: capsuleID, Share: []byte("share")}))
+
+	t.Run("updating a capsule keeps its shards", func(t *testing.T) {
+		require.NoError(t, s.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New(), IsComplete: true}))
+
+		exists, err := s.find(database.CollCapsulesActiveShards, shard.shardID.String(), &shardMetaData{})
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("deleting a capsule deletes what hangs off it", func(t *testing.T) {
+		require.NoError(t, s.delete(database.CollCapsules, capsuleID.String()))
+
+		exists, err := s.find(database.CollCapsulesActiveShards, shard.shardID.String(), &shardMetaData{})
+		require.NoError(t, err)
+		assert.False(t, exists)
+
+		exists, err = s.find(database.CollKeyShares, capsuleID.String(), &masterKeyShare{})
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+func TestFindShardsByRepairGroup(t *testing.T) {
+	stores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt:  func(t *testing.T) dbStorer { return newTestDBStore(t) },
+	}
+
+	for driver, newStore := range stores {
+		t.Run(driver, func(t *testing.T) {
+			s := newStore(t)
+			capsuleID := uuid.New()
+			require.NoError(t, s.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New()}))
+
+			repairGroupID, otherRepairGroupID := uuid.New(), uuid.New()
+			var want []shardMetaData
+			for i := range 6 {
+				shard := newTestShard(capsuleID, otherRepairGroupID)
+				if i%2 == 0 {
+					shard = newTestShard(capsuleID, repairGroupID)
+					want = append(want, shard)
+				}
+				require.NoError(t, s.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard))
+			}
+
+			got, err := s.findShardsByRepairGroup(repairGroupID)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, want, got)
+		})
+	}
+
+	t.Run("sqlite does no full table scans", func(t *testing.T) {
+		s := newTestSQLiteDBStore(t)
+
+		var plan []struct {
+			ID     int    `bun:"id"`
+			Parent int    `bun:"parent"`
+			NotUse int    `bun:"notused"`
+			Detail string `bun:"detail"`
+		}
+		err := s.DB.NewRaw(
+			"EXPLAIN QUERY PLAN SELECT * FROM shards WHERE repair_group_id = ?", uuid.New(),
+		).Scan(context.Background(), &plan)
+		require.NoError(t, err)
+		require.NotEmpty(t, plan)
+		assert.True(t, strings.Contains(plan[0].Detail, "shards_repair_group_id_idx"), plan[0].Detail)
+	})
+}
+
+func newTestSQLiteDBStore(t *testing.T) *sqliteDBStore {
+	t.Helper()
+
+	db := storage.NewSQLite(t.TempDir(), slog.Default())
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteDBStore(&SQLiteDBStoreConfig{DB: db, Keyring: testKeyring})
+}
+
+func newTestDBStore(t *testing.T) *dbStore {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	return NewDBStore(&DBStoreConfig{DB: db, Keyring: testKeyring})
+}
+
+// testKeyring seals what the stores of the tests keep, stores made on the same
+// dir have to share it.
+var testKeyring = newTestKeyring(1)
+
+func newTestKeyring(ids ...uint32) *customcrypto.Keyring {
+	k := customcrypto.NewKeyring()
+	for _, id := range ids {
+		key, err := customcrypto.NewDataKey()
+		if err != nil {
+			panic(err)
+		}
+		if err := k.Add(id, key); err != nil {
+			panic(err)
+		}
+		if err := k.SetCurrent(id); err != nil {
+			panic(err)
+		}
+	}
+
+	return k
+}
+
+func newTestShard(capsuleID, repairGroupID uuid.UUID) shardMetaData {
+	shardID := uuid.New()
+
+	return shardMetaData{
+		capsuleID:      capsuleID,
+		shardID:        shardID,
+		repairGroupID:  repairGroupID,
+		nonce:          []byte("nonce"),
+		hash:           sha256.Sum256(shardID[:]),
+		size:           1024,
+		dataShardNum:   32,
+		parityShardNum: 22,
+	}
+}
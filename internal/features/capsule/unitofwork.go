@@ -0,0 +1,185 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/google/uuid"
+)
+
+/*
+A unitOfWork writes objects to the CAS and records to the db so that either all
+of them are kept or none.
+
+	1. saveCAS stages the objects in objects/staging/<id>/, each one synced.
+	2. commit does the db writes in one tx, together with a unitOfWorkRecord.
+	   This is the commit point. Before it nothing is visible, after it
+	   everything has to be.
+	3. the staged objects are renamed in place.
+	4. the unitOfWorkRecord is deleted.
+
+A crash before 2 leaves only staged objects, recoverUnitsOfWork deletes them.
+A crash after 2 leaves the record, recoverUnitsOfWork finishes 3 and 4.
+
+NOTICE IMPORTANT: A unitOfWork is not safe for concurrent use, and it is used
+once. Make a new one for every set of writes.
+*/
+
+var (
+	ErrUnitOfWorkDone = errors.New("unit of work is already committed or rolled back")
+)
+
+// dbWrite is one write of a unitOfWork to the db.
+type dbWrite struct {
+	coll     database.Collection
+	key      string
+	v        any
+	isDelete bool
+}
+
+// unitOfWorkRecord is written with the db writes of a unitOfWork. While it
+// exists the unitOfWork's objects might still be staged.
+type unitOfWorkRecord struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+}
+
+type unitOfWork struct {
+	id        uuid.UUID
+	objects   objectStorer
+	db        dbStorer
+	now       func() time.Time
+	writes    []dbWrite
+	numStaged int
+	isDone    bool
+}
+
+func newUnitOfWork(objects objectStorer, db dbStorer, now func() time.Time) *unitOfWork {
+	return &unitOfWork{
+		id:      uuid.New(),
+		objects: objects,
+		db:      db,
+		now:     now,
+	}
+}
+
+// saveCAS stages data. It is only in the CAS after commit.
+func (u *unitOfWork) saveCAS(hash [32]byte, data []byte) error {
+	if u.isDone {
+		return ErrUnitOfWorkDone
+	}
+
+	if err := u.objects.stageCAS(u.id, hash, data); err != nil {
+		return err
+	}
+	u.numStaged++
+
+	return nil
+}
+
+// createOrUpdate adds a write of v to the db on commit.
+func (u *unitOfWork) createOrUpdate(coll database.Collection, key string, v any) {
+	u.writes = append(u.writes, dbWrite{coll: coll, key: key, v: v})
+}
+
+// delete adds a delete from the db on commit.
+func (u *unitOfWork) delete(coll database.Collection, key string) {
+	u.writes = append(u.writes, dbWrite{coll: coll, key: key, isDelete: true})
+}
+
+// commit keeps everything. If it fails before the db writes, nothing is kept.
+// If it fails after, everything is kept once recoverUnitsOfWork runs.
+func (u *unitOfWork) commit() error {
+	if u.isDone {
+		return ErrUnitOfWorkDone
+	}
+	u.isDone = true
+
+	if u.numStaged == 0 {
+		return u.db.commit(u.writes)
+	}
+
+	writes := append(u.writes, dbWrite{
+		coll: database.CollUnitsOfWork,
+		key:  u.id.String(),
+		v:    &unitOfWorkRecord{ID: u.id, CreatedAt: u.now()},
+	})
+	if err := u.db.commit(writes); err != nil {
+		return errors.Join(err, u.objects.discardStaged(u.id))
+	}
+
+	return finishUnitOfWork(u.objects, u.db, u.id)
+}
+
+// rollback drops everything. It does nothing after commit, so it can be
+// deferred.
+func (u *unitOfWork) rollback() error {
+	if u.isDone {
+		return nil
+	}
+	u.isDone = true
+
+	if u.numStaged == 0 {
+		return nil
+	}
+
+	return u.objects.discardStaged(u.id)
+}
+
+// finishUnitOfWork moves the staged objects of the committed unit of work id in
+// place and deletes its record. It can be run again if it fails midway.
+func finishUnitOfWork(objects objectStorer, db dbStorer, id uuid.UUID) error {
+	if err := objects.commitStaged(id); err != nil {
+		return fmt.Errorf("unit of work %s: %w", id, err)
+	}
+
+	return db.commit([]dbWrite{
+		{coll: database.CollUnitsOfWork, key: id.String(), isDelete: true},
+	})
+}
+
+// recoverUnitsOfWork finishes the units of work that were committed and drops
+// the ones that were not. It is run on start, before anything else writes.
+func recoverUnitsOfWork(objects objectStorer, db dbStorer) (finished, dropped int, err error) {
+	records, err := db.findUnitsOfWork()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	isCommitted := make(map[uuid.UUID]bool, len(records))
+	for _, r := range records {
+		isCommitted[r.ID] = true
+
+		if err := finishUnitOfWork(objects, db, r.ID); err != nil {
+			return finished, dropped, err
+		}
+		finished++
+	}
+
+	stagedIDs, err := objects.findStaged()
+	if err != nil {
+		return finished, dropped, err
+	}
+
+	for _, id := range stagedIDs {
+		if isCommitted[id] {
+			continue
+		}
+
+		if err := objects.discardStaged(id); err != nil {
+			return finished, dropped, err
+		}
+		dropped++
+	}
+
+	return finished, dropped, nil
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package capsule
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitOfWork(t *testing.T) {
+	stores := map[string]func(t *testing.T) dbStorer{
+		storage.DriverSQLite: func(t *testing.T) dbStorer { return newTestSQLiteDBStore(t) },
+		storage.DriverBBolt:  func(t *testing.T) dbStorer { return newTestDBStore(t) },
+	}
+
+	for driver, newStore := range stores {
+		t.Run(driver, func(t *testing.T) {
+			t.Run("commit", func(t *testing.T) {
+				objects, db, capsuleID := newTestUnitOfWorkStores(t, newStore)
+				shard, data := newTestShardWithData(capsuleID)
+
+				uow := newUnitOfWork(objects, db, time.Now)
+				require.NoError(t, uow.saveCAS(shard.hash, data))
+				uow.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard)
+				require.NoError(t, uow.commit())
+
+				got, err := objects.GetCAS(shard.hash)
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+
+				exists, err := db.find(database.CollCapsulesActiveShards, shard.shardID.String(), &shardMetaData{})
+				require.NoError(t, err)
+				assert.True(t, exists)
+
+				assertNothingPending(t, objects, db)
+
+				require.ErrorIs(t, uow.commit(), ErrUnitOfWorkDone)
+				require.NoError(t, uow.rollback())
+			})
+
+			t.Run("failed db write keeps nothing", func(t *testing.T) {
+				objects, db, capsuleID := newTestUnitOfWorkStores(t, newStore)
+				shard, data := newTestShardWithData(capsuleID)
+
+				uow := newUnitOfWork(objects, db, time.Now)
+				require.NoError(t, uow.saveCAS(shard.hash, data))
+				uow.createOrUpdate(database.CollCapsulesActiveShards, shard.shardID.String(), shard)
+				uow.createOrUpdate(database.CollCapsulesActiveShards, uuid.NewString(), make(chan int))
+				require.Error(t, uow.commit())
+
+				exists, err := objects.ExistsCAS(shard.hash)
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				exists, err = db.find(database.CollCapsulesActiveShards, shard.shardID.String(), &shardMetaData{})
+				require.NoError(t, err)
+				assert.False(t, exists)
+
+				assertNothingPending(t, objects, db)
+			})
+
+			t.Run("rollback", func(t *testing.T) {
+				objects, db, capsuleID := newTestUnitOfWorkStores(t, newStore)
+				shard, data := newTestShardWithData(capsuleID)
+
+				uow := newUnitOfWork(objects, db, time.Now)
+				require.NoError(t, uow.saveCAS(shard.hash, data))
+				require.NoError(t, uow.rollback())
+				require.ErrorIs(t, uow.commit(), ErrUnitOfWorkDone)
+
+				exists, err := objects.ExistsCAS(shard.hash)
+				require.NoError(t, err)
+				assert.False(t, exists)
+				assertNothingPending(t, objects, db)
+			})
+
+			t.Run("recover after a crash before the db commit", func(t *testing.T) {
+				objects, db, capsuleID := newTestUnitOfWorkStores(t, newStore)
+				shard, data := newTestShardWithData(capsuleID)
+
+				// Killed right after staging.
+				require.NoError(t, objects.stageCAS(uuid.New(), shard.hash, data))
+
+				finished, dropped, err := recoverUnitsOfWork(objects, db)
+				require.NoError(t, err)
+				assert.Equal(t, 0, finished)
+				assert.Equal(t, 1, dropped)
+
+				exists, err := objects.ExistsCAS(shard.hash)
+				require.NoError(t, err)
+				assert.False(t, exists)
+				assertNothingPending(t, objects, db)
+			})
+
+			t.Run("recover after a crash after the db commit", func(t *testing.T) {
+				objects, db, capsuleID := newTestUnitOfWorkStores(t, newStore)
+				shard, data := newTestShardWithData(capsuleID)
+
+				// Killed right after the db commit, what commit does up to there.
+				stagingID := uuid.New()
+				require.NoError(t, objects.stageCAS(stagingID, shard.hash, data))
+				require.NoError(t, db.commit([]dbWrite{
+					{coll: database.CollCapsulesActiveShards, key: shard.shardID.String(), v: shard},
+					{coll: database.CollUnitsOfWork, key: stagingID.String(), v: &unitOfWorkRecord{ID: stagingID, CreatedAt: time.Now()}},
+				}))
+
+				finished, dropped, err := recoverUnitsOfWork(objects, db)
+				require.NoError(t, err)
+				assert.Equal(t, 1, finished)
+				assert.Equal(t, 0, dropped)
+
+				got, err := objects.GetCAS(shard.hash)
+				require.NoError(t, err)
+				assert.Equal(t, data, got)
+				assertNothingPending(t, objects, db)
+
+				t.Run("again", func(t *testing.T) {
+					finished, dropped, err := recoverUnitsOfWork(objects, db)
+					require.NoError(t, err)
+					assert.Zero(t, finished+dropped)
+				})
+			})
+		})
+	}
+}
+
+func newTestUnitOfWorkStores(t *testing.T, newStore func(t *testing.T) dbStorer) (*objectStore, dbStorer, uuid.UUID) {
+	t.Helper()
+
+	objects := NewObjectStore(&FileStoreConfig{RootDir: t.TempDir(), Keyring: testKeyring})
+	db := newStore(t)
+
+	capsuleID := uuid.New()
+	require.NoError(t, db.createOrUpdate(database.CollCapsules, capsuleID.String(), &capsule{OwnerID: uuid.New()}))
+
+	return objects, db, capsuleID
+}
+
+func newTestShardWithData(capsuleID uuid.UUID) (shardMetaData, []byte) {
+	data := []byte("shard " + uuid.NewString())
+
+	shard := newTestShard(capsuleID, uuid.New())
+	shard.hash = sha256.Sum256(data)
+	shard.size = uint32(len(data))
+
+	return shard, data
+}
+
+func assertNothingPending(t *testing.T, objects *objectStore, db dbStorer) {
+	t.Helper()
+
+	stagingIDs, err := objects.findStaged()
+	require.NoError(t, err)
+	assert.Empty(t, stagingIDs)
+
+	records, err := db.findUnitsOfWork()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
@@ -9,4 +9,16 @@ type identity struct {
 	PublicKey  []byte    `json:"pubKey"`
 	Salt       []byte    `json:"salt"`
 	Nonce      []byte    `json:"nonce"`
+	// DataKeys are the keys what is kept at rest is sealed with, wrapped with
+	// the key derived from the password. Identities from before there were
+	// data keys have none, InitIdentity adds the first.
+	DataKeys []wrappedDataKey `json:"dataKeys,omitempty"`
+	// DataKeyID is the data key everything is sealed with now.
+	DataKeyID uint32 `json:"dataKeyId,omitempty"`
+}
+
+type wrappedDataKey struct {
+	ID     uint32 `json:"id"`
+	EncKey []byte `json:"encKey"`
+	Nonce  []byte `json:"nonce"`
 }
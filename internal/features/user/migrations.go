@@ -0,0 +1,67 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package user
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/uptrace/bun"
+)
+
+// NOTICE IMPORTANT: Read the rules at the top of storage/migrate.go before
+// adding a migration. A peer that can't load its identity loses every capsule
+// it holds.
+
+// The identity has had the same json form since the start, the fields added
+// since are optional. There is nothing to upgrade in bbolt yet.
+var bboltMigrations = []storage.BBoltMigration{}
+
+var sqliteMigrations = []storage.SQLiteMigration{
+	{Version: 1, Name: "create schema", Up: createSchema},
+	{Version: 2, Name: "identity data keys", Up: addDataKeys},
+}
+
+func createSchema(ctx context.Context, tx bun.Tx) error {
+	for _, model := range []any{(*identityRow)(nil), (*settingRow)(nil)} {
+		if _, err := tx.NewCreateTable().Model(model).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addDataKeys(ctx context.Context, tx bun.Tx) error {
+	// A new db already has the columns, createSchema makes identities from
+	// identityRow.
+	var columns []string
+	err := tx.NewRaw("SELECT name FROM pragma_table_info('identities')").Scan(ctx, &columns)
+	if err != nil {
+		return err
+	}
+
+	for _, column := range []string{
+		"data_keys BLOB",
+		"data_key_id INTEGER NOT NULL DEFAULT 0",
+	} {
+		name, _, _ := strings.Cut(column, " ")
+		if slices.Contains(columns, name) {
+			continue
+		}
+
+		_, err := tx.NewAddColumn().Model((*identityRow)(nil)).ColumnExpr(column).Exec(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package user
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The corpus in testdata/migrations is dumps of dbs written by older versions,
+// one bucket to a key, values as they were written. v0 is before migrations.
+
+func TestMigrateV0Identity(t *testing.T) {
+	bv, err := os.ReadFile("testdata/migrations/v0_identity.json")
+	require.NoError(t, err)
+
+	var dump map[string]map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(bv, &dump))
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for bucket, kvs := range dump {
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+			for k, v := range kvs {
+				if err := b.Put([]byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	s := NewDBStore(&DBStoreConfig{DB: db, UserSettingBucketName: "settings"})
+
+	version, err := storage.BBoltSchemaVersion(db, string(featureUser))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(len(bboltMigrations)), version)
+
+	var id identity
+	exists, err := s.find(identityKey, &id)
+	require.NoError(t, err)
+	require.True(t, exists)
+
+	assert.Equal(t, "9d2f4e6a-1b3c-4d5e-8f70-a1b2c3d4e5f6", id.PeerID.String())
+	for _, b := range [][]byte{id.EncPrivKey, id.PublicKey, id.Salt, id.Nonce} {
+		assert.NotEmpty(t, b)
+	}
+}
@@ -24,6 +24,17 @@ type servicer interface {
 	// GetIdentity returns the user's private and public key pair.
 	// Returns nil for if they are not set.
 	GetIdentity() (peerID uuid.UUID, privateKey []byte, PublicKey []byte)
+	// Keyring is what the other features seal what they keep at rest with. It
+	// has the data keys once InitIdentity is done.
+	Keyring() *customcrypto.Keyring
+	// ChangePassword wraps the identity with newPassword and makes a new data
+	// key the current one. The old data keys are kept till RetireDataKeys.
+	ChangePassword(oldPassword, newPassword string) error
+	// RetireDataKeys drops every data key but the current one.
+	//
+	// NOTICE IMPORTANT: Only call it once everything sealed with the old keys
+	// was sealed again, what is still sealed with them is lost.
+	RetireDataKeys() error
 }
 
 type ServiceConfig struct {
@@ -40,6 +51,7 @@ type service struct {
 	peerID     uuid.UUID
 	privateKey []byte
 	publicKey  []byte
+	keyring    *customcrypto.Keyring
 }
 
 func NewService(cfg *ServiceConfig) *service {
@@ -59,6 +71,7 @@ func NewService(cfg *ServiceConfig) *service {
 
 	s := &service{
 		ServiceConfig: cfg,
+		keyring:       customcrypto.NewKeyring(),
 	}
 
 	return s
@@ -114,9 +127,9 @@ func (s *service) InitIdentity(password string) error {
 
 	// encrypt new private
 	newEncPrivKey, usedNonce, err := s.CCrypto.Cipher.Encrypt(
-		newPrivKey,
-		nil,
 		derivedKey,
+		nil,
+		newPrivKey,
 	)
 	if err != nil {
 		return peererrors.New(
@@ -136,6 +149,16 @@ func (s *service) InitIdentity(password string) error {
 		Salt:       usedSalt,
 		Nonce:      usedNonce,
 	}
+	dataKeys, err := s.addDataKey(newIdentity, derivedKey, nil)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to make data key",
+			err,
+			featureUser,
+		)
+	}
 	if err = s.DBStore.save(
 		identityKey,
 		newIdentity,
@@ -154,6 +177,16 @@ func (s *service) InitIdentity(password string) error {
 	s.privateKey = newPrivKey
 	s.publicKey = newPubKey
 
+	if err := s.loadKeyring(newIdentity.DataKeyID, dataKeys); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to load data keys",
+			err,
+			featureUser,
+		)
+	}
+
 	return nil
 }
 
@@ -188,6 +221,25 @@ func (s *service) existingIdentity(pwd string) (bool, error) {
 		return false, err
 	}
 
+	dataKeys, err := s.unwrapDataKeys(retrievedIdentity, derivedKey)
+	if err != nil {
+		return false, err
+	}
+	if len(dataKeys) == 0 {
+		// From before there were data keys.
+		dataKeys, err = s.addDataKey(retrievedIdentity, derivedKey, nil)
+		if err != nil {
+			return false, err
+		}
+		if err := s.DBStore.save(identityKey, retrievedIdentity); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.loadKeyring(retrievedIdentity.DataKeyID, dataKeys); err != nil {
+		return false, err
+	}
+
 	s.peerID = retrievedIdentity.PeerID
 	s.privateKey = decPrivateKey
 	s.publicKey = retrievedIdentity.PublicKey
@@ -203,3 +255,213 @@ func (s *service) existingIdentity(pwd string) (bool, error) {
 func (s *service) GetIdentity() (peerID uuid.UUID, privKey []byte, PubKey []byte) {
 	return s.peerID, s.privateKey, s.publicKey
 }
+
+func (s *service) Keyring() *customcrypto.Keyring {
+	return s.keyring
+}
+
+func (s *service) ChangePassword(oldPassword, newPassword string) error {
+	id := new(identity)
+	exists, err := s.DBStore.find(identityKey, id)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find identity",
+			err,
+			featureUser,
+		)
+	}
+	if !exists {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			"there is no identity to change the password of",
+			nil,
+			featureUser,
+		)
+	}
+
+	oldKey, _, err := s.CCrypto.DeriveKey([]byte(oldPassword), id.Salt)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to derive key from password",
+			err,
+			featureUser,
+		)
+	}
+
+	privKey, err := s.CCrypto.Cipher.Decrypt(oldKey, id.Nonce, id.EncPrivKey)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeLocalPeer,
+			peererrors.CodeTodo,
+			"wrong password",
+			err,
+			featureUser,
+		)
+	}
+
+	dataKeys, err := s.unwrapDataKeys(id, oldKey)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to unwrap data keys",
+			err,
+			featureUser,
+		)
+	}
+
+	newKey, newSalt, err := s.CCrypto.DeriveKey([]byte(newPassword), nil)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to derive key from password",
+			err,
+			featureUser,
+		)
+	}
+
+	encPrivKey, nonce, err := s.CCrypto.Cipher.Encrypt(newKey, nil, privKey)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to encrypt private key",
+			err,
+			featureUser,
+		)
+	}
+	id.EncPrivKey, id.Nonce, id.Salt = encPrivKey, nonce, newSalt
+
+	// NOTICE IMPORTANT: A new password gets a new data key too, whoever had the
+	// old password must not be able to open what is sealed from now on.
+	dataKeys, err = s.addDataKey(id, newKey, dataKeys)
+	if err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to make data key",
+			err,
+			featureUser,
+		)
+	}
+
+	if err := s.DBStore.save(identityKey, id); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to save identity to database",
+			err,
+			featureUser,
+		)
+	}
+
+	if err := s.loadKeyring(id.DataKeyID, dataKeys); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to load data keys",
+			err,
+			featureUser,
+		)
+	}
+
+	return nil
+}
+
+func (s *service) RetireDataKeys() error {
+	id := new(identity)
+	exists, err := s.DBStore.find(identityKey, id)
+	if err != nil || !exists {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to find identity",
+			err,
+			featureUser,
+		)
+	}
+
+	kept := id.DataKeys[:0]
+	for _, wk := range id.DataKeys {
+		if wk.ID == id.DataKeyID {
+			kept = append(kept, wk)
+		}
+	}
+	if len(kept) == len(id.DataKeys) {
+		s.keyring.Retire()
+		return nil
+	}
+	id.DataKeys = kept
+
+	if err := s.DBStore.save(identityKey, id); err != nil {
+		return peererrors.New(
+			peererrors.ScopeInternalPeer,
+			peererrors.CodeTodo,
+			"failed to save identity to database",
+			err,
+			featureUser,
+		)
+	}
+	s.keyring.Retire()
+
+	return nil
+}
+
+// addDataKey makes a new data key, makes it id's current one and wraps it and
+// dataKeys with wrapKey into id. It returns dataKeys with the new key.
+func (s *service) addDataKey(id *identity, wrapKey []byte, dataKeys map[uint32][]byte) (map[uint32][]byte, error) {
+	newDataKey, err := customcrypto.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if dataKeys == nil {
+		dataKeys = make(map[uint32][]byte, 1)
+	}
+	newID := uint32(1)
+	for keyID := range dataKeys {
+		newID = max(newID, keyID+1)
+	}
+	dataKeys[newID] = newDataKey
+
+	id.DataKeys = id.DataKeys[:0]
+	for keyID, dataKey := range dataKeys {
+		encKey, nonce, err := s.CCrypto.Cipher.Encrypt(wrapKey, nil, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		id.DataKeys = append(id.DataKeys, wrappedDataKey{ID: keyID, EncKey: encKey, Nonce: nonce})
+	}
+	id.DataKeyID = newID
+
+	return dataKeys, nil
+}
+
+func (s *service) unwrapDataKeys(id *identity, wrapKey []byte) (map[uint32][]byte, error) {
+	dataKeys := make(map[uint32][]byte, len(id.DataKeys))
+	for _, wk := range id.DataKeys {
+		dataKey, err := s.CCrypto.Cipher.Decrypt(wrapKey, wk.Nonce, wk.EncKey)
+		if err != nil {
+			return nil, err
+		}
+		dataKeys[wk.ID] = dataKey
+	}
+
+	return dataKeys, nil
+}
+
+func (s *service) loadKeyring(current uint32, dataKeys map[uint32][]byte) error {
+	for keyID, dataKey := range dataKeys {
+		if err := s.keyring.Add(keyID, dataKey); err != nil {
+			return err
+		}
+	}
+
+	return s.keyring.SetCurrent(current)
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package user
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDataKeys(t *testing.T) {
+	db := newTestSQLiteDBStore(t)
+
+	s := newTestService(db)
+	require.NoError(t, s.InitIdentity("old password"))
+	peerID, privKey, _ := s.GetIdentity()
+	assert.Equal(t, uint32(1), s.Keyring().Current())
+
+	sealedWith1, err := s.Keyring().Seal([]byte("sealed before"), nil)
+	require.NoError(t, err)
+
+	t.Run("loaded again", func(t *testing.T) {
+		s := newTestService(db)
+		require.NoError(t, s.InitIdentity("old password"))
+		assert.Equal(t, uint32(1), s.Keyring().Current())
+
+		opened, err := s.Keyring().Open(sealedWith1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "sealed before", string(opened))
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		require.Error(t, s.ChangePassword("not the password", "new password"))
+		assert.Equal(t, uint32(1), s.Keyring().Current())
+	})
+
+	require.NoError(t, s.ChangePassword("old password", "new password"))
+	assert.Equal(t, uint32(2), s.Keyring().Current())
+
+	sealedWith2, err := s.Keyring().Seal([]byte("sealed after"), nil)
+	require.NoError(t, err)
+
+	t.Run("old keys are kept till retired", func(t *testing.T) {
+		s := newTestService(db)
+		require.Error(t, s.InitIdentity("old password"))
+		require.NoError(t, s.InitIdentity("new password"))
+
+		gotPeerID, gotPrivKey, _ := s.GetIdentity()
+		assert.Equal(t, peerID, gotPeerID)
+		assert.Equal(t, privKey, gotPrivKey)
+		assert.Equal(t, uint32(2), s.Keyring().Current())
+
+		opened, err := s.Keyring().Open(sealedWith1, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "sealed before", string(opened))
+
+		opened, err = s.Keyring().Open(sealedWith2, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "sealed after", string(opened))
+	})
+
+	require.NoError(t, s.RetireDataKeys())
+	_, err = s.Keyring().Open(sealedWith1, nil)
+	require.ErrorIs(t, err, customcrypto.ErrUnknownKey)
+
+	t.Run("retired for good", func(t *testing.T) {
+		s := newTestService(db)
+		require.NoError(t, s.InitIdentity("new password"))
+
+		_, err := s.Keyring().Open(sealedWith1, nil)
+		require.ErrorIs(t, err, customcrypto.ErrUnknownKey)
+
+		opened, err := s.Keyring().Open(sealedWith2, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "sealed after", string(opened))
+	})
+
+	t.Run("identity from before data keys", func(t *testing.T) {
+		var id identity
+		_, err := db.find(identityKey, &id)
+		require.NoError(t, err)
+		id.DataKeys, id.DataKeyID = nil, 0
+		require.NoError(t, db.save(identityKey, &id))
+
+		s := newTestService(db)
+		require.NoError(t, s.InitIdentity("new password"))
+		assert.Equal(t, uint32(1), s.Keyring().Current())
+
+		_, err = db.find(identityKey, &id)
+		require.NoError(t, err)
+		assert.Len(t, id.DataKeys, 1)
+	})
+}
+
+func newTestService(db dbStorer) *service {
+	return NewService(&ServiceConfig{
+		Ctx:     context.Background(),
+		DBStore: db,
+		CCrypto: customcrypto.NewCCrypto(),
+		Logger:  slog.Default(),
+	})
+}
+
+func newTestSQLiteDBStore(t *testing.T) *sqliteDBStore {
+	t.Helper()
+
+	db := storage.NewSQLite(t.TempDir(), slog.Default())
+	t.Cleanup(func() { db.Close() })
+
+	return NewSQLiteDBStore(&SQLiteDBStoreConfig{DB: db})
+}
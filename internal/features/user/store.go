@@ -6,6 +6,7 @@ import (
 	"log"
 
 	"github.com/engr-sjb/diogel/internal/shared/database"
+	"github.com/engr-sjb/diogel/internal/storage"
 	bolt "go.etcd.io/bbolt"
 	boltErr "go.etcd.io/bbolt/errors"
 )
@@ -44,6 +45,11 @@ func NewDBStore(cfg *DBStoreConfig) *dbStore {
 		log.Fatalln("invalid store config: UserSettingBucketName is empty")
 	}
 
+	_, _, err := storage.MigrateBBolt(cfg.DB, string(featureUser), bboltMigrations)
+	if err != nil {
+		log.Fatalf("failed to migrate user db: %v", err)
+	}
+
 	return &dbStore{
 		DBStoreConfig: cfg,
 	}
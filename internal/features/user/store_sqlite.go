@@ -0,0 +1,179 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/google/uuid"
+	"github.com/uptrace/bun"
+)
+
+/*
+The user's tables.
+
+	identities  the peer's identity. only ever one row.
+	settings    anything else the user keeps, as json under its key.
+*/
+
+type identityRow struct {
+	bun.BaseModel `bun:"table:identities"`
+
+	PeerID     uuid.UUID `bun:"peer_id,pk,type:text"`
+	EncPrivKey []byte    `bun:"enc_priv_key,notnull"`
+	PublicKey  []byte    `bun:"public_key,notnull"`
+	Salt       []byte    `bun:"salt,notnull"`
+	Nonce      []byte    `bun:"nonce,notnull"`
+	// DataKeys is identity.DataKeys as json.
+	DataKeys  []byte `bun:"data_keys"`
+	DataKeyID uint32 `bun:"data_key_id,notnull,default:0"`
+}
+
+type settingRow struct {
+	bun.BaseModel `bun:"table:settings"`
+
+	Key   string `bun:"key,pk"`
+	Value []byte `bun:"value,notnull"`
+}
+
+type SQLiteDBStoreConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+
+	DB *bun.DB
+}
+
+type sqliteDBStore struct {
+	*SQLiteDBStoreConfig
+}
+
+var _ dbStorer = (*sqliteDBStore)(nil)
+
+func NewSQLiteDBStore(cfg *SQLiteDBStoreConfig) *sqliteDBStore {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("store config is nil")
+	case cfg.DB == nil:
+		log.Fatalln("invalid store config: DB is nil")
+	}
+
+	s := &sqliteDBStore{
+		SQLiteDBStoreConfig: cfg,
+	}
+
+	_, _, err := storage.MigrateSQLite(context.Background(), cfg.DB, string(featureUser), sqliteMigrations)
+	if err != nil {
+		log.Fatalf("failed to migrate user db: %v", err)
+	}
+
+	return s
+}
+
+func (s *sqliteDBStore) find(key key, value any) (exists bool, err error) {
+	ctx := context.Background()
+
+	if v, isIdentity := value.(*identity); isIdentity && key == identityKey {
+		var row identityRow
+		err := s.DB.NewSelect().Model(&row).Limit(1).Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		*v = identity{
+			PeerID:     row.PeerID,
+			EncPrivKey: row.EncPrivKey,
+			PublicKey:  row.PublicKey,
+			Salt:       row.Salt,
+			Nonce:      row.Nonce,
+			DataKeyID:  row.DataKeyID,
+		}
+		if len(row.DataKeys) > 0 {
+			if err := json.Unmarshal(row.DataKeys, &v.DataKeys); err != nil {
+				return false, err
+			}
+		}
+
+		return true, nil
+	}
+
+	var row settingRow
+	err = s.DB.NewSelect().Model(&row).Where("key = ?", string(key)).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, json.Unmarshal(row.Value, value)
+}
+
+func (s *sqliteDBStore) save(key key, v any) error {
+	ctx := context.Background()
+
+	if id, isIdentity := v.(*identity); isIdentity && key == identityKey {
+		dataKeys, err := json.Marshal(id.DataKeys)
+		if err != nil {
+			return err
+		}
+
+		// There is only one identity, a new one replaces the old.
+		return s.DB.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.NewDelete().Model((*identityRow)(nil)).Where("1 = 1").Exec(ctx)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.NewInsert().Model(&identityRow{
+				PeerID:     id.PeerID,
+				EncPrivKey: id.EncPrivKey,
+				PublicKey:  id.PublicKey,
+				Salt:       id.Salt,
+				Nonce:      id.Nonce,
+				DataKeys:   dataKeys,
+				DataKeyID:  id.DataKeyID,
+			}).Exec(ctx)
+
+			return err
+		})
+	}
+
+	bv, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.NewInsert().
+		Model(&settingRow{Key: string(key), Value: bv}).
+		On("CONFLICT (key) DO UPDATE").
+		Set("value = EXCLUDED.value").
+		Exec(ctx)
+
+	return err
+}
+
+func (s *sqliteDBStore) delete(key key) error {
+	ctx := context.Background()
+
+	if key == identityKey {
+		_, err := s.DB.NewDelete().Model((*identityRow)(nil)).Where("1 = 1").Exec(ctx)
+		return err
+	}
+
+	_, err := s.DB.NewDelete().Model((*settingRow)(nil)).Where("key = ?", string(key)).Exec(ctx)
+
+	return err
+}
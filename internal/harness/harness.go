@@ -0,0 +1,428 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+/*
+Package harness boots whole peers on an in memory network so tests can script
+ceremonies against them end to end, the way they run for real: handshakes,
+the capsule service, the db and the object store all included.
+
+A Cluster is N peers, each with its own dir, on one memory.Network and one
+fake clock, or the real one if it is given. Peers can be killed and revived
+on the same dir, the network can be slowed down, made lossy or partitioned
+through Network(), and time only moves for the peers when Advance is called.
+That goes for the network's latency too, a late write only arrives once time
+is advanced past it.
+
+The ceremonies scripted so far are create, repair and recovery. Recover plays
+a guardian, not a beneficiary, reading a capsule back from the key shares of
+the guardians and the shards of the holders up, and hands back the files it
+got.
+
+NOTICE: heartbeat, silence and inheritance are not covered. The peers only log
+a HeartbeatCheck and nothing acts on a missed one, so silence is only the
+clock moved past the silence period, and there is no beneficiary to inherit
+yet. Their scripts, and Recover as a beneficiary, are left for a follow-up
+once those features land.
+*/
+package harness
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/cmd/diogel/peer"
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/features/capsule"
+	"github.com/engr-sjb/diogel/internal/features/ports"
+	"github.com/engr-sjb/diogel/internal/transport/memory"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrPeerDown       = errors.New("harness: peer is down")
+	ErrPeerUp         = errors.New("harness: peer is already up")
+	ErrCapsuleUnknown = errors.New("harness: capsule was not created by this cluster")
+)
+
+// Peer is what the harness needs of a peer.
+type Peer interface {
+	Start(ctx context.Context)
+	Stop()
+	ID() uuid.UUID
+	Create(ctx context.Context, letterContent string, filePaths []string, guardiansAddrs []string, silencePeriod time.Duration) error
+	HeldCapsule(capsuleID uuid.UUID) (*capsule.HeldCapsuleDTO, error)
+	FetchProviderShard(ctx context.Context, capsuleID uuid.UUID, hash [32]byte) ([]byte, error)
+	Audit(ctx context.Context, capsuleID uuid.UUID, addr string) (*capsule.AuditReportDTO, error)
+	Repair() (capsule.RepairReport, error)
+	Recover(ctx context.Context, capsuleID uuid.UUID, masterKey []byte, fileStore ports.FileStorer) error
+}
+
+type ClusterConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+	Ctx        context.Context
+	NumOfPeers int
+	// Dir is where each peer gets its own dir. Use t.TempDir().
+	Dir string
+	// Network is the config of the memory network, its Clock is the cluster's.
+	// Optional.
+	Network *memory.NetworkConfig
+	// DBDriver is the db every peer runs on. Optional, defaults to the peer's
+	// default.
+	DBDriver string
+	// StorageProviders are the peers that are storage providers. Every peer
+	// puts shards of its capsules with the others of them. Optional.
+	StorageProviders []int
+	// Clock is the time of the peers and the network. Optional, defaults to a
+	// clock.Fake that moves with Advance. Give clock.New() for what has to
+	// hold up on the wall clock, Advance can't be used then.
+	Clock clock.Clock
+}
+
+type clusterPeer struct {
+	Peer
+	addr string
+	isUp bool
+}
+
+// Cluster is N peers on one memory network. It is safe for concurrent use,
+// but ceremonies of the same owner must not run at the same time.
+type Cluster struct {
+	*ClusterConfig
+	network *memory.Network
+	clock   clock.Clock
+
+	mu    sync.Mutex
+	peers []*clusterPeer
+	// masterKeys are the master keys of the capsules created in the cluster.
+	masterKeys map[uuid.UUID][]byte
+	// lastCreated is the last capsule each peer created.
+	lastCreated map[int]uuid.UUID
+}
+
+// NewCluster boots all the peers. Close them with Close.
+func NewCluster(cfg *ClusterConfig) *Cluster {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("ClusterConfig cannot be nil")
+	case cfg.Ctx == nil:
+		log.Fatalln("Ctx cannot be nil")
+	case cfg.NumOfPeers < 2:
+		log.Fatalln("NumOfPeers must be at least 2")
+	case cfg.Dir == "":
+		log.Fatalln("Dir cannot be empty")
+	}
+
+	if cfg.Clock == nil {
+		cfg.Clock = clock.NewFake(time.Now())
+	}
+	// The network's latency and loss are on the peers' time too.
+	if cfg.Network == nil {
+		cfg.Network = &memory.NetworkConfig{}
+	}
+	cfg.Network.Clock = cfg.Clock
+
+	c := &Cluster{
+		ClusterConfig: cfg,
+		network:       memory.NewNetwork(cfg.Network),
+		clock:         cfg.Clock,
+		peers:         make([]*clusterPeer, cfg.NumOfPeers),
+		masterKeys:    make(map[uuid.UUID][]byte),
+		lastCreated:   make(map[int]uuid.UUID),
+	}
+
+	for i := range c.peers {
+		c.peers[i] = &clusterPeer{addr: fmt.Sprintf("peer-%d", i)}
+		c.start(i)
+	}
+
+	return c
+}
+
+// start boots peer i on its dir. It expects c.mu to be held or c not shared yet.
+func (c *Cluster) start(i int) {
+	cp := c.peers[i]
+
+	bootstrapPeers := make([]string, 0, len(c.peers)-1)
+	for j := range c.peers {
+		if j != i {
+			bootstrapPeers = append(bootstrapPeers, fmt.Sprintf("peer-%d", j))
+		}
+	}
+
+	var storageProviders []string
+	for _, j := range c.StorageProviders {
+		if j != i {
+			storageProviders = append(storageProviders, fmt.Sprintf("peer-%d", j))
+		}
+	}
+
+	// The master key is generated right before the capsule ID is handed out,
+	// on the same goroutine.
+	var masterKey []byte
+
+	p := peer.NewPeer(
+		&peer.PeerConfig{
+			Addr:              cp.addr,
+			AppDir:            filepath.Join(c.Dir, cp.addr),
+			BootstrapPeers:    bootstrapPeers,
+			Network:           c.network,
+			Clock:             c.clock,
+			DBDriver:          c.DBDriver,
+			IsStorageProvider: slices.Contains(c.StorageProviders, i),
+			StorageProviders:  storageProviders,
+			TestHooks: &capsule.TestHooks{
+				OnMasterKeyGenerated: func(key []byte) {
+					masterKey = append([]byte(nil), key...)
+				},
+				OnCapsuleCreated: func(capsuleID uuid.UUID) {
+					c.mu.Lock()
+					defer c.mu.Unlock()
+
+					c.masterKeys[capsuleID] = masterKey
+					c.lastCreated[i] = capsuleID
+				},
+			},
+		},
+	)
+	p.Start(c.Ctx)
+
+	cp.Peer = p
+	cp.isUp = true
+}
+
+// Network is the network the peers are on. Use it for latency, loss and
+// partitions.
+func (c *Cluster) Network() *memory.Network {
+	return c.network
+}
+
+// Clock is the clock every peer in the cluster gets the time from.
+func (c *Cluster) Clock() clock.Clock {
+	return c.clock
+}
+
+// Advance moves the time of every peer forward by d, firing their timers due
+// on the way. The cluster has to be on its default fake clock.
+func (c *Cluster) Advance(d time.Duration) {
+	fakeClock, isFake := c.clock.(*clock.Fake)
+	if !isFake {
+		log.Fatalln("Advance needs the cluster on a fake clock")
+	}
+
+	fakeClock.Advance(d)
+}
+
+// Addr is the addr of peer i on the network.
+func (c *Cluster) Addr(i int) string {
+	return c.peers[i].addr
+}
+
+// Peer is peer i. It changes when the peer is revived.
+func (c *Cluster) Peer(i int) Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.peers[i].Peer
+}
+
+// Kill shuts peer i down, its conns are cut like it died. Its dir is kept.
+func (c *Cluster) Kill(i int) error {
+	c.mu.Lock()
+	cp := c.peers[i]
+	if !cp.isUp {
+		c.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrPeerDown, cp.addr)
+	}
+	cp.isUp = false
+	p := cp.Peer
+	c.mu.Unlock()
+
+	// Not holding c.mu, the peer's hooks take it while it winds down.
+	p.Stop()
+
+	return nil
+}
+
+// Revive boots a killed peer i again on the same dir, so it comes back with
+// the same identity and whatever it held.
+func (c *Cluster) Revive(i int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.peers[i].isUp {
+		return fmt.Errorf("%w: %s", ErrPeerUp, c.peers[i].addr)
+	}
+
+	c.start(i)
+
+	return nil
+}
+
+// Create runs the create ceremony, owner making a capsule with the letter for
+// guardians. It returns the capsule's ID.
+func (c *Cluster) Create(ctx context.Context, owner int, guardians []int, letter string, silencePeriod time.Duration) (uuid.UUID, error) {
+	guardiansAddrs := make([]string, len(guardians))
+	for i, g := range guardians {
+		guardiansAddrs[i] = c.Addr(g)
+	}
+
+	c.mu.Lock()
+	cp := c.peers[owner]
+	if !cp.isUp {
+		c.mu.Unlock()
+		return uuid.Nil, fmt.Errorf("%w: %s", ErrPeerDown, cp.addr)
+	}
+	delete(c.lastCreated, owner)
+	c.mu.Unlock()
+
+	if err := cp.Create(ctx, letter, nil, guardiansAddrs, silencePeriod); err != nil {
+		return uuid.Nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capsuleID, isFound := c.lastCreated[owner]
+	if !isFound {
+		return uuid.Nil, fmt.Errorf("%w: %s created nothing", ErrCapsuleUnknown, cp.addr)
+	}
+
+	return capsuleID, nil
+}
+
+// MasterKey is the master key a capsule was created with.
+func (c *Cluster) MasterKey(capsuleID uuid.UUID) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	masterKey, isFound := c.masterKeys[capsuleID]
+	if !isFound {
+		return nil, fmt.Errorf("%w: %s", ErrCapsuleUnknown, capsuleID)
+	}
+
+	return masterKey, nil
+}
+
+// WaitForKeyShares polls guardians till each of them holds its key share of
+// the capsule, and returns the shares in the order of guardians.
+func (c *Cluster) WaitForKeyShares(ctx context.Context, capsuleID uuid.UUID, guardians []int) ([][]byte, error) {
+	shares := make([][]byte, len(guardians))
+
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		isDone := true
+		var lastErr error
+
+		for i, g := range guardians {
+			if shares[i] != nil {
+				continue
+			}
+
+			held, err := c.Peer(g).HeldCapsule(capsuleID)
+			switch {
+			case err != nil:
+				lastErr = err
+				isDone = false
+			case !held.IsKeyShareReceived:
+				isDone = false
+			default:
+				shares[i] = held.KeyShare
+			}
+		}
+
+		if isDone {
+			return shares, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(ctx.Err(), lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Recover has guardian read the capsule back with the master key shares
+// combine into, and returns its files by name.
+func (c *Cluster) Recover(ctx context.Context, capsuleID uuid.UUID, guardian int, shares [][]byte) (map[string][]byte, error) {
+	masterKey, err := customcrypto.NewCCrypto().SecretSharer.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	cp := c.peers[guardian]
+	if !cp.isUp {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrPeerDown, cp.addr)
+	}
+	c.mu.Unlock()
+
+	files := &memFileStore{files: make(map[string]*bytes.Buffer)}
+	if err := cp.Recover(ctx, capsuleID, masterKey, files); err != nil {
+		return nil, err
+	}
+
+	recovered := make(map[string][]byte, len(files.files))
+	for name, buf := range files.files {
+		recovered[name] = buf.Bytes()
+	}
+
+	return recovered, nil
+}
+
+// Close shuts down every peer still up.
+func (c *Cluster) Close() {
+	for i := range c.peers {
+		c.Kill(i)
+	}
+}
+
+// memFileStore keeps the files a recovery writes in memory.
+type memFileStore struct {
+	files map[string]*bytes.Buffer
+}
+
+func (m *memFileStore) Create(path string) (ports.File, error) {
+	buf := &bytes.Buffer{}
+	m.files[path] = buf
+	return &memFile{name: path, Buffer: buf}, nil
+}
+
+func (m *memFileStore) MkdirAll(path string) error {
+	return nil
+}
+
+// memFile is a file of memFileStore, it is only ever written to.
+type memFile struct {
+	*bytes.Buffer
+	name string
+}
+
+func (f *memFile) Close() error {
+	return nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) {
+	return nil, fmt.Errorf("%w: stat of %s", errors.ErrUnsupported, f.name)
+}
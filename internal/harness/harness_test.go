@@ -0,0 +1,413 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package harness
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/customcrypto"
+	"github.com/engr-sjb/diogel/internal/features/capsule"
+	"github.com/engr-sjb/diogel/internal/storage"
+	"github.com/engr-sjb/diogel/internal/transport/memory"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const letter = "if you are reading this, the switch went off."
+
+func TestCreateCeremony(t *testing.T) {
+	for _, dbDriver := range []string{storage.DriverSQLite, storage.DriverBBolt} {
+		t.Run(dbDriver, func(t *testing.T) {
+			c := newTestClusterOn(t, 4, dbDriver)
+			guardians := []int{1, 2, 3}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			capsuleID, err := c.Create(ctx, 0, guardians, letter, time.Hour)
+			require.NoError(t, err)
+
+			shares, err := c.WaitForKeyShares(ctx, capsuleID, guardians)
+			require.NoError(t, err)
+
+			for _, g := range guardians {
+				held, err := c.Peer(g).HeldCapsule(capsuleID)
+				require.NoError(t, err)
+				assert.Len(t, held.GuardianIDs, len(guardians))
+				assert.Equal(t, len(guardians), held.TotalShares)
+				assert.NotZero(t, held.TotalBlocks)
+			}
+
+			assertSharesRecoverMasterKey(t, c, capsuleID, shares)
+
+			t.Run("guardian keeps its share across a restart", func(t *testing.T) {
+				idBefore := c.Peer(2).ID()
+
+				require.NoError(t, c.Kill(2))
+				require.ErrorIs(t, c.Kill(2), ErrPeerDown)
+				require.NoError(t, c.Revive(2))
+
+				assert.Equal(t, idBefore, c.Peer(2).ID())
+
+				held, err := c.Peer(2).HeldCapsule(capsuleID)
+				require.NoError(t, err)
+				assert.Equal(t, shares[1], held.KeyShare)
+			})
+		})
+	}
+}
+
+func TestCreateCeremonyPartitioned(t *testing.T) {
+	c := newTestCluster(t, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// The owner can only reach one of its guardians.
+	c.Network().Partition(
+		[]string{c.Addr(0), c.Addr(1)},
+		[]string{c.Addr(2), c.Addr(3)},
+	)
+
+	_, err := c.Create(ctx, 0, []int{1, 2, 3}, letter, time.Hour)
+	require.Error(t, err)
+
+	c.Network().Heal()
+
+	capsuleID, err := c.Create(ctx, 0, []int{1, 2, 3}, letter, time.Hour)
+	require.NoError(t, err)
+
+	shares, err := c.WaitForKeyShares(ctx, capsuleID, []int{1, 2, 3})
+	require.NoError(t, err)
+	assertSharesRecoverMasterKey(t, c, capsuleID, shares)
+}
+
+func TestCreateCeremonyGuardianDown(t *testing.T) {
+	c := newTestCluster(t, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	require.NoError(t, c.Kill(3))
+
+	_, err := c.Create(ctx, 0, []int{1, 2, 3}, letter, time.Hour)
+	require.Error(t, err)
+
+	require.NoError(t, c.Revive(3))
+
+	capsuleID, err := c.Create(ctx, 0, []int{1, 2, 3}, letter, time.Hour)
+	require.NoError(t, err)
+
+	_, err = c.WaitForKeyShares(ctx, capsuleID, []int{1, 2, 3})
+	require.NoError(t, err)
+}
+
+func TestCreateCeremonyWithStorageProvider(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	c := NewCluster(&ClusterConfig{
+		Ctx:              ctx,
+		NumOfPeers:       5,
+		Dir:              t.TempDir(),
+		StorageProviders: []int{4},
+	})
+	t.Cleanup(c.Close)
+
+	guardians := []int{1, 2, 3}
+
+	capsuleID, err := c.Create(ctx, 0, guardians, letter, time.Hour)
+	require.NoError(t, err)
+
+	shares, err := c.WaitForKeyShares(ctx, capsuleID, guardians)
+	require.NoError(t, err)
+	assertSharesRecoverMasterKey(t, c, capsuleID, shares)
+
+	// Every guardian knows where the shards with the provider are.
+	held, err := c.Peer(1).HeldCapsule(capsuleID)
+	require.NoError(t, err)
+	require.NotEmpty(t, held.ProviderShards)
+	for _, g := range guardians[1:] {
+		other, err := c.Peer(g).HeldCapsule(capsuleID)
+		require.NoError(t, err)
+		assert.Equal(t, held.ProviderShards, other.ProviderShards)
+	}
+
+	// The provider holds shards, not the capsule.
+	_, err = c.Peer(4).HeldCapsule(capsuleID)
+	require.ErrorContains(t, err, "no held capsule")
+
+	shard := held.ProviderShards[0]
+	data, err := c.Peer(2).FetchProviderShard(ctx, capsuleID, shard.Hash)
+	require.NoError(t, err)
+	assert.Len(t, data, int(shard.Size))
+	assert.Equal(t, shard.Hash, sha256.Sum256(data))
+
+	t.Run("guardian audits the provider and another guardian", func(t *testing.T) {
+		for _, holder := range []int{4, 3} {
+			report, err := c.Peer(1).Audit(ctx, capsuleID, c.Addr(holder))
+			require.NoError(t, err)
+			assert.NotZero(t, report.Audited)
+			assert.Equal(t, report.Audited, report.Passed, "peer-%d", holder)
+			assert.Greater(t, report.Reliability.Score, 0.5)
+		}
+	})
+}
+
+func TestRepairGuardianDown(t *testing.T) {
+	c := newTestCluster(t, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	guardians := []int{1, 2, 3, 4}
+
+	capsuleID, err := c.Create(ctx, 0, guardians, letter, time.Hour)
+	require.NoError(t, err)
+
+	_, err = c.WaitForKeyShares(ctx, capsuleID, guardians)
+	require.NoError(t, err)
+
+	held, err := c.Peer(1).HeldCapsule(capsuleID)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), held.TotalBlocks)
+	total := len(held.Shards)
+
+	// The guardian with the most shards goes down. Of 54 shards, 32 rebuild
+	// the block and the repair keeps 11 more, so losing 12 to 22 of them
+	// takes the repair group below the safety margin but not past saving.
+	holds := make(map[string]int)
+	for _, sm := range held.Shards {
+		holds[sm.GuardianAddr]++
+	}
+	down := -1
+	for _, g := range guardians {
+		if n := holds[c.Addr(g)]; n <= 22 && (down < 0 || n > holds[c.Addr(down)]) {
+			down = g
+		}
+	}
+	if down < 0 || holds[c.Addr(down)] < 12 {
+		t.Skipf("no guardian holds 12 to 22 shards: %v", holds)
+	}
+
+	require.NoError(t, c.Kill(down))
+
+	var rebuilt int
+	for _, g := range guardians {
+		if g == down {
+			continue
+		}
+
+		// Only one of them leads, the others leave it the capsule.
+		report, err := c.Peer(g).Repair()
+		require.NoError(t, err)
+		rebuilt += report.Rebuilt
+	}
+	assert.Equal(t, holds[c.Addr(down)], rebuilt)
+
+	// Every guardian up gets the repaired manifest, none of its shards are with
+	// the one down anymore.
+	for _, g := range guardians {
+		if g == down {
+			continue
+		}
+
+		assert.Eventually(t, func() bool {
+			held, err := c.Peer(g).HeldCapsule(capsuleID)
+			if err != nil || len(held.Shards) != total {
+				return false
+			}
+			for _, sm := range held.Shards {
+				if sm.GuardianAddr == c.Addr(down) {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 10*time.Millisecond, "peer-%d", g)
+	}
+
+	// None of the guardians up holds more than its share of the block.
+	up := guardians[slices.IndexFunc(guardians, func(g int) bool { return g != down })]
+	held, err = c.Peer(up).HeldCapsule(capsuleID)
+	require.NoError(t, err)
+	share := (total + len(guardians) - 2) / (len(guardians) - 1)
+	clear(holds)
+	for _, sm := range held.Shards {
+		holds[sm.GuardianAddr]++
+	}
+	for addr, n := range holds {
+		assert.LessOrEqual(t, n, share, "%s holds more than its share", addr)
+	}
+
+	// The guardians that got the rebuilt shards hold them.
+	for _, g := range guardians {
+		if g == down {
+			continue
+		}
+
+		auditor := guardians[slices.IndexFunc(guardians, func(o int) bool { return o != g && o != down })]
+		report, err := c.Peer(auditor).Audit(ctx, capsuleID, c.Addr(g))
+		require.NoError(t, err)
+		assert.Equal(t, report.Audited, report.Passed, "peer-%d", g)
+	}
+}
+
+func TestSilenceRecovery(t *testing.T) {
+	const silencePeriod = 72 * time.Hour
+
+	c := newTestCluster(t, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	guardians := []int{1, 2, 3}
+
+	capsuleID, err := c.Create(ctx, 0, guardians, letter, silencePeriod)
+	require.NoError(t, err)
+
+	shares, err := c.WaitForKeyShares(ctx, capsuleID, guardians)
+	require.NoError(t, err)
+
+	held, err := c.Peer(1).HeldCapsule(capsuleID)
+	require.NoError(t, err)
+
+	// The owner goes silent past its silence period, and a guardian is lost on
+	// the way. The ones left have enough shares of both the key and the blocks.
+	// Nothing acts on the silence yet, see the package doc, a guardian recovers.
+	require.NoError(t, c.Kill(0))
+	c.Advance(silencePeriod + time.Hour)
+	require.NoError(t, c.Kill(3))
+
+	require.LessOrEqual(t, held.ThresholdShares, 2)
+	files, err := c.Recover(ctx, capsuleID, 1, shares[:held.ThresholdShares])
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string][]byte{capsule.LetterName: []byte(letter)}, files)
+
+	t.Run("too few key shares", func(t *testing.T) {
+		_, err := c.Recover(ctx, capsuleID, 2, shares[1:2])
+		require.Error(t, err)
+	})
+}
+
+func TestCreateCeremonyLongerThanAMsg(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams for seconds on the real clock")
+	}
+
+	// On the wall clock a slow network makes the capsule take seconds to get
+	// to the guardians, longer than a msg is given.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := NewCluster(&ClusterConfig{
+		Ctx:        ctx,
+		NumOfPeers: 4,
+		Dir:        t.TempDir(),
+		Network:    &memory.NetworkConfig{Latency: 100 * time.Millisecond},
+		Clock:      clock.New(),
+	})
+	t.Cleanup(func() {
+		c.Close()
+		cancel()
+	})
+	guardians := []int{1, 2, 3}
+
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer waitCancel()
+
+	// Random, so it doesn't compress away on the way.
+	random := make([]byte, 8<<20)
+	rand.Read(random)
+	bigLetter := hex.EncodeToString(random)
+
+	began := time.Now()
+	capsuleID, err := c.Create(waitCtx, 0, guardians, bigLetter, time.Hour)
+	require.NoError(t, err)
+	shares, err := c.WaitForKeyShares(waitCtx, capsuleID, guardians)
+	require.NoError(t, err)
+	require.Greater(t, time.Since(began), 2*time.Second, "the capsule got there too fast to matter")
+	t.Logf("capsule got to the guardians in %s", time.Since(began))
+
+	c.Network().SetLatency(0)
+	files, err := c.Recover(waitCtx, capsuleID, 1, shares)
+	require.NoError(t, err)
+	assert.True(t, files[capsule.LetterName] != nil && string(files[capsule.LetterName]) == bigLetter, "letter isn't the one sent")
+}
+
+func TestAdvance(t *testing.T) {
+	const silencePeriod = 278 * time.Hour
+
+	c := newTestCluster(t, 4)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	began := c.Clock().Now()
+	c.Advance(silencePeriod)
+	assert.Equal(t, silencePeriod, c.Clock().Since(began))
+
+	// Weeks going by in between must not get in the way of a ceremony.
+	capsuleID, err := c.Create(ctx, 0, []int{1, 2, 3}, letter, silencePeriod)
+	require.NoError(t, err)
+
+	// NOTICE: guardians receive the capsule after Create returns, and time
+	// jumping past the idle timeout of their streams mid stream fails it.
+	// Wait first.
+	_, err = c.WaitForKeyShares(ctx, capsuleID, []int{1, 2, 3})
+	require.NoError(t, err)
+
+	c.Advance(silencePeriod)
+
+	held, err := c.Peer(1).HeldCapsule(capsuleID)
+	require.NoError(t, err)
+	assert.True(t, held.IsKeyShareReceived)
+}
+
+func newTestCluster(t *testing.T, numOfPeers int) *Cluster {
+	t.Helper()
+
+	return newTestClusterOn(t, numOfPeers, storage.DriverSQLite)
+}
+
+func newTestClusterOn(t *testing.T, numOfPeers int, dbDriver string) *Cluster {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := NewCluster(&ClusterConfig{
+		Ctx:        ctx,
+		NumOfPeers: numOfPeers,
+		Dir:        t.TempDir(),
+		DBDriver:   dbDriver,
+	})
+
+	t.Cleanup(func() {
+		c.Close()
+		cancel()
+	})
+
+	return c
+}
+
+func assertSharesRecoverMasterKey(t *testing.T, c *Cluster, capsuleID uuid.UUID, shares [][]byte) {
+	t.Helper()
+
+	masterKey, err := c.MasterKey(capsuleID)
+	require.NoError(t, err)
+
+	recovered, err := customcrypto.NewCCrypto().SecretSharer.Combine(shares)
+	require.NoError(t, err)
+	assert.Equal(t, masterKey, recovered)
+}
@@ -18,48 +18,39 @@ import (
 
 type Msg any
 
-// Msgs is a collection of message types used in the peer system. Note that the
-// messages can contain both by value or by reference of the same type.
+// ID is the stable numeric id of a message type on the wire. It is carried in
+// the frame header, or in front of the payload for protocol v2, and tells the
+// other side which message type to decode the payload into. See Registry.
 //
-/*
-eg. var Msgs = [8]any{
-	&CapsuleStream{}, // Has a pointer type
-	CapsuleStream{}, // Has a value type
-	// Both the above types are of the same type but by different values.
-	&ReCapsuleStream{},
-	ReCapsuleStream{},
-	&ContinueCapsuleStream{},
-	ContinueCapsuleStream{},
-	&HeartbeatCheck{},
-	HeartbeatCheck{},
-}
-*/
-//
-// IMPORTANT NOTE: ALWAYS ADD ALL AND EVERY MESSAGE YOU CREATE TO THIS ARRAY,
-// AND INCREASE THE ARRAY SIZE BY EXACTLY THE NUMBER OF MESSAGES ADDED. THIS IS
-// USED TO REGISTER THE MESSAGES WITH THE SERIALIZER
-//
-// It contains the following message types:
-//   - CapsuleStream: Handles initial capsule streaming with various relevant information.
-//   - ReCapsuleStream: Manages re-capsule of a capsule.
-//   - ContinueCapsuleStream: Controls continuation of interrupted capsule streams.
-//   - HeartbeatCheck: Manages heartbeat verification.
-var Msgs = []any{ // todo: do another research on gob registration of types. both pointer and value types are consider same. not sure yet
-	// notice: ... add note here
-	// &CapsuleStream{},
-	CapsuleIncomingStream{},
-	// &ReCapsuleStream{},
-	CapsuleIncomingShardStream{},
-	CapsuleIncomingManifestStream{},
-	CapsuleReStream{},
-	// &ContinueCapsuleStream{},
-	ContinueCapsuleStream{},
-	// &DeleteCapsule{},
-	DeleteCapsule{},
-	// &HeartbeatCheck{},
-	HeartbeatCheck{},
-	RecoveryCeremony{},
-}
+// IMPORTANT NOTE: IDS ARE PART OF THE WIRE FORMAT. NEVER CHANGE OR REUSE AN ID,
+// ONLY ADD NEW ONES. A PEER ON AN OLDER BUILD WILL READ THE OLD MEANING. ALSO
+// ADD THE MESSAGE TO builtinSpecs IN registry.go.
+type ID uint16
+
+const (
+	IDCapsuleIncomingStream         ID = 1
+	IDCapsuleIncomingShardStream    ID = 2
+	IDCapsuleIncomingManifestStream ID = 3
+	IDCapsuleMasterKeyShare         ID = 4
+	IDCapsuleStreamChuck            ID = 5
+	IDCapsuleReStream               ID = 6
+	IDContinueCapsuleStream         ID = 7
+	IDDeleteCapsule                 ID = 8
+	IDHeartbeatCheck                ID = 9
+	IDRecoveryCeremony              ID = 10
+	IDErrorMessage                  ID = 11
+	IDStreamEnd                     ID = 12
+	IDStreamAck                     ID = 13
+	IDProviderStoreShard            ID = 14
+	IDProviderShard                 ID = 15
+	IDProviderFetchShard            ID = 16
+	IDProviderAck                   ID = 17
+	IDAuditChallenge                ID = 18
+	IDAuditProof                    ID = 19
+	IDRepairStoreShard              ID = 20
+	IDRepairManifest                ID = 21
+	IDCapsuleStreamShard            ID = 22
+)
 
 type CapsuleIncomingStream struct {
 	CapsuleID uuid.UUID
@@ -81,6 +72,8 @@ type CapsuleIncomingStream struct {
 	CreatedAt            time.Time
 }
 
+// CapsuleIncomingShardStream is a shard of a capsule with the shard following
+// it. Only a peer on an older build sends it, see CapsuleStreamShard.
 type CapsuleIncomingShardStream struct {
 	ShardID                      uuid.UUID
 	CapsuleID                    uuid.UUID
@@ -91,16 +84,65 @@ type CapsuleIncomingShardStream struct {
 	IsFinal                      bool
 }
 
+// CapsuleStreamShard is a shard of a capsule going to a guardian. Its shard is
+// the next Size bytes of the stream the owner has open with the guardian for
+// the capsule's shards, see RemotePeer.SendStream.
+type CapsuleStreamShard struct {
+	ShardID                      uuid.UUID
+	CapsuleID                    uuid.UUID
+	RepairGroupID                uuid.UUID
+	Nonce                        []byte
+	DataShardNum, ParityShardNum uint8
+	Size                         uint32
+	IsFinal                      bool
+}
+
+// CapsuleIncomingManifestStream is the manifest of a capsule. The owner sends
+// it to the guardians on a stream of its own, after the shards.
 type CapsuleIncomingManifestStream struct {
 	CapsuleID   uuid.UUID
 	TotalBlocks uint64
 	Blocks      []BlockManifest
+	// ProviderShards are the shards the owner put with storage providers
+	// instead of a guardian.
+	ProviderShards []ProviderShardManifest
+	// Shards are the shards the owner put with the guardians, so they can
+	// audit each other.
+	Shards []ShardManifest
 }
 
 type BlockManifest struct {
 	RepairGroupID  uuid.UUID
 	DataShardNum   uint8
 	ParityShardNum uint8
+	Nonce          []byte // the block was sealed with, for the shards a repair rebuilds.
+}
+
+// ProviderShardManifest is where a shard put with a storage provider is, so
+// the guardians can fetch it back during recovery.
+type ProviderShardManifest struct {
+	ShardID           uuid.UUID
+	RepairGroupID     uuid.UUID
+	Hash              [32]byte // sha256 of the shard, all the provider knows it by.
+	Size              uint32
+	Nonce             []byte // Nonce of the block the shard is of.
+	ProviderPublicKey customcrypto.PublicKeyBytes
+	ProviderAddr      string
+	MerkleRoot        [32]byte // of the shard, to audit the provider with.
+}
+
+// ShardManifest is which guardian a shard was put with. A zero MerkleRoot is a
+// shard from before audits, it can't be audited.
+type ShardManifest struct {
+	ShardID           uuid.UUID
+	RepairGroupID     uuid.UUID
+	Hash              [32]byte
+	Size              uint32
+	MerkleRoot        [32]byte
+	GuardianPublicKey customcrypto.PublicKeyBytes
+	// GuardianAddr is where the repair reaches the guardian. Empty for shards
+	// from before the repair.
+	GuardianAddr string
 }
 
 type CapsuleMasterKeyShare struct {
@@ -109,13 +151,35 @@ type CapsuleMasterKeyShare struct {
 	// ShareIndex      uint8
 	TotalShares     uint16
 	ThresholdShares uint8
+	Size            uint32 // Size of the share that follows the message.
 }
 
+// CapsuleStreamChuck is one chunk of a data stream, see RemotePeer.SendStream.
+// Size bytes of data follow it. Despite the name it carries any stream, not
+// just capsules.
 type CapsuleStreamChuck struct {
-	IsFinal bool
-	ID      uuid.UUID
-	Seq     uint32
-	Size    uint32
+	ID       uuid.UUID // ID of the stream.
+	Seq      uint32
+	Size     uint32
+	Checksum uint32 // crc32 (Castagnoli) of the data that follows.
+}
+
+// StreamEnd marks the end of a data stream. It says how much was sent so the
+// receiver can tell a finished stream from a cut one.
+type StreamEnd struct {
+	ID       uuid.UUID
+	Chunks   uint32
+	Size     uint64
+	Checksum []byte // sha256 of the whole stream.
+}
+
+// StreamAck is sent back by the receiver of a data stream. Chunks is how many
+// chunks it has written out so far, the sender uses it to not get too far
+// ahead. IsDone is set once the StreamEnd checks out.
+type StreamAck struct {
+	ID     uuid.UUID
+	Chunks uint32
+	IsDone bool
 }
 
 type CapsuleReStream struct {
@@ -131,6 +195,7 @@ type CapsuleReStream struct {
 }
 
 type DeleteCapsule struct {
+	CapsuleID uuid.UUID
 }
 
 type ContinueCapsuleStream struct {
@@ -147,4 +212,93 @@ type HeartbeatCheck struct {
 }
 
 type RecoveryCeremony struct {
+	CapsuleID uuid.UUID
+}
+
+// ErrorMessage carries a ScopeRemotePeer error back to the remote peer that
+// caused it.
+type ErrorMessage struct {
+	Code    peererrors.Code
+	Message string
+	// StreamID is the stream the error ends, if it is about one.
+	StreamID uuid.UUID
+}
+
+// ProviderStoreShard asks a storage provider to hold a shard. The
+// ProviderShard with the shard follows it. A provider is never told what
+// capsule a shard is of.
+type ProviderStoreShard struct {
+	Hash [32]byte // sha256 of the shard.
+	Size uint32
+}
+
+// ProviderShard carries a shard to or from a storage provider. Size bytes of
+// the shard follow it.
+type ProviderShard struct {
+	Hash [32]byte
+	Size uint32
+}
+
+// ProviderFetchShard asks a storage provider for the shard of Hash.
+type ProviderFetchShard struct {
+	Hash [32]byte
+}
+
+// ProviderAck is a storage provider's answer to a ProviderStoreShard or a
+// ProviderFetchShard. When it is not IsOK, Code and Message say why.
+type ProviderAck struct {
+	Hash    [32]byte
+	IsOK    bool
+	Code    peererrors.Code
+	Message string
+}
+
+func (m CapsuleIncomingShardStream) DataSize() uint32 { return m.Size }
+func (m CapsuleMasterKeyShare) DataSize() uint32      { return m.Size }
+func (m CapsuleStreamChuck) DataSize() uint32         { return m.Size }
+func (m ProviderShard) DataSize() uint32              { return m.Size }
+
+// AuditChallenge asks whoever holds the shard of Hash to prove it still does,
+// with the Merkle proofs of its leaves at Leaves.
+type AuditChallenge struct {
+	Hash   [32]byte
+	Leaves []uint32
+}
+
+// AuditProof is the answer to an AuditChallenge. When it is not IsOK, Code
+// and Message say why.
+type AuditProof struct {
+	Hash    [32]byte
+	IsOK    bool
+	Code    peererrors.Code
+	Message string
+	Leaves  []AuditLeaf
+}
+
+// AuditLeaf is a leaf of a shard, with the path of hashes from it up to the
+// root.
+type AuditLeaf struct {
+	Index uint32
+	Data  []byte
+	Path  [][32]byte
+}
+
+// RepairStoreShard asks a guardian of CapsuleID to hold a shard the repair
+// rebuilt. The ProviderShard with the shard follows it, and the guardian
+// answers with a ProviderAck.
+type RepairStoreShard struct {
+	CapsuleID      uuid.UUID
+	ShardID        uuid.UUID
+	RepairGroupID  uuid.UUID
+	Hash           [32]byte
+	Size           uint32
+	Nonce          []byte
+	DataShardNum   uint8
+	ParityShardNum uint8
+}
+
+// RepairManifest is the manifest of a capsule after a repair moved some of its
+// shards, for the other guardians of the capsule to keep instead of theirs.
+type RepairManifest struct {
+	Manifest CapsuleIncomingManifestStream
 }
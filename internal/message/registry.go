@@ -0,0 +1,250 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package message
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+const (
+	// DefaultMaxPayloadSize is the encoded size limit for message types that
+	// don't ask for more. Most messages are a few uuids and numbers.
+	DefaultMaxPayloadSize uint32 = 64 << 10 //64KiB
+	// MaxChunkDataSize is the most raw data that can follow a single message.
+	MaxChunkDataSize uint32 = 256 << 10 //256KiB
+
+	maxManifestPayloadSize uint32 = 16 << 20 //16MiB
+	maxKeyShareDataSize    uint32 = 1 << 10  //1KiB
+
+	// MaxAuditLeaves is the most leaves an AuditChallenge asks for.
+	MaxAuditLeaves = 8
+	// AuditLeafSize is the size of the leaves of a shard's Merkle tree, the
+	// last one can be shorter.
+	AuditLeafSize = 1 << 10 //1KiB
+)
+
+var (
+	ErrDuplicateID = errors.New("message: id is already registered")
+	ErrInvalidSpec = errors.New("message: invalid spec")
+)
+
+// DataCarrier is implemented by messages that have raw data follow them on the
+// wire. DataSize is the number of bytes that follow.
+type DataCarrier interface {
+	DataSize() uint32
+}
+
+// Spec describes one message type on the wire.
+type Spec struct {
+	ID ID
+	// New returns a pointer to a new zero message, for decoding into.
+	New func() Msg
+	// MaxPayloadSize is the largest encoded message we accept. Zero means
+	// DefaultMaxPayloadSize.
+	MaxPayloadSize uint32
+	// HasData is true when raw data follows the message. The message then has
+	// to implement DataCarrier and MaxDataSize caps what it can say it carries.
+	HasData     bool
+	MaxDataSize uint32
+}
+
+// Registry maps message IDs to their Spec. Both the protocol, to frame and
+// decode messages, and the transport, to know how much raw data to read, look
+// messages up in it. Handlers live in transport.Router, keyed by the same IDs.
+type Registry struct {
+	mu     sync.RWMutex
+	byID   map[ID]Spec
+	byType map[reflect.Type]ID
+}
+
+// NewRegistry returns a registry that already holds every built-in message.
+//
+// NOTICE IMPORTANT: ALWAYS ADD EVERY MESSAGE YOU CREATE TO builtinSpecs BELOW
+// WITH A NEW ID. THAT IS ALL IT TAKES FOR IT TO GO OVER THE WIRE.
+func NewRegistry() *Registry {
+	r := &Registry{
+		byID:   make(map[ID]Spec),
+		byType: make(map[reflect.Type]ID),
+	}
+
+	for _, spec := range builtinSpecs() {
+		if err := r.Register(spec); err != nil {
+			// Only a programming error in builtinSpecs can get here.
+			panic(err)
+		}
+	}
+
+	return r
+}
+
+func builtinSpecs() []Spec {
+	return []Spec{
+		{ID: IDCapsuleIncomingStream, New: newOf[CapsuleIncomingStream]},
+		{
+			ID:          IDCapsuleIncomingShardStream,
+			New:         newOf[CapsuleIncomingShardStream],
+			HasData:     true,
+			MaxDataSize: MaxChunkDataSize,
+		},
+		{
+			ID:  IDCapsuleIncomingManifestStream,
+			New: newOf[CapsuleIncomingManifestStream],
+			// A manifest grows with the capsule, so it gets a lot more room.
+			MaxPayloadSize: maxManifestPayloadSize,
+		},
+		{
+			ID:          IDCapsuleMasterKeyShare,
+			New:         newOf[CapsuleMasterKeyShare],
+			HasData:     true,
+			MaxDataSize: maxKeyShareDataSize,
+		},
+		{
+			ID:          IDCapsuleStreamChuck,
+			New:         newOf[CapsuleStreamChuck],
+			HasData:     true,
+			MaxDataSize: MaxChunkDataSize,
+		},
+		{ID: IDCapsuleReStream, New: newOf[CapsuleReStream]},
+		{ID: IDContinueCapsuleStream, New: newOf[ContinueCapsuleStream]},
+		{ID: IDDeleteCapsule, New: newOf[DeleteCapsule]},
+		{ID: IDHeartbeatCheck, New: newOf[HeartbeatCheck]},
+		{ID: IDRecoveryCeremony, New: newOf[RecoveryCeremony]},
+		{ID: IDErrorMessage, New: newOf[ErrorMessage]},
+		{ID: IDStreamEnd, New: newOf[StreamEnd]},
+		{ID: IDStreamAck, New: newOf[StreamAck]},
+		{ID: IDProviderStoreShard, New: newOf[ProviderStoreShard]},
+		{
+			ID:          IDProviderShard,
+			New:         newOf[ProviderShard],
+			HasData:     true,
+			MaxDataSize: MaxChunkDataSize,
+		},
+		{ID: IDProviderFetchShard, New: newOf[ProviderFetchShard]},
+		{ID: IDProviderAck, New: newOf[ProviderAck]},
+		{ID: IDAuditChallenge, New: newOf[AuditChallenge]},
+		// MaxAuditLeaves leaves and their paths fit the default.
+		{ID: IDAuditProof, New: newOf[AuditProof]},
+		{ID: IDRepairStoreShard, New: newOf[RepairStoreShard]},
+		{
+			ID:             IDRepairManifest,
+			New:            newOf[RepairManifest],
+			MaxPayloadSize: maxManifestPayloadSize,
+		},
+		{ID: IDCapsuleStreamShard, New: newOf[CapsuleStreamShard]},
+	}
+}
+
+func newOf[T any]() Msg {
+	return new(T)
+}
+
+// Register adds spec to the registry. An ID or a message type can only be
+// registered once.
+func (r *Registry) Register(spec Spec) error {
+	switch {
+	case spec.ID == 0:
+		return fmt.Errorf("%w: id 0 is reserved", ErrInvalidSpec)
+	case spec.New == nil:
+		return fmt.Errorf("%w: id %d has no constructor", ErrInvalidSpec, spec.ID)
+	case spec.MaxPayloadSize == 0:
+		spec.MaxPayloadSize = DefaultMaxPayloadSize
+	}
+
+	msg := spec.New()
+	t := reflect.TypeOf(msg)
+	if t == nil || t.Kind() != reflect.Pointer {
+		return fmt.Errorf(
+			"%w: id %d constructor must return a pointer, got %T",
+			ErrInvalidSpec,
+			spec.ID,
+			msg,
+		)
+	}
+
+	if spec.HasData {
+		if _, isDataCarrier := msg.(DataCarrier); !isDataCarrier {
+			return fmt.Errorf(
+				"%w: id %d has data but %T is not a DataCarrier",
+				ErrInvalidSpec,
+				spec.ID,
+				msg,
+			)
+		}
+		if spec.MaxDataSize == 0 {
+			return fmt.Errorf("%w: id %d has data but no MaxDataSize", ErrInvalidSpec, spec.ID)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if registered, isFound := r.byID[spec.ID]; isFound {
+		return fmt.Errorf(
+			"%w: id %d is %T",
+			ErrDuplicateID,
+			spec.ID,
+			registered.New(),
+		)
+	}
+	if id, isFound := r.byType[t.Elem()]; isFound {
+		return fmt.Errorf(
+			"%w: %s already has id %d",
+			ErrDuplicateID,
+			t.Elem(),
+			id,
+		)
+	}
+
+	r.byID[spec.ID] = spec
+	r.byType[t.Elem()] = spec.ID
+
+	return nil
+}
+
+// Lookup returns the spec registered under id.
+func (r *Registry) Lookup(id ID) (Spec, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	spec, isFound := r.byID[id]
+	return spec, isFound
+}
+
+// Msgs returns a zero value of every registered message type, in id order.
+func (r *Registry) Msgs() []Msg {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := slices.Sorted(maps.Keys(r.byID))
+	msgs := make([]Msg, len(ids))
+	for i, id := range ids {
+		msgs[i] = reflect.ValueOf(r.byID[id].New()).Elem().Interface()
+	}
+
+	return msgs
+}
+
+// IDOf returns the id msg is registered under. Pointers and values of a
+// message type have the same id.
+func (r *Registry) IDOf(msg Msg) (ID, bool) {
+	t := reflect.TypeOf(msg)
+	if t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	id, isFound := r.byType[t]
+	return id, isFound
+}
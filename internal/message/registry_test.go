@@ -0,0 +1,96 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package message
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testMsg struct {
+	A int
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	t.Run("built-in messages are registered", func(t *testing.T) {
+		id, isFound := r.IDOf(&HeartbeatCheck{})
+		require.True(t, isFound)
+		assert.Equal(t, IDHeartbeatCheck, id)
+
+		spec, isFound := r.Lookup(IDCapsuleIncomingShardStream)
+		require.True(t, isFound)
+		assert.True(t, spec.HasData)
+		assert.IsType(t, &CapsuleIncomingShardStream{}, spec.New())
+
+		spec, isFound = r.Lookup(IDHeartbeatCheck)
+		require.True(t, isFound)
+		assert.Equal(t, DefaultMaxPayloadSize, spec.MaxPayloadSize)
+	})
+
+	t.Run("msgs are zero values in id order", func(t *testing.T) {
+		msgs := r.Msgs()
+		require.Len(t, msgs, int(IDCapsuleStreamShard))
+		assert.Equal(t, CapsuleIncomingStream{}, msgs[0])
+		assert.Equal(t, HeartbeatCheck{}, msgs[IDHeartbeatCheck-1])
+	})
+
+	tests := []struct {
+		name    string
+		spec    Spec
+		wantErr error
+	}{
+		{
+			name:    "reserved id: should fail",
+			spec:    Spec{ID: 0, New: newOf[testMsg]},
+			wantErr: ErrInvalidSpec,
+		},
+		{
+			name:    "no constructor: should fail",
+			spec:    Spec{ID: 1000},
+			wantErr: ErrInvalidSpec,
+		},
+		{
+			name:    "constructor returns a value: should fail",
+			spec:    Spec{ID: 1000, New: func() Msg { return testMsg{} }},
+			wantErr: ErrInvalidSpec,
+		},
+		{
+			name:    "data on a message that isn't a DataCarrier: should fail",
+			spec:    Spec{ID: 1000, New: newOf[testMsg], HasData: true, MaxDataSize: 1},
+			wantErr: ErrInvalidSpec,
+		},
+		{
+			name:    "taken id: should fail",
+			spec:    Spec{ID: IDHeartbeatCheck, New: newOf[testMsg]},
+			wantErr: ErrDuplicateID,
+		},
+		{
+			name:    "taken type: should fail",
+			spec:    Spec{ID: 1000, New: newOf[HeartbeatCheck]},
+			wantErr: ErrDuplicateID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorIs(t, r.Register(tt.spec), tt.wantErr)
+		})
+	}
+
+	t.Run("new message", func(t *testing.T) {
+		require.NoError(t, r.Register(Spec{ID: 1000, New: newOf[testMsg]}))
+
+		id, isFound := r.IDOf(testMsg{})
+		require.True(t, isFound)
+		assert.Equal(t, ID(1000), id)
+	})
+}
@@ -29,6 +29,26 @@ const (
 const (
 	//Auth: 2000+
 	ErrBadRequest Code = 2000 + iota
+	// ErrNotGuardian is a peer refusing what only a guardian of the capsule
+	// can ask of it, or asking what only one can.
+	ErrNotGuardian
+)
+
+const (
+	//Storage: 3000+
+	// ErrQuotaExceeded is a guardian refusing what would take an owner, or
+	// all owners, past what it agreed to hold.
+	ErrQuotaExceeded Code = 3000 + iota
+	// ErrInsufficientStorage is a guardian refusing because its disk is full.
+	ErrInsufficientStorage
+	// ErrNotStorageProvider is a peer refusing a shard because it is not a
+	// storage provider.
+	ErrNotStorageProvider
+	// ErrShardNotFound is a peer that doesn't hold the shard asked for.
+	ErrShardNotFound
+	// ErrShardCorrupted is a peer whose copy of the shard asked for is not of
+	// its hash anymore.
+	ErrShardCorrupted
 )
 
 const (
@@ -47,6 +67,18 @@ func (c Code) String() string {
 	switch c {
 	// case ErrInternalDB:
 	// 	return "internal database error."
+	case ErrQuotaExceeded:
+		return "storage quota exceeded."
+	case ErrInsufficientStorage:
+		return "insufficient storage."
+	case ErrNotStorageProvider:
+		return "not a storage provider."
+	case ErrShardNotFound:
+		return "shard not found."
+	case ErrShardCorrupted:
+		return "shard corrupted."
+	case ErrNotGuardian:
+		return "not a guardian."
 	}
 	return "unknown error."
 
@@ -65,6 +97,7 @@ func New(scope Scope, code Code, message string, err error, featLoc features.Fea
 	//TODO: I think we need to add a user message and a system or dev message for the engineers.
 	return &PeerError{
 		scope:   scope,
+		code:    code,
 		message: message,
 		err:     err,
 		featLoc: featLoc,
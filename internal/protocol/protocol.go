@@ -10,8 +10,12 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"slices"
+	"sync"
 	"time"
 
 	"io"
@@ -28,39 +32,168 @@ const (
 	// version1 is the version 1 of the protocol.
 	//notice: Adjust this v1HeaderSize accordingly if you add more fields for the frame.
 
-	v1                  version = 1
-	v1HeaderVersionSize uint8   = 1 // This is the size of the protocol version to be read.
-	v1HeaderPayloadSize uint8   = 4 // This is the size of the payload to be read.
-	v1HeaderSize        uint8   = v1HeaderVersionSize + v1HeaderPayloadSize
+	v1 version = 1 // gob payloads, the message is picked by the name gob has for its type.
+	v2 version = 2 // Same frame layout as v1, but msgpack payloads led by their message id, so non Go peers can speak it.
+	// v3 has the same payloads as v2 but moves the message id into the header,
+	// so a frame is checked against its message's limits before any of it is
+	// read.
+	//
+	// NOTICE IMPORTANT: A FRAME LAYOUT NEVER CHANGES UNDER A VERSION THAT HAS
+	// SHIPPED. PEERS ON AN OLDER BUILD STILL NEGOTIATE IT, ADD A NEW VERSION.
+	v3 version = 3
+
+	v1HeaderVersionSize uint8 = 1 // This is the size of the protocol version to be read.
+	v1HeaderPayloadSize uint8 = 4 // This is the size of the payload to be read.
+	v1HeaderSize        uint8 = v1HeaderVersionSize + v1HeaderPayloadSize
+	v2PayloadMsgIDSize  uint8 = 2 // This is the size of the message id in front of a v2 payload.
+	v3HeaderMsgIDSize   uint8 = 2 // This is the size of the message id to be read.
+	v3HeaderSize        uint8 = v1HeaderVersionSize + v3HeaderMsgIDSize + v1HeaderPayloadSize
+
+	// maxFrameSize is the hard cap on the payload of any single frame, whatever
+	// its message type. Per message type limits sit below it, see
+	// message.Spec.MaxPayloadSize.
+	maxFrameSize uint32 = 16 << 20 //16MiB
+	// maxPooledPayloadBufSize is the biggest payload buffer put back in
+	// payloadBufPool. Most frames are a few hundred bytes, a buffer that grew
+	// for a big one is left for the gc, so the pool doesn't keep it alive.
+	maxPooledPayloadBufSize = 64 << 10 //64KiB
+	// maxPublicKeySize is the largest public key we accept in the handshake.
+	// Our ed25519 keys are 32 bytes, this leaves room for other key kinds.
+	maxPublicKeySize uint32 = 64
+
+	// noVersion is sent back by the server in place of the agreed version when
+	// it shares no version with the client.
+	noVersion version = 0
+
+	helloVersionsCountSize uint8 = 1 // This is the size of the number of versions in a hello.
+	helloCapabilitiesSize  uint8 = 4 // This is the size of the capability flags in a hello.
+)
 
-	maxLength = 16 << 20 //16KiB	// TODO: check this max length for header.
-	// op = 1024 * 16240
+// Capability is a bit set of optional features a peer can speak on top of a
+// protocol version. Both sides advertise theirs in the handshake and only the
+// features both of them have are turned on for the connection.
+type Capability uint32
 
+const (
+	CapCompression Capability = 1 << iota
+	CapEncryption
+	CapMultiplexing
 )
 
+// Has reports whether all the features in c2 are set on c.
+func (c Capability) Has(c2 Capability) bool {
+	return c&c2 == c2
+}
+
+var (
+	ErrIncompatibleVersion = errors.New("protocol: no common protocol version with remote peer")
+	ErrUnsupportedVersion  = errors.New("protocol: unsupported protocol version")
+	ErrFrameTooLarge       = errors.New("protocol: frame payload exceeds size limit")
+	ErrEmptyFrame          = errors.New("protocol: frame has no payload")
+	ErrTruncatedFrame      = errors.New("protocol: frame is shorter than its header says")
+	ErrMalformedFrame      = errors.New("protocol: frame payload could not be decoded")
+	ErrInvalidPublicKey    = errors.New("protocol: invalid public key size")
+	ErrUnknownMessage      = errors.New("protocol: unknown message id")
+	ErrNoHello             = errors.New("protocol: remote peer sent no hello, it may be on a build from before version negotiation")
+)
+
+var payloadBufPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func putPayloadBuf(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledPayloadBufSize {
+		return
+	}
+
+	payloadBufPool.Put(buf)
+}
+
 type Protocol interface {
 	Version() version
-	DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (remotePublicKey []byte, err error)
-	DoClientHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (remotePublicKey []byte, err error)
+	// DoServerHandshake and DoClientHandshake swap public keys, then a hello
+	// each way to agree on a version and capabilities.
+	//
+	// NOTICE IMPORTANT: PEERS ON A BUILD FROM BEFORE VERSION NEGOTIATION ONLY SWAP
+	// PUBLIC KEYS, THEY NEVER SEND OR ANSWER A HELLO. THEY CAN'T CONNECT TO THIS
+	// BUILD EITHER WAY, SO EVERY PEER OF A FAMILY HAS TO MOVE TO IT AT ONCE.
+	// FROM THIS BUILD ON, ROLLING UPGRADES WORK THROUGH THE NEGOTIATED VERSION.
+	// A server tells such a client apart by its first frame, see ErrNoHello. A
+	// client can't tell such a server apart, it gives up on the handshake
+	// deadline.
+	DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (*Session, error)
+	DoClientHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (*Session, error)
 	ReadFrame(r io.Reader, rf *Frame) error
 	WriteFrame(w io.Writer, wf *Frame) error
+	// Registry returns the message registry frames are read and written with.
+	Registry() *message.Registry
+}
+
+// Session is what both peers agreed on during the handshake. It lives as long
+// as the connection it was negotiated on.
+type Session struct {
+	RemotePublicKey []byte
+	Version         version
+	Capabilities    Capability
 }
 
 type protocol struct {
-	serialize serialize.Serializer
+	registry *message.Registry
+	// serializers holds the serializer for the payloads of each version.
+	serializers map[version]serialize.Serializer
+	// versions holds the protocol versions this peer speaks, newest first.
+	versions     []version
+	capabilities Capability
 	// TODO: might have to bring cCrypto in here for handshake
 }
 
 var _ Protocol = (*protocol)(nil)
 
-func NewProtocol(s serialize.Serializer) *protocol {
-	return &protocol{
-		serialize: s,
+// NewProtocol returns a protocol that speaks v1 with gobSerializer and, when
+// msgpackSerializer is not nil, v2 and v3 with msgpackSerializer. Which one a
+// connection uses is settled in the handshake. Only messages in registry can
+// be read or written.
+//
+// NOTICE: v1 names messages by their gob name, so every message in registry
+// is registered with gobSerializer here. Messages registered in registry
+// later can't go over v1.
+func NewProtocol(registry *message.Registry, gobSerializer, msgpackSerializer serialize.Serializer) *protocol {
+	switch {
+	case registry == nil:
+		log.Fatalln("registry cannot be nil")
+	case gobSerializer == nil:
+		log.Fatalln("gobSerializer cannot be nil")
 	}
 
+	for _, msg := range registry.Msgs() {
+		if err := gobSerializer.Register(msg); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	p := &protocol{
+		registry: registry,
+		serializers: map[version]serialize.Serializer{
+			v1: gobSerializer,
+		},
+		versions: []version{v1},
+		// TODO: advertise CapCompression, CapEncryption and CapMultiplexing once
+		// the transport actually does them.
+		capabilities: 0,
+	}
+
+	if msgpackSerializer != nil {
+		p.serializers[v2] = msgpackSerializer
+		p.serializers[v3] = msgpackSerializer
+		p.versions = []version{v3, v2, v1}
+	}
+
+	return p
 }
 
-func (p protocol) DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (remotePublicKey []byte, err error) {
+func (p protocol) DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (*Session, error) {
 	// TODO: I can pass in a remote key slice to fill with their remote key rather than returning a slice. Not sure yet.
 
 	//  Set deadline for handshake
@@ -72,7 +205,7 @@ func (p protocol) DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey
 	}
 
 	//------ Receive their public key.
-	remotePublicKey, err = receivePublicKey(remotePeerConn)
+	remotePublicKey, err := receivePublicKey(remotePeerConn)
 	if err != nil {
 		return nil, err
 	}
@@ -83,10 +216,37 @@ func (p protocol) DoServerHandshake(remotePeerConn io.ReadWriter, localPublicKey
 		return nil, err
 	}
 
-	return remotePublicKey, nil
+	//------ Receive their hello and pick the highest version we both speak.
+	remoteVersions, remoteCapabilities, err := receiveHello(remotePeerConn)
+	if err != nil {
+		return nil, err
+	}
+
+	agreedVersion := p.highestCommonVersion(remoteVersions)
+
+	//------ Send our answer. Even on a mismatch we answer, so the client can tell its user why.
+	err = sendAccept(
+		remotePeerConn,
+		agreedVersion,
+		p.versions,
+		p.capabilities,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if agreedVersion == noVersion {
+		return nil, incompatibleVersionErr(p.versions, remoteVersions)
+	}
+
+	return &Session{
+		RemotePublicKey: remotePublicKey,
+		Version:         agreedVersion,
+		Capabilities:    p.capabilities & remoteCapabilities,
+	}, nil
 }
 
-func (p protocol) DoClientHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (remotePublicKey []byte, err error) {
+func (p protocol) DoClientHandshake(remotePeerConn io.ReadWriter, localPublicKey []byte) (*Session, error) {
 	// TODO: I can pass in a remote key slice to fill with their remote key rather than returning a slice. Not sure yet.
 
 	// Set deadline for handshake
@@ -106,24 +266,199 @@ func (p protocol) DoClientHandshake(remotePeerConn io.ReadWriter, localPublicKey
 	*/
 
 	//------ Send our public key.
-	err = sendPublicKey(remotePeerConn, localPublicKey)
+	err := sendPublicKey(remotePeerConn, localPublicKey)
 	if err != nil {
 		return nil, err
 	}
 
 	//------ Receive their public key.
-	remotePublicKey, err = receivePublicKey(remotePeerConn)
+	remotePublicKey, err := receivePublicKey(remotePeerConn)
+	if err != nil {
+		return nil, err
+	}
+
+	//------ Send our hello with every version and capability we have.
+	err = sendHello(remotePeerConn, p.versions, p.capabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	//------ Receive the version the server picked.
+	agreedVersion, remoteVersions, remoteCapabilities, err := receiveAccept(remotePeerConn)
 	if err != nil {
 		return nil, err
 	}
 
-	return remotePublicKey, nil
+	if agreedVersion == noVersion {
+		return nil, incompatibleVersionErr(p.versions, remoteVersions)
+	}
+
+	// The server should only ever pick from what we sent, but we never trust it.
+	if !slices.Contains(p.versions, agreedVersion) {
+		return nil, fmt.Errorf(
+			"%w: remote peer picked v%d which we never offered",
+			ErrUnsupportedVersion,
+			agreedVersion,
+		)
+	}
+
+	return &Session{
+		RemotePublicKey: remotePublicKey,
+		Version:         agreedVersion,
+		Capabilities:    p.capabilities & remoteCapabilities,
+	}, nil
+}
+
+// highestCommonVersion returns the newest version found in both our versions
+// and remoteVersions, or noVersion if there is none.
+func (p protocol) highestCommonVersion(remoteVersions []version) version {
+	agreedVersion := noVersion
+	for _, v := range remoteVersions {
+		if v > agreedVersion && slices.Contains(p.versions, v) {
+			agreedVersion = v
+		}
+	}
+
+	return agreedVersion
+}
+
+func incompatibleVersionErr(localVersions, remoteVersions []version) error {
+	return fmt.Errorf(
+		"%w: we speak %v, remote peer speaks %v",
+		ErrIncompatibleVersion,
+		localVersions,
+		remoteVersions,
+	)
+}
+
+/*
+sendHello writes our supported versions and capabilities to the remote peer.
+
+	hello
+	- byte[0]     |1bytes| = n, the number of versions
+	- byte[1:n+1] |nbytes| = versions, one byte each
+	- byte[n+1:]  |4bytes| = capabilities
+*/
+func sendHello(remotePeerConn io.Writer, versions []version, capabilities Capability) error {
+	_, err := remotePeerConn.Write(
+		appendHello(nil, versions, capabilities),
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to send hello to remote peer: %w",
+			err,
+		)
+	}
+
+	return nil
+}
+
+func appendHello(buf []byte, versions []version, capabilities Capability) []byte {
+	buf = append(buf, uint8(len(versions)))
+	for _, v := range versions {
+		buf = append(buf, byte(v))
+	}
+
+	return byteOrder.AppendUint32(buf, uint32(capabilities))
+}
+
+func receiveHello(remotePeerConn io.Reader) ([]version, Capability, error) {
+	countBuf := make([]byte, helloVersionsCountSize)
+	_, err := io.ReadFull(remotePeerConn, countBuf)
+	if err != nil {
+		return nil, 0, fmt.Errorf(
+			"failed to receive hello from remote peer: %w",
+			err,
+		)
+	}
+
+	if countBuf[0] == 0 {
+		return nil, 0, errors.New("failed to receive hello from remote peer: it offered no versions")
+	}
+
+	buf := make([]byte, int(countBuf[0])+int(helloCapabilitiesSize))
+	_, err = io.ReadFull(remotePeerConn, buf)
+	if err != nil {
+		return nil, 0, fmt.Errorf(
+			"failed to receive hello from remote peer: %w",
+			err,
+		)
+	}
+
+	versions := make([]version, countBuf[0])
+	for i := range versions {
+		versions[i] = version(buf[i])
+
+		// A peer from before version negotiation goes straight to a v1 frame,
+		// which reads here as one version followed by the top byte of its
+		// payload size. That byte is 0 for any frame under maxFrameSize, and
+		// noVersion is never offered in a real hello.
+		if versions[i] == noVersion {
+			return nil, 0, ErrNoHello
+		}
+	}
+
+	capabilities := Capability(byteOrder.Uint32(buf[countBuf[0]:]))
+
+	return versions, capabilities, nil
+}
+
+/*
+sendAccept writes the version the server picked followed by the server's own
+hello, so a rejected client can still say which versions the server speaks.
+
+	accept
+	- byte[0]  |1bytes| = agreed version, noVersion when there is none
+	- byte[1:]          = hello
+*/
+func sendAccept(remotePeerConn io.Writer, agreedVersion version, versions []version, capabilities Capability) error {
+	buf := appendHello(
+		[]byte{byte(agreedVersion)},
+		versions,
+		capabilities,
+	)
+
+	_, err := remotePeerConn.Write(buf)
+	if err != nil {
+		return fmt.Errorf(
+			"failed to send accept to remote peer: %w",
+			err,
+		)
+	}
+
+	return nil
+}
+
+func receiveAccept(remotePeerConn io.Reader) (version, []version, Capability, error) {
+	agreedBuf := make([]byte, v1HeaderVersionSize)
+	_, err := io.ReadFull(remotePeerConn, agreedBuf)
+	if err != nil {
+		return noVersion, nil, 0, fmt.Errorf(
+			"failed to receive accept from remote peer: %w",
+			err,
+		)
+	}
+
+	remoteVersions, remoteCapabilities, err := receiveHello(remotePeerConn)
+	if err != nil {
+		return noVersion, nil, 0, err
+	}
+
+	return version(agreedBuf[0]), remoteVersions, remoteCapabilities, nil
 }
 
 func sendPublicKey(remotePeerConn io.ReadWriter, localPublicKey []byte) error {
 	// size := 4 //TODO: pick a better name for the number of bytes that hold the length size of localPublicKey.
 
 	localPublicKeySize := len(localPublicKey)
+	if localPublicKeySize == 0 || localPublicKeySize > int(maxPublicKeySize) {
+		return fmt.Errorf(
+			"%w: ours is %d bytes, max is %d",
+			ErrInvalidPublicKey,
+			localPublicKeySize,
+			maxPublicKeySize,
+		)
+	}
 
 	buf := make([]byte, (int(v1HeaderPayloadSize) + localPublicKeySize))
 	byteOrder.PutUint32(buf[:int(v1HeaderPayloadSize)], uint32(localPublicKeySize))
@@ -156,11 +491,19 @@ func receivePublicKey(remotePeerConn io.ReadWriter) ([]byte, error) {
 	}
 
 	remotePublicKeySize := byteOrder.Uint32(payloadBufSize)
+	if remotePublicKeySize == 0 || remotePublicKeySize > maxPublicKeySize {
+		// Never allocate what the remote peer asks for before checking it.
+		return nil, fmt.Errorf(
+			"%w: got %d bytes, max is %d",
+			ErrInvalidPublicKey,
+			remotePublicKeySize,
+			maxPublicKeySize,
+		)
+	}
 
 	remotePublicKey := make([]byte, remotePublicKeySize)
 	_, err = io.ReadFull(
-		io.LimitReader(remotePeerConn, int64(remotePublicKeySize)),
-		// payloadBuf,
+		remotePeerConn,
 		remotePublicKey,
 	)
 	if err != nil {
@@ -181,65 +524,297 @@ type Payload struct {
 
 type Frame struct {
 	Version version
+	// ID is the message id of the payload. ReadFrame sets it; WriteFrame
+	// sets it from the registry.
+	ID message.ID
 	Payload
 }
 
 func (p protocol) ReadFrame(r io.Reader, rf *Frame) error {
 	/*
-		header
+		v1 and v2 header
 		- byte[0]   |1bytes| = version
 		- byte[1:5] |4bytes| = msgSize
 
+		v3 header
+		- byte[0]   |1bytes| = version
+		- byte[1:3] |2bytes| = msgID
+		- byte[3:7] |4bytes| = msgSize
+
 		read this number of msgSize bytes from the reader to get the msg
 
-		the payload is a gob encoding of various Msg structs
+		the payload is
+		- v1: a gob encoding of the Payload, its Msg is whatever type gob has the name of.
+		- v2: 2B of msgID, then the msgpack encoding of the Msg struct msgID is registered to.
+		- v3: the msgpack encoding of the Msg struct msgID is registered to.
 
-		This is the reading framing protocol v1.
-		- read the headerBuf of v1HeaderSize from the reader.
-		- 1B of headerBuf for version from the header.
-		- read 4byte for the msg(payload) size from header.
+		This is the reading framing protocol.
+		- read 1B for the version, it tells us the header and the serializer.
+		- for v3, read 2B for the msgID, which we look up in the registry for its spec.
+		- read 4byte for the msg(payload) size from header and check it against the spec, or maxFrameSize when we don't know the msg yet.
 		- now read msg(payload) size from the reader to get msg.
-		- now use gob to serialize it into a msg type which will later be switch type cast on.
+		- now use the serializer of the version to decode it. v1 and v2 check the size against the spec once they know the msg.
 	*/
 
 	//TODO: Might have to decrypt data before with a Key(mainly a public key in this case.) or maybe do it after writing to the rf here. so its data is is decrypted outside. Not sure yet.
 
-	headerBuf := make([]byte, v1HeaderSize)
+	var versionBuf [v1HeaderVersionSize]byte
+	_, err := io.ReadFull(r, versionBuf[:])
+	if err != nil {
+		return err
+	}
+
+	rf.Version = version(versionBuf[0])
+	s, isFound := p.serializers[rf.Version]
+	if !isFound {
+		return fmt.Errorf("%w: v%d", ErrUnsupportedVersion, rf.Version)
+	}
+
+	if rf.Version == v1 || rf.Version == v2 {
+		return p.readV1Frame(r, s, rf)
+	}
+
+	headerBuf := make([]byte, v3HeaderSize-v1HeaderVersionSize)
+	_, err = io.ReadFull(r, headerBuf)
+	if err != nil {
+		return err
+	}
+
+	rf.ID = message.ID(byteOrder.Uint16(headerBuf[0:2]))
+	spec, isFound := p.registry.Lookup(rf.ID)
+	if !isFound {
+		return fmt.Errorf("%w: %d", ErrUnknownMessage, rf.ID)
+	}
+
+	msgSize := byteOrder.Uint32(headerBuf[2:6])
+	// NOTICE: We know the limit from the id alone, so an oversized frame is
+	// turned away before we read a single byte of it.
+	err = checkMsgSize(rf.ID, msgSize, min(spec.MaxPayloadSize, maxFrameSize))
+	if err != nil {
+		return err
+	}
+
+	payloadBuf, err := readPayload(r, msgSize)
+	if err != nil {
+		return err
+	}
+	defer putPayloadBuf(payloadBuf)
+
+	msg, err := decodeMsg(s, spec, payloadBuf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	rf.Payload = Payload{
+		Msg: msg,
+	}
+
+	return nil
+}
+
+// readV1Frame reads the rest of a v1 or v2 frame after its version. Their
+// headers don't say what the message is, so it is only checked against its
+// own limits once the payload is in.
+func (p protocol) readV1Frame(r io.Reader, s serialize.Serializer, rf *Frame) error {
+	headerBuf := make([]byte, v1HeaderPayloadSize)
 	_, err := io.ReadFull(r, headerBuf)
 	if err != nil {
 		return err
 	}
 
-	rf.Version = version(headerBuf[0])
-	msgSize := byteOrder.Uint32(headerBuf[1:5])
+	msgSize := byteOrder.Uint32(headerBuf)
+	err = checkMsgSize(0, msgSize, maxFrameSize)
+	if err != nil {
+		return err
+	}
+
+	payloadBuf, err := readPayload(r, msgSize)
+	if err != nil {
+		return err
+	}
+	defer putPayloadBuf(payloadBuf)
+
+	payload := payloadBuf.Bytes()
+	if rf.Version == v1 {
+		payloadReader := bytes.NewReader(payload)
+		rf.Payload = Payload{}
+		err = s.Decode(payloadReader, &rf.Payload)
+		switch {
+		case err != nil:
+			return fmt.Errorf("%w: %w", ErrMalformedFrame, err)
+		case rf.Payload.Msg == nil:
+			return fmt.Errorf("%w: payload has no message", ErrMalformedFrame)
+		case payloadReader.Len() != 0:
+			return fmt.Errorf(
+				"%w: %d trailing bytes after message",
+				ErrMalformedFrame,
+				payloadReader.Len(),
+			)
+		}
+
+		var isFound bool
+		rf.ID, isFound = p.registry.IDOf(rf.Payload.Msg)
+		if !isFound {
+			return fmt.Errorf("%w: %T is not registered", ErrUnknownMessage, rf.Payload.Msg)
+		}
+
+		spec, _ := p.registry.Lookup(rf.ID)
+		return checkMsgSize(rf.ID, msgSize, min(spec.MaxPayloadSize, maxFrameSize))
+	}
 
-	err = p.serialize.Decode(
-		io.LimitReader(r, int64(msgSize)),
-		&rf.Payload,
-	)
+	if len(payload) < int(v2PayloadMsgIDSize) {
+		return fmt.Errorf("%w: payload has no message id", ErrMalformedFrame)
+	}
+
+	rf.ID = message.ID(byteOrder.Uint16(payload[:v2PayloadMsgIDSize]))
+	spec, isFound := p.registry.Lookup(rf.ID)
+	if !isFound {
+		return fmt.Errorf("%w: %d", ErrUnknownMessage, rf.ID)
+	}
+
+	err = checkMsgSize(rf.ID, msgSize, min(spec.MaxPayloadSize, maxFrameSize))
+	if err != nil {
+		return err
+	}
+
+	msg, err := decodeMsg(s, spec, payload[v2PayloadMsgIDSize:])
 	if err != nil {
 		return err
 	}
 
+	rf.Payload = Payload{
+		Msg: msg,
+	}
+
 	return nil
 }
 
+func checkMsgSize(id message.ID, msgSize, maxSize uint32) error {
+	switch {
+	case msgSize == 0:
+		return ErrEmptyFrame
+	case msgSize > maxSize:
+		return fmt.Errorf(
+			"%w: header says %d bytes for message %d, max is %d",
+			ErrFrameTooLarge,
+			msgSize,
+			id,
+			maxSize,
+		)
+	}
+
+	return nil
+}
+
+// readPayload reads msgSize bytes of payload from r into a buffer from
+// payloadBufPool. The caller puts it back with putPayloadBuf.
+func readPayload(r io.Reader, msgSize uint32) (*bytes.Buffer, error) {
+	// NOTICE: We copy the payload in as it arrives rather than allocating
+	// msgSize upfront. So a remote peer that lies in the header can only make
+	// us hold as many bytes as it has actually sent.
+	payloadBuf := payloadBufPool.Get().(*bytes.Buffer)
+	payloadBuf.Reset()
+
+	_, err := io.CopyN(payloadBuf, r, int64(msgSize))
+	if err != nil {
+		got := payloadBuf.Len()
+		putPayloadBuf(payloadBuf)
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf(
+				"%w: header says %d bytes, got %d",
+				ErrTruncatedFrame,
+				msgSize,
+				got,
+			)
+		}
+		return nil, err
+	}
+
+	return payloadBuf, nil
+}
+
+// decodeMsg decodes payload into a new message of spec.
+func decodeMsg(s serialize.Serializer, spec message.Spec, payload []byte) (message.Msg, error) {
+	// The decoder only ever sees the msgSize bytes of the payload, and gob
+	// refuses slices longer than its remaining input, so a payload can't
+	// decode into something much bigger than itself.
+	payloadReader := bytes.NewReader(payload)
+	msg := spec.New()
+	err := s.Decode(payloadReader, msg)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrMalformedFrame, err)
+	}
+
+	if payloadReader.Len() != 0 {
+		return nil, fmt.Errorf(
+			"%w: %d trailing bytes after message",
+			ErrMalformedFrame,
+			payloadReader.Len(),
+		)
+	}
+
+	// Messages come out as values, so handlers can type switch on them.
+	return reflect.ValueOf(msg).Elem().Interface(), nil
+}
+
 func (p protocol) WriteFrame(w io.Writer, wf *Frame) error {
+	s, isFound := p.serializers[wf.Version]
+	if !isFound {
+		return fmt.Errorf("%w: v%d", ErrUnsupportedVersion, wf.Version)
+	}
+
+	id, isFound := p.registry.IDOf(wf.Payload.Msg)
+	if !isFound {
+		return fmt.Errorf("%w: %T is not registered", ErrUnknownMessage, wf.Payload.Msg)
+	}
+	wf.ID = id
+
+	spec, _ := p.registry.Lookup(id)
+	maxSize := min(spec.MaxPayloadSize, maxFrameSize)
+
 	var payloadBuf bytes.Buffer
-	if err := p.serialize.Encode(&payloadBuf, wf.Payload); err != nil {
+	var err error
+	switch wf.Version {
+	case v1:
+		// The message goes in as the Payload interface, so gob writes its name.
+		err = s.Encode(&payloadBuf, &wf.Payload)
+	case v2:
+		payloadBuf.Write(byteOrder.AppendUint16(nil, uint16(wf.ID)))
+		err = s.Encode(&payloadBuf, wf.Payload.Msg)
+	default:
+		err = s.Encode(&payloadBuf, wf.Payload.Msg)
+	}
+	if err != nil {
 		return err
 	}
 
-	totalFrameSize := int(v1HeaderSize) + payloadBuf.Len()
+	if payloadBuf.Len() > int(maxSize) {
+		return fmt.Errorf(
+			"%w: %T is %d bytes, max is %d",
+			ErrFrameTooLarge,
+			wf.Payload.Msg,
+			payloadBuf.Len(),
+			maxSize,
+		)
+	}
 
-	buf := make([]byte, totalFrameSize)
-	buf[0] = byte(wf.Version)
-	byteOrder.PutUint32(buf[1:5], uint32(payloadBuf.Len()))
-	copy(buf[v1HeaderSize:], payloadBuf.Bytes())
+	var buf []byte
+	if wf.Version == v1 || wf.Version == v2 {
+		buf = make([]byte, int(v1HeaderSize)+payloadBuf.Len())
+		buf[0] = byte(wf.Version)
+		byteOrder.PutUint32(buf[1:5], uint32(payloadBuf.Len()))
+		copy(buf[v1HeaderSize:], payloadBuf.Bytes())
+	} else {
+		buf = make([]byte, int(v3HeaderSize)+payloadBuf.Len())
+		buf[0] = byte(wf.Version)
+		byteOrder.PutUint16(buf[1:3], uint16(wf.ID))
+		byteOrder.PutUint32(buf[3:7], uint32(payloadBuf.Len()))
+		copy(buf[v3HeaderSize:], payloadBuf.Bytes())
+	}
 
 	//TODO: Might have to encrypt data before with a Key(mainly a public key in this case.) or maybe do it before passing the wf here. so its data is already encrypted. Not sure yet.
 
-	_, err := w.Write(buf)
+	_, err = w.Write(buf)
 	if err != nil {
 		return err
 	}
@@ -247,6 +822,13 @@ func (p protocol) WriteFrame(w io.Writer, wf *Frame) error {
 	return nil
 }
 
+// Registry returns the message registry frames are read and written with.
+func (p protocol) Registry() *message.Registry {
+	return p.registry
+}
+
+// Version returns the newest protocol version this peer speaks. The version a
+// connection actually uses is the one agreed in its Session.
 func (p *protocol) Version() version {
-	return v1
+	return p.versions[0]
 }
@@ -0,0 +1,428 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestHandshakeNegotiation(t *testing.T) {
+	tests := []struct {
+		name               string
+		clientVersions     []version
+		serverVersions     []version
+		clientCapabilities Capability
+		serverCapabilities Capability
+		wantVersion        version
+		wantCapabilities   Capability
+		wantErr            error
+	}{
+		{
+			name:           "same single version",
+			clientVersions: []version{v1},
+			serverVersions: []version{v1},
+			wantVersion:    v1,
+		},
+		{
+			name:           "newer client picks highest common version",
+			clientVersions: []version{3, 2, v1},
+			serverVersions: []version{2, v1},
+			wantVersion:    2,
+		},
+		{
+			name:           "newer server picks highest common version",
+			clientVersions: []version{v1},
+			serverVersions: []version{3, 2, v1},
+			wantVersion:    v1,
+		},
+		{
+			name:               "only shared capabilities are turned on",
+			clientVersions:     []version{v1},
+			serverVersions:     []version{v1},
+			clientCapabilities: CapCompression | CapEncryption,
+			serverCapabilities: CapEncryption | CapMultiplexing,
+			wantVersion:        v1,
+			wantCapabilities:   CapEncryption,
+		},
+		{
+			name:           "no common version rejects the peer: should fail",
+			clientVersions: []version{v1},
+			serverVersions: []version{3, 2},
+			wantErr:        ErrIncompatibleVersion,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &protocol{
+				versions:     tt.clientVersions,
+				capabilities: tt.clientCapabilities,
+			}
+			server := &protocol{
+				versions:     tt.serverVersions,
+				capabilities: tt.serverCapabilities,
+			}
+
+			clientConn, serverConn := net.Pipe()
+			defer clientConn.Close()
+			defer serverConn.Close()
+
+			clientKey := []byte("client-public-key")
+			serverKey := []byte("server-public-key")
+
+			type result struct {
+				session *Session
+				err     error
+			}
+			serverResult := make(chan result, 1)
+			go func() {
+				session, err := server.DoServerHandshake(serverConn, serverKey)
+				serverResult <- result{session, err}
+			}()
+
+			clientSession, clientErr := client.DoClientHandshake(clientConn, clientKey)
+			got := <-serverResult
+
+			if tt.wantErr != nil {
+				require.ErrorIs(t, clientErr, tt.wantErr)
+				require.ErrorIs(t, got.err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, clientErr)
+			require.NoError(t, got.err)
+
+			assert.Equal(t, serverKey, clientSession.RemotePublicKey)
+			assert.Equal(t, clientKey, got.session.RemotePublicKey)
+
+			assert.Equal(t, tt.wantVersion, clientSession.Version)
+			assert.Equal(t, tt.wantVersion, got.session.Version)
+
+			assert.Equal(t, tt.wantCapabilities, clientSession.Capabilities)
+			assert.Equal(t, tt.wantCapabilities, got.session.Capabilities)
+		})
+	}
+}
+
+func TestHandshakeLegacyClient(t *testing.T) {
+	server := NewProtocol(message.NewRegistry(), serialize.New(), nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		// A peer from before version negotiation swaps public keys and goes
+		// straight to its first v1 frame.
+		if err := sendPublicKey(clientConn, []byte("client-public-key")); err != nil {
+			return
+		}
+		if _, err := receivePublicKey(clientConn); err != nil {
+			return
+		}
+		clientConn.Write([]byte{byte(v1), 0, 0, 0, 5, 1, 2, 3, 4, 5})
+	}()
+
+	_, err := server.DoServerHandshake(serverConn, []byte("server-public-key"))
+	require.ErrorIs(t, err, ErrNoHello)
+}
+
+func TestReadFrameRejectsUnsupportedVersion(t *testing.T) {
+	p := NewProtocol(message.NewRegistry(), serialize.New(), nil)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	go func() {
+		// A v9 header with an empty payload.
+		clientConn.Write([]byte{9, 0, 9, 0, 0, 0, 0})
+	}()
+
+	err := p.ReadFrame(serverConn, new(Frame))
+	require.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+func TestReadFrameLimits(t *testing.T) {
+	p := newTestProtocol()
+
+	validFrame := encodeTestFrame(t, p, message.HeartbeatCheck{ID: uuid.New()})
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr error
+	}{
+		{
+			name:    "empty payload: should fail",
+			frame:   []byte{byte(v3), 0, 9, 0, 0, 0, 0},
+			wantErr: ErrEmptyFrame,
+		},
+		{
+			name:    "header bigger than max frame size: should fail",
+			frame:   []byte{byte(v3), 0, 3, 0xff, 0xff, 0xff, 0xff},
+			wantErr: ErrFrameTooLarge,
+		},
+		{
+			name:    "payload shorter than header says: should fail",
+			frame:   validFrame[:len(validFrame)-3],
+			wantErr: ErrTruncatedFrame,
+		},
+		{
+			name:    "payload that isn't a message: should fail",
+			frame:   []byte{byte(v3), 0, 9, 0, 0, 0, 3, 0xc1, 2, 3},
+			wantErr: ErrMalformedFrame,
+		},
+		{
+			name:    "unknown message id: should fail",
+			frame:   []byte{byte(v3), 0xff, 0xff, 0, 0, 0, 3, 1, 2, 3},
+			wantErr: ErrUnknownMessage,
+		},
+		{
+			name: "message over its type limit: should fail",
+			frame: encodeRawTestFrame(t, p, message.HeartbeatCheck{
+				UserPubKey: make([]byte, message.DefaultMaxPayloadSize),
+			}),
+			wantErr: ErrFrameTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.ReadFrame(bytes.NewReader(tt.frame), new(Frame))
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("valid frame", func(t *testing.T) {
+		rf := new(Frame)
+		err := p.ReadFrame(bytes.NewReader(validFrame), rf)
+		require.NoError(t, err)
+		assert.IsType(t, message.HeartbeatCheck{}, rf.Payload.Msg)
+		assert.Equal(t, message.IDHeartbeatCheck, rf.ID)
+	})
+
+	t.Run("manifest can go over the default limit", func(t *testing.T) {
+		manifest := message.CapsuleIncomingManifestStream{
+			Blocks: make([]message.BlockManifest, 4096),
+		}
+		for i := range manifest.Blocks {
+			manifest.Blocks[i].RepairGroupID = uuid.New()
+		}
+
+		rf := new(Frame)
+		err := p.ReadFrame(bytes.NewReader(encodeTestFrame(t, p, manifest)), rf)
+		require.NoError(t, err)
+	})
+}
+
+func TestFrameRoundTripPerVersion(t *testing.T) {
+	p := newTestProtocol()
+
+	sent := message.CapsuleIncomingShardStream{
+		ShardID:        uuid.New(),
+		CapsuleID:      uuid.New(),
+		RepairGroupID:  uuid.New(),
+		Nonce:          []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12},
+		DataShardNum:   32,
+		ParityShardNum: 22,
+		Size:           19418,
+		IsFinal:        true,
+	}
+
+	for _, v := range []version{v1, v2, v3} {
+		t.Run(fmt.Sprintf("v%d", v), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := p.WriteFrame(&buf, &Frame{Version: v, Payload: Payload{Msg: &sent}})
+			require.NoError(t, err)
+
+			rf := new(Frame)
+			err = p.ReadFrame(&buf, rf)
+			require.NoError(t, err)
+
+			assert.Equal(t, v, rf.Version)
+			assert.Equal(t, sent, rf.Payload.Msg)
+		})
+	}
+}
+
+// TestReadFrameOldLayouts reads frames the way peers from before v3 write
+// them. They still negotiate v1 and v2, so those layouts can never change.
+func TestReadFrameOldLayouts(t *testing.T) {
+	p := newTestProtocol()
+	sent := message.HeartbeatCheck{ID: uuid.New(), UserPubKey: []byte("public-key")}
+
+	var gobPayload bytes.Buffer
+	err := gob.NewEncoder(&gobPayload).Encode(&Payload{Msg: sent})
+	require.NoError(t, err)
+
+	msgpackMsg, err := msgpack.Marshal(sent)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		version version
+		payload []byte
+	}{
+		{name: "v1 gob payload", version: v1, payload: gobPayload.Bytes()},
+		{
+			name:    "v2 msgpack payload led by its id",
+			version: v2,
+			payload: append([]byte{0, byte(message.IDHeartbeatCheck)}, msgpackMsg...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := byteOrder.AppendUint32([]byte{byte(tt.version)}, uint32(len(tt.payload)))
+			frame = append(frame, tt.payload...)
+
+			rf := new(Frame)
+			err := p.ReadFrame(bytes.NewReader(frame), rf)
+			require.NoError(t, err)
+			assert.Equal(t, tt.version, rf.Version)
+			assert.Equal(t, message.IDHeartbeatCheck, rf.ID)
+			assert.Equal(t, sent, rf.Payload.Msg)
+
+			// And they get back what they would have written themselves.
+			assert.Equal(t, frame, encodeTestFrameOf(t, p, tt.version, sent))
+		})
+	}
+
+	t.Run("v1 message over its type limit: should fail", func(t *testing.T) {
+		var payload bytes.Buffer
+		err := gob.NewEncoder(&payload).Encode(&Payload{Msg: message.HeartbeatCheck{
+			UserPubKey: make([]byte, message.DefaultMaxPayloadSize),
+		}})
+		require.NoError(t, err)
+
+		frame := byteOrder.AppendUint32([]byte{byte(v1)}, uint32(payload.Len()))
+		err = p.ReadFrame(bytes.NewReader(append(frame, payload.Bytes()...)), new(Frame))
+		require.ErrorIs(t, err, ErrFrameTooLarge)
+	})
+
+	t.Run("v2 unknown message id: should fail", func(t *testing.T) {
+		frame := []byte{byte(v2), 0, 0, 0, 3, 0xff, 0xff, 0xc0}
+		err := p.ReadFrame(bytes.NewReader(frame), new(Frame))
+		require.ErrorIs(t, err, ErrUnknownMessage)
+	})
+}
+
+func FuzzReadFrame(f *testing.F) {
+	p := newTestProtocol()
+
+	f.Add(encodeTestFrame(f, p, message.HeartbeatCheck{ID: uuid.New()}))
+	f.Add(encodeTestFrame(f, p, message.CapsuleIncomingShardStream{Size: 1024, Nonce: make([]byte, 12)}))
+	f.Add([]byte{byte(v3), 0, 9, 0, 0, 0, 0})
+	f.Add([]byte{byte(v3), 0, 3, 0xff, 0xff, 0xff, 0xff, 1})
+	f.Add([]byte{byte(v3), 0, 9, 0, 0, 0, 8, 1, 2})
+	f.Add(encodeTestFrameOf(f, p, v1, message.HeartbeatCheck{ID: uuid.New()}))
+	f.Add([]byte{byte(v1), 0, 0, 0, 3, 1, 2, 3})
+	f.Add(encodeTestFrameOf(f, p, v2, message.HeartbeatCheck{ID: uuid.New()}))
+	f.Add([]byte{byte(v2), 0, 0, 0, 3, 0, 9, 0xc0})
+
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		rf := new(Frame)
+		r := bytes.NewReader(frame)
+		err := p.ReadFrame(r, rf)
+		if err != nil {
+			return
+		}
+
+		// Anything we accept has to be a registered message that fits its own
+		// limits.
+		require.NotNil(t, rf.Payload.Msg)
+		spec, isFound := p.Registry().Lookup(rf.ID)
+		require.True(t, isFound)
+
+		headerSize := int(v3HeaderSize)
+		if rf.Version == v1 || rf.Version == v2 {
+			headerSize = int(v1HeaderSize)
+		}
+		read := len(frame) - r.Len()
+		require.LessOrEqual(t, uint32(read-headerSize), spec.MaxPayloadSize)
+	})
+}
+
+func FuzzReceivePublicKey(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 4, 1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 32, 1})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		key, err := receivePublicKey(
+			&bytesReadWriter{Reader: bytes.NewReader(in)},
+		)
+		if err != nil {
+			return
+		}
+
+		require.NotEmpty(t, key)
+		require.LessOrEqual(t, len(key), int(maxPublicKeySize))
+	})
+}
+
+// bytesReadWriter is a read only io.ReadWriter for feeding handshake readers.
+type bytesReadWriter struct {
+	*bytes.Reader
+}
+
+func (bytesReadWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func newTestProtocol() *protocol {
+	return NewProtocol(message.NewRegistry(), serialize.New(), serialize.NewMsgpack())
+}
+
+func encodeTestFrame(tb testing.TB, p *protocol, msg message.Msg) []byte {
+	tb.Helper()
+
+	return encodeTestFrameOf(tb, p, p.Version(), msg)
+}
+
+func encodeTestFrameOf(tb testing.TB, p *protocol, v version, msg message.Msg) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	err := p.WriteFrame(&buf, &Frame{Version: v, Payload: Payload{Msg: msg}})
+	require.NoError(tb, err)
+
+	return buf.Bytes()
+}
+
+// encodeRawTestFrame builds a frame without going through WriteFrame, so tests
+// can make frames that WriteFrame would refuse and see ReadFrame reject them.
+func encodeRawTestFrame(tb testing.TB, p *protocol, msg message.Msg) []byte {
+	tb.Helper()
+
+	id, isFound := p.registry.IDOf(msg)
+	require.True(tb, isFound)
+
+	var payloadBuf bytes.Buffer
+	err := p.serializers[v3].Encode(&payloadBuf, msg)
+	require.NoError(tb, err)
+
+	frame := []byte{byte(v3)}
+	frame = byteOrder.AppendUint16(frame, uint16(id))
+	frame = byteOrder.AppendUint32(frame, uint32(payloadBuf.Len()))
+
+	return append(frame, payloadBuf.Bytes()...)
+}
@@ -0,0 +1,37 @@
+package serialize
+
+import (
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// msgpackSerialize encodes values with msgpack, a compact format with
+// implementations in most languages. Unlike gob, nothing about it is Go
+// specific, so non Go clients can speak it too.
+//
+// Structs are encoded as maps keyed by field name. An old peer skips fields
+// it doesn't know about and leaves the ones it doesn't get at their zero
+// value, so adding fields to a message doesn't break it.
+//
+// Nothing about the type goes on the wire. The caller has to know what to
+// decode into, for frames that is the message id in the frame header.
+type msgpackSerialize struct{}
+
+func NewMsgpack() *msgpackSerialize {
+	return &msgpackSerialize{}
+}
+
+func (msgpackSerialize) Encode(w io.Writer, p any) error {
+	return msgpack.NewEncoder(w).Encode(p)
+}
+
+func (msgpackSerialize) Decode(r io.Reader, p any) error {
+	return msgpack.NewDecoder(r).Decode(p)
+}
+
+// Register does nothing. msgpack only ever decodes into concrete types, so
+// there is nothing to register.
+func (msgpackSerialize) Register(types ...any) error {
+	return nil
+}
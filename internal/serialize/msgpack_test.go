@@ -0,0 +1,68 @@
+package serialize
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// oldHeartbeat and newHeartbeat are the same message as an old and a newer
+// peer know it.
+type oldHeartbeat struct {
+	ID   string
+	Seen uint32
+}
+
+type newHeartbeat struct {
+	ID      string
+	Seen    uint32
+	Comment string
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	s := NewMsgpack()
+
+	var buf bytes.Buffer
+	err := s.Encode(&buf, &oldHeartbeat{ID: "a", Seen: 3})
+	require.NoError(t, err)
+
+	got := new(oldHeartbeat)
+	err = s.Decode(&buf, got)
+	require.NoError(t, err)
+	assert.Equal(t, &oldHeartbeat{ID: "a", Seen: 3}, got)
+}
+
+func TestMsgpackAddingFieldsKeepsOldPeersWorking(t *testing.T) {
+	s := NewMsgpack()
+
+	t.Run("new to old drops the unknown field", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := s.Encode(&buf, newHeartbeat{ID: "a", Seen: 3, Comment: "hi"})
+		require.NoError(t, err)
+
+		got := new(oldHeartbeat)
+		require.NoError(t, s.Decode(&buf, got))
+		assert.Equal(t, &oldHeartbeat{ID: "a", Seen: 3}, got)
+	})
+
+	t.Run("old to new leaves the missing field zero", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := s.Encode(&buf, oldHeartbeat{ID: "a", Seen: 3})
+		require.NoError(t, err)
+
+		got := new(newHeartbeat)
+		require.NoError(t, s.Decode(&buf, got))
+		assert.Equal(t, &newHeartbeat{ID: "a", Seen: 3}, got)
+	})
+}
+
+func TestGobRegisterReturnsConflicts(t *testing.T) {
+	type gobConflict struct{}
+
+	s := New()
+	require.NoError(t, s.Register(gobConflict{}))
+	require.NoError(t, s.Register(gobConflict{}), "registering the same value twice is fine")
+	require.Error(t, s.Register(&gobConflict{}), "pointer and value of one type conflict in gob")
+}
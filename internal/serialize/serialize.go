@@ -2,13 +2,14 @@ package serialize
 
 import (
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
 type Serializer interface {
 	Encode(io.Writer, any) error
 	Decode(r io.Reader, p any) error
-	Register(types ...any)
+	Register(types ...any) error
 }
 
 type serialize struct{}
@@ -27,20 +28,32 @@ func (serialize) Decode(r io.Reader, p any) error {
 
 /*
 Register registers all types that would be encoded and decoded as any/interface
-types. You can register both the pointer type or value type.
-eg. Register(&type, type)
+types. Register either the pointer type or the value type of a type, not both,
+as gob sees both as the same type under different names.
+eg. Register(type{}) or Register(&type{})
+
+Registering the same value twice is fine.
 */
-func (serialize) Register(types ...any) {
+func (serialize) Register(types ...any) error {
 	for _, v := range types {
-		// Use a closure to handle each registration separately
-		func(val any) {
-			defer func() {
-				if r := recover(); r != nil {
-					// Type was already registered, just continue
-				}
-			}()
-			gob.Register(val)
-			// log.Println(v)
-		}(v)
+		if err := gobRegister(v); err != nil {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// gobRegister turns the panic gob.Register raises on conflicting names into
+// an error.
+func gobRegister(v any) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("serialize: failed to register %T: %v", v, r)
+		}
+	}()
+
+	gob.Register(v)
+
+	return nil
 }
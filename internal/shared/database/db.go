@@ -7,6 +7,9 @@ const (
 	BucketCapsulesActiveShards = "capsules:active_shards"
 	BucketCapsuleManifests     = "capsules:manifests"
 	BucketCapsulesRecovery     = "capsules:recovery"
+	BucketUnitsOfWork          = "capsules:units_of_work"
+	BucketProviderShards       = "capsules:provider_shards"
+	BucketAuditScores          = "capsules:audit_scores"
 
 	BucketGuardians  = "guardians"
 	BucketKeyShares  = "keyshares"
@@ -27,6 +30,9 @@ const (
 	CollCapsulesActiveShards
 	CollCapsuleManifests
 	CollCapsulesRecovery
+	CollUnitsOfWork
+	CollProviderShards
+	CollAuditScores
 
 	CollGuardians
 	CollKeyShares
@@ -47,6 +53,12 @@ func (c Collection) BucketName() string {
 		return BucketCapsuleManifests
 	case CollCapsulesRecovery:
 		return BucketCapsulesRecovery
+	case CollUnitsOfWork:
+		return BucketUnitsOfWork
+	case CollProviderShards:
+		return BucketProviderShards
+	case CollAuditScores:
+		return BucketAuditScores
 
 	case CollGuardians:
 		return BucketGuardians
@@ -0,0 +1,219 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/uptrace/bun"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+Migrations upgrade what a feature keeps in the db from one schema version to the
+next. Every feature has its own version, so a feature only ever migrates its own
+data.
+
+	bbolt   the version is in the "meta" bucket under "schema_version:<feature>".
+	sqlite  the version is in the schema_versions table.
+
+A db without a version is at version 0, which is what peers wrote before
+there were migrations.
+
+NOTICE IMPORTANT:
+  - Migrations are never edited or removed once released, a change to the data
+    is always a new migration at the end of the list.
+  - Every migration runs in its own tx together with the bump of the version, so
+    it is either done and recorded or not done at all.
+  - Up must still be idempotent, it must leave data it already upgraded as is.
+*/
+
+var (
+	ErrSchemaTooNew       = errors.New("db schema is newer than this app, upgrade the app")
+	ErrInvalidMigrations  = errors.New("migrations must be numbered 1, 2, 3... in order")
+	ErrEmptyFeatureName   = errors.New("feature name is empty")
+	errInvalidVersionSize = errors.New("stored schema version is not 8 bytes")
+)
+
+const bucketMeta = "meta"
+
+// BBoltMigration is one upgrade step of a feature's data in bbolt.
+type BBoltMigration struct {
+	Version uint64
+	Name    string
+	Up      func(tx *bolt.Tx) error
+}
+
+// SQLiteMigration is one upgrade step of a feature's tables in sqlite.
+type SQLiteMigration struct {
+	Version uint64
+	Name    string
+	Up      func(ctx context.Context, tx bun.Tx) error
+}
+
+// schemaVersionRow is the schema version of one feature.
+type schemaVersionRow struct {
+	bun.BaseModel `bun:"table:schema_versions"`
+
+	Feature    string    `bun:"feature,pk"`
+	Version    uint64    `bun:"version,notnull"`
+	MigratedAt time.Time `bun:"migrated_at,notnull"`
+}
+
+// MigrateBBolt runs the migrations of feature that db is not at yet, in order.
+// It returns the version db was at before and is at now.
+func MigrateBBolt(db *bolt.DB, feature string, migrations []BBoltMigration) (from, to uint64, err error) {
+	if err := validateVersions(feature, len(migrations), func(i int) uint64 {
+		return migrations[i].Version
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	from, err = BBoltSchemaVersion(db, feature)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > uint64(len(migrations)) {
+		return from, from, fmt.Errorf("%w: %s is at %d, app knows up to %d", ErrSchemaTooNew, feature, from, len(migrations))
+	}
+
+	to = from
+	for _, m := range migrations[from:] {
+		err := db.Update(func(tx *bolt.Tx) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+
+			b, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+			if err != nil {
+				return err
+			}
+
+			return b.Put(schemaVersionKey(feature), binary.BigEndian.AppendUint64(nil, m.Version))
+		})
+		if err != nil {
+			return from, to, fmt.Errorf("%s migration %d %q: %w", feature, m.Version, m.Name, err)
+		}
+
+		to = m.Version
+	}
+
+	return from, to, nil
+}
+
+// BBoltSchemaVersion is the version feature's data is at in db.
+func BBoltSchemaVersion(db *bolt.DB, feature string) (uint64, error) {
+	var version uint64
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucketMeta))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get(schemaVersionKey(feature))
+		if v == nil {
+			return nil
+		}
+		if len(v) != 8 {
+			return errInvalidVersionSize
+		}
+
+		version = binary.BigEndian.Uint64(v)
+
+		return nil
+	})
+
+	return version, err
+}
+
+// MigrateSQLite runs the migrations of feature that db is not at yet, in order.
+// It returns the version db was at before and is at now.
+func MigrateSQLite(ctx context.Context, db *bun.DB, feature string, migrations []SQLiteMigration) (from, to uint64, err error) {
+	if err := validateVersions(feature, len(migrations), func(i int) uint64 {
+		return migrations[i].Version
+	}); err != nil {
+		return 0, 0, err
+	}
+
+	_, err = db.NewCreateTable().Model((*schemaVersionRow)(nil)).IfNotExists().Exec(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	from, err = SQLiteSchemaVersion(ctx, db, feature)
+	if err != nil {
+		return 0, 0, err
+	}
+	if from > uint64(len(migrations)) {
+		return from, from, fmt.Errorf("%w: %s is at %d, app knows up to %d", ErrSchemaTooNew, feature, from, len(migrations))
+	}
+
+	to = from
+	for _, m := range migrations[from:] {
+		err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			if err := m.Up(ctx, tx); err != nil {
+				return err
+			}
+
+			_, err := tx.NewInsert().
+				Model(&schemaVersionRow{Feature: feature, Version: m.Version, MigratedAt: time.Now().UTC()}).
+				On("CONFLICT (feature) DO UPDATE").
+				Set("version = EXCLUDED.version").
+				Set("migrated_at = EXCLUDED.migrated_at").
+				Exec(ctx)
+
+			return err
+		})
+		if err != nil {
+			return from, to, fmt.Errorf("%s migration %d %q: %w", feature, m.Version, m.Name, err)
+		}
+
+		to = m.Version
+	}
+
+	return from, to, nil
+}
+
+// SQLiteSchemaVersion is the version feature's tables are at in db.
+func SQLiteSchemaVersion(ctx context.Context, db bun.IDB, feature string) (uint64, error) {
+	var row schemaVersionRow
+	err := db.NewSelect().Model(&row).Where("feature = ?", feature).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return row.Version, nil
+}
+
+func schemaVersionKey(feature string) []byte {
+	return []byte("schema_version:" + feature)
+}
+
+// validateVersions makes sure the n migrations of feature are numbered 1..n,
+// which is what lets a version double as the index of the next migration.
+func validateVersions(feature string, n int, version func(i int) uint64) error {
+	if feature == "" {
+		return ErrEmptyFeatureName
+	}
+
+	for i := range n {
+		if version(i) != uint64(i+1) {
+			return fmt.Errorf("%w: %s has %d at %d", ErrInvalidMigrations, feature, version(i), i)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uptrace/bun"
+	bolt "go.etcd.io/bbolt"
+)
+
+var errBroken = errors.New("broken migration")
+
+func TestMigrateBBolt(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var ran []uint64
+	step := func(version uint64) BBoltMigration {
+		return BBoltMigration{
+			Version: version,
+			Up: func(tx *bolt.Tx) error {
+				ran = append(ran, version)
+				_, err := tx.CreateBucketIfNotExists([]byte("test"))
+				return err
+			},
+		}
+	}
+	migrations := []BBoltMigration{step(1), step(2)}
+
+	from, to, err := MigrateBBolt(db, "test", migrations)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), from)
+	assert.Equal(t, uint64(2), to)
+	assert.Equal(t, []uint64{1, 2}, ran)
+
+	t.Run("only runs new migrations", func(t *testing.T) {
+		ran = nil
+		migrations = append(migrations, step(3))
+
+		from, to, err := MigrateBBolt(db, "test", migrations)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), from)
+		assert.Equal(t, uint64(3), to)
+		assert.Equal(t, []uint64{3}, ran)
+	})
+
+	t.Run("other features have their own version", func(t *testing.T) {
+		version, err := BBoltSchemaVersion(db, "other")
+		require.NoError(t, err)
+		assert.Zero(t, version)
+	})
+
+	t.Run("failed migration is not recorded", func(t *testing.T) {
+		broken := append(migrations, BBoltMigration{
+			Version: 4,
+			Up: func(tx *bolt.Tx) error {
+				if _, err := tx.CreateBucket([]byte("half done")); err != nil {
+					return err
+				}
+				return errBroken
+			},
+		})
+
+		_, to, err := MigrateBBolt(db, "test", broken)
+		require.ErrorIs(t, err, errBroken)
+		assert.Equal(t, uint64(3), to)
+
+		version, err := BBoltSchemaVersion(db, "test")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), version)
+
+		err = db.View(func(tx *bolt.Tx) error {
+			assert.Nil(t, tx.Bucket([]byte("half done")))
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("db newer than app", func(t *testing.T) {
+		_, _, err := MigrateBBolt(db, "test", migrations[:1])
+		require.ErrorIs(t, err, ErrSchemaTooNew)
+	})
+}
+
+func TestMigrateSQLite(t *testing.T) {
+	ctx := context.Background()
+	db := NewSQLite(t.TempDir(), slog.Default())
+	defer db.Close()
+
+	migrations := []SQLiteMigration{
+		{
+			Version: 1,
+			Up: func(ctx context.Context, tx bun.Tx) error {
+				_, err := tx.ExecContext(ctx, "CREATE TABLE test (id INTEGER PRIMARY KEY)")
+				return err
+			},
+		},
+	}
+
+	from, to, err := MigrateSQLite(ctx, db, "test", migrations)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), from)
+	assert.Equal(t, uint64(1), to)
+
+	// Would fail on the CREATE TABLE if it ran again.
+	from, to, err = MigrateSQLite(ctx, db, "test", migrations)
+	require.NoError(t, err)
+	assert.Equal(t, to, from)
+
+	t.Run("failed migration is rolled back", func(t *testing.T) {
+		broken := append(migrations, SQLiteMigration{
+			Version: 2,
+			Up: func(ctx context.Context, tx bun.Tx) error {
+				if _, err := tx.ExecContext(ctx, "CREATE TABLE half_done (id INTEGER)"); err != nil {
+					return err
+				}
+				return errBroken
+			},
+		})
+
+		_, _, err := MigrateSQLite(ctx, db, "test", broken)
+		require.ErrorIs(t, err, errBroken)
+
+		version, err := SQLiteSchemaVersion(ctx, db, "test")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), version)
+
+		var n int
+		err = db.NewRaw("SELECT count(*) FROM sqlite_master WHERE name = 'half_done'").Scan(ctx, &n)
+		require.NoError(t, err)
+		assert.Zero(t, n)
+	})
+
+	t.Run("db newer than app", func(t *testing.T) {
+		_, _, err := MigrateSQLite(ctx, db, "test", nil)
+		require.ErrorIs(t, err, ErrSchemaTooNew)
+	})
+}
+
+func TestMigrationsMustBeInOrder(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "diogel.db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	noop := func(tx *bolt.Tx) error { return nil }
+
+	_, _, err = MigrateBBolt(db, "test", []BBoltMigration{{Version: 1, Up: noop}, {Version: 3, Up: noop}})
+	require.ErrorIs(t, err, ErrInvalidMigrations)
+
+	_, _, err = MigrateBBolt(db, "", nil)
+	require.ErrorIs(t, err, ErrEmptyFeatureName)
+}
@@ -0,0 +1,68 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/dialect/sqlitedialect"
+	_ "modernc.org/sqlite"
+)
+
+// The db drivers a peer can be run with.
+const (
+	DriverSQLite = "sqlite"
+	DriverBBolt  = "bbolt"
+)
+
+// NewSQLite opens <dir>/db/diogel.sqlite. Every feature creates its own tables
+// in it.
+func NewSQLite(dir string, logger *slog.Logger) *bun.DB {
+	keyPath := fmt.Sprintf(
+		"%s/db",
+		dir,
+	)
+
+	err := os.MkdirAll(
+		keyPath,
+		0700,
+	)
+	if err != nil {
+		log.Fatal("Error creating directory")
+	}
+
+	// NOTICE IMPORTANT: foreign keys are off by default in sqlite and the pragma
+	// is per conn, so it has to be in the dsn for every conn to get it.
+	sqlDB, err := sql.Open(
+		"sqlite",
+		fmt.Sprintf(
+			"file:%s/diogel.sqlite?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)",
+			keyPath,
+		),
+	)
+	if err != nil {
+		log.Fatal("Error opening sqlite database")
+	}
+
+	// sqlite only has one writer anyway. One conn means writers queue up here
+	// instead of failing with SQLITE_BUSY.
+	sqlDB.SetMaxOpenConns(1)
+
+	if err := sqlDB.Ping(); err != nil {
+		log.Fatalf("Error connecting to sqlite database: %v", err)
+	}
+
+	logger.Debug("sqlite db connected!", "dir", keyPath)
+
+	return bun.NewDB(sqlDB, sqlitedialect.New())
+}
@@ -0,0 +1,217 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/transport"
+)
+
+type MemoryTransportConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+	Ctx          context.Context
+	ShutdownWG   *sync.WaitGroup
+	Network      *Network
+	PublicKey    []byte
+	Logger       *slog.Logger
+	Protocol     protocol.Protocol
+	Addr         string // any unique name on Network.
+	Clock        clock.Clock
+	OnConnect    transport.OnConnect
+	OnDisconnect transport.OnDisconnect
+	OnMessage    transport.OnMessage
+}
+
+// memoryTransport is an in process transport for tests. Peers on the same
+// Network connect to each other without any sockets, and the Network decides
+// how slow and lossy that is. Everything above the transport, handshake and
+// all, runs the same as on tcp.
+type memoryTransport struct {
+	*MemoryTransportConfig
+	wg *sync.WaitGroup
+}
+
+var (
+	_ transport.Transport    = (*memoryTransport)(nil)
+	_ transport.ConnUpgrader = (*memoryTransport)(nil)
+)
+
+func NewMemoryTransport(cfg *MemoryTransportConfig) *memoryTransport {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("MemoryTransportConfig cannot be nil")
+	case cfg.Ctx == nil:
+		log.Fatalln("Context cannot be nil")
+	case cfg.ShutdownWG == nil:
+		log.Fatalln("ShutdownWG cannot be nil")
+	case cfg.Network == nil:
+		log.Fatalln("Network cannot be nil")
+	case cfg.PublicKey == nil:
+		log.Fatalln("PublicKey cannot be nil")
+	case cfg.Logger == nil:
+		log.Fatalln("Logger cannot be nil")
+	case cfg.Protocol == nil:
+		log.Fatalln("Protocol cannot be nil")
+	case cfg.Addr == "":
+		log.Fatalln("Addr cannot be empty")
+	case cfg.Clock == nil:
+		log.Fatalln("Clock cannot be nil")
+	case cfg.OnConnect == nil:
+		log.Fatalln("OnConnect cannot be nil")
+	case cfg.OnDisconnect == nil:
+		log.Fatalln("OnDisconnect cannot be nil")
+	case cfg.OnMessage == nil:
+		log.Fatalln("OnMessage cannot be nil")
+	}
+
+	t := &memoryTransport{
+		MemoryTransportConfig: cfg,
+		wg:                    &sync.WaitGroup{},
+	}
+
+	if err := t.Network.listen(t.Addr, t); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Going away with the ctx, like the other transports do.
+	t.ShutdownWG.Add(1)
+	go func() {
+		defer t.ShutdownWG.Done()
+
+		<-t.Ctx.Done()
+		t.Close()
+		t.wg.Wait()
+	}()
+
+	return t
+}
+
+/* As Server Methods Start*/
+
+// ServeConn runs the server handshake on conn and serves it like a conn we
+// accepted ourselves. conn is closed if the handshake fails.
+func (t *memoryTransport) ServeConn(conn net.Conn) error {
+	session, err := t.Protocol.DoServerHandshake(conn, t.PublicKey)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not perform handshake: %w", err)
+	}
+
+	remotePeer, err := t.newRemotePeer(session, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	t.handleRemotePeerConn(remotePeer)
+
+	return nil
+}
+
+func (t *memoryTransport) handleRemotePeerConn(remotePeerConn transport.RemotePeerConn) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer remotePeerConn.Close()
+		defer t.OnDisconnect(remotePeerConn.ID())
+
+		t.OnConnect(remotePeerConn)
+
+		for {
+			if t.Ctx.Err() != nil {
+				return
+			}
+
+			msg, err := remotePeerConn.ReadMsg()
+			if err != nil {
+				if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+					t.Logger.Debug(
+						"memory: readFrame err, dropping conn",
+						"addr", t.Addr,
+						"remotePeer", remotePeerConn.Addr(),
+						"err", err,
+					)
+				}
+				return
+			}
+
+			t.OnMessage(remotePeerConn, msg)
+		}
+	}()
+}
+
+/* As Server Methods End */
+
+/* As Client methods Start */
+
+func (t *memoryTransport) ConnectToPeer(addr string) (transport.RemotePeerConn, error) {
+	clientConn, serverConn, server, err := t.Network.dial(t.Addr, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	server.wg.Add(1)
+	go func() {
+		defer server.wg.Done()
+
+		if err := server.ServeConn(serverConn); err != nil {
+			server.Logger.Debug("memory: could not serve conn", "addr", server.Addr, "from", t.Addr, "err", err)
+		}
+	}()
+
+	return t.UpgradeConn(clientConn)
+}
+
+// UpgradeConn runs the client handshake on conn. conn is closed if it fails.
+func (t *memoryTransport) UpgradeConn(conn net.Conn) (transport.RemotePeerConn, error) {
+	session, err := t.Protocol.DoClientHandshake(conn, t.PublicKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("remote peer failed client handshake: %w", err)
+	}
+
+	remotePeer, err := t.newRemotePeer(session, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return remotePeer, nil
+}
+
+/* As Client methods End */
+
+// Close takes us off the Network and cuts all our conns, like the peer died.
+func (t *memoryTransport) Close() error {
+	t.Network.unlisten(t.Addr, t)
+	return nil
+}
+
+func (t *memoryTransport) newRemotePeer(session *protocol.Session, conn net.Conn) (transport.RemotePeerConn, error) {
+	switch {
+	case session == nil:
+		return nil, errors.New("session can't be nil")
+	case session.RemotePublicKey == nil:
+		return nil, errors.New("publicKey can't be nil")
+	case conn == nil:
+		return nil, errors.New("conn can't be nil")
+	}
+
+	return transport.NewRemotePeer(session, conn, conn.RemoteAddr(), t.Protocol, t.Clock), nil
+}
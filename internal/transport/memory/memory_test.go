@@ -0,0 +1,337 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectToPeer(t *testing.T) {
+	network := NewNetwork(nil)
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	assert.Equal(t, "peer-b-public-key", string(remotePeer.PublicKey()))
+
+	served := b.waitConnected(t)
+	assert.Equal(t, "peer-a-public-key", string(served.PublicKey()))
+
+	sent := message.HeartbeatCheck{ID: uuid.New(), CapsuleID: uuid.New()}
+	_, err = remotePeer.Send(&sent, nil)
+	require.NoError(t, err)
+	assert.Equal(t, sent, b.waitMsg(t))
+
+	t.Run("unknown addr", func(t *testing.T) {
+		_, err := a.ConnectToPeer("nobody")
+		require.ErrorIs(t, err, ErrUnreachable)
+	})
+}
+
+func TestLatency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+
+	network := NewNetwork(&NetworkConfig{Latency: latency})
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+
+	start := time.Now()
+	_, err = remotePeer.Send(&message.HeartbeatCheck{ID: uuid.New()}, nil)
+	require.NoError(t, err)
+	b.waitMsg(t)
+
+	assert.GreaterOrEqual(t, time.Since(start), latency)
+}
+
+func TestLatencyOnFakeClock(t *testing.T) {
+	fakeClock := clock.NewFake(time.Now())
+	network := NewNetwork(&NetworkConfig{Clock: fakeClock})
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+
+	network.SetLatency(time.Hour)
+
+	sent := message.HeartbeatCheck{ID: uuid.New()}
+	_, err = remotePeer.Send(&sent, nil)
+	require.NoError(t, err)
+
+	// b's read loop waits on the clock for the write to get there.
+	fakeClock.BlockUntil(1)
+	select {
+	case msg := <-b.msgs:
+		t.Fatalf("got %v before its latency went by", msg)
+	default:
+	}
+
+	fakeClock.Advance(time.Hour)
+	assert.Equal(t, sent, b.waitMsg(t))
+}
+
+func TestLossIsDeterministic(t *testing.T) {
+	lossPattern := func(seed uint64) []bool {
+		network := NewNetwork(&NetworkConfig{
+			Loss:              0.5,
+			RetransmitTimeout: time.Hour,
+			Seed:              seed,
+		})
+
+		pattern := make([]bool, 64)
+		for i := range pattern {
+			pattern[i] = time.Until(network.deliverAt()) > 30*time.Minute
+		}
+		return pattern
+	}
+
+	first := lossPattern(7)
+	assert.Equal(t, first, lossPattern(7))
+	assert.NotEqual(t, first, lossPattern(8))
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+}
+
+func TestLossStillDelivers(t *testing.T) {
+	network := NewNetwork(&NetworkConfig{
+		Loss:              1,
+		RetransmitTimeout: 20 * time.Millisecond,
+	})
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+
+	for range 5 {
+		sent := message.HeartbeatCheck{ID: uuid.New()}
+		_, err = remotePeer.Send(&sent, nil)
+		require.NoError(t, err)
+		assert.Equal(t, sent, b.waitMsg(t))
+	}
+}
+
+func TestPartition(t *testing.T) {
+	network := NewNetwork(nil)
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+	c := newTestMemoryTransport(t, network, "peer-c")
+
+	_, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	served := b.waitConnected(t)
+
+	network.Partition([]string{"peer-a"}, []string{"peer-b", "peer-c"})
+
+	assert.Equal(t, served.ID(), b.waitDisconnected(t))
+
+	_, err = a.ConnectToPeer("peer-b")
+	require.ErrorIs(t, err, ErrUnreachable)
+
+	// Same side of the partition still works.
+	_, err = c.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+
+	network.Heal()
+
+	_, err = a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+}
+
+func TestDisconnect(t *testing.T) {
+	network := NewNetwork(nil)
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	served := b.waitConnected(t)
+
+	network.Disconnect("peer-a", "peer-b")
+
+	assert.Equal(t, served.ID(), b.waitDisconnected(t))
+
+	_, err = remotePeer.Send(&message.HeartbeatCheck{}, nil)
+	require.Error(t, err)
+
+	_, err = a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+}
+
+func TestKillAndRevive(t *testing.T) {
+	network := NewNetwork(nil)
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	_, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	b.waitConnected(t)
+
+	// Killing b the way a peer shuts down, with its ctx.
+	b.cancel()
+	b.waitDisconnected(t)
+
+	_, err = a.ConnectToPeer("peer-b")
+	require.ErrorIs(t, err, ErrUnreachable)
+
+	revived := newTestMemoryTransport(t, network, "peer-b")
+
+	// The old b closing again must not take the revived one off the network.
+	require.NoError(t, b.Close())
+
+	_, err = a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	revived.waitConnected(t)
+}
+
+func TestStream(t *testing.T) {
+	network := NewNetwork(&NetworkConfig{Latency: time.Millisecond})
+	a := newTestMemoryTransport(t, network, "peer-a")
+	b := newTestMemoryTransport(t, network, "peer-b")
+
+	// b's read loop runs all along, the stream gets its frames past it.
+	remotePeer, err := a.ConnectToPeer("peer-b")
+	require.NoError(t, err)
+	served := b.waitConnected(t)
+
+	data := make([]byte, 3*1024*1024+7)
+	rand.Read(data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := remotePeer.SendStream(ctx, bytes.NewReader(data))
+		sendErr <- err
+	}()
+
+	_, err = remotePeer.Send(&message.HeartbeatCheck{}, nil)
+	require.NoError(t, err)
+
+	var got bytes.Buffer
+	_, err = served.ReceiveStream(ctx, &got)
+	require.NoError(t, err)
+	require.NoError(t, <-sendErr)
+	assert.True(t, bytes.Equal(data, got.Bytes()))
+
+	// The loop only ever got the message.
+	assert.IsType(t, message.HeartbeatCheck{}, <-b.msgs)
+	assert.Empty(t, b.msgs)
+}
+
+type testMemoryTransport struct {
+	*memoryTransport
+	cancel       context.CancelFunc
+	connected    chan transport.RemotePeerConn
+	disconnected chan uuid.UUID
+	msgs         chan message.Msg
+}
+
+func newTestMemoryTransport(t *testing.T, network *Network, addr string) *testMemoryTransport {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	tt := &testMemoryTransport{
+		cancel:       cancel,
+		connected:    make(chan transport.RemotePeerConn, 4),
+		disconnected: make(chan uuid.UUID, 4),
+		msgs:         make(chan message.Msg, 4),
+	}
+
+	tt.memoryTransport = NewMemoryTransport(&MemoryTransportConfig{
+		Ctx:        ctx,
+		ShutdownWG: wg,
+		Network:    network,
+		PublicKey:  []byte(addr + "-public-key"),
+		Logger:     slog.Default(),
+		Protocol:   protocol.NewProtocol(message.NewRegistry(), serialize.New(), nil),
+		Addr:       addr,
+		Clock:      clock.New(),
+		OnConnect: func(remotePeer transport.RemotePeerConn) error {
+			tt.connected <- remotePeer
+			return nil
+		},
+		OnDisconnect: func(remotePeerID uuid.UUID) error {
+			tt.disconnected <- remotePeerID
+			return nil
+		},
+		OnMessage: func(remotePeer transport.RemotePeer, msg message.Msg) {
+			tt.msgs <- msg
+		},
+	})
+
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	return tt
+}
+
+func (tt *testMemoryTransport) waitConnected(t *testing.T) transport.RemotePeerConn {
+	t.Helper()
+
+	select {
+	case remotePeer := <-tt.connected:
+		return remotePeer
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: never got a conn", tt.Addr)
+		return nil
+	}
+}
+
+func (tt *testMemoryTransport) waitDisconnected(t *testing.T) uuid.UUID {
+	t.Helper()
+
+	select {
+	case id := <-tt.disconnected:
+		return id
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: never saw a disconnect", tt.Addr)
+		return uuid.Nil
+	}
+}
+
+func (tt *testMemoryTransport) waitMsg(t *testing.T) message.Msg {
+	t.Helper()
+
+	select {
+	case msg := <-tt.msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: never got a msg", tt.Addr)
+		return nil
+	}
+}
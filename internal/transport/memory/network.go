@@ -0,0 +1,217 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+)
+
+var (
+	ErrUnreachable = errors.New("memory: peer is unreachable")
+	ErrAddrInUse   = errors.New("memory: addr already in use")
+)
+
+type NetworkConfig struct {
+	// Latency is how long every write takes to get to the other end.
+	Latency time.Duration
+	// Loss is the chance, 0 to 1, that a write is lost. Like on tcp, lost
+	// writes are resent, so they show up RetransmitTimeout late rather than
+	// not at all.
+	Loss float64
+	// RetransmitTimeout is how late a lost write is. Defaults to 200ms.
+	RetransmitTimeout time.Duration
+	// Seed seeds which writes are lost, so a test sees the same losses every run.
+	Seed uint64
+	// Clock is what latency and retransmits are timed on. Defaults to the real
+	// clock. On a Fake one, a write that is late only arrives when the clock
+	// is advanced past it.
+	Clock clock.Clock
+}
+
+// Network is what memory transports on it connect through. It is a registry of
+// their addrs, and where latency, loss, partitions and disconnects are set.
+// Settings can be changed while peers are connected.
+type Network struct {
+	mu                sync.Mutex
+	latency           time.Duration
+	loss              float64
+	retransmitTimeout time.Duration
+	rand              *rand.Rand
+	clock             clock.Clock
+
+	transports map[string]*memoryTransport
+	conns      map[*conn]struct{}
+	// partitionOf is the partition group of each addr. Addrs not in it are in
+	// group 0 together.
+	partitionOf map[string]int
+}
+
+func NewNetwork(cfg *NetworkConfig) *Network {
+	if cfg == nil {
+		cfg = &NetworkConfig{}
+	}
+	if cfg.RetransmitTimeout == 0 {
+		cfg.RetransmitTimeout = 200 * time.Millisecond
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.New()
+	}
+
+	return &Network{
+		latency:           cfg.Latency,
+		loss:              cfg.Loss,
+		retransmitTimeout: cfg.RetransmitTimeout,
+		rand:              rand.New(rand.NewPCG(cfg.Seed, cfg.Seed)),
+		clock:             cfg.Clock,
+		transports:        make(map[string]*memoryTransport),
+		conns:             make(map[*conn]struct{}),
+		partitionOf:       make(map[string]int),
+	}
+}
+
+func (n *Network) SetLatency(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency = latency
+}
+
+func (n *Network) SetLoss(loss float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.loss = loss
+}
+
+// Partition splits the network. Each group of addrs can only reach addrs in
+// the same group, and conns between groups are cut. Addrs in no group form one
+// more group together.
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitionOf = make(map[string]int)
+	for i, group := range groups {
+		for _, a := range group {
+			n.partitionOf[a] = i + 1
+		}
+	}
+
+	for c := range n.conns {
+		if !n.canReach(string(c.local), string(c.remote)) {
+			c.cut()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// Heal undoes Partition. Cut conns stay cut, peers have to connect again.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitionOf = make(map[string]int)
+}
+
+// Disconnect cuts every conn between a and b, like a dropped link. They can
+// connect again right away.
+func (n *Network) Disconnect(a, b string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for c := range n.conns {
+		local, remote := string(c.local), string(c.remote)
+		if (local == a && remote == b) || (local == b && remote == a) {
+			c.cut()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// canReach expects n.mu to be held.
+func (n *Network) canReach(a, b string) bool {
+	return n.partitionOf[a] == n.partitionOf[b]
+}
+
+// deliverAt is when a write made now gets to the other end.
+func (n *Network) deliverAt() time.Time {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delay := n.latency
+	if n.loss > 0 && n.rand.Float64() < n.loss {
+		delay += n.retransmitTimeout
+	}
+
+	return n.clock.Now().Add(delay)
+}
+
+func (n *Network) listen(a string, t *memoryTransport) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, isFound := n.transports[a]; isFound {
+		return fmt.Errorf("%w: %s", ErrAddrInUse, a)
+	}
+	n.transports[a] = t
+
+	return nil
+}
+
+// unlisten takes t off the network and cuts all of its conns, like the peer
+// at a died. It does nothing if a is not t's anymore, a peer revived at a
+// doesn't get killed by its old self closing late.
+func (n *Network) unlisten(a string, t *memoryTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.transports[a] != t {
+		return
+	}
+	delete(n.transports, a)
+
+	for c := range n.conns {
+		if string(c.local) == a || string(c.remote) == a {
+			c.cut()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// dial returns both ends of a new conn from a to b, and b's transport.
+func (n *Network) dial(a, b string) (client *conn, server *conn, serverTransport *memoryTransport, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	serverTransport, isFound := n.transports[b]
+	if !isFound || !n.canReach(a, b) {
+		return nil, nil, nil, fmt.Errorf("%w: %s -> %s", ErrUnreachable, a, b)
+	}
+
+	aToB, bToA := newPipe(n.clock), newPipe(n.clock)
+	client = &conn{network: n, in: bToA, out: aToB, local: addr(a), remote: addr(b)}
+	server = &conn{network: n, in: aToB, out: bToA, local: addr(b), remote: addr(a)}
+
+	n.conns[client] = struct{}{}
+	n.conns[server] = struct{}{}
+
+	return client, server, serverTransport, nil
+}
+
+func (n *Network) forget(c *conn) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delete(n.conns, c)
+}
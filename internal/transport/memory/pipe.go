@@ -0,0 +1,226 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package memory
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+)
+
+// addr is the net.Addr of a memory conn, just the addr the transport was
+// registered with on its Network.
+type addr string
+
+func (a addr) Network() string { return "memory" }
+func (a addr) String() string  { return string(a) }
+
+type chunk struct {
+	b         []byte
+	deliverAt time.Time
+}
+
+/*
+pipe is one direction of a memory conn. Unlike net.Pipe, writes never wait for
+a reader, they are queued. Streams need that, both ends write at the same time.
+
+Each write is one "packet". It becomes readable at its deliverAt, which the
+Network sets from its latency and loss on its clock. Chunks are never
+reordered, a chunk is never delivered before the one written ahead of it.
+
+NOTICE: The read deadline stays on the real time, like on every other conn.
+*/
+type pipe struct {
+	mu            sync.Mutex
+	chunks        []chunk
+	lastDeliverAt time.Time
+	isWriteClosed bool // the writer is done, reads return io.EOF once drained.
+	isReadClosed  bool // the reader is done, reads and writes fail.
+	readDeadline  time.Time
+	notify        chan struct{}
+	clock         clock.Clock
+}
+
+func newPipe(clock clock.Clock) *pipe {
+	return &pipe{
+		notify: make(chan struct{}, 1),
+		clock:  clock,
+	}
+}
+
+func (p *pipe) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *pipe) write(b []byte, deliverAt time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isWriteClosed || p.isReadClosed {
+		return 0, net.ErrClosed
+	}
+
+	// Never overtake what was written before.
+	if deliverAt.Before(p.lastDeliverAt) {
+		deliverAt = p.lastDeliverAt
+	}
+	p.lastDeliverAt = deliverAt
+
+	p.chunks = append(p.chunks, chunk{
+		b:         append([]byte(nil), b...),
+		deliverAt: deliverAt,
+	})
+	p.wake()
+
+	return len(b), nil
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	for {
+		p.mu.Lock()
+		if p.isReadClosed {
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+
+		readDeadline := p.readDeadline
+		if !readDeadline.IsZero() && !time.Now().Before(readDeadline) {
+			p.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		now := p.clock.Now()
+		var deliverAt time.Time
+		if len(p.chunks) > 0 {
+			head := &p.chunks[0]
+			if !now.Before(head.deliverAt) {
+				n := copy(b, head.b)
+				head.b = head.b[n:]
+				if len(head.b) == 0 {
+					p.chunks = p.chunks[1:]
+				}
+				p.mu.Unlock()
+				return n, nil
+			}
+			deliverAt = head.deliverAt
+		} else if p.isWriteClosed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.mu.Unlock()
+
+		p.wait(now, deliverAt, readDeadline)
+	}
+}
+
+// wait waits for a write or close, till deliverAt on the clock and till
+// readDeadline on the real time, whichever comes first. Zero times are not
+// waited for.
+func (p *pipe) wait(now, deliverAt, readDeadline time.Time) {
+	// A nil chan never fires, we only wait on the timers we have.
+	var deliverC, deadlineC <-chan time.Time
+	if !deliverAt.IsZero() {
+		timer := p.clock.NewTimer(deliverAt.Sub(now))
+		defer timer.Stop()
+		deliverC = timer.C()
+	}
+	if !readDeadline.IsZero() {
+		timer := time.NewTimer(time.Until(readDeadline))
+		defer timer.Stop()
+		deadlineC = timer.C
+	}
+
+	select {
+	case <-p.notify:
+	case <-deliverC:
+	case <-deadlineC:
+	}
+}
+
+func (p *pipe) setReadDeadline(t time.Time) {
+	p.mu.Lock()
+	p.readDeadline = t
+	p.mu.Unlock()
+	p.wake()
+}
+
+func (p *pipe) closeWrite() {
+	p.mu.Lock()
+	p.isWriteClosed = true
+	p.mu.Unlock()
+	p.wake()
+}
+
+func (p *pipe) closeRead() {
+	p.mu.Lock()
+	p.isReadClosed = true
+	p.chunks = nil
+	p.mu.Unlock()
+	p.wake()
+}
+
+// conn is one end of a memory conn.
+type conn struct {
+	network       *Network
+	in            *pipe
+	out           *pipe
+	local, remote addr
+	closeOnce     sync.Once
+}
+
+var _ net.Conn = (*conn)(nil)
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.in.read(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	return c.out.write(b, c.network.deliverAt())
+}
+
+// Close closes both directions. The other end reads what is already on its
+// way and then io.EOF.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.out.closeWrite()
+		c.in.closeRead()
+		c.network.forget(c)
+	})
+
+	return nil
+}
+
+// cut drops the conn like a network failure would, nothing in flight arrives.
+func (c *conn) cut() {
+	c.in.closeRead()
+	c.out.closeRead()
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.in.setReadDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writes never block.
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
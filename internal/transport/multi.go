@@ -0,0 +1,107 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+const (
+	NetworkTCP  = "tcp"
+	NetworkQUIC = "quic"
+
+	// addrSep separates the addrs of one peer in a multi addr.
+	addrSep = ","
+)
+
+var ErrUnknownNetwork = errors.New("no transport for network")
+
+// ParseAddr splits an addr like "quic://1.2.3.4:3001" into its network and
+// host:port. Addrs without a network are tcp, which is what every addr was
+// before there was more than one transport.
+func ParseAddr(addr string) (network, hostPort string) {
+	network, hostPort, hasNetwork := strings.Cut(addr, "://")
+	if !hasNetwork {
+		return NetworkTCP, addr
+	}
+
+	return network, hostPort
+}
+
+// multiTransport runs a transport per network at once, so a peer can be
+// reached on any of the addrs it advertises.
+type multiTransport struct {
+	byNetwork map[string]Transport
+}
+
+var _ Transport = (*multiTransport)(nil)
+
+func NewMultiTransport(byNetwork map[string]Transport) *multiTransport {
+	switch {
+	case len(byNetwork) == 0:
+		log.Fatalln("byNetwork cannot be empty")
+	}
+
+	for network, t := range byNetwork {
+		if t == nil {
+			log.Fatalf("transport for network %s cannot be nil", network)
+		}
+	}
+
+	return &multiTransport{
+		byNetwork: byNetwork,
+	}
+}
+
+// ConnectToPeer connects with the transport for addr's network. addr can also
+// be a multi addr, a comma separated list of one peer's addrs, like
+// "quic://1.2.3.4:4001,tcp://1.2.3.4:3001". They are tried in order and the
+// first that connects wins.
+func (m *multiTransport) ConnectToPeer(addr string) (RemotePeerConn, error) {
+	var errs []error
+
+	for a := range strings.SplitSeq(addr, addrSep) {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		network, hostPort := ParseAddr(a)
+
+		t, isFound := m.byNetwork[network]
+		if !isFound {
+			errs = append(errs, fmt.Errorf("%w %q in %s", ErrUnknownNetwork, network, a))
+			continue
+		}
+
+		remotePeer, err := t.ConnectToPeer(hostPort)
+		if err == nil {
+			return remotePeer, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no addr in %q", addr)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+func (m *multiTransport) Close() error {
+	var errs []error
+	for _, t := range m.byNetwork {
+		errs = append(errs, t.Close())
+	}
+
+	return errors.Join(errs...)
+}
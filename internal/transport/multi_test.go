@@ -0,0 +1,110 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		addr         string
+		wantNetwork  string
+		wantHostPort string
+	}{
+		{addr: ":3001", wantNetwork: NetworkTCP, wantHostPort: ":3001"},
+		{addr: "tcp://1.2.3.4:3001", wantNetwork: NetworkTCP, wantHostPort: "1.2.3.4:3001"},
+		{addr: "quic://1.2.3.4:4001", wantNetwork: NetworkQUIC, wantHostPort: "1.2.3.4:4001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, hostPort := ParseAddr(tt.addr)
+			assert.Equal(t, tt.wantNetwork, network)
+			assert.Equal(t, tt.wantHostPort, hostPort)
+		})
+	}
+}
+
+func TestMultiTransportConnectToPeer(t *testing.T) {
+	tcp := &fakeTransport{failFor: map[string]bool{"1.2.3.4:3001": true}}
+	quic := &fakeTransport{}
+
+	m := NewMultiTransport(map[string]Transport{
+		NetworkTCP:  tcp,
+		NetworkQUIC: quic,
+	})
+
+	tests := []struct {
+		name     string
+		addr     string
+		wantErr  error
+		wantTCP  []string
+		wantQUIC []string
+	}{
+		{
+			name:    "plain addr is tcp",
+			addr:    ":3001",
+			wantTCP: []string{":3001"},
+		},
+		{
+			name:     "quic addr",
+			addr:     "quic://1.2.3.4:4001",
+			wantQUIC: []string{"1.2.3.4:4001"},
+		},
+		{
+			name:     "multi addr falls through to the next addr",
+			addr:     "tcp://1.2.3.4:3001, quic://1.2.3.4:4001",
+			wantTCP:  []string{"1.2.3.4:3001"},
+			wantQUIC: []string{"1.2.3.4:4001"},
+		},
+		{
+			name:    "unknown network",
+			addr:    "sctp://1.2.3.4:5001",
+			wantErr: ErrUnknownNetwork,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tcp.dialed, quic.dialed = nil, nil
+
+			_, err := m.ConnectToPeer(tt.addr)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTCP, tcp.dialed)
+			assert.Equal(t, tt.wantQUIC, quic.dialed)
+		})
+	}
+}
+
+type fakeTransport struct {
+	failFor map[string]bool
+	dialed  []string
+}
+
+func (f *fakeTransport) ConnectToPeer(addr string) (RemotePeerConn, error) {
+	f.dialed = append(f.dialed, addr)
+	if f.failFor[addr] {
+		return nil, errors.New("fake: unreachable")
+	}
+
+	return &remotePeerConn{}, nil
+}
+
+func (f *fakeTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,278 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package nat
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscover(t *testing.T) {
+	server := newTestServer(t, clock.New())
+	peer, _ := newTestPeer(t, server, "peer-a", natOpen, clock.New())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	endpoint, err := peer.Discover(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, peer.PacketConn.LocalAddr().String(), endpoint.String())
+	assert.Equal(t, endpoint.String(), peer.PublicAddr().String())
+}
+
+func TestConnectToPeer(t *testing.T) {
+	tests := []struct {
+		name string
+		nat  natBehaviour
+	}{
+		{
+			name: "hole punch through cone NATs",
+			nat:  natCone,
+		},
+		{
+			name: "relay when udp between peers is blocked",
+			nat:  natBlocked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, clock.New())
+			peerA, _ := newTestPeer(t, server, "peer-a", tt.nat, clock.New())
+			_, innerB := newTestPeer(t, server, "peer-b", tt.nat, clock.New())
+
+			remotePeer, err := peerA.ConnectToPeer("peer-b")
+			require.NoError(t, err)
+			defer remotePeer.Close()
+
+			var served transport.RemotePeerConn
+			select {
+			case served = <-innerB.served:
+			case <-time.After(5 * time.Second):
+				t.Fatal("peer-b never served the conn")
+			}
+			defer served.Close()
+
+			assert.Equal(t, innerB.publicKey, []byte(remotePeer.PublicKey()))
+
+			sent := message.HeartbeatCheck{ID: uuid.New(), CapsuleID: uuid.New()}
+			_, err = remotePeer.Send(&sent, nil)
+			require.NoError(t, err)
+
+			var got message.HeartbeatCheck
+			_, err = served.Receive(&got, nil)
+			require.NoError(t, err)
+			assert.Equal(t, sent.ID, got.ID)
+			assert.Equal(t, sent.CapsuleID, got.CapsuleID)
+		})
+	}
+}
+
+func TestConnectToUnknownPeer(t *testing.T) {
+	server := newTestServer(t, clock.New())
+	peer, _ := newTestPeer(t, server, "peer-a", natOpen, clock.New())
+
+	_, err := peer.ConnectToPeer("nobody")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrPeerNotFound)
+}
+
+func TestRegistrationExpires(t *testing.T) {
+	serverClock, peerClock := clock.NewFake(time.Now()), clock.NewFake(time.Now())
+	server := newTestServer(t, serverClock)
+	newTestPeer(t, server, "peer-a", natOpen, peerClock)
+
+	_, isFound := server.lookup("peer-a")
+	require.True(t, isFound)
+
+	serverClock.Advance(server.RegistrationTTL + time.Second)
+	_, isFound = server.lookup("peer-a")
+	require.False(t, isFound)
+
+	// The refresh registers the peer again. Its ticker waits on the clock,
+	// with the After of the first register that was answered in time.
+	peerClock.BlockUntil(2)
+	peerClock.Advance(30 * time.Second)
+	assert.Eventually(t, func() bool {
+		_, isFound := server.lookup("peer-a")
+		return isFound
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func newTestServer(t *testing.T, c clock.Clock) *Server {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	server := NewServer(&ServerConfig{
+		Ctx:              ctx,
+		Logger:           slog.Default(),
+		Clock:            c,
+		Addr:             "127.0.0.1:0",
+		RelayAddr:        "127.0.0.1:0",
+		RelayJoinTimeout: 2 * time.Second,
+	})
+	require.NoError(t, server.Listen())
+
+	done := make(chan struct{})
+	go func() {
+		server.Serve()
+		close(done)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return server
+}
+
+func newTestPeer(t *testing.T, server *Server, addr string, nat natBehaviour, c clock.Clock) (*natTransport, *fakeInner) {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	inner := &fakeInner{
+		protocol:  protocol.NewProtocol(message.NewRegistry(), serialize.New(), nil),
+		publicKey: []byte(addr + "-public-key"),
+		served:    make(chan transport.RemotePeerConn, 1),
+	}
+
+	peer := NewTransport(&TransportConfig{
+		Ctx:            ctx,
+		ShutdownWG:     wg,
+		Logger:         slog.Default(),
+		Clock:          c,
+		Inner:          inner,
+		RendezvousAddr: server.UDPAddr().String(),
+		AdvertisedAddr: addr,
+		PacketConn: &restrictedConn{
+			PacketConn: pc,
+			nat:        nat,
+			rendezvous: server.UDPAddr().String(),
+			sentTo:     make(map[string]bool),
+		},
+		PunchTimeout: time.Second,
+	})
+
+	t.Cleanup(func() {
+		cancel()
+		peer.Close()
+		wg.Wait()
+	})
+
+	return peer, inner
+}
+
+type natBehaviour int
+
+const (
+	// natOpen lets every packet in.
+	natOpen natBehaviour = iota
+	// natCone only lets packets in from addrs we sent to first, like most
+	// home routers.
+	natCone
+	// natBlocked only lets the rendezvous server in, so punching never works.
+	natBlocked
+)
+
+// restrictedConn pretends a udp socket sits behind a NAT.
+type restrictedConn struct {
+	net.PacketConn
+	nat        natBehaviour
+	rendezvous string
+
+	mu     sync.Mutex
+	sentTo map[string]bool
+}
+
+func (c *restrictedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sentTo[addr.String()] = true
+	c.mu.Unlock()
+
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *restrictedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.isAllowed(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *restrictedConn) isAllowed(from net.Addr) bool {
+	switch c.nat {
+	case natCone:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.sentTo[from.String()]
+	case natBlocked:
+		return from.String() == c.rendezvous
+	default:
+		return true
+	}
+}
+
+// fakeInner stands in for the tcp transport. It can never connect directly,
+// which is the whole reason for nat, but handshakes the conns it is handed.
+type fakeInner struct {
+	protocol  protocol.Protocol
+	publicKey []byte
+	served    chan transport.RemotePeerConn
+}
+
+func (f *fakeInner) ConnectToPeer(addr string) (transport.RemotePeerConn, error) {
+	return nil, errors.New("fake: no direct route")
+}
+
+func (f *fakeInner) Close() error {
+	return nil
+}
+
+func (f *fakeInner) UpgradeConn(conn net.Conn) (transport.RemotePeerConn, error) {
+	session, err := f.protocol.DoClientHandshake(conn, f.publicKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return transport.NewRemotePeer(session, conn, conn.RemoteAddr(), f.protocol, clock.New()), nil
+}
+
+func (f *fakeInner) ServeConn(conn net.Conn) error {
+	session, err := f.protocol.DoServerHandshake(conn, f.publicKey)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	f.served <- transport.NewRemotePeer(session, conn, conn.RemoteAddr(), f.protocol, clock.New())
+	return nil
+}
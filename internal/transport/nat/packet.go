@@ -0,0 +1,168 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package nat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type packetType uint8
+
+const (
+	// STUN like discovery of our public endpoint.
+	bindRequest packetType = iota + 1
+	bindResponse
+
+	// Telling the rendezvous server which addr we can be reached by.
+	registerRequest
+	registerResponse
+
+	// Asking the rendezvous server to set up a hole punch to a peer.
+	connectRequest
+	connectResponse
+	// punchNotify tells a peer that another peer wants to punch to it.
+	punchNotify
+	// probe and probeAck are sent between the peers themselves to open up
+	// their NATs.
+	probe
+	probeAck
+
+	// Relaying, the fallback when punching fails.
+	relayRequest
+	relayNotify
+	relayJoin
+	relayReady
+)
+
+const (
+	// maxPacketSize is the largest control packet we send or accept. They are
+	// a few short strings, so this is plenty and stays under any udp MTU.
+	maxPacketSize = 1200
+	// relayFrameLenSize is the size of the length prefix of relay frames.
+	relayFrameLenSize = 2
+)
+
+// packetMagic starts every udp control packet. Its first byte has the two top
+// bits clear, which is how quic tells non QUIC packets apart, so control
+// packets and QUIC can share one udp socket.
+var packetMagic = []byte{0x00, 'D', 'G', 'L'}
+
+var (
+	ErrNotControlPacket = errors.New("nat: not a control packet")
+	ErrPeerNotFound     = errors.New("nat: peer is not registered with the rendezvous server")
+)
+
+/*
+packet is a control packet between a peer and the rendezvous server, or
+between two peers while punching.
+
+	udp
+	- byte[0:4] |4bytes| = packetMagic
+	- byte[4:]           = json encoded packet
+
+	tcp (relay)
+	- byte[0:2] |2bytes| = n, the size of the json
+	- byte[2:n+2]        = json encoded packet
+*/
+type packet struct {
+	Type packetType `json:"type"`
+	// TxID matches a response to its request.
+	TxID uint64 `json:"txid,omitempty"`
+	// Addr is the addr a peer is known by, the one others pass to ConnectToPeer.
+	Addr string `json:"addr,omitempty"`
+	// From is the addr of the peer that sent the request.
+	From string `json:"from,omitempty"`
+	// Endpoint is a public udp endpoint as seen by the rendezvous server.
+	Endpoint  string `json:"endpoint,omitempty"`
+	RelayPort int    `json:"relayPort,omitempty"`
+	Token     string `json:"token,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (p *packet) err() error {
+	if p.Error == "" {
+		return nil
+	}
+
+	if p.Error == ErrPeerNotFound.Error() {
+		return ErrPeerNotFound
+	}
+
+	return errors.New(p.Error)
+}
+
+func encodePacket(p *packet) ([]byte, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packetMagic)+len(body) > maxPacketSize {
+		return nil, fmt.Errorf("nat: control packet is %d bytes, max is %d", len(body), maxPacketSize)
+	}
+
+	return append(append([]byte{}, packetMagic...), body...), nil
+}
+
+func decodePacket(b []byte) (*packet, error) {
+	if !bytes.HasPrefix(b, packetMagic) {
+		return nil, ErrNotControlPacket
+	}
+
+	p := new(packet)
+	if err := json.Unmarshal(b[len(packetMagic):], p); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNotControlPacket, err)
+	}
+
+	return p, nil
+}
+
+// writeRelayFrame writes p to a relay conn. Frames are length prefixed so the
+// reader never reads past the handshake into relayed bytes.
+func writeRelayFrame(w io.Writer, p *packet) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxPacketSize {
+		return fmt.Errorf("nat: relay frame is %d bytes, max is %d", len(body), maxPacketSize)
+	}
+
+	buf := binary.BigEndian.AppendUint16(nil, uint16(len(body)))
+	_, err = w.Write(append(buf, body...))
+	return err
+}
+
+func readRelayFrame(r io.Reader) (*packet, error) {
+	var lenBuf [relayFrameLenSize]byte
+	if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint16(lenBuf[:])
+	if size == 0 || size > maxPacketSize {
+		return nil, fmt.Errorf("nat: relay frame of %d bytes", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	p := new(packet)
+	if err := json.Unmarshal(body, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
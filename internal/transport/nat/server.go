@@ -0,0 +1,361 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package nat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+)
+
+type ServerConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+	Ctx    context.Context
+	Logger *slog.Logger
+	// Clock is what registrations expire and relay joins time out on.
+	Clock clock.Clock
+	// Addr is the udp addr peers discover their endpoint, register and punch on.
+	Addr string
+	// RelayAddr is the tcp addr peers relay through.
+	RelayAddr string
+	// RegistrationTTL is how long a registration lives without a refresh.
+	RegistrationTTL time.Duration
+	// RelayJoinTimeout is how long a relay request waits for the other peer.
+	RelayJoinTimeout time.Duration
+}
+
+type registration struct {
+	endpoint  *net.UDPAddr
+	expiresAt time.Time
+}
+
+// Server is the rendezvous server. It tells peers their public endpoint, keeps
+// track of where registered peers can be reached, sets up hole punches between
+// them and relays for the ones that can't punch through.
+//
+// todo: registrations aren't authenticated yet, anyone can register any addr.
+// They should be signed with the peer's key.
+type Server struct {
+	*ServerConfig
+	udpConn net.PacketConn
+	relayLn net.Listener
+
+	peersMu sync.RWMutex
+	peers   map[string]registration
+
+	relaysMu      sync.Mutex
+	pendingRelays map[string]chan net.Conn
+
+	wg sync.WaitGroup
+}
+
+func NewServer(cfg *ServerConfig) *Server {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("ServerConfig cannot be nil")
+	case cfg.Ctx == nil:
+		log.Fatalln("Ctx cannot be nil")
+	case cfg.Logger == nil:
+		log.Fatalln("Logger cannot be nil")
+	case cfg.Clock == nil:
+		log.Fatalln("Clock cannot be nil")
+	case cfg.Addr == "":
+		log.Fatalln("Addr cannot be empty")
+	case cfg.RelayAddr == "":
+		log.Fatalln("RelayAddr cannot be empty")
+	}
+	if cfg.RegistrationTTL == 0 {
+		cfg.RegistrationTTL = 90 * time.Second
+	}
+	if cfg.RelayJoinTimeout == 0 {
+		cfg.RelayJoinTimeout = 10 * time.Second
+	}
+
+	return &Server{
+		ServerConfig:  cfg,
+		peers:         make(map[string]registration),
+		pendingRelays: make(map[string]chan net.Conn),
+	}
+}
+
+// Listen binds the udp and relay listeners. Serve can be called after.
+func (s *Server) Listen() error {
+	var err error
+
+	s.udpConn, err = net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on udp %s: %w", s.Addr, err)
+	}
+
+	s.relayLn, err = net.Listen("tcp", s.RelayAddr)
+	if err != nil {
+		s.udpConn.Close()
+		return fmt.Errorf("could not listen on tcp %s: %w", s.RelayAddr, err)
+	}
+
+	return nil
+}
+
+// UDPAddr returns the addr peers should use as their rendezvous addr.
+func (s *Server) UDPAddr() net.Addr {
+	return s.udpConn.LocalAddr()
+}
+
+// Serve serves peers till the server's Ctx is done.
+func (s *Server) Serve() {
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.serveUDP()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.serveRelay()
+	}()
+
+	<-s.Ctx.Done()
+	s.udpConn.Close()
+	s.relayLn.Close()
+
+	s.wg.Wait()
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.Logger.Warn("rendezvous: udp read failed", "err", err)
+			continue
+		}
+
+		udpAddr, isUDPAddr := addr.(*net.UDPAddr)
+		if !isUDPAddr {
+			continue
+		}
+
+		p, err := decodePacket(buf[:n])
+		if err != nil {
+			// Not ours, or junk. Never answer it.
+			continue
+		}
+
+		s.handlePacket(udpAddr, p)
+	}
+}
+
+func (s *Server) handlePacket(from *net.UDPAddr, p *packet) {
+	switch p.Type {
+	case bindRequest:
+		s.send(from, &packet{
+			Type:     bindResponse,
+			TxID:     p.TxID,
+			Endpoint: from.String(),
+		})
+
+	case registerRequest:
+		if p.Addr == "" {
+			s.send(from, &packet{Type: registerResponse, TxID: p.TxID, Error: "addr is empty"})
+			return
+		}
+
+		s.peersMu.Lock()
+		s.peers[p.Addr] = registration{
+			endpoint:  from,
+			expiresAt: s.Clock.Now().Add(s.RegistrationTTL),
+		}
+		s.peersMu.Unlock()
+
+		s.send(from, &packet{
+			Type:      registerResponse,
+			TxID:      p.TxID,
+			Endpoint:  from.String(),
+			RelayPort: s.relayLn.Addr().(*net.TCPAddr).Port,
+		})
+
+	case connectRequest:
+		target, isFound := s.lookup(p.Addr)
+		if !isFound {
+			s.send(from, &packet{Type: connectResponse, TxID: p.TxID, Error: ErrPeerNotFound.Error()})
+			return
+		}
+
+		// Both sides start probing each other at about the same time, which is
+		// what gets a packet through both NATs.
+		s.send(target, &packet{
+			Type:     punchNotify,
+			Addr:     p.From,
+			Endpoint: from.String(),
+		})
+		s.send(from, &packet{
+			Type:     connectResponse,
+			TxID:     p.TxID,
+			Endpoint: target.String(),
+		})
+	}
+}
+
+func (s *Server) lookup(addr string) (*net.UDPAddr, bool) {
+	s.peersMu.RLock()
+	reg, isFound := s.peers[addr]
+	s.peersMu.RUnlock()
+
+	if !isFound || s.Clock.Now().After(reg.expiresAt) {
+		return nil, false
+	}
+
+	return reg.endpoint, true
+}
+
+func (s *Server) send(to *net.UDPAddr, p *packet) {
+	b, err := encodePacket(p)
+	if err != nil {
+		s.Logger.Error("rendezvous: could not encode packet", "err", err)
+		return
+	}
+
+	if _, err := s.udpConn.WriteTo(b, to); err != nil {
+		s.Logger.Warn("rendezvous: udp write failed", "to", to, "err", err)
+	}
+}
+
+func (s *Server) serveRelay() {
+	for {
+		conn, err := s.relayLn.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.Logger.Warn("rendezvous: relay accept failed", "err", err)
+			continue
+		}
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleRelayConn(conn)
+		}()
+	}
+}
+
+func (s *Server) handleRelayConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(s.RelayJoinTimeout))
+	p, err := readRelayFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	switch p.Type {
+	case relayJoin:
+		s.relaysMu.Lock()
+		joined, isFound := s.pendingRelays[p.Token]
+		delete(s.pendingRelays, p.Token)
+		s.relaysMu.Unlock()
+
+		if !isFound {
+			conn.Close()
+			return
+		}
+
+		// The requesting side owns the conn from here.
+		joined <- conn
+
+	case relayRequest:
+		s.relay(conn, p)
+
+	default:
+		conn.Close()
+	}
+}
+
+// relay asks the peer at p.Addr to join conn's relay and then pipes bytes
+// between the two.
+//
+// todo: relayed bytes go through us, so we need a limit per peer.
+func (s *Server) relay(conn net.Conn, p *packet) {
+	defer conn.Close()
+
+	target, isFound := s.lookup(p.Addr)
+	if !isFound {
+		writeRelayFrame(conn, &packet{Type: relayReady, Error: ErrPeerNotFound.Error()})
+		return
+	}
+
+	token := newToken()
+	joined := make(chan net.Conn, 1)
+
+	s.relaysMu.Lock()
+	s.pendingRelays[token] = joined
+	s.relaysMu.Unlock()
+	defer func() {
+		s.relaysMu.Lock()
+		delete(s.pendingRelays, token)
+		s.relaysMu.Unlock()
+	}()
+
+	s.send(target, &packet{
+		Type:  relayNotify,
+		Addr:  p.From,
+		Token: token,
+	})
+
+	var other net.Conn
+	select {
+	case other = <-joined:
+	case <-s.Clock.After(s.RelayJoinTimeout):
+		writeRelayFrame(conn, &packet{Type: relayReady, Error: "remote peer never joined the relay"})
+		return
+	case <-s.Ctx.Done():
+		return
+	}
+	defer other.Close()
+
+	if err := writeRelayFrame(other, &packet{Type: relayReady}); err != nil {
+		return
+	}
+	if err := writeRelayFrame(conn, &packet{Type: relayReady}); err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go pipe(conn, other)
+	go pipe(other, conn)
+
+	// Once either side is done, the relay is.
+	select {
+	case <-done:
+	case <-s.Ctx.Done():
+	}
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,632 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package nat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/transport"
+	diogelquic "github.com/engr-sjb/diogel/internal/transport/quic"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// requestTries is how many times a request to the rendezvous server is
+	// sent before giving up. It is udp, so packets do get lost.
+	requestTries = 3
+	// probeInterval is how often probes are sent while punching.
+	probeInterval = 50 * time.Millisecond
+	// relayTimeout is how long we wait for the relay to pair us up.
+	relayTimeout = 15 * time.Second
+)
+
+var (
+	ErrRendezvousTimeout = errors.New("nat: rendezvous server did not answer")
+	ErrPunchFailed       = errors.New("nat: hole punch failed")
+	ErrNotRegistered     = errors.New("nat: not registered with the rendezvous server yet")
+)
+
+// Upgrader is a transport that can also take over conns made by us. The tcp
+// transport is one.
+type Upgrader interface {
+	transport.Transport
+	transport.ConnUpgrader
+}
+
+type TransportConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+	Ctx        context.Context
+	ShutdownWG *sync.WaitGroup
+	Logger     *slog.Logger
+	// Clock is what the punch, the rendezvous requests and the refresh are
+	// timed on. Deadlines on conns stay on the real time.
+	Clock clock.Clock
+	// Inner is the transport we connect with directly first, and hand the
+	// punched and relayed conns to for the handshake.
+	Inner Upgrader
+	// RendezvousAddr is the udp host:port of the rendezvous server.
+	RendezvousAddr string
+	// AdvertisedAddr is the addr other peers know us by, the one they pass to
+	// ConnectToPeer.
+	AdvertisedAddr string
+	// PacketConn is the udp socket we punch and speak QUIC on. If nil, one is
+	// opened on ListenAddr.
+	PacketConn net.PacketConn
+	ListenAddr string
+	// PunchTimeout is how long a hole punch gets before we fall back to the
+	// relay.
+	PunchTimeout time.Duration
+	// RequestTimeout is how long each try of a rendezvous request waits.
+	RequestTimeout time.Duration
+	// RefreshInterval is how often we register again. It also keeps our NAT
+	// mapping to the rendezvous server open.
+	RefreshInterval time.Duration
+}
+
+// natTransport gets us to peers behind NATs. It wraps an Inner transport and
+// is a transport.Transport itself, so nothing above it knows how a conn was
+// made. ConnectToPeer tries, in order:
+//   - a direct connect with Inner.
+//   - a udp hole punch set up through the rendezvous server, with QUIC over
+//     the punched path.
+//   - a tcp relay through the rendezvous server.
+//
+// Control packets and QUIC share one udp socket, so the NAT mapping the
+// rendezvous server sees is the one the punched QUIC conn goes through.
+type natTransport struct {
+	*TransportConfig
+	rendezvous     *net.UDPAddr
+	rendezvousHost string
+
+	quicTransport *quic.Transport
+	ln            *quic.Listener
+	tlsConfig     *diogelquic.TLSConfig
+	quicConf      *quic.Config
+
+	txID      atomic.Uint64
+	pendingMu sync.Mutex
+	pending   map[uint64]chan *packet
+
+	probesMu sync.Mutex
+	probes   map[string][]chan struct{} // keyed by the endpoint we are punching to.
+
+	registrationMu sync.RWMutex
+	publicAddr     *net.UDPAddr
+	relayPort      int
+}
+
+var (
+	_ transport.Transport    = (*natTransport)(nil)
+	_ transport.ConnUpgrader = (*natTransport)(nil)
+)
+
+func NewTransport(cfg *TransportConfig) *natTransport {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("TransportConfig cannot be nil")
+	case cfg.Ctx == nil:
+		log.Fatalln("Ctx cannot be nil")
+	case cfg.ShutdownWG == nil:
+		log.Fatalln("ShutdownWG cannot be nil")
+	case cfg.Logger == nil:
+		log.Fatalln("Logger cannot be nil")
+	case cfg.Clock == nil:
+		log.Fatalln("Clock cannot be nil")
+	case cfg.Inner == nil:
+		log.Fatalln("Inner cannot be nil")
+	case cfg.RendezvousAddr == "":
+		log.Fatalln("RendezvousAddr cannot be empty")
+	case cfg.AdvertisedAddr == "":
+		log.Fatalln("AdvertisedAddr cannot be empty")
+	}
+	if cfg.ListenAddr == "" {
+		cfg.ListenAddr = ":0"
+	}
+	if cfg.PunchTimeout == 0 {
+		cfg.PunchTimeout = 5 * time.Second
+	}
+	if cfg.RequestTimeout == 0 {
+		cfg.RequestTimeout = time.Second
+	}
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = 30 * time.Second
+	}
+
+	rendezvous, err := net.ResolveUDPAddr("udp", cfg.RendezvousAddr)
+	if err != nil {
+		log.Fatalf("could not resolve rendezvous addr %s: %v", cfg.RendezvousAddr, err)
+	}
+	rendezvousHost, _, err := net.SplitHostPort(cfg.RendezvousAddr)
+	if err != nil {
+		log.Fatalf("could not split rendezvous addr %s: %v", cfg.RendezvousAddr, err)
+	}
+
+	if cfg.PacketConn == nil {
+		cfg.PacketConn, err = net.ListenPacket("udp", cfg.ListenAddr)
+		if err != nil {
+			log.Fatalf("could not listen on udp %s: %v", cfg.ListenAddr, err)
+		}
+	}
+
+	tlsConfig, err := diogelquic.NewTLSConfig()
+	if err != nil {
+		log.Fatalf("could not make tls config for quic: %v", err)
+	}
+
+	t := &natTransport{
+		TransportConfig: cfg,
+		rendezvous:      rendezvous,
+		rendezvousHost:  rendezvousHost,
+		quicTransport:   &quic.Transport{Conn: cfg.PacketConn},
+		tlsConfig:       tlsConfig,
+		quicConf: &quic.Config{
+			KeepAlivePeriod: 15 * time.Second,
+			MaxIdleTimeout:  time.Minute,
+		},
+		pending: make(map[uint64]chan *packet),
+		probes:  make(map[string][]chan struct{}),
+	}
+
+	t.ln, err = t.quicTransport.Listen(t.tlsConfig.Server, t.quicConf)
+	if err != nil {
+		log.Fatalf("could not listen for quic on %s: %v", cfg.PacketConn.LocalAddr(), err)
+	}
+
+	t.ShutdownWG.Add(2)
+	go func() {
+		defer t.ShutdownWG.Done()
+		t.readLoop()
+	}()
+	go func() {
+		defer t.ShutdownWG.Done()
+		t.acceptLoop()
+	}()
+
+	if err := t.register(); err != nil {
+		// Not fatal, the refresh loop keeps trying.
+		t.Logger.Warn("nat: could not register with rendezvous server", "err", err)
+	}
+
+	t.ShutdownWG.Add(1)
+	go func() {
+		defer t.ShutdownWG.Done()
+		t.refreshLoop()
+	}()
+
+	return t
+}
+
+// ConnectToPeer connects to the peer at addr directly, with a hole punch or
+// through the relay, whichever works first.
+func (t *natTransport) ConnectToPeer(addr string) (transport.RemotePeerConn, error) {
+	remotePeer, directErr := t.Inner.ConnectToPeer(addr)
+	if directErr == nil {
+		return remotePeer, nil
+	}
+
+	conn, punchErr := t.punch(addr)
+	if punchErr == nil {
+		remotePeer, punchErr = t.Inner.UpgradeConn(conn)
+		if punchErr == nil {
+			return remotePeer, nil
+		}
+	}
+
+	t.Logger.Info("nat: hole punch failed, trying relay", "addr", addr, "err", punchErr)
+
+	conn, relayErr := t.dialRelay(addr)
+	if relayErr == nil {
+		remotePeer, relayErr = t.Inner.UpgradeConn(conn)
+		if relayErr == nil {
+			return remotePeer, nil
+		}
+	}
+
+	return nil, fmt.Errorf(
+		"could not reach peer %s: %w",
+		addr,
+		errors.Join(directErr, punchErr, relayErr),
+	)
+}
+
+func (t *natTransport) UpgradeConn(conn net.Conn) (transport.RemotePeerConn, error) {
+	return t.Inner.UpgradeConn(conn)
+}
+
+func (t *natTransport) ServeConn(conn net.Conn) error {
+	return t.Inner.ServeConn(conn)
+}
+
+// Discover asks the rendezvous server what our udp endpoint looks like from
+// the outside.
+func (t *natTransport) Discover(ctx context.Context) (*net.UDPAddr, error) {
+	resp, err := t.roundTrip(ctx, &packet{Type: bindRequest})
+	if err != nil {
+		return nil, err
+	}
+
+	return net.ResolveUDPAddr("udp", resp.Endpoint)
+}
+
+// PublicAddr returns our public udp endpoint as of the last registration, or
+// nil if we never registered.
+func (t *natTransport) PublicAddr() *net.UDPAddr {
+	t.registrationMu.RLock()
+	defer t.registrationMu.RUnlock()
+
+	return t.publicAddr
+}
+
+func (t *natTransport) Close() error {
+	return errors.Join(
+		t.ln.Close(),
+		t.quicTransport.Close(),
+		t.PacketConn.Close(),
+		t.Inner.Close(),
+	)
+}
+
+func (t *natTransport) register() error {
+	ctx, cancel := clock.WithTimeout(t.Ctx, t.Clock, t.RequestTimeout*requestTries)
+	defer cancel()
+
+	resp, err := t.roundTrip(ctx, &packet{
+		Type: registerRequest,
+		Addr: t.AdvertisedAddr,
+	})
+	if err != nil {
+		return err
+	}
+
+	publicAddr, err := net.ResolveUDPAddr("udp", resp.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	t.registrationMu.Lock()
+	t.publicAddr = publicAddr
+	t.relayPort = resp.RelayPort
+	t.registrationMu.Unlock()
+
+	return nil
+}
+
+func (t *natTransport) refreshLoop() {
+	ticker := t.Clock.NewTicker(t.RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.Ctx.Done():
+			return
+		case <-ticker.C():
+			if err := t.register(); err != nil {
+				t.Logger.Warn("nat: could not refresh registration", "err", err)
+			}
+		}
+	}
+}
+
+// roundTrip sends p to the rendezvous server and waits for its response,
+// sending it again if none comes in time.
+func (t *natTransport) roundTrip(ctx context.Context, p *packet) (*packet, error) {
+	p.TxID = t.txID.Add(1)
+
+	respCh := make(chan *packet, 1)
+	t.pendingMu.Lock()
+	t.pending[p.TxID] = respCh
+	t.pendingMu.Unlock()
+	defer func() {
+		t.pendingMu.Lock()
+		delete(t.pending, p.TxID)
+		t.pendingMu.Unlock()
+	}()
+
+	b, err := encodePacket(p)
+	if err != nil {
+		return nil, err
+	}
+
+	for range requestTries {
+		if _, err := t.quicTransport.WriteTo(b, t.rendezvous); err != nil {
+			return nil, err
+		}
+
+		select {
+		case resp := <-respCh:
+			return resp, resp.err()
+		case <-t.Clock.After(t.RequestTimeout):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, ErrRendezvousTimeout
+}
+
+func (t *natTransport) sendPacket(to net.Addr, p *packet) {
+	b, err := encodePacket(p)
+	if err != nil {
+		t.Logger.Error("nat: could not encode packet", "err", err)
+		return
+	}
+
+	if _, err := t.quicTransport.WriteTo(b, to); err != nil {
+		t.Logger.Debug("nat: udp write failed", "to", to, "err", err)
+	}
+}
+
+// readLoop handles the control packets that come in on our udp socket. QUIC
+// packets never get here, the quic transport takes them.
+func (t *natTransport) readLoop() {
+	buf := make([]byte, maxPacketSize)
+
+	for {
+		n, addr, err := t.quicTransport.ReadNonQUICPacket(t.Ctx, buf)
+		if err != nil {
+			return
+		}
+
+		p, err := decodePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		t.handlePacket(addr, p)
+	}
+}
+
+func (t *natTransport) handlePacket(from net.Addr, p *packet) {
+	isFromRendezvous := from.String() == t.rendezvous.String()
+
+	switch p.Type {
+	case bindResponse, registerResponse, connectResponse:
+		if !isFromRendezvous {
+			return
+		}
+
+		t.pendingMu.Lock()
+		respCh, isFound := t.pending[p.TxID]
+		t.pendingMu.Unlock()
+
+		if isFound {
+			select {
+			case respCh <- p:
+			default: // A late duplicate.
+			}
+		}
+
+	case punchNotify:
+		if !isFromRendezvous {
+			return
+		}
+
+		endpoint, err := net.ResolveUDPAddr("udp", p.Endpoint)
+		if err != nil {
+			return
+		}
+
+		// Open our side of the hole. The peer that asked dials us over QUIC
+		// once its probes get through.
+		go func() {
+			ctx, cancel := clock.WithTimeout(t.Ctx, t.Clock, t.PunchTimeout)
+			defer cancel()
+
+			if err := t.probe(ctx, endpoint); err != nil {
+				t.Logger.Debug("nat: punch from peer never got through", "addr", p.Addr, "err", err)
+			}
+		}()
+
+	case probe:
+		t.sendPacket(from, &packet{Type: probeAck})
+		t.probeArrived(from)
+
+	case probeAck:
+		t.probeArrived(from)
+
+	case relayNotify:
+		if !isFromRendezvous {
+			return
+		}
+
+		go func() {
+			if err := t.joinRelay(p.Token); err != nil {
+				t.Logger.Warn("nat: could not join relay", "addr", p.Addr, "err", err)
+			}
+		}()
+	}
+}
+
+// probe sends probes to endpoint till one of theirs gets to us, which means
+// the path through both NATs is open.
+func (t *natTransport) probe(ctx context.Context, endpoint *net.UDPAddr) error {
+	arrived := make(chan struct{})
+
+	key := endpoint.String()
+	t.probesMu.Lock()
+	t.probes[key] = append(t.probes[key], arrived)
+	t.probesMu.Unlock()
+
+	ticker := t.Clock.NewTicker(probeInterval)
+	defer ticker.Stop()
+
+	for {
+		t.sendPacket(endpoint, &packet{Type: probe})
+
+		select {
+		case <-arrived:
+			return nil
+		case <-ctx.Done():
+			t.probesMu.Lock()
+			delete(t.probes, key)
+			t.probesMu.Unlock()
+
+			return fmt.Errorf("%w: no probe from %s: %w", ErrPunchFailed, endpoint, context.Cause(ctx))
+		case <-ticker.C():
+		}
+	}
+}
+
+func (t *natTransport) probeArrived(from net.Addr) {
+	t.probesMu.Lock()
+	waiters := t.probes[from.String()]
+	delete(t.probes, from.String())
+	t.probesMu.Unlock()
+
+	for _, arrived := range waiters {
+		close(arrived)
+	}
+}
+
+// punch asks the rendezvous server to set up a hole punch to the peer at addr
+// and returns a QUIC conn over the punched path.
+func (t *natTransport) punch(addr string) (net.Conn, error) {
+	ctx, cancel := clock.WithTimeout(t.Ctx, t.Clock, t.PunchTimeout)
+	defer cancel()
+
+	resp, err := t.roundTrip(ctx, &packet{
+		Type: connectRequest,
+		Addr: addr,
+		From: t.AdvertisedAddr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := net.ResolveUDPAddr("udp", resp.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.probe(ctx, endpoint); err != nil {
+		return nil, err
+	}
+
+	quicConn, err := t.quicTransport.Dial(ctx, endpoint, t.tlsConfig.Client, t.quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: quic dial: %w", ErrPunchFailed, err)
+	}
+
+	stream, err := quicConn.OpenStreamSync(ctx)
+	if err != nil {
+		quicConn.CloseWithError(0, "")
+		return nil, fmt.Errorf("%w: quic stream: %w", ErrPunchFailed, err)
+	}
+
+	return diogelquic.NewStreamConn(stream, quicConn), nil
+}
+
+func (t *natTransport) acceptLoop() {
+	for {
+		quicConn, err := t.ln.Accept(t.Ctx)
+		if err != nil {
+			return
+		}
+
+		go func() {
+			ctx, cancel := clock.WithTimeout(t.Ctx, t.Clock, t.PunchTimeout)
+			stream, err := quicConn.AcceptStream(ctx)
+			cancel()
+			if err != nil {
+				quicConn.CloseWithError(0, "")
+				return
+			}
+
+			err = t.Inner.ServeConn(diogelquic.NewStreamConn(stream, quicConn))
+			if err != nil {
+				t.Logger.Warn("nat: could not serve punched conn", "remoteAddr", quicConn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+func (t *natTransport) relayAddr() (string, error) {
+	t.registrationMu.RLock()
+	relayPort := t.relayPort
+	t.registrationMu.RUnlock()
+
+	if relayPort == 0 {
+		return "", ErrNotRegistered
+	}
+
+	return net.JoinHostPort(t.rendezvousHost, strconv.Itoa(relayPort)), nil
+}
+
+// dialRelay asks the relay to pair us with the peer at addr.
+func (t *natTransport) dialRelay(addr string) (net.Conn, error) {
+	return t.relay(&packet{
+		Type: relayRequest,
+		Addr: addr,
+		From: t.AdvertisedAddr,
+	})
+}
+
+// joinRelay joins the relay a peer asked for and serves the conn like one we
+// accepted.
+func (t *natTransport) joinRelay(token string) error {
+	conn, err := t.relay(&packet{
+		Type:  relayJoin,
+		Token: token,
+	})
+	if err != nil {
+		return err
+	}
+
+	return t.Inner.ServeConn(conn)
+}
+
+func (t *natTransport) relay(p *packet) (net.Conn, error) {
+	relayAddr, err := t.relayAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := clock.WithTimeout(t.Ctx, t.Clock, relayTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", relayAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writeRelayFrame(conn, p); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(relayTimeout))
+	ready, err := readRelayFrame(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if ready.Type != relayReady {
+		conn.Close()
+		return nil, fmt.Errorf("nat: relay sent packet type %d, want ready", ready.Type)
+	}
+	if err := ready.err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
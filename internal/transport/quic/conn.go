@@ -0,0 +1,96 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package quic
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"time"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+const ALPN = "diogel"
+
+// StreamConn is a QUIC stream as a net.Conn, so the rest of the transport can
+// treat it like a tcp conn.
+type StreamConn struct {
+	*quicgo.Stream
+	conn *quicgo.Conn
+}
+
+var _ net.Conn = (*StreamConn)(nil)
+
+func NewStreamConn(stream *quicgo.Stream, conn *quicgo.Conn) *StreamConn {
+	return &StreamConn{Stream: stream, conn: conn}
+}
+
+func (c *StreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *StreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the stream and the QUIC conn under it. We only ever open one
+// stream per conn.
+func (c *StreamConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+type TLSConfig struct {
+	Server *tls.Config
+	Client *tls.Config
+}
+
+// NewTLSConfig makes a throwaway self signed cert for QUIC, which can't run
+// without TLS.
+//
+// NOTICE: The cert says nothing about who the peer is, so clients don't verify
+// it. Peers get to know each other in the protocol handshake, same as on tcp.
+// todo: sign the cert with the peer's identity key and check it against the
+// public key from the handshake.
+func NewTLSConfig() (*TLSConfig, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: ALPN},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TLSConfig{
+		Server: &tls.Config{
+			Certificates: []tls.Certificate{{
+				Certificate: [][]byte{certDER},
+				PrivateKey:  privateKey,
+			}},
+			NextProtos: []string{ALPN},
+		},
+		Client: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{ALPN},
+		},
+	}, nil
+}
@@ -0,0 +1,292 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package quic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/transport"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+type QUICTransportConfig struct {
+	// NOTICE IMPORTANT: When you add a field, ALWAYS check if it is it's default value in its contractor func.
+	Ctx          context.Context
+	ShutdownWG   *sync.WaitGroup
+	PublicKey    []byte
+	Logger       *slog.Logger
+	Protocol     protocol.Protocol
+	Addr         string // udp addr to listen on.
+	DialTimeout  time.Duration
+	Clock        clock.Clock
+	OnConnect    transport.OnConnect
+	OnDisconnect transport.OnDisconnect
+	OnMessage    transport.OnMessage
+}
+
+// quicTransport is the udp transport. QUIC gives us reliable streams over udp,
+// so conns survive the peer's addr changing (connection migration) and go
+// through NATs better than tcp.
+//
+// NOTICE: For now every conn carries one stream, the one the handshake runs
+// on, so it looks like a tcp conn to everything above.
+// todo: open a stream per capsule stream so big transfers don't hold up
+// control msgs.
+type quicTransport struct {
+	*QUICTransportConfig
+	wg            *sync.WaitGroup
+	udpConn       net.PacketConn
+	quicTransport *quicgo.Transport
+	ln            *quicgo.Listener
+	tlsConfig     *TLSConfig
+	quicConf      *quicgo.Config
+}
+
+var (
+	_ transport.Transport    = (*quicTransport)(nil)
+	_ transport.ConnUpgrader = (*quicTransport)(nil)
+)
+
+func NewQUICTransport(cfg *QUICTransportConfig) *quicTransport {
+	// NOTICE IMPORTANT: check if all fields on cfg are not their default value before use.
+	switch {
+	case cfg == nil:
+		log.Fatalln("QUICTransportConfig cannot be nil")
+	case cfg.Ctx == nil:
+		log.Fatalln("Context cannot be nil")
+	case cfg.ShutdownWG == nil:
+		log.Fatalln("ShutdownWG cannot be nil")
+	case cfg.PublicKey == nil:
+		log.Fatalln("PublicKey cannot be nil")
+	case cfg.Logger == nil:
+		log.Fatalln("Logger cannot be nil")
+	case cfg.Protocol == nil:
+		log.Fatalln("Protocol cannot be nil")
+	case cfg.Addr == "":
+		log.Fatalln("Addr cannot be empty")
+	case cfg.DialTimeout == time.Duration(0):
+		log.Fatalln("DialTimeout cannot be zero")
+	case cfg.Clock == nil:
+		log.Fatalln("Clock cannot be nil")
+	case cfg.OnConnect == nil:
+		log.Fatalln("OnConnect cannot be nil")
+	case cfg.OnDisconnect == nil:
+		log.Fatalln("OnDisconnect cannot be nil")
+	case cfg.OnMessage == nil:
+		log.Fatalln("OnMessage cannot be nil")
+	}
+
+	tlsConfig, err := NewTLSConfig()
+	if err != nil {
+		log.Fatalf("could not make tls config: %v", err)
+	}
+
+	udpConn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		log.Fatalf("could not listen on udp %s: %v", cfg.Addr, err)
+	}
+
+	t := &quicTransport{
+		QUICTransportConfig: cfg,
+		wg:                  &sync.WaitGroup{},
+		udpConn:             udpConn,
+		// Dialing from the socket we listen on means the remote peer sees the
+		// same addr either way.
+		quicTransport: &quicgo.Transport{Conn: udpConn},
+		tlsConfig:     tlsConfig,
+		quicConf: &quicgo.Config{
+			KeepAlivePeriod: 15 * time.Second,
+			MaxIdleTimeout:  time.Minute,
+		},
+	}
+
+	t.ln, err = t.quicTransport.Listen(t.tlsConfig.Server, t.quicConf)
+	if err != nil {
+		log.Fatalf("could not listen for quic on %s: %v", udpConn.LocalAddr(), err)
+	}
+
+	t.ShutdownWG.Add(1)
+	go func() {
+		defer t.ShutdownWG.Done()
+		t.acceptLoop()
+	}()
+
+	return t
+}
+
+// LocalAddr returns the udp addr we listen on.
+func (t *quicTransport) LocalAddr() net.Addr {
+	return t.udpConn.LocalAddr()
+}
+
+/* As Server Methods Start*/
+
+func (t *quicTransport) acceptLoop() {
+	for {
+		quicConn, err := t.ln.Accept(t.Ctx)
+		if err != nil {
+			if t.Ctx.Err() == nil && !errors.Is(err, quicgo.ErrServerClosed) {
+				log.Printf("[QUICTransport: %s]: accept err: %v\n", t.LocalAddr(), err)
+			}
+
+			t.wg.Wait()
+			return
+		}
+
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+
+			ctx, cancel := context.WithTimeout(t.Ctx, t.DialTimeout)
+			stream, err := quicConn.AcceptStream(ctx)
+			cancel()
+			if err != nil {
+				quicConn.CloseWithError(0, "")
+				return
+			}
+
+			if err := t.ServeConn(NewStreamConn(stream, quicConn)); err != nil {
+				log.Printf(
+					"[QUICTransport: %s]: [remote peer %s]; %v. dropping conn\n",
+					t.LocalAddr(),
+					quicConn.RemoteAddr(),
+					err,
+				)
+			}
+		}()
+	}
+}
+
+// ServeConn runs the server handshake on conn and serves it like a conn we
+// accepted ourselves. conn is closed if the handshake fails.
+func (t *quicTransport) ServeConn(conn net.Conn) error {
+	session, err := t.Protocol.DoServerHandshake(conn, t.PublicKey)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not perform handshake: %w", err)
+	}
+
+	remotePeer, err := t.newRemotePeer(session, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	t.handleRemotePeerConn(remotePeer)
+
+	return nil
+}
+
+func (t *quicTransport) handleRemotePeerConn(remotePeerConn transport.RemotePeerConn) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		defer remotePeerConn.Close()
+		defer t.OnDisconnect(remotePeerConn.ID())
+
+		t.OnConnect(remotePeerConn)
+
+		for {
+			if t.Ctx.Err() != nil {
+				return
+			}
+
+			msg, err := remotePeerConn.ReadMsg()
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					log.Printf(
+						"[QUICTransport: %s]: [remote peer %s]; readFrame err: %v. dropping conn\n",
+						t.LocalAddr(),
+						remotePeerConn.PublicKey(),
+						err,
+					)
+				}
+				return
+			}
+
+			t.OnMessage(remotePeerConn, msg)
+		}
+	}()
+}
+
+/* As Server Methods End */
+
+/* As Client methods Start */
+
+func (t *quicTransport) ConnectToPeer(addr string) (transport.RemotePeerConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(t.Ctx, t.DialTimeout)
+	defer cancel()
+
+	quicConn, err := t.quicTransport.Dial(ctx, udpAddr, t.tlsConfig.Client, t.quicConf)
+	if err != nil {
+		return nil, fmt.Errorf("couldn’t dial peer addr %s: %w", addr, err)
+	}
+
+	stream, err := quicConn.OpenStreamSync(ctx)
+	if err != nil {
+		quicConn.CloseWithError(0, "")
+		return nil, fmt.Errorf("couldn’t open stream to peer addr %s: %w", addr, err)
+	}
+
+	return t.UpgradeConn(NewStreamConn(stream, quicConn))
+}
+
+// UpgradeConn runs the client handshake on conn. conn is closed if it fails.
+func (t *quicTransport) UpgradeConn(conn net.Conn) (transport.RemotePeerConn, error) {
+	session, err := t.Protocol.DoClientHandshake(conn, t.PublicKey)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("remote peer failed client handshake: %w", err)
+	}
+
+	remotePeer, err := t.newRemotePeer(session, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return remotePeer, nil
+}
+
+/* As Client methods End */
+
+func (t *quicTransport) Close() error {
+	return errors.Join(
+		t.ln.Close(),
+		t.quicTransport.Close(),
+		t.udpConn.Close(),
+	)
+}
+
+func (t *quicTransport) newRemotePeer(session *protocol.Session, conn net.Conn) (transport.RemotePeerConn, error) {
+	switch {
+	case session == nil:
+		return nil, errors.New("session can't be nil")
+	case session.RemotePublicKey == nil:
+		return nil, errors.New("publicKey can't be nil")
+	case conn == nil:
+		return nil, errors.New("conn can't be nil")
+	}
+
+	return transport.NewRemotePeer(session, conn, conn.RemoteAddr(), t.Protocol, t.Clock), nil
+}
@@ -0,0 +1,149 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package quic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/engr-sjb/diogel/internal/transport"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQUICTransport(t *testing.T) {
+	server := newTestQUICTransport(t, "server-public-key")
+	client := newTestQUICTransport(t, "client-public-key")
+
+	remotePeer, err := client.ConnectToPeer(server.LocalAddr().String())
+	require.NoError(t, err)
+	defer remotePeer.Close()
+	assert.Equal(t, []byte("server-public-key"), []byte(remotePeer.PublicKey()))
+
+	var served transport.RemotePeerConn
+	select {
+	case served = <-server.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server never got the conn")
+	}
+	assert.Equal(t, []byte("client-public-key"), []byte(served.PublicKey()))
+
+	t.Run("messages get to OnMessage", func(t *testing.T) {
+		sent := message.HeartbeatCheck{ID: uuid.New(), CapsuleID: uuid.New()}
+		_, err := remotePeer.Send(&sent, nil)
+		require.NoError(t, err)
+
+		select {
+		case got := <-server.msgs:
+			assert.Equal(t, sent, got)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server never got the msg")
+		}
+	})
+
+	t.Run("disconnect is reported", func(t *testing.T) {
+		require.NoError(t, remotePeer.Close())
+
+		select {
+		case id := <-server.disconnected:
+			assert.Equal(t, served.ID(), id)
+		case <-time.After(5 * time.Second):
+			t.Fatal("server never saw the disconnect")
+		}
+	})
+}
+
+func TestQUICTransportStream(t *testing.T) {
+	server := newTestQUICTransport(t, "server-public-key")
+	client := newTestQUICTransport(t, "client-public-key")
+
+	// The server's read loop runs all along, the stream gets its frames past it.
+	remotePeer, err := client.ConnectToPeer(server.LocalAddr().String())
+	require.NoError(t, err)
+	defer remotePeer.Close()
+
+	served := <-server.connected
+
+	data := make([]byte, 3*1024*1024+7)
+	rand.Read(data)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := remotePeer.SendStream(ctx, bytes.NewReader(data))
+		sendErr <- err
+	}()
+
+	var got bytes.Buffer
+	_, err = served.ReceiveStream(ctx, &got)
+	require.NoError(t, err)
+	require.NoError(t, <-sendErr)
+	assert.True(t, bytes.Equal(data, got.Bytes()))
+}
+
+type testQUICTransport struct {
+	*quicTransport
+	connected    chan transport.RemotePeerConn
+	disconnected chan uuid.UUID
+	msgs         chan message.Msg
+}
+
+func newTestQUICTransport(t *testing.T, publicKey string) *testQUICTransport {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+
+	tt := &testQUICTransport{
+		connected:    make(chan transport.RemotePeerConn, 1),
+		disconnected: make(chan uuid.UUID, 1),
+		msgs:         make(chan message.Msg, 1),
+	}
+
+	tt.quicTransport = NewQUICTransport(&QUICTransportConfig{
+		Ctx:         ctx,
+		ShutdownWG:  wg,
+		PublicKey:   []byte(publicKey),
+		Logger:      slog.Default(),
+		Protocol:    protocol.NewProtocol(message.NewRegistry(), serialize.New(), nil),
+		Addr:        "127.0.0.1:0",
+		DialTimeout: 2 * time.Second,
+		Clock:       clock.New(),
+		OnConnect: func(remotePeer transport.RemotePeerConn) error {
+			tt.connected <- remotePeer
+			return nil
+		},
+		OnDisconnect: func(remotePeerID uuid.UUID) error {
+			tt.disconnected <- remotePeerID
+			return nil
+		},
+		OnMessage: func(remotePeer transport.RemotePeer, msg message.Msg) {
+			tt.msgs <- msg
+		},
+	})
+
+	t.Cleanup(func() {
+		cancel()
+		tt.Close()
+		wg.Wait()
+	})
+
+	return tt
+}
@@ -8,14 +8,18 @@
 package transport
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/engr-sjb/diogel/internal/clock"
 	"github.com/engr-sjb/diogel/internal/customcrypto"
 	"github.com/engr-sjb/diogel/internal/message"
 	"github.com/engr-sjb/diogel/internal/protocol"
@@ -30,6 +34,8 @@ const (
 var (
 	ErrChunkSizeExceeded     = errors.New("chunk size exceeded")
 	ErrUnexpectedMessageType = errors.New("unexpected message type")
+	ErrVersionMismatch       = errors.New("frame version does not match the negotiated protocol version")
+	ErrUnexpectedData        = errors.New("data does not match what the message says it carries")
 )
 
 type RemotePeer interface {
@@ -40,11 +46,20 @@ type RemotePeer interface {
 	Addr() net.Addr
 	Send(msg message.Msg, data []byte) (int, error)
 	Receive(msg message.Msg, data []byte) (int, error)
+	// SendStream sends all of r, for data bigger than one Send can carry.
+	SendStream(ctx context.Context, r io.Reader) (int64, error)
+	// ReceiveStream writes the next stream the remote peer opens with
+	// SendStream to w.
+	ReceiveStream(ctx context.Context, w io.Writer) (int64, error)
 }
 
 type RemotePeerConn interface {
 	io.Closer
 	IsStale(threshold time.Duration) bool
+	// Session returns what was agreed with the remote peer in the handshake.
+	Session() protocol.Session
+	// ReadMsg reads the next message for the read loop of a transport.
+	ReadMsg() (message.Msg, error)
 	RemotePeer
 }
 
@@ -56,6 +71,8 @@ type remotePeerConn struct {
 	publicKeyStr customcrypto.PublicKeyStr
 	publicKey    customcrypto.PublicKeyBytes
 	protocol     protocol.Protocol
+	session      protocol.Session
+	clock        clock.Clock
 
 	writeMu     sync.Mutex
 	writeFrame  protocol.Frame
@@ -65,6 +82,16 @@ type remotePeerConn struct {
 	readFrame  protocol.Frame
 	lastReadOp atomic.Int64 // lastReadOp holds the time when a last operation occurred.
 
+	// streamsMu guards the streams open on the conn and what goes with them,
+	// see stream.go.
+	streamsMu sync.Mutex
+	streams   map[uuid.UUID]*stream
+	incoming  chan *stream // opened by the remote peer, for ReceiveStream.
+	pending   []pendingMsg
+	readTurn  chan struct{}
+	// isRefusing is set while a refusal of a stream is being sent, see route.
+	isRefusing atomic.Bool
+
 	// isBeingRead, isBeingWritten bool
 }
 
@@ -72,10 +99,13 @@ type remotePeerConn struct {
 var _ RemotePeerConn = (*remotePeerConn)(nil)
 
 func NewRemotePeer(
-	publicKey customcrypto.PublicKeyBytes,
+	session *protocol.Session,
 	conn net.Conn,
 	addr net.Addr,
-	protocol protocol.Protocol) *remotePeerConn {
+	protocol protocol.Protocol,
+	clock clock.Clock) *remotePeerConn {
+	publicKey := customcrypto.PublicKeyBytes(session.RemotePublicKey)
+
 	// NOTICE IMPORTANT: In order not to do an allocation and then copy just to get a string via hex.EncodeToString(publicKey) or string(publicKey) which is a performance overhead I don't want in this section. So we are using unsafe.String to get the pointer of the first element and then its length. I am doing this cause I know for a fact that there is no reason for the public bytes array or slice to be changed.
 	// NOTICE: The RISK 1: If the a byte or bytes of the underlying array or slice is changed, the string will be mutated. Which normal strings in Go don't do; they are immutable.
 	// NOTICE: The RISK 2: If the publicKey byte is a byte slice ([]byte) and we use append() on it for whatever reason, the underlying array (unsafe.SliceData(publicKey)) pointers to will not point to the same pointer as before. We will have a dangling pointer. Meaning it will contain garbage data.
@@ -88,6 +118,10 @@ func NewRemotePeer(
 		publicKeyStr: customcrypto.PublicKeyStr(publicKeyStr),
 		publicKey:    publicKey,
 		protocol:     protocol,
+		session:      *session,
+		clock:        clock,
+		streams:      make(map[uuid.UUID]*stream),
+		incoming:     make(chan *stream, maxIncomingStreams),
 	}
 }
 
@@ -99,7 +133,7 @@ func (pr *remotePeerConn) Write(p []byte) (n int, err error) {
 
 func (pr *remotePeerConn) Read(p []byte) (n int, err error) {
 	pr.readMu.Lock()
-	defer pr.readMu.Unlock()
+	defer pr.unlockRead()
 
 	return pr.read(p)
 }
@@ -112,6 +146,10 @@ func (pr *remotePeerConn) Send(msg message.Msg, data []byte) (int, error) {
 		return 0, ErrChunkSizeExceeded
 	}
 
+	if err := pr.checkData(msg, data); err != nil {
+		return 0, err
+	}
+
 	if err := pr.send(msg); err != nil {
 		return 0, err
 	}
@@ -138,34 +176,32 @@ func (pr *remotePeerConn) Send(msg message.Msg, data []byte) (int, error) {
 
 func (pr *remotePeerConn) Receive(msg message.Msg, data []byte) (int, error) {
 	pr.readMu.Lock()
-	defer pr.readMu.Unlock()
+	defer pr.unlockRead()
+
+	// A stream waiting on its inbox may have read it already.
+	if pending, isFound := pr.popPending(); isFound {
+		return pending.receive(msg, data)
+	}
 
-	if err := pr.protocol.ReadFrame(pr, &pr.readFrame); err != nil {
+	if err := pr.readMsg((*lockedConn)(pr)); err != nil {
 		return 0, err
 	}
 
-	msg = pr.readFrame.Payload.Msg
+	if err := setMsg(msg, pr.readFrame.Payload.Msg); err != nil {
+		return 0, err
+	}
 
-	if data == nil {
+	spec, _ := pr.protocol.Registry().Lookup(pr.readFrame.ID)
+	if !spec.HasData {
 		return 0, nil
 	}
 
-	var size int = 0
-
-	switch newMsg := pr.readFrame.Payload.Msg.(type) {
-	//Todo: Rethink this design as we have to do a type assertion over here just know size to read from the connection and also have assert again in the caller who is calling the receive just to be able too use the actual message type.
-	case message.CapsuleStreamChuck:
-		size = int(newMsg.Size)
-
-	case message.CapsuleIncomingShardStream:
-		size = int(newMsg.Size)
+	// The registry only lets a spec have data if its message is a DataCarrier.
+	size := int(pr.readFrame.Payload.Msg.(message.DataCarrier).DataSize())
 
-	default:
-		return 0, ErrUnexpectedMessageType
-	}
-
-	if size > chunkSize || size <= len(data) {
-		//Todo: I think we need to have a cap size or rethink creating the buf outside and sending it in.
+	if size <= 0 || size > int(spec.MaxDataSize) || size > chunkSize || size > len(data) {
+		// NOTICE: size comes from the remote peer. We only ever read it into the
+		// caller's buffer, never allocate for it.
 		return 0, ErrChunkSizeExceeded
 	}
 
@@ -177,17 +213,143 @@ func (pr *remotePeerConn) Receive(msg message.Msg, data []byte) (int, error) {
 		return 0, errors.New("read more data than buffer capacity")
 	}
 
-	pr.lastReadOp.Store(time.Now().UnixNano())
+	pr.lastReadOp.Store(pr.clock.Now().UnixNano())
 
 	//Todo: Check err or so. not sure if i should return the read full error or handle it here or turn it.
 
 	return n, err
 }
 
+// ReadMsg reads the next message off the conn for the read loop of a
+// transport. Frames of the streams on the conn go to their streams on the way,
+// the loop never sees them.
+//
+// NOTICE: Data is only ever taken by a handler in Receive, so the data of a
+// message that gets here is thrown away.
+func (pr *remotePeerConn) ReadMsg() (message.Msg, error) {
+	pr.readMu.Lock()
+	defer pr.unlockRead()
+
+	if pending, isFound := pr.popPending(); isFound {
+		return pending.msg, nil
+	}
+
+	if err := pr.readMsg((*lockedConn)(pr)); err != nil {
+		return nil, err
+	}
+
+	spec, _ := pr.protocol.Registry().Lookup(pr.readFrame.ID)
+	if spec.HasData {
+		size := pr.readFrame.Payload.Msg.(message.DataCarrier).DataSize()
+		if size > spec.MaxDataSize || size > chunkSize {
+			return nil, ErrChunkSizeExceeded
+		}
+
+		_, err := io.CopyN(io.Discard, (*lockedConn)(pr), int64(size))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return pr.readFrame.Payload.Msg, nil
+}
+
+// readMsg reads frames from r into readFrame till one isn't a stream's. The
+// caller holds readMu.
+func (pr *remotePeerConn) readMsg(r io.Reader) error {
+	for {
+		isStreamFrame, err := pr.readFrameFrom(r)
+		if err != nil || !isStreamFrame {
+			return err
+		}
+	}
+}
+
+// readFrameFrom reads a frame from r into readFrame, a stream's goes on to it,
+// see route. The caller holds readMu.
+func (pr *remotePeerConn) readFrameFrom(r io.Reader) (bool, error) {
+	if err := pr.protocol.ReadFrame(r, &pr.readFrame); err != nil {
+		return false, err
+	}
+
+	if pr.readFrame.Version != pr.session.Version {
+		return false, fmt.Errorf(
+			"%w: got v%d on a v%d conn",
+			ErrVersionMismatch,
+			pr.readFrame.Version,
+			pr.session.Version,
+		)
+	}
+
+	return pr.route(r)
+}
+
+// checkData makes sure data is exactly what the spec of msg says follows it,
+// so the remote peer never reads a message and data that disagree.
+func (pr *remotePeerConn) checkData(msg message.Msg, data []byte) error {
+	registry := pr.protocol.Registry()
+
+	id, isFound := registry.IDOf(msg)
+	if !isFound {
+		return fmt.Errorf("%w: %T", protocol.ErrUnknownMessage, msg)
+	}
+	spec, _ := registry.Lookup(id)
+
+	if !spec.HasData {
+		if data != nil {
+			return fmt.Errorf("%w: %T carries no data", ErrUnexpectedData, msg)
+		}
+		return nil
+	}
+
+	size := msg.(message.DataCarrier).DataSize()
+	switch {
+	case size > spec.MaxDataSize:
+		return ErrChunkSizeExceeded
+	case int(size) != len(data):
+		return fmt.Errorf(
+			"%w: %T says %d bytes, got %d",
+			ErrUnexpectedData,
+			msg,
+			size,
+			len(data),
+		)
+	}
+
+	return nil
+}
+
+// setMsg copies the received msg into dst, which must be a pointer to the
+// same message type. A nil dst means the caller doesn't want it.
+func setMsg(dst message.Msg, msg message.Msg) error {
+	if dst == nil {
+		return nil
+	}
+
+	dstValue := reflect.ValueOf(dst)
+	if dstValue.Kind() != reflect.Pointer || dstValue.IsNil() {
+		return fmt.Errorf("%w: can't receive into %T", ErrUnexpectedMessageType, dst)
+	}
+
+	msgValue := reflect.ValueOf(msg)
+	if msgValue.Type() != dstValue.Elem().Type() {
+		return fmt.Errorf(
+			"%w: want %s, got %T",
+			ErrUnexpectedMessageType,
+			dstValue.Elem().Type(),
+			msg,
+		)
+	}
+
+	dstValue.Elem().Set(msgValue)
+
+	return nil
+}
+
 func (pr *remotePeerConn) write(p []byte) (int, error) {
 	n, err := pr.conn.Write(p)
 	if err == nil {
-		pr.lastWriteOp.Store(time.Now().UnixNano())
+		pr.lastWriteOp.Store(pr.clock.Now().UnixNano())
 	}
 
 	return n, err
@@ -195,20 +357,33 @@ func (pr *remotePeerConn) write(p []byte) (int, error) {
 
 func (pr *remotePeerConn) send(msg message.Msg) error {
 	pr.writeFrame.Payload.Msg = msg
-	pr.writeFrame.Version = pr.protocol.Version()
+	pr.writeFrame.Version = pr.session.Version
 
-	return pr.protocol.WriteFrame(pr, &pr.writeFrame)
+	return pr.protocol.WriteFrame((*lockedConn)(pr), &pr.writeFrame)
 }
 
 func (pr *remotePeerConn) read(p []byte) (int, error) {
 	n, err := pr.conn.Read(p)
 	if err == nil {
-		pr.lastReadOp.Store(time.Now().UnixNano())
+		pr.lastReadOp.Store(pr.clock.Now().UnixNano())
 	}
 
 	return n, err
 }
 
+// lockedConn is a remotePeerConn whose lock is already held by the caller. It
+// lets Send and Receive hand the conn to the protocol without Read and Write
+// trying to take the same lock again.
+type lockedConn remotePeerConn
+
+func (c *lockedConn) Read(p []byte) (int, error) {
+	return (*remotePeerConn)(c).read(p)
+}
+
+func (c *lockedConn) Write(p []byte) (int, error) {
+	return (*remotePeerConn)(c).write(p)
+}
+
 func (pr *remotePeerConn) ID() uuid.UUID {
 	return pr.id
 }
@@ -225,6 +400,10 @@ func (pr *remotePeerConn) PublicKey() customcrypto.PublicKeyBytes {
 	return pr.publicKey
 }
 
+func (pr *remotePeerConn) Session() protocol.Session {
+	return pr.session
+}
+
 func (pr *remotePeerConn) IsStale(threshold time.Duration) bool {
 	writeNano := pr.lastWriteOp.Load()
 	readNano := pr.lastReadOp.Load()
@@ -238,7 +417,7 @@ func (pr *remotePeerConn) IsStale(threshold time.Duration) bool {
 		mostRecentNano = readNano
 	}
 
-	return time.Since(time.Unix(0, mostRecentNano)) > threshold
+	return pr.clock.Since(time.Unix(0, mostRecentNano)) > threshold
 }
 
 func (pr *remotePeerConn) Close() error {
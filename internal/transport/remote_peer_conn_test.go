@@ -0,0 +1,160 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/engr-sjb/diogel/internal/serialize"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func FuzzReceive(f *testing.F) {
+	p := newTestProtocol()
+
+	shardMsg := encodeTestFrame(f, p, message.CapsuleIncomingShardStream{
+		ShardID: uuid.New(),
+		Size:    8,
+	})
+	f.Add(append(shardMsg, []byte("shard123")...))
+	f.Add(shardMsg)
+	f.Add(encodeTestFrame(f, p, message.CapsuleIncomingShardStream{Size: chunkSize + 1}))
+	f.Add(encodeTestFrame(f, p, message.HeartbeatCheck{ID: uuid.New()}))
+	f.Add([]byte{1, 0, 2, 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, in []byte) {
+		rp := newTestRemotePeerConn(p, in)
+		data := make([]byte, 1024)
+
+		n, err := rp.Receive(&message.CapsuleIncomingShardStream{}, data)
+		if err != nil {
+			return
+		}
+
+		require.LessOrEqual(t, n, len(data))
+	})
+}
+
+func TestReceiveFillsMsgAndData(t *testing.T) {
+	p := newTestProtocol()
+
+	sent := message.CapsuleMasterKeyShare{
+		CapsuleID:       uuid.New(),
+		TotalShares:     3,
+		ThresholdShares: 2,
+		Size:            5,
+	}
+	in := append(encodeTestFrame(t, p, sent), []byte("share")...)
+
+	t.Run("into the message type that was sent", func(t *testing.T) {
+		var got message.CapsuleMasterKeyShare
+		data := make([]byte, 16)
+
+		n, err := newTestRemotePeerConn(p, in).Receive(&got, data)
+		require.NoError(t, err)
+		assert.Equal(t, sent, got)
+		assert.Equal(t, []byte("share"), data[:n])
+	})
+
+	t.Run("into another message type: should fail", func(t *testing.T) {
+		_, err := newTestRemotePeerConn(p, in).Receive(&message.HeartbeatCheck{}, make([]byte, 16))
+		require.ErrorIs(t, err, ErrUnexpectedMessageType)
+	})
+
+	t.Run("without room for the data: should fail", func(t *testing.T) {
+		_, err := newTestRemotePeerConn(p, in).Receive(&message.CapsuleMasterKeyShare{}, nil)
+		require.ErrorIs(t, err, ErrChunkSizeExceeded)
+	})
+}
+
+func TestSendChecksData(t *testing.T) {
+	p := newTestProtocol()
+	rp := newTestRemotePeerConn(p, nil)
+
+	_, err := rp.Send(&message.CapsuleMasterKeyShare{Size: 4}, []byte("share"))
+	require.ErrorIs(t, err, ErrUnexpectedData)
+
+	_, err = rp.Send(&message.HeartbeatCheck{}, []byte("data"))
+	require.ErrorIs(t, err, ErrUnexpectedData)
+
+	n, err := rp.Send(&message.CapsuleMasterKeyShare{Size: 5}, []byte("share"))
+	require.NoError(t, err)
+	assert.Equal(t, 5, n)
+}
+
+func TestIsStale(t *testing.T) {
+	const threshold = 278 * time.Hour
+
+	clk := clock.NewFake(time.Now())
+	rp := newTestRemotePeerConn(newTestProtocol(), nil)
+	rp.clock = clk
+
+	// Never used, so nothing to say it is alive.
+	assert.True(t, rp.IsStale(threshold))
+
+	_, err := rp.Send(&message.HeartbeatCheck{ID: uuid.New()}, nil)
+	require.NoError(t, err)
+	assert.False(t, rp.IsStale(threshold))
+
+	clk.Advance(threshold)
+	assert.False(t, rp.IsStale(threshold))
+
+	clk.Advance(time.Nanosecond)
+	assert.True(t, rp.IsStale(threshold))
+}
+
+func newTestProtocol() protocol.Protocol {
+	return protocol.NewProtocol(message.NewRegistry(), serialize.New(), nil)
+}
+
+func newTestRemotePeerConn(p protocol.Protocol, in []byte) *remotePeerConn {
+	return NewRemotePeer(
+		&protocol.Session{
+			RemotePublicKey: []byte("remote-public-key"),
+			Version:         p.Version(),
+		},
+		&readOnlyConn{Reader: bytes.NewReader(in)},
+		nil,
+		p,
+		clock.New(),
+	)
+}
+
+func encodeTestFrame(tb testing.TB, p protocol.Protocol, msg message.Msg) []byte {
+	tb.Helper()
+
+	var buf bytes.Buffer
+	err := p.WriteFrame(&buf, &protocol.Frame{
+		Version: p.Version(),
+		Payload: protocol.Payload{Msg: msg},
+	})
+	require.NoError(tb, err)
+
+	return buf.Bytes()
+}
+
+// readOnlyConn is a net.Conn that reads from a fixed input and drops writes.
+type readOnlyConn struct {
+	*bytes.Reader
+}
+
+func (readOnlyConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (readOnlyConn) Close() error                       { return nil }
+func (readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,120 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/engr-sjb/diogel/internal/message"
+)
+
+var (
+	ErrNoHandler        = errors.New("no handler for message")
+	ErrHandlerExists    = errors.New("message already has a handler")
+	ErrUnregisteredType = errors.New("message is not in the registry")
+)
+
+// Handler handles one incoming message from remotePeer. msg is the message
+// value, so a handler can type assert it straight to the type it registered
+// for.
+type Handler func(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error
+
+// Router dispatches incoming messages to the handler registered for their id.
+// Features register their handlers into it on startup, so adding a message
+// never means touching the peer.
+type Router struct {
+	registry *message.Registry
+
+	mu       sync.RWMutex
+	handlers map[message.ID]Handler
+	// streams are the messages whose handlers receive streams, see
+	// HandleStream.
+	streams map[message.ID]bool
+}
+
+func NewRouter(registry *message.Registry) *Router {
+	if registry == nil {
+		log.Fatalln("registry cannot be nil")
+	}
+
+	return &Router{
+		registry: registry,
+		handlers: make(map[message.ID]Handler),
+		streams:  make(map[message.ID]bool),
+	}
+}
+
+// Handle registers h for the message with id. A message can only have one
+// handler, and only messages in the registry can have one.
+func (r *Router) Handle(id message.ID, h Handler) error {
+	return r.handle(id, h, false)
+}
+
+// HandleStream is Handle for a message whose handler receives streams. It
+// runs for as long as its streams take, not under the timeout of a message,
+// a stream gives up by itself on a remote peer that goes quiet. See IsStream.
+func (r *Router) HandleStream(id message.ID, h Handler) error {
+	return r.handle(id, h, true)
+}
+
+func (r *Router) handle(id message.ID, h Handler, isStream bool) error {
+	if _, isFound := r.registry.Lookup(id); !isFound {
+		return fmt.Errorf("%w: id %d", ErrUnregisteredType, id)
+	}
+	if h == nil {
+		return fmt.Errorf("transport: nil handler for id %d", id)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, isFound := r.handlers[id]; isFound {
+		return fmt.Errorf("%w: id %d", ErrHandlerExists, id)
+	}
+
+	r.handlers[id] = h
+	r.streams[id] = isStream
+
+	return nil
+}
+
+// IsStream is true for a message whose handler was registered with
+// HandleStream.
+func (r *Router) IsStream(msg message.Msg) bool {
+	id, isFound := r.registry.IDOf(msg)
+	if !isFound {
+		return false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.streams[id]
+}
+
+// Dispatch calls the handler registered for msg and returns its error.
+func (r *Router) Dispatch(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error {
+	id, isFound := r.registry.IDOf(msg)
+	if !isFound {
+		return fmt.Errorf("%w: %T", ErrUnregisteredType, msg)
+	}
+
+	r.mu.RLock()
+	h, isFound := r.handlers[id]
+	r.mu.RUnlock()
+
+	if !isFound {
+		return fmt.Errorf("%w: %T", ErrNoHandler, msg)
+	}
+
+	return h(ctx, remotePeer, msg)
+}
@@ -0,0 +1,80 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"context"
+	"testing"
+
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterDispatch(t *testing.T) {
+	router := NewRouter(message.NewRegistry())
+
+	var got message.Msg
+	err := router.Handle(
+		message.IDHeartbeatCheck,
+		func(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error {
+			got = msg
+			return nil
+		},
+	)
+	require.NoError(t, err)
+
+	sent := message.HeartbeatCheck{ID: uuid.New()}
+
+	t.Run("value and pointer go to the same handler", func(t *testing.T) {
+		require.NoError(t, router.Dispatch(context.Background(), nil, sent))
+		assert.Equal(t, sent, got)
+
+		require.NoError(t, router.Dispatch(context.Background(), nil, &sent))
+		assert.Equal(t, &sent, got)
+	})
+
+	t.Run("message without a handler: should fail", func(t *testing.T) {
+		err := router.Dispatch(context.Background(), nil, message.DeleteCapsule{})
+		require.ErrorIs(t, err, ErrNoHandler)
+	})
+
+	t.Run("message not in the registry: should fail", func(t *testing.T) {
+		err := router.Dispatch(context.Background(), nil, struct{ A int }{})
+		require.ErrorIs(t, err, ErrUnregisteredType)
+	})
+
+	t.Run("second handler for a message: should fail", func(t *testing.T) {
+		err := router.Handle(
+			message.IDHeartbeatCheck,
+			func(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error { return nil },
+		)
+		require.ErrorIs(t, err, ErrHandlerExists)
+	})
+
+	t.Run("stream handler", func(t *testing.T) {
+		err := router.HandleStream(
+			message.IDCapsuleIncomingStream,
+			func(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error { return nil },
+		)
+		require.NoError(t, err)
+
+		assert.True(t, router.IsStream(message.CapsuleIncomingStream{}))
+		assert.False(t, router.IsStream(sent))
+		assert.False(t, router.IsStream(struct{ A int }{}))
+	})
+
+	t.Run("handler for an unknown id: should fail", func(t *testing.T) {
+		err := router.Handle(
+			message.ID(9999),
+			func(ctx context.Context, remotePeer RemotePeer, msg message.Msg) error { return nil },
+		)
+		require.ErrorIs(t, err, ErrUnregisteredType)
+	})
+}
@@ -0,0 +1,662 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/peererrors"
+	"github.com/google/uuid"
+)
+
+const (
+	// streamChunkSize is how much data goes in each chunk of a stream.
+	streamChunkSize = int(message.MaxChunkDataSize)
+	// streamWindow is how many chunks the sender can have in flight before it
+	// waits for the receiver to ack. It is what gives us backpressure: a slow
+	// receiver holds the sender to streamWindow*streamChunkSize (2MiB) ahead.
+	streamWindow uint32 = 8
+	// maxIncomingStreams is how many streams the remote peer can have opened
+	// that no ReceiveStream has taken yet.
+	maxIncomingStreams = 4
+	// maxPendingMsgs is how many messages a stream waiting on its inbox keeps
+	// for the next Receive or ReadMsg, see pump.
+	maxPendingMsgs = 4 * int(streamWindow)
+	// streamIdleTimeout is how long a stream waits on the remote peer for its
+	// next frame. A stream takes as long as its payload does, it is only cut
+	// short by the remote peer going quiet.
+	streamIdleTimeout = 30 * time.Second
+)
+
+var (
+	ErrStreamChecksum   = errors.New("stream: checksum mismatch")
+	ErrStreamOutOfOrder = errors.New("stream: chunk out of order")
+	ErrStreamRejected   = errors.New("stream: remote peer rejected the stream")
+	ErrStreamOverrun    = errors.New("stream: remote peer went past the window")
+	ErrStreamIdle       = errors.New("stream: remote peer went quiet")
+	ErrTooManyPending   = errors.New("stream: too many messages read for nobody")
+)
+
+var crc32Table = crc32.MakeTable(crc32.Castagnoli)
+
+var streamBufPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, streamChunkSize)
+		return &buf
+	},
+}
+
+// aLongTimeAgo is a read deadline that has already passed, it cuts a blocked
+// read short.
+var aLongTimeAgo = time.Unix(1, 0)
+
+/*
+stream is a stream open on a conn. Its frames go to its inbox whoever reads
+them off the conn: the read loop of the transport, a Receive, or a stream
+waiting on its own inbox, see await.
+
+	stream
+	- CapsuleStreamChuck + data, one per chunk, each with a crc32 of its data.
+	- StreamEnd with the chunk count, total size and sha256 of the stream.
+	- StreamAck back from the receiver for every chunk it writes out, and
+	  one with IsDone once the StreamEnd checks out.
+	- ErrorMessage with the StreamID, from whichever end gives up on it.
+*/
+type stream struct {
+	id    uuid.UUID
+	inbox chan streamFrame
+	// isOverrun is set once a frame didn't fit in the inbox and was dropped.
+	// The sender never has more than streamWindow chunks in flight, so only a
+	// remote peer that ignores it gets here.
+	isOverrun atomic.Bool
+}
+
+type streamFrame struct {
+	msg  message.Msg
+	data *[]byte // the data of a chunk, from streamBufPool.
+}
+
+func (f streamFrame) release() {
+	if f.data != nil {
+		streamBufPool.Put(f.data)
+	}
+}
+
+// pendingMsg is a message a stream waiting on its inbox read off the conn for
+// somebody else, with its data.
+type pendingMsg struct {
+	msg  message.Msg
+	data []byte
+}
+
+func (p pendingMsg) receive(msg message.Msg, data []byte) (int, error) {
+	if err := setMsg(msg, p.msg); err != nil {
+		return 0, err
+	}
+
+	if p.data == nil {
+		return 0, nil
+	}
+	if len(p.data) > len(data) {
+		return 0, ErrChunkSizeExceeded
+	}
+
+	return copy(data, p.data), nil
+}
+
+/*
+SendStream sends everything in r to the remote peer, which has to be in
+ReceiveStream. It returns once the remote peer has checked the whole stream.
+Whatever r has is sent as it comes, a chunk doesn't wait to be full.
+
+The remote peer acks each chunk it writes out with a StreamAck, and we never
+get more than streamWindow chunks ahead of its acks. ctx cancels the stream,
+a wait for an ack too, and an ack that takes longer than streamIdleTimeout
+fails it with ErrStreamIdle.
+
+NOTICE: The conn is only held a frame at a time, so Send and Receive and
+other streams go on on it while the stream does.
+*/
+func (pr *remotePeerConn) SendStream(ctx context.Context, r io.Reader) (int64, error) {
+	s := pr.openStream(uuid.New())
+	defer pr.closeStream(s)
+
+	bufPtr := streamBufPool.Get().(*[]byte)
+	defer streamBufPool.Put(bufPtr)
+	buf := *bufPtr
+
+	var (
+		sum   = sha256.New()
+		total int64
+		seq   uint32
+		acked uint32
+	)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			// Backpressure: wait for the remote peer to catch up. Acks already
+			// in are taken too, so a rejection is seen before the next chunk.
+			for seq-acked >= streamWindow || len(s.inbox) > 0 {
+				ack, err := pr.receiveStreamAck(ctx, s)
+				if err != nil {
+					return total, err
+				}
+				acked = ack.Chunks
+			}
+
+			chunk := &message.CapsuleStreamChuck{
+				ID:       s.id,
+				Seq:      seq,
+				Size:     uint32(n),
+				Checksum: crc32.Checksum(buf[:n], crc32Table),
+			}
+			if _, err := pr.Send(chunk, buf[:n]); err != nil {
+				return total, err
+			}
+
+			sum.Write(buf[:n])
+			total += int64(n)
+			seq++
+		}
+
+		if errors.Is(readErr, io.EOF) {
+			break
+		}
+		if readErr != nil {
+			return total, readErr
+		}
+	}
+
+	_, err := pr.Send(&message.StreamEnd{
+		ID:       s.id,
+		Chunks:   seq,
+		Size:     uint64(total),
+		Checksum: sum.Sum(nil),
+	}, nil)
+	if err != nil {
+		return total, err
+	}
+
+	// Drain the acks of the last window till the remote peer says it is done.
+	for {
+		ack, err := pr.receiveStreamAck(ctx, s)
+		if err != nil {
+			return total, err
+		}
+		if ack.IsDone {
+			return total, nil
+		}
+	}
+}
+
+/*
+ReceiveStream writes the next stream the remote peer opens with SendStream to
+w, streams are taken in the order they were opened. It checks every chunk as
+it comes in and the whole stream at the end. It returns the number of bytes
+written to w.
+
+A remote peer that sends nothing for streamIdleTimeout, before it opens the
+stream or in the middle of it, fails it with ErrStreamIdle.
+
+If the stream is bad, the remote peer is told with an ErrorMessage so it
+doesn't wait on us. Whatever was already written to w is left there, it is up
+to the caller to throw it away.
+*/
+func (pr *remotePeerConn) ReceiveStream(ctx context.Context, w io.Writer) (int64, error) {
+	s, err := awaitIdle(ctx, pr, pr.incoming)
+	if err != nil {
+		return 0, err
+	}
+	defer pr.closeStream(s)
+
+	total, err := pr.receiveStream(ctx, s, w)
+	if err != nil && !errors.Is(err, ErrStreamRejected) {
+		// Best effort, the stream has already failed.
+		pr.Send(&message.ErrorMessage{
+			Code:     peererrors.ErrBadRequest,
+			Message:  err.Error(),
+			StreamID: s.id,
+		}, nil)
+	}
+
+	return total, err
+}
+
+func (pr *remotePeerConn) receiveStream(ctx context.Context, s *stream, w io.Writer) (int64, error) {
+	var (
+		sum   = sha256.New()
+		total int64
+		seq   uint32
+	)
+
+	for {
+		frame, err := pr.nextStreamFrame(ctx, s)
+		if err != nil {
+			return total, err
+		}
+
+		switch newMsg := frame.msg.(type) {
+		case message.CapsuleStreamChuck:
+			if newMsg.Seq != seq {
+				frame.release()
+				return total, fmt.Errorf(
+					"%w: want chunk %d of %s, got chunk %d",
+					ErrStreamOutOfOrder,
+					seq,
+					s.id,
+					newMsg.Seq,
+				)
+			}
+
+			data := (*frame.data)[:newMsg.Size]
+			if crc32.Checksum(data, crc32Table) != newMsg.Checksum {
+				frame.release()
+				return total, fmt.Errorf("%w: chunk %d", ErrStreamChecksum, seq)
+			}
+
+			n, err := w.Write(data)
+			sum.Write(data)
+			frame.release()
+			total += int64(n)
+			if err != nil {
+				return total, err
+			}
+			seq++
+
+			if _, err := pr.Send(&message.StreamAck{ID: s.id, Chunks: seq}, nil); err != nil {
+				return total, err
+			}
+
+		case message.StreamEnd:
+			switch {
+			case newMsg.Chunks != seq || newMsg.Size != uint64(total):
+				return total, fmt.Errorf(
+					"%w: sent %d chunks of %d bytes, got %d chunks of %d bytes",
+					ErrStreamChecksum,
+					newMsg.Chunks,
+					newMsg.Size,
+					seq,
+					total,
+				)
+			case !bytes.Equal(newMsg.Checksum, sum.Sum(nil)):
+				return total, fmt.Errorf("%w: whole stream", ErrStreamChecksum)
+			}
+
+			_, err := pr.Send(&message.StreamAck{ID: s.id, Chunks: seq, IsDone: true}, nil)
+			return total, err
+
+		case message.ErrorMessage:
+			return total, fmt.Errorf("%w: %s", ErrStreamRejected, newMsg.Message)
+
+		default:
+			return total, fmt.Errorf("%w: %T in a stream", ErrUnexpectedMessageType, frame.msg)
+		}
+	}
+}
+
+// receiveStreamAck waits for the next ack of s.
+func (pr *remotePeerConn) receiveStreamAck(ctx context.Context, s *stream) (message.StreamAck, error) {
+	frame, err := pr.nextStreamFrame(ctx, s)
+	if err != nil {
+		return message.StreamAck{}, err
+	}
+	frame.release()
+
+	switch newMsg := frame.msg.(type) {
+	case message.StreamAck:
+		return newMsg, nil
+	case message.ErrorMessage:
+		return message.StreamAck{}, fmt.Errorf("%w: %s", ErrStreamRejected, newMsg.Message)
+	default:
+		return message.StreamAck{}, fmt.Errorf("%w: %T while waiting for an ack", ErrUnexpectedMessageType, frame.msg)
+	}
+}
+
+func (pr *remotePeerConn) nextStreamFrame(ctx context.Context, s *stream) (streamFrame, error) {
+	frame, err := awaitIdle(ctx, pr, s.inbox)
+	if err != nil {
+		return streamFrame{}, err
+	}
+
+	if s.isOverrun.Load() {
+		frame.release()
+		return streamFrame{}, ErrStreamOverrun
+	}
+
+	return frame, nil
+}
+
+func (pr *remotePeerConn) openStream(id uuid.UUID) *stream {
+	s := &stream{
+		id:    id,
+		inbox: make(chan streamFrame, streamWindow+2),
+	}
+
+	pr.streamsMu.Lock()
+	defer pr.streamsMu.Unlock()
+	pr.streams[id] = s
+
+	return s
+}
+
+// closeStream drops s, frames of it that still come in are thrown away.
+func (pr *remotePeerConn) closeStream(s *stream) {
+	pr.streamsMu.Lock()
+	delete(pr.streams, s.id)
+	pr.streamsMu.Unlock()
+
+	for {
+		select {
+		case frame := <-s.inbox:
+			frame.release()
+		default:
+			return
+		}
+	}
+}
+
+/*
+route hands the frame in readFrame to its stream, reading the data of a
+chunk from r. It is false for a frame that isn't a stream's. The caller holds
+readMu.
+
+The first frame of a stream we don't know of opens it for ReceiveStream. The
+frames of a stream we no longer know of, one that is done or given up on, are
+thrown away.
+*/
+func (pr *remotePeerConn) route(r io.Reader) (bool, error) {
+	msg := pr.readFrame.Payload.Msg
+
+	var id uuid.UUID
+	switch newMsg := msg.(type) {
+	case message.CapsuleStreamChuck:
+		id = newMsg.ID
+	case message.StreamEnd:
+		id = newMsg.ID
+	case message.StreamAck:
+		id = newMsg.ID
+	case message.ErrorMessage:
+		if newMsg.StreamID == uuid.Nil {
+			return false, nil
+		}
+		id = newMsg.StreamID
+	default:
+		return false, nil
+	}
+
+	frame := streamFrame{msg: msg}
+	if chunk, isChunk := msg.(message.CapsuleStreamChuck); isChunk {
+		size := int(chunk.Size)
+		if size <= 0 || size > streamChunkSize {
+			// NOTICE: size comes from the remote peer. We only ever read it
+			// into our own buffer, never allocate for it.
+			return true, ErrChunkSizeExceeded
+		}
+
+		frame.data = streamBufPool.Get().(*[]byte)
+		if _, err := io.ReadFull(r, (*frame.data)[:size]); err != nil {
+			frame.release()
+			return true, err
+		}
+	}
+
+	pr.streamsMu.Lock()
+	s, isFound := pr.streams[id]
+	isRefused := false
+	if !isFound && opensStream(msg) {
+		s = &stream{
+			id:    id,
+			inbox: make(chan streamFrame, streamWindow+2),
+		}
+		select {
+		case pr.incoming <- s:
+			pr.streams[id] = s
+		default:
+			s, isRefused = nil, true
+		}
+	}
+	pr.streamsMu.Unlock()
+
+	if s == nil {
+		frame.release()
+		if isRefused && pr.isRefusing.CompareAndSwap(false, true) {
+			// NOTICE: Not sent here, we hold readMu and the remote peer may be
+			// waiting on us to read before it reads this.
+			// SECURITY: Only one refusal is on its way at a time, the others
+			// are dropped. A remote peer that opens streams without reading
+			// its conn can't pile goroutines up on us, and a stream of it
+			// whose refusal was dropped goes idle, see streamIdleTimeout.
+			go func() {
+				defer pr.isRefusing.Store(false)
+
+				pr.Send(&message.ErrorMessage{
+					Code:     peererrors.ErrBadRequest,
+					Message:  "too many streams waiting to be received",
+					StreamID: id,
+				}, nil)
+			}()
+		}
+		return true, nil
+	}
+
+	select {
+	case s.inbox <- frame:
+	default:
+		s.isOverrun.Store(true)
+		frame.release()
+	}
+
+	return true, nil
+}
+
+// opensStream is true for the first frame of a stream: its first chunk, or
+// the end of a stream with no chunks.
+func opensStream(msg message.Msg) bool {
+	switch newMsg := msg.(type) {
+	case message.CapsuleStreamChuck:
+		return newMsg.Seq == 0
+	case message.StreamEnd:
+		return newMsg.Chunks == 0
+	}
+
+	return false
+}
+
+/*
+await waits for the next value on ch. While nothing else is reading the conn,
+it reads frames off it itself with pump, so a stream gets its frames whether
+or not the conn has a read loop. ctx cancels the wait.
+*/
+func await[T any](ctx context.Context, pr *remotePeerConn, ch chan T) (T, error) {
+	var zero T
+
+	for {
+		select {
+		case v := <-ch:
+			return v, nil
+		default:
+		}
+
+		if err := ctx.Err(); err != nil {
+			return zero, err
+		}
+
+		// The turn is taken before TryLock, so a reader letting go in between
+		// isn't missed.
+		turn := pr.readTurnCh()
+		if pr.readMu.TryLock() {
+			err := pr.pump(ctx)
+			pr.unlockRead()
+			if err != nil {
+				return zero, err
+			}
+			continue
+		}
+
+		select {
+		case v := <-ch:
+			return v, nil
+		case <-turn:
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
+
+// awaitIdle is await that gives up with ErrStreamIdle once the remote peer has
+// sent nothing on ch for streamIdleTimeout.
+func awaitIdle[T any](ctx context.Context, pr *remotePeerConn, ch chan T) (T, error) {
+	idleCtx, cancel := clock.WithTimeout(ctx, pr.clock, streamIdleTimeout)
+	defer cancel()
+
+	v, err := await(idleCtx, pr, ch)
+	if err != nil && ctx.Err() == nil && idleCtx.Err() != nil {
+		return v, fmt.Errorf("%w: nothing for %s", ErrStreamIdle, streamIdleTimeout)
+	}
+
+	return v, err
+}
+
+/*
+pump reads a frame off the conn for a stream waiting on its inbox. The caller
+holds readMu. A frame that isn't a stream's is kept for the next Receive or
+ReadMsg, except an ErrorMessage, which is the remote peer refusing what we are
+doing on the conn.
+*/
+func (pr *remotePeerConn) pump(ctx context.Context) error {
+	r := &byteCountingReader{r: (*lockedConn)(pr)}
+
+	// A read can't be given a ctx, so a cancel cuts it short with a deadline
+	// that has already passed.
+	isCut := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		pr.conn.SetReadDeadline(aLongTimeAgo)
+		close(isCut)
+	})
+
+	err := pr.pumpFrame(r)
+	if !stop() {
+		<-isCut
+		pr.conn.SetReadDeadline(time.Time{})
+
+		if err != nil {
+			if r.n > 0 {
+				// NOTICE: Cut halfway through a frame, the rest of it would be
+				// read as the next frame, so the conn is of no more use.
+				pr.conn.Close()
+			}
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+func (pr *remotePeerConn) pumpFrame(r io.Reader) error {
+	isStreamFrame, err := pr.readFrameFrom(r)
+	if err != nil || isStreamFrame {
+		return err
+	}
+
+	msg := pr.readFrame.Payload.Msg
+	if errMsg, isErrMsg := msg.(message.ErrorMessage); isErrMsg {
+		return fmt.Errorf("%w: %s", ErrStreamRejected, errMsg.Message)
+	}
+
+	pending := pendingMsg{msg: msg}
+	spec, _ := pr.protocol.Registry().Lookup(pr.readFrame.ID)
+	if spec.HasData {
+		size := int(msg.(message.DataCarrier).DataSize())
+		if size <= 0 || size > int(spec.MaxDataSize) || size > chunkSize {
+			return ErrChunkSizeExceeded
+		}
+
+		pending.data = make([]byte, size)
+		if _, err := io.ReadFull(r, pending.data); err != nil {
+			return err
+		}
+	}
+
+	pr.streamsMu.Lock()
+	defer pr.streamsMu.Unlock()
+
+	if len(pr.pending) >= maxPendingMsgs {
+		return ErrTooManyPending
+	}
+	pr.pending = append(pr.pending, pending)
+
+	return nil
+}
+
+// popPending takes the oldest message a stream read for somebody else. The
+// caller holds readMu, so none are read in between.
+func (pr *remotePeerConn) popPending() (pendingMsg, bool) {
+	pr.streamsMu.Lock()
+	defer pr.streamsMu.Unlock()
+
+	if len(pr.pending) == 0 {
+		return pendingMsg{}, false
+	}
+
+	pending := pr.pending[0]
+	pr.pending[0] = pendingMsg{}
+	pr.pending = pr.pending[1:]
+
+	return pending, true
+}
+
+// readTurnCh returns a channel that is closed the next time readMu is let go.
+func (pr *remotePeerConn) readTurnCh() <-chan struct{} {
+	pr.streamsMu.Lock()
+	defer pr.streamsMu.Unlock()
+
+	if pr.readTurn == nil {
+		pr.readTurn = make(chan struct{})
+	}
+
+	return pr.readTurn
+}
+
+func (pr *remotePeerConn) unlockRead() {
+	pr.readMu.Unlock()
+
+	pr.streamsMu.Lock()
+	defer pr.streamsMu.Unlock()
+
+	if pr.readTurn != nil {
+		close(pr.readTurn)
+		pr.readTurn = nil
+	}
+}
+
+type byteCountingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *byteCountingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
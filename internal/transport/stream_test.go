@@ -0,0 +1,340 @@
+/*
+	Copyright (c) 2025 Stephen Jersuit Benyah
+	Licensed under the Repo-Only Non-Commercial & No-Derivatives License with Anti-Training Clause (RONCND-AT) v1.0.
+	See LICENSE and CONTRIBUTION_LICENSE_AGREEMENT.md in repository root.
+	Prohibited: copying, reuse, redistribution, or use as training data for machine learning/AI.
+*/
+
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"hash/crc32"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/engr-sjb/diogel/internal/clock"
+	"github.com/engr-sjb/diogel/internal/message"
+	"github.com/engr-sjb/diogel/internal/protocol"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "smaller than a chunk", size: 1000},
+		{name: "exactly one chunk", size: streamChunkSize},
+		{name: "many chunks, more than a window", size: streamChunkSize*int(streamWindow)*2 + 123},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, receiver := newTestRemotePeerConnPair(t)
+
+			data := make([]byte, tt.size)
+			rand.Read(data)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			type result struct {
+				n   int64
+				err error
+			}
+			sent := make(chan result, 1)
+			go func() {
+				n, err := sender.SendStream(ctx, bytes.NewReader(data))
+				sent <- result{n, err}
+			}()
+
+			var got bytes.Buffer
+			n, err := receiver.ReceiveStream(ctx, &got)
+			require.NoError(t, err)
+			assert.Equal(t, int64(tt.size), n)
+			assert.True(t, bytes.Equal(data, got.Bytes()))
+
+			res := <-sent
+			require.NoError(t, res.err)
+			assert.Equal(t, int64(tt.size), res.n)
+		})
+	}
+}
+
+func TestStreamBackpressure(t *testing.T) {
+	sender, receiver := newTestRemotePeerConnPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A reader that counts how much the sender has taken from it.
+	src := &countingReader{r: io.LimitReader(rand.Reader, int64(streamChunkSize)*64)}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sender.SendStream(ctx, src)
+		done <- err
+	}()
+
+	// Nobody receives, so the sender has to stop at its window.
+	time.Sleep(200 * time.Millisecond)
+	maxAhead := int64(streamChunkSize) * int64(streamWindow+1)
+	assert.LessOrEqual(t, src.n.Load(), maxAhead)
+
+	_, err := receiver.ReceiveStream(ctx, io.Discard)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+}
+
+func TestStreamRejectsCorruptChunk(t *testing.T) {
+	sender, receiver := newTestRemotePeerConnPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		s := sender.openStream(uuid.New())
+		defer sender.closeStream(s)
+
+		data := []byte("some data")
+		_, err := sender.Send(&message.CapsuleStreamChuck{
+			ID:       s.id,
+			Size:     uint32(len(data)),
+			Checksum: 1, // not the checksum of data.
+		}, data)
+		if err == nil {
+			_, err = sender.receiveStreamAck(ctx, s)
+		}
+		sendErr <- err
+	}()
+
+	_, err := receiver.ReceiveStream(ctx, io.Discard)
+	require.ErrorIs(t, err, ErrStreamChecksum)
+
+	// The sender is told rather than left waiting.
+	require.ErrorIs(t, <-sendErr, ErrStreamRejected)
+}
+
+func TestStreamWithReadLoop(t *testing.T) {
+	sender, receiver := newTestRemotePeerConnPair(t)
+
+	// Both ends read their conn like a transport does, stream frames have to
+	// get to their streams past it and the rest to the loop.
+	senderMsgs := runTestReadLoop(t, sender)
+	receiverMsgs := runTestReadLoop(t, receiver)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	data := make([]byte, streamChunkSize*int(streamWindow)*2+123)
+	rand.Read(data)
+
+	sendErr := make(chan error, 1)
+	go func() {
+		_, err := sender.SendStream(ctx, bytes.NewReader(data))
+		sendErr <- err
+	}()
+
+	// Messages go on while the stream does, both ways.
+	_, err := sender.Send(&message.HeartbeatCheck{}, nil)
+	require.NoError(t, err)
+	_, err = receiver.Send(&message.RecoveryCeremony{}, nil)
+	require.NoError(t, err)
+
+	var got bytes.Buffer
+	_, err = receiver.ReceiveStream(ctx, &got)
+	require.NoError(t, err)
+	require.NoError(t, <-sendErr)
+	assert.True(t, bytes.Equal(data, got.Bytes()))
+
+	assert.IsType(t, message.HeartbeatCheck{}, <-receiverMsgs)
+	assert.IsType(t, message.RecoveryCeremony{}, <-senderMsgs)
+	assert.Empty(t, receiverMsgs, "the loop saw a stream frame")
+	assert.Empty(t, senderMsgs, "the loop saw a stream frame")
+}
+
+func TestStreamCancel(t *testing.T) {
+	t.Run("a wait for an ack", func(t *testing.T) {
+		sender, _ := newTestRemotePeerConnPair(t)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		sendErr := make(chan error, 1)
+		go func() {
+			// Nobody receives, so the sender waits on acks at its window.
+			_, err := sender.SendStream(ctx, io.LimitReader(rand.Reader, int64(streamChunkSize)*64))
+			sendErr <- err
+		}()
+
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+
+		select {
+		case err := <-sendErr:
+			require.ErrorIs(t, err, context.Canceled)
+		case <-time.After(5 * time.Second):
+			t.Fatal("SendStream didn't return on cancel")
+		}
+	})
+
+	t.Run("a wait for a stream, the conn still works after", func(t *testing.T) {
+		sender, receiver := newTestRemotePeerConnPair(t)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_, err := receiver.ReceiveStream(ctx, io.Discard)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		_, err = sender.Send(&message.HeartbeatCheck{}, nil)
+		require.NoError(t, err)
+		_, err = receiver.Receive(&message.HeartbeatCheck{}, nil)
+		require.NoError(t, err)
+	})
+}
+
+func TestStreamIdle(t *testing.T) {
+	sender, receiver := newTestRemotePeerConnPair(t)
+	fakeClock := clock.NewFake(time.Now())
+	receiver.clock = fakeClock
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	received := make(chan error, 1)
+	go func() {
+		_, err := receiver.ReceiveStream(ctx, io.Discard)
+		received <- err
+	}()
+
+	// One chunk, then the sender goes quiet.
+	s := sender.openStream(uuid.New())
+	defer sender.closeStream(s)
+	data := []byte("some data")
+	_, err := sender.Send(&message.CapsuleStreamChuck{
+		ID:       s.id,
+		Size:     uint32(len(data)),
+		Checksum: crc32.Checksum(data, crc32Table),
+	}, data)
+	require.NoError(t, err)
+	_, err = sender.receiveStreamAck(ctx, s)
+	require.NoError(t, err)
+
+	// Not a moment less than the idle timeout cuts it.
+	fakeClock.BlockUntil(1)
+	fakeClock.Advance(streamIdleTimeout - time.Second)
+	select {
+	case err := <-received:
+		t.Fatalf("stream was cut before it went idle: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fakeClock.Advance(time.Second)
+	require.ErrorIs(t, <-received, ErrStreamIdle)
+
+	// The sender is told rather than left waiting.
+	_, err = sender.receiveStreamAck(ctx, s)
+	require.ErrorIs(t, err, ErrStreamRejected)
+}
+
+func TestStreamRefusalsDontPileUp(t *testing.T) {
+	// net.Pipe doesn't buffer, a refusal blocks till the remote peer reads it.
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+	p := newTestProtocol()
+	session := &protocol.Session{
+		RemotePublicKey: []byte("remote-public-key"),
+		Version:         p.Version(),
+	}
+	sender := NewRemotePeer(session, clientConn, nil, p, clock.New())
+	receiver := NewRemotePeer(session, serverConn, nil, p, clock.New())
+	runTestReadLoop(t, receiver)
+
+	before := runtime.NumGoroutine()
+
+	// The sender opens far more streams than are taken and never reads its
+	// conn.
+	for range maxIncomingStreams + 100 {
+		_, err := sender.Send(&message.StreamEnd{ID: uuid.New()}, nil)
+		require.NoError(t, err)
+	}
+
+	assert.LessOrEqual(t, runtime.NumGoroutine()-before, 1, "a goroutine per refused stream")
+}
+
+// runTestReadLoop reads pr the way the read loop of a transport does and
+// returns the messages it gets.
+func runTestReadLoop(t *testing.T, pr *remotePeerConn) <-chan message.Msg {
+	t.Helper()
+
+	msgs := make(chan message.Msg, 16)
+	go func() {
+		for {
+			msg, err := pr.ReadMsg()
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+
+	return msgs
+}
+
+// newTestRemotePeerConnPair returns two remotePeerConns on either end of a
+// loopback tcp conn. Unlike net.Pipe, tcp buffers writes, which streams need
+// as both ends write at the same time.
+func newTestRemotePeerConnPair(t *testing.T) (*remotePeerConn, *remotePeerConn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	serverConn := <-accepted
+	require.NotNil(t, serverConn)
+
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	p := newTestProtocol()
+	session := &protocol.Session{
+		RemotePublicKey: []byte("remote-public-key"),
+		Version:         p.Version(),
+	}
+
+	return NewRemotePeer(session, clientConn, nil, p, clock.New()), NewRemotePeer(session, serverConn, nil, p, clock.New())
+}
+
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/engr-sjb/diogel/internal/clock"
 	"github.com/engr-sjb/diogel/internal/protocol"
 	"github.com/engr-sjb/diogel/internal/transport"
 )
@@ -37,6 +38,7 @@ type TCPTransportConfig struct {
 	Addr           string
 	BootstrapPeers []string //todo: reconsider sending bootstraps here. as i think calling in peer is better.
 	DialTimeout    time.Duration
+	Clock          clock.Clock
 	OnConnect      transport.OnConnect
 	OnDisconnect   transport.OnDisconnect
 	OnMessage      transport.OnMessage
@@ -48,7 +50,10 @@ type tcpTransport struct {
 	ln net.Listener
 }
 
-var _ transport.Transport = (*tcpTransport)(nil)
+var (
+	_ transport.Transport    = (*tcpTransport)(nil)
+	_ transport.ConnUpgrader = (*tcpTransport)(nil)
+)
 
 func NewTCPTransport(cfg *TCPTransportConfig) *tcpTransport {
 	//todo: return an error
@@ -82,6 +87,8 @@ func NewTCPTransport(cfg *TCPTransportConfig) *tcpTransport {
 		log.Fatalln("BootstrapPeers cannot be empty") // todo: not sure if we should pass bootstrap to transport. My just have method on transport that takes in a bootstrap does on connect.
 	case cfg.DialTimeout == time.Duration(0):
 		log.Fatalln("DialTimeout cannot be zero")
+	case cfg.Clock == nil:
+		log.Fatalln("Clock cannot be nil")
 	case cfg.OnConnect == nil:
 		log.Fatalln("OnConnect cannot be nil")
 	case cfg.OnDisconnect == nil:
@@ -167,46 +174,48 @@ func (t *tcpTransport) acceptLoop() {
 				continue
 			}
 
-			remotePublicKey, err := t.Protocol.DoServerHandshake(
-				conn,
-				t.PublicKey,
-			)
-
-			if err != nil {
+			if err := t.ServeConn(conn); err != nil {
 				log.Printf(
-					"[TCPTransport: %s]: [remote peer %s]; could not perform handshake. dropping conn\n",
+					"[TCPTransport: %s]: [remote peer %s]; %v. dropping conn\n",
 					t.ln.Addr(),
 					conn.RemoteAddr().String(),
-				)
-				conn.Close()
-				return
-			}
-
-			peer, err := t.newRemotePeer(
-				// ports.PublicKey(remotePublicKeyStr),
-				remotePublicKey,
-				conn,
-			)
-			if err != nil {
-				log.Println(
-					"dropping conn",
 					err,
 				)
-				conn.Close()
-				t.OnDisconnect(peer.ID())
-
-				continue
 			}
+		}
+	}
+}
 
-			log.Printf(
-				"[TCPTransport: %s]: [remotePeer %s]; connected...\n",
-				t.ln.Addr(),
-				peer.PublicKeyStr()[:6],
-			)
+// ServeConn runs the server handshake on conn and serves it like a conn we
+// accepted ourselves. conn is closed if the handshake fails.
+func (t *tcpTransport) ServeConn(conn net.Conn) error {
+	session, err := t.Protocol.DoServerHandshake(
+		conn,
+		t.PublicKey,
+	)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("could not perform handshake: %w", err)
+	}
 
-			t.handleRemotePeerConn(peer)
-		}
+	peer, err := t.newRemotePeer(
+		session,
+		conn,
+	)
+	if err != nil {
+		conn.Close()
+		return err
 	}
+
+	log.Printf(
+		"[TCPTransport: %s]: [remotePeer %s]; connected...\n",
+		t.ln.Addr(),
+		peer.PublicKeyStr()[:6],
+	)
+
+	t.handleRemotePeerConn(peer)
+
+	return nil
 }
 
 func (t *tcpTransport) handleRemotePeerConn(remotePeerConn transport.RemotePeerConn) {
@@ -239,8 +248,7 @@ func (t *tcpTransport) handleRemotePeerConn(remotePeerConn transport.RemotePeerC
 				return
 
 			default:
-				readFrame := new(protocol.Frame)
-				err := t.Protocol.ReadFrame(remotePeerConn, readFrame)
+				msg, err := remotePeerConn.ReadMsg()
 				if err != nil {
 					if errors.Is(err, io.EOF) {
 						log.Printf(
@@ -261,7 +269,7 @@ func (t *tcpTransport) handleRemotePeerConn(remotePeerConn transport.RemotePeerC
 					return
 				}
 
-				t.OnMessage(remotePeerConn, readFrame.Payload.Msg)
+				t.OnMessage(remotePeerConn, msg)
 			}
 		}
 	}(remotePeerConn)
@@ -358,7 +366,7 @@ func (t *tcpTransport) connect(addr string) (transport.RemotePeerConn, error) {
 				err,
 			)
 
-			time.Sleep(retryDelay)
+			<-t.Clock.After(retryDelay)
 
 			// retryDelay = time.Duration(
 			// 	float64(retryDelay) * math.Pow(2, retryExponent),
@@ -380,16 +388,23 @@ func (t *tcpTransport) connect(addr string) (transport.RemotePeerConn, error) {
 		break
 	}
 
-	publicKey, err := t.Protocol.DoClientHandshake(conn, t.PublicKey)
+	return t.UpgradeConn(conn)
+}
+
+// UpgradeConn runs the client handshake on conn. conn is closed if it fails.
+func (t *tcpTransport) UpgradeConn(conn net.Conn) (transport.RemotePeerConn, error) {
+	session, err := t.Protocol.DoClientHandshake(conn, t.PublicKey)
 	if err != nil {
-		return nil, errors.New("remote peer failed failed client handshake")
+		conn.Close()
+		return nil, fmt.Errorf("remote peer failed client handshake: %w", err)
 	}
 
 	remotePeer, err := t.newRemotePeer(
-		publicKey,
+		session,
 		conn,
 	)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return remotePeer, nil
@@ -401,15 +416,17 @@ func (t *tcpTransport) Close() error {
 	return t.ln.Close()
 }
 
-func (t *tcpTransport) newRemotePeer(publicKey []byte, conn net.Conn) (transport.RemotePeerConn, error) {
+func (t *tcpTransport) newRemotePeer(session *protocol.Session, conn net.Conn) (transport.RemotePeerConn, error) {
 	switch {
-	case publicKey == nil:
+	case session == nil:
+		return nil, errors.New("session can't be nil")
+	case session.RemotePublicKey == nil:
 		return nil, errors.New("publicKey can't be nil")
 	case conn == nil:
 		return nil, errors.New("conn can't be nil")
 	}
 
-	rp := transport.NewRemotePeer(publicKey, conn, t.ln.Addr(), t.Protocol)
+	rp := transport.NewRemotePeer(session, conn, t.ln.Addr(), t.Protocol, t.Clock)
 
 	return rp, nil
 }
@@ -1,6 +1,8 @@
 package transport
 
 import (
+	"net"
+
 	"github.com/engr-sjb/diogel/internal/message"
 	"github.com/google/uuid"
 )
@@ -17,3 +19,13 @@ type Transport interface {
 	// Close closes the transport listener.
 	Close() error
 }
+
+// ConnUpgrader is implemented by transports that can take over a conn made
+// somewhere else, like a hole punched or relayed conn from the nat package.
+type ConnUpgrader interface {
+	// UpgradeConn runs the client side of the handshake on conn.
+	UpgradeConn(conn net.Conn) (RemotePeerConn, error)
+	// ServeConn runs the server side of the handshake on conn and then serves
+	// it like one of the transport's own accepted conns.
+	ServeConn(conn net.Conn) error
+}